@@ -0,0 +1,108 @@
+package badge
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"time"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+)
+
+const (
+	// Green, Yellow, Red and Grey are the colours of healthy, degraded, unhealthy and stale or unknown badges
+	Green  = "#4c1"
+	Yellow = "#dfb317"
+	Red    = "#e05d44"
+	Grey   = "#9f9f9f"
+
+	// charWidth approximates the width of a character of 11px Verdana, and padding surrounds the text of each side
+	charWidth = 7
+	padding   = 10
+)
+
+var svg = template.Must(template.New("badge").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{.Label}}: {{.Message}}">
+<title>{{.Label}}: {{.Message}}</title>
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{{.Width}}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="{{.LabelWidth}}" height="20" fill="#555"/>
+<rect x="{{.LabelWidth}}" width="{{.MessageWidth}}" height="20" fill="{{.Colour}}"/>
+<rect width="{{.Width}}" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="14">{{.Label}}</text>
+<text x="{{.MessageX}}" y="14">{{.Message}}</text>
+</g>
+</svg>
+`))
+
+// Badge is a shield with a label on the left and a coloured message on the right
+type Badge struct {
+	Label   string
+	Message string
+	Colour  string
+}
+
+// ForState returns a Badge showing the given health state and how long it has held, which is grey when the latest
+// check is stale
+func ForState(label string, state string, since time.Time, stale bool, now time.Time) Badge {
+	b := Badge{Label: label, Message: state + " for " + Humanise(now.Sub(since)), Colour: Grey}
+	if stale {
+		b.Message = state + ", stale"
+		return b
+	}
+	switch state {
+	case constants.Healthy:
+		b.Colour = Green
+	case constants.Degraded:
+		b.Colour = Yellow
+	case constants.Unhealthy:
+		b.Colour = Red
+	}
+	return b
+}
+
+// SVG renders the Badge
+func (b Badge) SVG() ([]byte, error) {
+	labelWidth := len([]rune(b.Label))*charWidth + padding
+	messageWidth := len([]rune(b.Message))*charWidth + padding
+
+	var buf bytes.Buffer
+	err := svg.Execute(&buf, map[string]interface{}{
+		"Label":        b.Label,
+		"Message":      b.Message,
+		"Colour":       b.Colour,
+		"Width":        labelWidth + messageWidth,
+		"LabelWidth":   labelWidth,
+		"MessageWidth": messageWidth,
+		"LabelX":       float64(labelWidth) / 2,
+		"MessageX":     float64(labelWidth) + float64(messageWidth)/2,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render badge, err: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ETag returns a strong entity tag for the rendered SVG of a Badge
+func ETag(svg []byte) string {
+	h := fnv.New64a()
+	h.Write(svg)
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// Humanise returns the largest whole unit of a duration, e.g. 3d, 5h or 12m
+func Humanise(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return "<1m"
+	}
+}
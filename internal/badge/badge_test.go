@@ -0,0 +1,42 @@
+package badge
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+)
+
+func Test_ForState(t *testing.T) {
+	now := time.Now()
+
+	b := ForState("billing-api", constants.Unhealthy, now.Add(-3*time.Hour-10*time.Minute), false, now)
+	assert.Equal(t, Badge{Label: "billing-api", Message: "unhealthy for 3h", Colour: Red}, b)
+
+	b = ForState("energy", constants.Healthy, now.Add(-50*time.Hour), false, now)
+	assert.Equal(t, Badge{Label: "energy", Message: "healthy for 2d", Colour: Green}, b)
+
+	b = ForState("energy", constants.Degraded, now.Add(-30*time.Second), false, now)
+	assert.Equal(t, Badge{Label: "energy", Message: "degraded for <1m", Colour: Yellow}, b)
+
+	b = ForState("energy", constants.Healthy, now.Add(-time.Hour), true, now)
+	assert.Equal(t, Badge{Label: "energy", Message: "healthy, stale", Colour: Grey}, b)
+}
+
+func Test_SVG(t *testing.T) {
+	svg, err := Badge{Label: "<script>", Message: "healthy for 2d", Colour: Green}.SVG()
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(string(svg), "<svg"))
+	assert.Contains(t, string(svg), `fill="#4c1"`)
+	assert.Contains(t, string(svg), "healthy for 2d")
+	assert.NotContains(t, string(svg), "<script>")
+
+	other, err := Badge{Label: "<script>", Message: "healthy for 3d", Colour: Green}.SVG()
+	require.NoError(t, err)
+	assert.Equal(t, ETag(svg), ETag(svg))
+	assert.NotEqual(t, ETag(svg), ETag(other))
+}
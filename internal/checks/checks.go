@@ -1,16 +1,20 @@
 package checks
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
 	"github.com/utilitywarehouse/health-aggregator/internal/constants"
 	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
 
@@ -21,9 +25,12 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+// defaultRequestTimeout bounds each health check request unless configured with WithConfig
+const defaultRequestTimeout = 10 * time.Second
+
 var (
+	// requests are bounded by the request timeout of the HealthChecker rather than the client
 	client = &http.Client{
-		Timeout: 10 * time.Second,
 		Transport: &http.Transport{
 			MaxIdleConnsPerHost: 128,
 			Dial: (&net.Dialer{
@@ -40,36 +47,125 @@ type httpClient interface {
 
 // HealthChecker contains the httpClient
 type HealthChecker struct {
-	baseURL   string
-	client    httpClient
-	k8sClient kubernetes.Interface
-	metrics   instrumentation.Metrics
+	baseURL string
+	client  httpClient
+	tls     *TLSCredentials
+	creds   *credentials
+	k8s     clusterClients
+	metrics instrumentation.Metrics
+	config  *config.Store
+
+	// latencyThreshold marks pods degraded when their health check takes longer, unless overridden by the
+	// uw.health.aggregator.latency-threshold annotation. Zero disables the threshold
+	latencyThreshold     time.Duration
+	retries              RetryPolicy
+	maxConcurrent        int
+	maxConcurrentPerNode int
+
+	// patterns caches the compiled check-regex of http-regex Services, so that each is compiled once rather than for
+	// every pod on every check
+	patterns     *patternCache
+	certExpiries *certExpiries
+}
+
+// Option configures optional behaviour of a HealthChecker
+type Option func(*HealthChecker)
+
+// WithTLSCredentials sets the CA bundle and client certificate used to scrape Services annotated with
+// uw.health.aggregator.tls
+func WithTLSCredentials(creds *TLSCredentials) Option {
+	return func(c *HealthChecker) {
+		c.tls = creds
+	}
+}
+
+// WithConfig reads the request timeout from the current config for every health check, so that changes are applied
+// when the config is reloaded
+func WithConfig(cfg *config.Store) Option {
+	return func(c *HealthChecker) {
+		c.config = cfg
+	}
+}
+
+// WithClusters sets the clients used for Services discovered in each named cluster. Services without a cluster, or in
+// a cluster without a client, use the client passed to NewHealthChecker
+func WithClusters(clients map[string]kubernetes.Interface) Option {
+	return func(c *HealthChecker) {
+		c.k8s.clusters = clients
+	}
+}
+
+// WithLatencyThreshold marks pods as degraded when their health check takes longer than the given duration
+func WithLatencyThreshold(threshold time.Duration) Option {
+	return func(c *HealthChecker) {
+		c.latencyThreshold = threshold
+	}
 }
 
 // NewHealthChecker returns a struct with an httpClient
-func NewHealthChecker(k8sClient kubernetes.Interface, metrics instrumentation.Metrics, baseURL string) HealthChecker {
+func NewHealthChecker(k8sClient kubernetes.Interface, metrics instrumentation.Metrics, baseURL string, opts ...Option) HealthChecker {
 
-	return HealthChecker{client: client, k8sClient: k8sClient, metrics: metrics, baseURL: baseURL}
+	c := HealthChecker{client: client, k8s: clusterClients{local: k8sClient}, metrics: metrics, baseURL: baseURL, maxConcurrent: defaultMaxConcurrentChecks, patterns: newPatternCache()}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.creds = newCredentials(c.k8s)
+	c.certExpiries = newCertExpiries(metrics.Gauges[constants.HealthAggregatorCertExpiry])
+	if c.tls == nil {
+		// without configured credentials the system roots are used to verify servers
+		c.tls, _ = NewTLSCredentials("", "", "")
+	}
+	return c
 }
 
 // DoHealthchecks performs http requests to retrieve health check responses for Services on a channel of type Service.
 // Responses are sent to a channel of type model.ServiceStatus and any errors are sent to a channel of type error.
-func (c *HealthChecker) DoHealthchecks(healthchecks chan model.Service, statusResponses chan model.ServiceStatus, errs chan error) {
+// DoHealthchecks returns once the healthchecks channel is closed and all queued Services have been checked, or once
+// ctx is cancelled, which aborts any in-flight checks and discards their results. The statusResponses channel is
+// closed on return so that pending results can be flushed.
+func (c *HealthChecker) DoHealthchecks(ctx context.Context, healthchecks chan model.Service, statusResponses chan model.ServiceStatus, errs chan error) {
 	aggregatorCounterVec := c.metrics.Counters[constants.HealthAggregatorOutcome]
 	inFlightChecksGaugeVec := c.metrics.Gauges[constants.HealthAggregatorInFlight]
-	jobsDurationHistogramVec := c.metrics.Histograms[constants.HealthAggregatorJobDurationSeconds]
+	queuedServicesGaugeVec := c.metrics.Gauges[constants.HealthAggregatorQueuedServices]
+
+	queue := newFairQueue()
+	limiter := newScrapeLimiter(c.maxConcurrent, c.maxConcurrentPerNode)
+
+	// move services onto the fair queue so that they are checked in round robin order across namespaces
+	go func() {
+		defer queue.close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case svc, ok := <-healthchecks:
+				if !ok {
+					return
+				}
+				queue.push(svc)
+				queuedServicesGaugeVec.With(map[string]string{}).Set(float64(queue.len()))
+			}
+		}
+	}()
 
-	readers := 100
-	for i := 0; i < readers; i++ {
-		go func(healthchecks chan model.Service) {
-			for svc := range healthchecks {
+	var workers sync.WaitGroup
+	for i := 0; i < c.maxConcurrent; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				svc, ok := queue.pop()
+				if !ok || ctx.Err() != nil {
+					return
+				}
+				queuedServicesGaugeVec.With(map[string]string{}).Set(float64(queue.len()))
 				inFlightChecksGaugeVec.With(map[string]string{}).Inc()
 
 				serviceCheckTime := time.Now().UTC()
 
 				log.Debugf("Trying pod health checks for %v...", svc.Name)
 				// Get pods for the service
-				pods, err := c.getPodsForService(svc.Namespace, svc.Name)
+				pods, err := c.getPodsForService(ctx, svc.Cluster, svc.Namespace, svc.Name)
 				if err != nil {
 					errText := fmt.Sprintf("cannot retrieve pods for service with name %s to perform healthcheck: %s", svc.Name, err.Error())
 					select {
@@ -80,6 +176,9 @@ func (c *HealthChecker) DoHealthchecks(healthchecks chan model.Service, statusRe
 					continue
 				}
 
+				// the certificate expiry of pods which have gone away is no longer reported
+				c.certExpiries.checkedPods(svc, pods)
+
 				// no pods are running - no point scraping the health endpoints
 				if len(pods) == 0 {
 					errMsg := fmt.Sprintf("desired replicas is set to %v but there are no pods running", svc.Deployment.DesiredReplicas)
@@ -91,30 +190,25 @@ func (c *HealthChecker) DoHealthchecks(healthchecks chan model.Service, statusRe
 				noOfUnavailablePods := 0
 				noOfHealthyPods := 0
 
-				var podHealthResponses []model.PodHealthResponse
-				for _, pod := range pods {
-
-					var podHealthResponse model.PodHealthResponse
-
-					start := time.Now()
-					podHealthResponse, err := c.getHealthCheckForPod(pod, svc.AppPort)
-					duration := time.Since(start)
-					jobsDurationHistogramVec.WithLabelValues("health_scrape").Observe(duration.Seconds())
-
+				podHealthResponses, podErrs := c.checkPods(ctx, pods, svc, limiter)
+				if ctx.Err() != nil {
+					// the checks were aborted, so the results do not reflect the health of the service
+					inFlightChecksGaugeVec.With(map[string]string{}).Dec()
+					return
+				}
+				for i, err := range podErrs {
 					if err != nil {
 						if aggregatorCounterVec != nil {
 							aggregatorCounterVec.With(map[string]string{constants.PerformedHealthcheckResult: "failure"}).Inc()
 						}
 						noOfUnavailablePods++
-						log.Debugf("pod %v (service %v) health check returned an error: %v", pod.Name, pod.ServiceName, err.Error())
+						log.Debugf("pod %v (service %v) health check returned an error: %v", pods[i].Name, pods[i].ServiceName, err.Error())
 					} else {
 						noOfHealthyPods++
 						if aggregatorCounterVec != nil {
 							aggregatorCounterVec.With(map[string]string{constants.PerformedHealthcheckResult: "success"}).Inc()
 						}
 					}
-
-					podHealthResponses = append(podHealthResponses, podHealthResponse)
 				}
 
 				// report if there are fewer running pods than desired replicas
@@ -129,32 +223,77 @@ func (c *HealthChecker) DoHealthchecks(healthchecks chan model.Service, statusRe
 					podsUnhealthyMsg = fmt.Sprintf("%v/%v pods failed health checks", noOfUnavailablePods, len(pods))
 				}
 
+				status := model.ServiceStatus{Service: svc, CheckTime: serviceCheckTime, HealthyPods: noOfHealthyPods, PodChecks: podHealthResponses}
+				status.LatencyP50Ms, status.LatencyMaxMs = latencySummary(podHealthResponses)
+
 				switch {
 				case podsFewerThanDesiredReplicasMsg != "" && podsUnhealthyMsg != "":
-					statusResponses <- model.ServiceStatus{Service: svc, CheckTime: serviceCheckTime, AggregatedState: constants.Unhealthy, HealthyPods: noOfHealthyPods, PodChecks: podHealthResponses, Error: podsUnhealthyMsg + " - " + podsFewerThanDesiredReplicasMsg}
-					inFlightChecksGaugeVec.With(map[string]string{}).Dec()
-					continue
+					status.AggregatedState = constants.Unhealthy
+					status.Error = podsUnhealthyMsg + " - " + podsFewerThanDesiredReplicasMsg
 				case podsFewerThanDesiredReplicasMsg != "":
-					statusResponses <- model.ServiceStatus{Service: svc, CheckTime: serviceCheckTime, AggregatedState: constants.Unhealthy, HealthyPods: noOfHealthyPods, PodChecks: podHealthResponses, Error: podsFewerThanDesiredReplicasMsg}
-					inFlightChecksGaugeVec.With(map[string]string{}).Dec()
-					continue
-				case podsUnhealthyMsg != "":
-					aggregatedState := mostSevereState(podHealthResponses)
-					statusResponses <- model.ServiceStatus{Service: svc, CheckTime: serviceCheckTime, AggregatedState: aggregatedState, HealthyPods: noOfHealthyPods, PodChecks: podHealthResponses, Error: podsUnhealthyMsg}
-					inFlightChecksGaugeVec.With(map[string]string{}).Dec()
-					continue
+					status.AggregatedState = constants.Unhealthy
+					status.Error = podsFewerThanDesiredReplicasMsg
 				default:
-					aggregatedState := mostSevereState(podHealthResponses)
-					statusResponses <- model.ServiceStatus{Service: svc, CheckTime: serviceCheckTime, AggregatedState: aggregatedState, HealthyPods: noOfHealthyPods, PodChecks: podHealthResponses, Error: podsUnhealthyMsg}
+					status.AggregatedState = mostSevereState(podHealthResponses)
+					status.Error = podsUnhealthyMsg
 				}
+				statusResponses <- status
 				inFlightChecksGaugeVec.With(map[string]string{}).Dec()
 			}
-		}(healthchecks)
+		}()
 	}
+
+	workers.Wait()
+	close(statusResponses)
+}
+
+// patternCache holds compiled check-regex patterns by their source
+type patternCache struct {
+	mu       sync.RWMutex
+	patterns map[string]*regexp.Regexp
 }
 
-func (c *HealthChecker) getPodsForService(namespaceName string, serviceName string) ([]model.Pod, error) {
-	k8sPods, err := c.k8sClient.CoreV1().Pods(namespaceName).List(metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", serviceName)})
+func newPatternCache() *patternCache {
+	return &patternCache{patterns: make(map[string]*regexp.Regexp)}
+}
+
+// compile returns the compiled pattern, compiling it on first use. An empty pattern is rejected, as it would match
+// every response
+func (p *patternCache) compile(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errors.New("http-regex checks require a uw.health.aggregator.check-regex annotation")
+	}
+
+	p.mu.RLock()
+	re, ok := p.patterns[pattern]
+	p.mu.RUnlock()
+	if ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.patterns[pattern] = re
+	p.mu.Unlock()
+	return re, nil
+}
+
+func (c *HealthChecker) requestTimeout() time.Duration {
+	if c.config == nil {
+		return defaultRequestTimeout
+	}
+	return c.config.Get().Scheduling.RequestTimeout
+}
+
+func (c *HealthChecker) getPodsForService(ctx context.Context, cluster string, namespaceName string, serviceName string) ([]model.Pod, error) {
+	// the client-go version in use does not accept a context, so cancellation is only checked before the call
+	if err := ctx.Err(); err != nil {
+		return []model.Pod{}, err
+	}
+	k8sPods, err := c.k8s.get(cluster).CoreV1().Pods(namespaceName).List(metav1.ListOptions{LabelSelector: fmt.Sprintf("app=%s", serviceName)})
 	if err != nil {
 		return []model.Pod{}, fmt.Errorf("failed to get the list of pods from k8s cluster: %v", err.Error())
 	}
@@ -177,7 +316,19 @@ func populatePod(k8sPod v1.Pod) model.Pod {
 	}
 }
 
-func (c *HealthChecker) getHealthCheckForPod(pod model.Pod, appPort string) (model.PodHealthResponse, error) {
+// checkPod performs the health check for a pod according to the check type configured for its Service
+func (c *HealthChecker) checkPod(ctx context.Context, pod model.Pod, svc model.Service) (model.PodHealthResponse, error) {
+	switch svc.HealthAnnotations.CheckType {
+	case constants.CheckTypeGRPC:
+		return c.getGRPCHealthCheckForPod(ctx, pod, svc)
+	case constants.CheckTypeTCP:
+		return c.getTCPHealthCheckForPod(ctx, pod, svc)
+	default:
+		return c.getHealthCheckForPod(ctx, pod, svc)
+	}
+}
+
+func (c *HealthChecker) getHealthCheckForPod(ctx context.Context, pod model.Pod, svc model.Service) (model.PodHealthResponse, error) {
 	log.Debugf("Getting health check for pod " + pod.Name + " service " + pod.ServiceName)
 	var podHealthResponse model.PodHealthResponse
 	podHealthResponse.CheckTime = time.Now().UTC()
@@ -185,9 +336,34 @@ func (c *HealthChecker) getHealthCheckForPod(pod model.Pod, appPort string) (mod
 	podHealthResponse.StatusCode = 0
 	podHealthResponse.Name = pod.Name
 
+	checkType := svc.HealthAnnotations.CheckType
+
+	var pattern *regexp.Regexp
+	if checkType == constants.CheckTypeHTTPRegex {
+		var err error
+		pattern, err = c.patterns.compile(svc.HealthAnnotations.CheckRegex)
+		if err != nil {
+			podHealthResponse.Error = "error compiling healthcheck regex: " + err.Error()
+			podHealthResponse.Body = syntheticHealthcheckBody(svc, checkType, constants.Unhealthy, podHealthResponse.Error)
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
+	}
+
+	httpc := c.client
+	scheme := "http"
+	if tlsMode := svc.HealthAnnotations.TLSMode; tlsMode != "" && tlsMode != constants.TLSModeDisabled {
+		tlsClient, err := c.tls.client(tlsMode, svc.HealthAnnotations.TLSServerName)
+		if err != nil {
+			podHealthResponse.Error = "error configuring tls for healthcheck request: " + err.Error()
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
+		httpc = tlsClient
+		scheme = "https"
+	}
+
 	var url string
 	if c.baseURL == "" {
-		url = fmt.Sprintf("http://%s:%s/__/health", pod.IP, appPort)
+		url = fmt.Sprintf("%s://%s:%s%s", scheme, pod.IP, svc.AppPort, healthcheckPath(svc))
 	} else {
 		url = c.baseURL
 	}
@@ -198,8 +374,51 @@ func (c *HealthChecker) getHealthCheckForPod(pod model.Pod, appPort string) (mod
 		return podHealthResponse, errors.New(podHealthResponse.Error + ": " + err.Error())
 	}
 
-	req.Header.Set("Accept", "application/json")
-	resp, err := c.client.Do(req)
+	switch checkType {
+	case constants.CheckTypeHTTPStatus, constants.CheckTypeHTTPRegex:
+		req.Header.Set("Accept", "application/json")
+	default:
+		req.Header.Set("Accept", acceptHeader(svc.HealthAnnotations.Format))
+	}
+
+	if svc.HealthAnnotations.AuthSecret != "" {
+		headers, err := c.creds.headers(svc.Cluster, svc.Namespace, svc.HealthAnnotations.AuthSecret)
+		if err != nil {
+			podHealthResponse.Error = "error getting healthcheck credentials: " + err.Error()
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+	}
+
+	var firstByte, requestStart time.Time
+	traceCtx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	})
+
+	// each attempt has its own timeout within the deadline of all attempts, neither of which must be cancelled until
+	// the response body has been read
+	retryCtx, cancelRetries := c.retryDeadline(traceCtx)
+	defer cancelRetries()
+	timeout := c.requestTimeout()
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	var resp *http.Response
+	podHealthResponse.Attempts, err = c.withRetries(retryCtx, func() error {
+		attemptCtx, cancel := context.WithTimeout(retryCtx, timeout)
+		cancels = append(cancels, cancel)
+
+		requestStart = time.Now()
+		var doErr error
+		resp, doErr = httpc.Do(req.WithContext(attemptCtx))
+		return doErr
+	})
 	if err != nil {
 		podHealthResponse.Error = "error performing healthcheck request: " + err.Error()
 		return podHealthResponse, errors.New(podHealthResponse.Error + ": " + err.Error())
@@ -213,10 +432,22 @@ func (c *HealthChecker) getHealthCheckForPod(pod model.Pod, appPort string) (mod
 	}()
 
 	podHealthResponse.StatusCode = resp.StatusCode
+	if !firstByte.IsZero() {
+		podHealthResponse.TTFBMs = durationMillis(firstByte.Sub(requestStart))
+	}
 
-	if resp.StatusCode != 200 {
-		podHealthResponse.Error = fmt.Sprintf("healthcheck endpoint returned non-200 status (%v)", resp.StatusCode)
-		return podHealthResponse, errors.New(podHealthResponse.Error)
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		certExpiry := resp.TLS.PeerCertificates[0].NotAfter.UTC()
+		podHealthResponse.CertExpiry = &certExpiry
+		c.certExpiries.set(svc, pod.Name, certExpiry)
+	}
+
+	if checkType == constants.CheckTypeHTTPStatus || checkType == constants.CheckTypeHTTPRegex {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			podHealthResponse.Error = fmt.Sprintf("healthcheck endpoint returned non-2xx status (%v)", resp.StatusCode)
+			podHealthResponse.Body = syntheticHealthcheckBody(svc, checkType, constants.Unhealthy, podHealthResponse.Error)
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -224,15 +455,46 @@ func (c *HealthChecker) getHealthCheckForPod(pod model.Pod, appPort string) (mod
 		podHealthResponse.Error = "error reading healthcheck response"
 		return podHealthResponse, errors.New(podHealthResponse.Error + ": " + err.Error())
 	}
+	podHealthResponse.BodySize = int64(len(body))
+
+	if checkType == constants.CheckTypeHTTPStatus {
+		podHealthResponse.State = constants.Healthy
+		podHealthResponse.Body = syntheticHealthcheckBody(svc, checkType, constants.Healthy, fmt.Sprintf("%s returned status %v", req.URL.Path, resp.StatusCode))
+		return podHealthResponse, nil
+	}
+
+	if checkType == constants.CheckTypeHTTPRegex {
+		if !pattern.Match(body) {
+			podHealthResponse.Error = fmt.Sprintf("healthcheck response did not match %q", svc.HealthAnnotations.CheckRegex)
+			podHealthResponse.Body = syntheticHealthcheckBody(svc, checkType, constants.Unhealthy, podHealthResponse.Error)
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
+		podHealthResponse.State = constants.Healthy
+		podHealthResponse.Body = syntheticHealthcheckBody(svc, checkType, constants.Healthy, fmt.Sprintf("healthcheck response matched %q", svc.HealthAnnotations.CheckRegex))
+		return podHealthResponse, nil
+	}
+
+	adapter := selectFormatAdapter(svc.HealthAnnotations.Format, resp.Header.Get("Content-Type"), body)
+	health, parseErr := adapter.parse(body)
 
-	health := &model.HealthcheckBody{}
-	if err := json.Unmarshal(body, &health); err != nil {
+	// Spring Actuator, health+json and readyz endpoints report failures with a 503 (or 500) status alongside a body
+	// describing the failing checks, whereas UW health endpoints must always return a 200
+	_, isUWFormat := adapter.(uwFormat)
+	if resp.StatusCode != 200 && (isUWFormat || parseErr != nil) {
+		podHealthResponse.Error = fmt.Sprintf("healthcheck endpoint returned non-200 status (%v)", resp.StatusCode)
+		return podHealthResponse, errors.New(podHealthResponse.Error)
+	}
+
+	if parseErr != nil {
 		podHealthResponse.Error = "error parsing healthcheck response"
-		return podHealthResponse, errors.New(podHealthResponse.Error + ": " + err.Error())
+		return podHealthResponse, errors.New(podHealthResponse.Error + ": " + parseErr.Error())
 	}
 
 	podHealthResponse.State = health.Health
-	podHealthResponse.Body = *health
+	podHealthResponse.Body = health
+	if isUWFormat {
+		podHealthResponse.Warnings = validateHealthcheckBody(health)
+	}
 
 	if podHealthResponse.Body.Health != constants.Healthy {
 		podHealthResponse.Error = "pod failing one or more health checks"
@@ -1,14 +1,33 @@
 package checks
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
 	"github.com/utilitywarehouse/health-aggregator/internal/helpers"
 	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
 
@@ -16,7 +35,10 @@ import (
 	"github.com/utilitywarehouse/health-aggregator/internal/constants"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 
 	"github.com/utilitywarehouse/health-aggregator/internal/model"
 )
@@ -77,7 +99,7 @@ func Test_DoHealthchecksForAHealthyService(t *testing.T) {
 
 	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), apiStub.URL)
 
-	go checker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
 
 	// add services to scrape to channel
 	go func() {
@@ -112,7 +134,7 @@ func Test_DoHealthchecksForAnUnhealthyService(t *testing.T) {
 
 	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), apiStub.URL)
 
-	go checker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
 
 	// add services to scrape to channel
 	go func() {
@@ -147,7 +169,7 @@ func Test_DoHealthchecksForADegradedService(t *testing.T) {
 
 	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), apiStub.URL)
 
-	go checker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
 
 	// add services to scrape to channel
 	go func() {
@@ -181,7 +203,7 @@ func Test_DoHealthchecksWhenFewerThanDesiredPodsRunning(t *testing.T) {
 	setupServerReturnHealthyPod()
 
 	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), apiStub.URL)
-	go checker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
 
 	// add services to scrape to channel
 	go func() {
@@ -201,6 +223,44 @@ func Test_DoHealthchecksWhenFewerThanDesiredPodsRunning(t *testing.T) {
 	}
 }
 
+func Test_DoHealthchecksUsesTheClientForTheServiceCluster(t *testing.T) {
+
+	errs := make(chan error, 10)
+	statusResponses := make(chan model.ServiceStatus, 10)
+	servicesToScrape := make(chan model.Service, 10)
+
+	local, svc := setUpNamespaceWithService(t, 2)
+	require.NoError(t, attachPods(2, svc.Name, local))
+
+	// the same service runs a single pod in the prod cluster
+	prod := fake.NewSimpleClientset()
+	require.NoError(t, attachPods(1, svc.Name, prod))
+	prodSvc := svc
+	prodSvc.Cluster = "prod"
+
+	setupServerReturnHealthyPod()
+
+	checker := NewHealthChecker(local, instrumentation.SetupMetrics(), apiStub.URL, WithClusters(map[string]kubernetes.Interface{"prod": prod}))
+
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
+
+	servicesToScrape <- svc
+	servicesToScrape <- prodSvc
+	close(servicesToScrape)
+
+	healthyPods := make(map[string]int)
+	for status := range statusResponses {
+		healthyPods[status.Service.Cluster] = status.HealthyPods
+	}
+
+	select {
+	case err := <-errs:
+		t.Errorf("Should not get an error, got %v", err)
+	default:
+	}
+	assert.Equal(t, map[string]int{"": 2, "prod": 1}, healthyPods)
+}
+
 func Test_DoHealthchecksReportsUnhealthyWhenNoPodsRunning(t *testing.T) {
 
 	errs := make(chan error, 10)
@@ -210,7 +270,7 @@ func Test_DoHealthchecksReportsUnhealthyWhenNoPodsRunning(t *testing.T) {
 	client, svc := setUpNamespaceWithService(t, 2)
 
 	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), "")
-	go checker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
 
 	// add services to scrape to channel
 	go func() {
@@ -244,7 +304,7 @@ func Test_DoHealthchecksReportsUnhealthyWhenPodHealthCheckReturnServerError(t *t
 	setupServerReturnError500()
 
 	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), apiStub.URL)
-	go checker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
 
 	// add services to scrape to channel
 	go func() {
@@ -264,6 +324,1046 @@ func Test_DoHealthchecksReportsUnhealthyWhenPodHealthCheckReturnServerError(t *t
 	}
 }
 
+func Test_DoHealthchecksMarksSlowPodsDegraded(t *testing.T) {
+
+	errs := make(chan error, 10)
+	statusResponses := make(chan model.ServiceStatus, 10)
+	servicesToScrape := make(chan model.Service, 10)
+
+	client, svc := setUpNamespaceWithService(t, 2)
+
+	err := attachPods(2, svc.Name, client)
+	require.NoError(t, err)
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+			log.Error(err)
+		}
+	}))
+	defer stub.Close()
+
+	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), stub.URL, WithLatencyThreshold(20*time.Millisecond))
+
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
+
+	go func() {
+		servicesToScrape <- svc
+		close(servicesToScrape)
+	}()
+
+	select {
+	case <-errs:
+		t.Errorf("Should not get an error")
+
+	case s := <-statusResponses:
+		assert.Equal(t, constants.Degraded, s.AggregatedState)
+		assert.Equal(t, 0, s.HealthyPods)
+		require.Equal(t, 2, len(s.PodChecks))
+		for _, podCheck := range s.PodChecks {
+			assert.Equal(t, constants.Degraded, podCheck.State)
+			assert.Contains(t, podCheck.Error, "above the latency threshold of 20ms")
+			assert.True(t, podCheck.LatencyMs >= 50)
+			assert.True(t, podCheck.TTFBMs >= 50)
+			assert.Equal(t, int64(len(healthyCheckReponse)), podCheck.BodySize)
+		}
+		assert.True(t, s.LatencyP50Ms >= 50)
+		assert.True(t, s.LatencyMaxMs >= s.LatencyP50Ms)
+	}
+}
+
+func Test_LatencySummary(t *testing.T) {
+	p50, max := latencySummary(nil)
+	assert.Equal(t, 0.0, p50)
+	assert.Equal(t, 0.0, max)
+
+	p50, max = latencySummary([]model.PodHealthResponse{{LatencyMs: 30}, {LatencyMs: 10}, {LatencyMs: 20}, {LatencyMs: 400}})
+	assert.Equal(t, 20.0, p50)
+	assert.Equal(t, 400.0, max)
+}
+
+func Test_DoHealthchecksForAGRPCService(t *testing.T) {
+
+	errs := make(chan error, 10)
+	statusResponses := make(chan model.ServiceStatus, 10)
+	servicesToScrape := make(chan model.Service, 10)
+
+	client, svc := setUpNamespaceWithService(t, 2)
+
+	err := attachPodsWithIP(2, svc.Name, "127.0.0.1", client)
+	require.NoError(t, err)
+
+	port, healthServer := setupGRPCHealthServer(t)
+	healthServer.SetServingStatus("uw-foo", healthpb.HealthCheckResponse_SERVING)
+
+	svc.AppPort = port
+	svc.HealthAnnotations.CheckType = constants.CheckTypeGRPC
+	svc.HealthAnnotations.GRPCService = "uw-foo"
+
+	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), "")
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
+
+	go func() {
+		servicesToScrape <- svc
+		close(servicesToScrape)
+	}()
+
+	select {
+	case <-errs:
+		t.Errorf("Should not get an error")
+
+	case s := <-statusResponses:
+		assert.Equal(t, constants.Healthy, s.AggregatedState)
+		assert.Equal(t, 2, s.HealthyPods)
+		require.Equal(t, 2, len(s.PodChecks))
+		assert.Equal(t, constants.Healthy, s.PodChecks[0].Body.Health)
+		assert.Equal(t, "grpc.health.v1.Health/Check", s.PodChecks[0].Body.Checks[0].Name)
+	}
+}
+
+func Test_DoHealthchecksForAnUnhealthyGRPCServiceUsingWatch(t *testing.T) {
+
+	errs := make(chan error, 10)
+	statusResponses := make(chan model.ServiceStatus, 10)
+	servicesToScrape := make(chan model.Service, 10)
+
+	client, svc := setUpNamespaceWithService(t, 1)
+
+	err := attachPodsWithIP(1, svc.Name, "127.0.0.1", client)
+	require.NoError(t, err)
+
+	port, healthServer := setupGRPCHealthServer(t)
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	svc.AppPort = port
+	svc.HealthAnnotations.CheckType = constants.CheckTypeGRPC
+	svc.HealthAnnotations.GRPCWatch = "true"
+
+	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), "")
+	go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
+
+	go func() {
+		servicesToScrape <- svc
+		close(servicesToScrape)
+	}()
+
+	select {
+	case <-errs:
+		t.Errorf("Should not get an error")
+
+	case s := <-statusResponses:
+		assert.Equal(t, constants.Unhealthy, s.AggregatedState)
+		assert.Equal(t, 0, s.HealthyPods)
+		require.Equal(t, 1, len(s.PodChecks))
+		assert.Equal(t, "pod failing one or more health checks", s.PodChecks[0].Error)
+		assert.Equal(t, "grpc.health.v1.Health/Watch", s.PodChecks[0].Body.Checks[0].Name)
+	}
+}
+
+func Test_GRPCServingStatusToHealth(t *testing.T) {
+	assert.Equal(t, constants.Healthy, grpcServingStatusToHealth(healthpb.HealthCheckResponse_SERVING))
+	assert.Equal(t, constants.Unhealthy, grpcServingStatusToHealth(healthpb.HealthCheckResponse_NOT_SERVING))
+	assert.Equal(t, constants.Degraded, grpcServingStatusToHealth(healthpb.HealthCheckResponse_UNKNOWN))
+	assert.Equal(t, constants.Unhealthy, grpcServingStatusToHealth(healthpb.HealthCheckResponse_SERVICE_UNKNOWN))
+}
+
+func Test_DoHealthchecksForNonUWCheckTypes(t *testing.T) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	_, tcpPort, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		checkType       string
+		checkRegex      string
+		appPort         string
+		statusCode      int
+		body            string
+		expectedState   string
+		expectedHealthy int
+	}{
+		{name: "tcp connects", checkType: constants.CheckTypeTCP, appPort: tcpPort, expectedState: constants.Healthy, expectedHealthy: 1},
+		{name: "tcp refused", checkType: constants.CheckTypeTCP, appPort: "1", expectedState: constants.Unhealthy},
+		{name: "http-status 2xx", checkType: constants.CheckTypeHTTPStatus, statusCode: http.StatusNoContent, expectedState: constants.Healthy, expectedHealthy: 1},
+		{name: "http-status 5xx", checkType: constants.CheckTypeHTTPStatus, statusCode: http.StatusServiceUnavailable, expectedState: constants.Unhealthy},
+		{name: "http-regex match", checkType: constants.CheckTypeHTTPRegex, checkRegex: "^\\+PONG", statusCode: http.StatusOK, body: "+PONG", expectedState: constants.Healthy, expectedHealthy: 1},
+		{name: "http-regex no match", checkType: constants.CheckTypeHTTPRegex, checkRegex: "^\\+PONG", statusCode: http.StatusOK, body: "-ERR", expectedState: constants.Unhealthy},
+		// an empty pattern would match every response
+		{name: "http-regex without pattern", checkType: constants.CheckTypeHTTPRegex, statusCode: http.StatusOK, body: "-ERR", expectedState: constants.Unhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 10)
+			statusResponses := make(chan model.ServiceStatus, 10)
+			servicesToScrape := make(chan model.Service, 10)
+
+			client, svc := setUpNamespaceWithService(t, 1)
+
+			err := attachPodsWithIP(1, svc.Name, "127.0.0.1", client)
+			require.NoError(t, err)
+
+			svc.AppPort = tt.appPort
+			svc.HealthAnnotations.CheckType = tt.checkType
+			svc.HealthAnnotations.CheckRegex = tt.checkRegex
+
+			stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+				if _, err := w.Write([]byte(tt.body)); err != nil {
+					log.Error(err)
+				}
+			}))
+			defer stub.Close()
+
+			baseURL := stub.URL
+			if tt.checkType == constants.CheckTypeTCP {
+				baseURL = ""
+			}
+
+			checker := NewHealthChecker(client, instrumentation.SetupMetrics(), baseURL)
+			go checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
+
+			go func() {
+				servicesToScrape <- svc
+				close(servicesToScrape)
+			}()
+
+			select {
+			case <-errs:
+				t.Errorf("Should not get an error")
+
+			case s := <-statusResponses:
+				assert.Equal(t, tt.expectedState, s.AggregatedState)
+				assert.Equal(t, tt.expectedHealthy, s.HealthyPods)
+				require.Equal(t, 1, len(s.PodChecks))
+				assert.Equal(t, tt.expectedState, s.PodChecks[0].Body.Health)
+				require.Equal(t, 1, len(s.PodChecks[0].Body.Checks))
+				assert.Equal(t, tt.checkType, s.PodChecks[0].Body.Checks[0].Name)
+			}
+		})
+	}
+}
+
+func Test_PatternCacheCompilesEachPatternOnce(t *testing.T) {
+	patterns := newPatternCache()
+
+	first, err := patterns.compile("^\\+PONG")
+	require.NoError(t, err)
+	second, err := patterns.compile("^\\+PONG")
+	require.NoError(t, err)
+	assert.True(t, first == second, "expected the compiled pattern to be cached")
+
+	_, err = patterns.compile("")
+	assert.Error(t, err)
+	_, err = patterns.compile("(")
+	assert.Error(t, err)
+}
+
+func Test_GetHealthCheckForPodFormats(t *testing.T) {
+
+	springBody := `{"status":"DOWN","components":{"db":{"status":"DOWN","details":{"error":"timeout"}},"diskSpace":{"status":"UP"}}}`
+	legacySpringBody := `{"status":"UP","details":{"db":{"status":"UP"}}}`
+	healthJSONBody := `{"status":"warn","serviceId":"accounts","checks":{"db:responseTime":[{"componentId":"primary","status":"warn","observedValue":250,"observedUnit":"ms"}]}}`
+	readyzBody := "[+]ping ok\n[+]log ok\n[-]etcd failed: reason withheld\nreadyz check failed\n"
+	uwBody := `{"name":"accounts","health":"healthy","checks":[{"name":"db","health":"healthy"}]}`
+
+	tests := []struct {
+		name           string
+		format         string
+		contentType    string
+		statusCode     int
+		body           string
+		expectedState  string
+		expectedChecks []model.Check
+		expectErr      bool
+	}{
+		{name: "spring detected", contentType: "application/json", statusCode: http.StatusServiceUnavailable, body: springBody, expectedState: constants.Unhealthy,
+			expectedChecks: []model.Check{{Name: "db", Health: constants.Unhealthy, Output: `{"error":"timeout"}`}, {Name: "diskSpace", Health: constants.Healthy}}, expectErr: true},
+		{name: "spring legacy details", format: constants.FormatSpring, statusCode: http.StatusOK, body: legacySpringBody, expectedState: constants.Healthy,
+			expectedChecks: []model.Check{{Name: "db", Health: constants.Healthy}}},
+		{name: "health+json by content type", contentType: "application/health+json", statusCode: http.StatusOK, body: healthJSONBody, expectedState: constants.Degraded,
+			expectedChecks: []model.Check{{Name: "db:responseTime (primary)", Health: constants.Degraded, Output: "250 ms"}}, expectErr: true},
+		{name: "readyz detected", contentType: "text/plain", statusCode: http.StatusInternalServerError, body: readyzBody, expectedState: constants.Unhealthy,
+			expectedChecks: []model.Check{{Name: "ping", Health: constants.Healthy, Output: "ok"}, {Name: "log", Health: constants.Healthy, Output: "ok"}, {Name: "etcd", Health: constants.Unhealthy, Output: "failed: reason withheld"}}, expectErr: true},
+		{name: "uw detected", contentType: "application/json", statusCode: http.StatusOK, body: uwBody, expectedState: constants.Healthy,
+			expectedChecks: []model.Check{{Name: "db", Health: constants.Healthy}}},
+		{name: "uw requires 200", format: constants.FormatUW, statusCode: http.StatusServiceUnavailable, body: uwBody, expectedState: constants.Unhealthy, expectErr: true},
+		{name: "readyz requested but not returned", format: constants.FormatReadyz, statusCode: http.StatusOK, body: uwBody, expectedState: constants.Unhealthy, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(tt.statusCode)
+				if _, err := w.Write([]byte(tt.body)); err != nil {
+					log.Error(err)
+				}
+			}))
+			defer stub.Close()
+
+			svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+			svc.HealthAnnotations.Format = tt.format
+
+			checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), stub.URL)
+			podHealthResponse, err := checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedState, podHealthResponse.State)
+			if tt.expectedChecks != nil {
+				assert.Equal(t, tt.expectedChecks, podHealthResponse.Body.Checks)
+			}
+		})
+	}
+}
+
+func Test_AcceptHeader(t *testing.T) {
+	// services without a format annotation are sent the same Accept header as before formats were supported
+	assert.Equal(t, "application/json", acceptHeader(""))
+	assert.Equal(t, "application/json", acceptHeader(constants.FormatAuto))
+	assert.Equal(t, "application/health+json", acceptHeader(constants.FormatHealthJSON))
+	assert.Equal(t, "text/plain", acceptHeader(constants.FormatReadyz))
+}
+
+func Test_ValidateHealthcheckBody(t *testing.T) {
+
+	healthy := model.Check{Name: "db", Health: constants.Healthy}
+	degraded := model.Check{Name: "cache", Health: constants.Degraded}
+
+	tests := []struct {
+		name             string
+		body             model.HealthcheckBody
+		expectedWarnings []string
+	}{
+		{name: "compliant", body: model.HealthcheckBody{Name: "svc", Health: constants.Degraded, Checks: []model.Check{healthy, degraded}}},
+		{name: "missing checks", body: model.HealthcheckBody{Name: "svc", Health: constants.Healthy},
+			expectedWarnings: []string{"checks is missing"}},
+		{name: "empty checks", body: model.HealthcheckBody{Name: "svc", Health: constants.Healthy, Checks: []model.Check{}},
+			expectedWarnings: []string{"checks is empty"}},
+		{name: "wrong case", body: model.HealthcheckBody{Name: "svc", Health: "Healthy", Checks: []model.Check{{Name: "db", Health: "HEALTHY"}}},
+			expectedWarnings: []string{`health "Healthy" should be lower case`, `check "db" health "HEALTHY" should be lower case`}},
+		{name: "invalid health", body: model.HealthcheckBody{Name: "svc", Health: "ok", Checks: []model.Check{healthy}},
+			expectedWarnings: []string{`health "ok" is not one of healthy, degraded or unhealthy`}},
+		{name: "duplicate names", body: model.HealthcheckBody{Name: "svc", Health: constants.Healthy, Checks: []model.Check{healthy, healthy}},
+			expectedWarnings: []string{`check name "db" is duplicated`}},
+		{name: "contradicting health", body: model.HealthcheckBody{Name: "svc", Health: constants.Healthy, Checks: []model.Check{healthy, degraded}},
+			expectedWarnings: []string{`health is "healthy" but the most severe check is "degraded"`}},
+		{name: "missing name", body: model.HealthcheckBody{Health: constants.Healthy, Checks: []model.Check{healthy}},
+			expectedWarnings: []string{"name is missing"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedWarnings, validateHealthcheckBody(tt.body))
+		})
+	}
+}
+
+func Test_GetHealthCheckForPodOverTLS(t *testing.T) {
+
+	stub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+			log.Error(err)
+		}
+	}))
+	defer stub.Close()
+
+	dir, err := ioutil.TempDir("", "health-aggregator-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stub.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	creds, err := NewTLSCredentials(caFile, "", "")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		tlsMode       string
+		serverName    string
+		expectedState string
+		expectedError string
+	}{
+		{name: "verified against ca", tlsMode: constants.TLSModeTLS, serverName: "example.com", expectedState: constants.Healthy},
+		{name: "wrong server name", tlsMode: constants.TLSModeTLS, serverName: "foo.example.org", expectedState: constants.Unhealthy, expectedError: "error performing healthcheck request"},
+		{name: "insecure", tlsMode: constants.TLSModeInsecure, expectedState: constants.Healthy},
+		{name: "mtls without client certificate", tlsMode: constants.TLSModeMTLS, expectedState: constants.Unhealthy, expectedError: "error configuring tls"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+			svc.HealthAnnotations.TLSMode = tt.tlsMode
+			svc.HealthAnnotations.TLSServerName = tt.serverName
+
+			metrics := instrumentation.SetupMetrics()
+			checker := NewHealthChecker(fake.NewSimpleClientset(), metrics, stub.URL, WithTLSCredentials(creds))
+			podHealthResponse, err := checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+
+			assert.Equal(t, tt.expectedState, podHealthResponse.State)
+			if tt.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, podHealthResponse.Error, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, podHealthResponse.CertExpiry)
+			assert.Equal(t, stub.Certificate().NotAfter.UTC(), *podHealthResponse.CertExpiry)
+		})
+	}
+}
+
+func Test_GetGRPCHealthCheckForPodOverTLS(t *testing.T) {
+
+	// the certificate of an httptest TLS server is valid for example.com and 127.0.0.1
+	stub := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := stub.TLS.Certificates[0]
+	caCert := stub.Certificate()
+	stub.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("uw-foo", healthpb.HealthCheckResponse_SERVING)
+	server := grpc.NewServer(grpc.Creds(grpccredentials.NewServerTLSFromCert(&cert)))
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			log.Error(err)
+		}
+	}()
+	defer server.Stop()
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "health-aggregator-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	creds, err := NewTLSCredentials(caFile, "", "")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		tlsMode          string
+		serverName       string
+		expectedState    string
+		expectedError    string
+		expectedAttempts int
+	}{
+		{name: "verified against ca", tlsMode: constants.TLSModeTLS, serverName: "example.com", expectedState: constants.Healthy, expectedAttempts: 1},
+		{name: "wrong server name", tlsMode: constants.TLSModeTLS, serverName: "foo.example.org", expectedState: constants.Unhealthy, expectedError: "error connecting to grpc health service", expectedAttempts: 1},
+		{name: "insecure", tlsMode: constants.TLSModeInsecure, expectedState: constants.Healthy, expectedAttempts: 1},
+		{name: "mtls without client certificate", tlsMode: constants.TLSModeMTLS, expectedState: constants.Unhealthy, expectedError: "error configuring tls"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+			svc.AppPort = port
+			svc.HealthAnnotations.CheckType = constants.CheckTypeGRPC
+			svc.HealthAnnotations.GRPCService = "uw-foo"
+			svc.HealthAnnotations.TLSMode = tt.tlsMode
+			svc.HealthAnnotations.TLSServerName = tt.serverName
+
+			// a failed handshake is neither repeated by the grpc client nor retried
+			start := time.Now()
+			checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), "", WithTLSCredentials(creds),
+				WithRetries(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+			podHealthResponse, err := checker.getGRPCHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1", IP: "127.0.0.1"}, svc)
+
+			assert.Equal(t, tt.expectedState, podHealthResponse.State)
+			assert.True(t, time.Since(start) < 2*time.Second, "a failed handshake should be returned at once")
+			assert.Equal(t, tt.expectedAttempts, podHealthResponse.Attempts)
+			if tt.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, podHealthResponse.Error, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, podHealthResponse.CertExpiry)
+			assert.Equal(t, caCert.NotAfter.UTC(), *podHealthResponse.CertExpiry)
+		})
+	}
+}
+
+func Test_CertExpiriesDeletesPodsNoLongerChecked(t *testing.T) {
+	gauge := instrumentation.SetupMetrics().Gauges[constants.HealthAggregatorCertExpiry]
+	expiries := newCertExpiries(gauge)
+
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+	expiry := time.Now().Add(24 * time.Hour)
+	expiries.checkedPods(svc, []model.Pod{{Name: "pod-a"}, {Name: "pod-b"}})
+	expiries.set(svc, "pod-a", expiry)
+	expiries.set(svc, "pod-b", expiry)
+
+	// pod-b has gone away
+	expiries.checkedPods(svc, []model.Pod{{Name: "pod-a"}})
+	assert.False(t, gauge.DeleteLabelValues(svc.Cluster, svc.Namespace, svc.Name, "pod-b"))
+
+	// the Service has not been checked for too long, e.g. as it was removed
+	expiries.checked[model.ServicesStateKey{Cluster: svc.Cluster, Namespace: svc.Namespace, Service: svc.Name}] = time.Now().Add(-2 * certExpiryTTL)
+	expiries.swept = time.Now().Add(-2 * certExpiryTTL)
+	expiries.checkedPods(helpers.GenerateDummyServiceForNamespace(namespaceName, 1), nil)
+	assert.False(t, gauge.DeleteLabelValues(svc.Cluster, svc.Namespace, svc.Name, "pod-a"))
+}
+
+func Test_TLSCredentialsReloadOnChange(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "health-aggregator-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	stub.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: stub.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	creds, err := NewTLSCredentials(caFile, "", "")
+	require.NoError(t, err)
+
+	c1, err := creds.client(constants.TLSModeTLS, "")
+	require.NoError(t, err)
+	c2, err := creds.client(constants.TLSModeTLS, "")
+	require.NoError(t, err)
+	assert.True(t, c1 == c2, "clients should be reused until the credentials change")
+
+	// an invalid file is ignored and the previous credentials kept
+	require.NoError(t, ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+	require.NoError(t, os.Chtimes(caFile, time.Now(), time.Now().Add(time.Minute)))
+	creds.checkedAt = time.Time{}
+	c3, err := creds.client(constants.TLSModeTLS, "")
+	require.NoError(t, err)
+	assert.True(t, c1 == c3)
+
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+	require.NoError(t, os.Chtimes(caFile, time.Now(), time.Now().Add(2*time.Minute)))
+	creds.checkedAt = time.Time{}
+	c4, err := creds.client(constants.TLSModeTLS, "")
+	require.NoError(t, err)
+	assert.False(t, c1 == c4, "a new client should be built from the reloaded credentials")
+}
+
+func Test_GetHealthCheckForPodWithAuthSecret(t *testing.T) {
+
+	var gotAuthorization, gotAPIKey string
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+		gotAPIKey = r.Header.Get("X-Api-Key")
+		if gotAuthorization != "Bearer rotated" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+			log.Error(err)
+		}
+	}))
+	defer stub.Close()
+
+	client := fake.NewSimpleClientset()
+	var gets int32
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, k8sruntime.Object, error) {
+		atomic.AddInt32(&gets, 1)
+		return false, nil, nil
+	})
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "health-auth", Namespace: namespaceName},
+		Data:       map[string][]byte{"token": []byte("original\n"), "header.X-Api-Key": []byte("abc123")},
+	}
+	_, err := client.CoreV1().Secrets(namespaceName).Create(secret)
+	require.NoError(t, err)
+
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+	svc.HealthAnnotations.AuthSecret = "health-auth"
+
+	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), stub.URL)
+
+	podHealthResponse, err := checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	assert.Error(t, err)
+	assert.Equal(t, "Bearer original", gotAuthorization)
+	assert.Equal(t, "abc123", gotAPIKey)
+	assert.Equal(t, http.StatusUnauthorized, podHealthResponse.StatusCode)
+
+	// rotate the token - the cached credentials are used until they are refreshed
+	secret.Data["token"] = []byte("rotated")
+	_, err = client.CoreV1().Secrets(namespaceName).Update(secret)
+	require.NoError(t, err)
+
+	_, err = checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	assert.Error(t, err)
+	assert.Equal(t, "Bearer original", gotAuthorization)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+
+	checker.creds.refreshInterval = 0
+
+	podHealthResponse, err = checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer rotated", gotAuthorization)
+	assert.Equal(t, constants.Healthy, podHealthResponse.State)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+
+	// the previous credentials are kept while the secret cannot be read
+	require.NoError(t, client.CoreV1().Secrets(namespaceName).Delete("health-auth", &metav1.DeleteOptions{}))
+	podHealthResponse, err = checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer rotated", gotAuthorization)
+
+	// a missing secret is reported on the pod check
+	svc.HealthAnnotations.AuthSecret = "missing"
+	podHealthResponse, err = checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	assert.Error(t, err)
+	assert.Contains(t, podHealthResponse.Error, "error getting healthcheck credentials")
+}
+
+func Test_CredentialsShareConcurrentSecretReads(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	_, err := client.CoreV1().Secrets(namespaceName).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "health-auth", Namespace: namespaceName},
+		Data:       map[string][]byte{"token": []byte("abc")},
+	})
+	require.NoError(t, err)
+
+	var gets int32
+	release := make(chan struct{})
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, k8sruntime.Object, error) {
+		atomic.AddInt32(&gets, 1)
+		<-release
+		return false, nil, nil
+	})
+
+	creds := newCredentials(clusterClients{local: client})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			headers, err := creds.headers("", namespaceName, "health-auth")
+			assert.NoError(t, err)
+			assert.Equal(t, "Bearer abc", headers["Authorization"])
+		}()
+	}
+	// let the checks queue up on the first read before it completes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+}
+
+func Test_GetHealthCheckForPodUsesConfiguredRequestTimeout(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer stub.Close()
+
+	cfg := config.Default()
+	cfg.Scheduling.RequestTimeout = 50 * time.Millisecond
+	store, err := config.NewStore("", cfg)
+	require.NoError(t, err)
+
+	checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), stub.URL, WithConfig(store))
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+
+	start := time.Now()
+	podHealthResponse, err := checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	require.Error(t, err)
+	assert.Equal(t, constants.Unhealthy, podHealthResponse.State)
+	assert.True(t, time.Since(start) < time.Second, "request should time out after the configured request timeout")
+}
+
+type flakyClient struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyClient) Do(req *http.Request) (*http.Response, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		err := f.err
+		if err == nil {
+			err = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+		}
+		return nil, &url.Error{Op: "Get", URL: req.URL.String(), Err: err}
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func Test_GetHealthCheckForPodRetriesNetworkErrors(t *testing.T) {
+
+	tests := []struct {
+		name             string
+		failures         int
+		err              error
+		statusCode       int
+		policy           RetryPolicy
+		expectedAttempts int
+		expectedState    string
+	}{
+		{name: "retried after a connection reset", failures: 1, statusCode: http.StatusOK, policy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, expectedAttempts: 2, expectedState: constants.Healthy},
+		{name: "attempts exhausted", failures: 5, statusCode: http.StatusOK, policy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, expectedAttempts: 3, expectedState: constants.Unhealthy},
+		{name: "retry would exceed the deadline", failures: 1, statusCode: http.StatusOK, policy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, Deadline: 100 * time.Millisecond}, expectedAttempts: 1, expectedState: constants.Unhealthy},
+		{name: "retries disabled", failures: 1, statusCode: http.StatusOK, expectedAttempts: 1, expectedState: constants.Unhealthy},
+		{name: "non-200 is not retried", statusCode: http.StatusInternalServerError, policy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, expectedAttempts: 1, expectedState: constants.Unhealthy},
+		{name: "tls error is not retried", failures: 1, err: x509.UnknownAuthorityError{}, statusCode: http.StatusOK, policy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, expectedAttempts: 1, expectedState: constants.Unhealthy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+				if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+					log.Error(err)
+				}
+			}))
+			defer stub.Close()
+
+			svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+
+			checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), stub.URL, WithRetries(tt.policy))
+			checker.client = &flakyClient{failures: tt.failures, err: tt.err}
+
+			podHealthResponse, _ := checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+			assert.Equal(t, tt.expectedAttempts, podHealthResponse.Attempts)
+			assert.Equal(t, tt.expectedState, podHealthResponse.State)
+		})
+	}
+}
+
+func Test_GetHealthCheckForPodCancelsAttemptsAtTheDeadline(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer stub.Close()
+
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+	checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), stub.URL,
+		WithRetries(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Deadline: 100 * time.Millisecond}))
+
+	start := time.Now()
+	podHealthResponse, err := checker.getHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1"}, svc)
+	require.Error(t, err)
+	assert.Equal(t, constants.Unhealthy, podHealthResponse.State)
+	assert.True(t, time.Since(start) < time.Second, "the attempt in progress should be cancelled at the deadline")
+}
+
+func Test_GetGRPCHealthCheckForPodRetriesRefusedConnections(t *testing.T) {
+	// nothing listens on the port of a closed listener
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, lis.Close())
+
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+	svc.AppPort = port
+	svc.HealthAnnotations.CheckType = constants.CheckTypeGRPC
+
+	checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), "",
+		WithRetries(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	podHealthResponse, err := checker.getGRPCHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1", IP: "127.0.0.1"}, svc)
+	require.Error(t, err)
+	assert.Equal(t, 3, podHealthResponse.Attempts)
+	assert.Contains(t, podHealthResponse.Error, "error connecting to grpc health service")
+}
+
+func Test_GetTCPHealthCheckForPodStopsRetryingAtTheDeadline(t *testing.T) {
+	// nothing listens on the port of a closed listener
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, lis.Close())
+
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, 1)
+	svc.AppPort = port
+	svc.HealthAnnotations.CheckType = constants.CheckTypeTCP
+
+	// the first backoff would end after the deadline, so there is no second attempt
+	checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), "",
+		WithRetries(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, Deadline: 100 * time.Millisecond}))
+
+	start := time.Now()
+	podHealthResponse, err := checker.getTCPHealthCheckForPod(context.Background(), model.Pod{Name: "pod-1", IP: "127.0.0.1"}, svc)
+	require.Error(t, err)
+	assert.Equal(t, 1, podHealthResponse.Attempts)
+	assert.True(t, time.Since(start) < time.Second, "retries should stop at the deadline")
+}
+
+func Test_Temporary(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{name: "connection refused", err: &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, expected: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, expected: true},
+		{name: "eof", err: &url.Error{Op: "Get", Err: io.EOF}, expected: true},
+		{name: "timeout", err: &url.Error{Op: "Get", Err: context.DeadlineExceeded}, expected: true},
+		{name: "unknown authority", err: &url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}},
+		{name: "failed handshake", err: handshakeError{x509.HostnameError{Certificate: &x509.Certificate{}, Host: "foo"}}},
+		{name: "cancelled", err: context.Canceled},
+		{name: "other", err: fmt.Errorf("unsupported protocol scheme")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, temporary(tt.err))
+		})
+	}
+}
+
+func Test_FairQueueRoundRobinsAcrossNamespaces(t *testing.T) {
+	q := newFairQueue()
+	for _, svc := range []model.Service{
+		{Namespace: "energy", Name: "a"}, {Namespace: "energy", Name: "b"}, {Namespace: "energy", Name: "c"},
+		{Namespace: "auth", Name: "d"}, {Namespace: "billing", Name: "e"}, {Namespace: "auth", Name: "f"},
+	} {
+		q.push(svc)
+	}
+	q.close()
+
+	var got []string
+	for {
+		svc, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, svc.Name)
+	}
+	assert.Equal(t, []string{"a", "d", "e", "b", "f", "c"}, got)
+}
+
+func Test_CheckPodsRespectsConcurrencyLimits(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		global        int
+		perNode       int
+		nodes         []string
+		expectedLimit int
+	}{
+		{name: "per node limit", global: 10, perNode: 2, nodes: []string{"node-a"}, expectedLimit: 2},
+		{name: "global limit", global: 3, perNode: 2, nodes: []string{"node-a", "node-b", "node-c", "node-d"}, expectedLimit: 3},
+		{name: "no per node limit", global: 8, nodes: []string{"node-a"}, expectedLimit: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+
+				w.WriteHeader(http.StatusOK)
+				if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+					log.Error(err)
+				}
+			}))
+			defer stub.Close()
+
+			var pods []model.Pod
+			for i := 0; i < 8; i++ {
+				pods = append(pods, model.Pod{Name: fmt.Sprintf("pod-%d", i), Node: tt.nodes[i%len(tt.nodes)]})
+			}
+
+			checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), stub.URL, WithConcurrency(tt.global, tt.perNode))
+			svc := helpers.GenerateDummyServiceForNamespace(namespaceName, len(pods))
+
+			podHealthResponses, podErrs := checker.checkPods(context.Background(), pods, svc, newScrapeLimiter(checker.maxConcurrent, checker.maxConcurrentPerNode))
+
+			require.Equal(t, len(pods), len(podHealthResponses))
+			for i := range pods {
+				assert.NoError(t, podErrs[i])
+				assert.Equal(t, pods[i].Name, podHealthResponses[i].Name)
+			}
+			assert.Equal(t, tt.expectedLimit, maxInFlight)
+		})
+	}
+}
+
+func Test_CheckPodsStartsAGoroutinePerSlot(t *testing.T) {
+	var mu sync.Mutex
+	maxGoroutines := 0
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if n := runtime.NumGoroutine(); n > maxGoroutines {
+			maxGoroutines = n
+		}
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+			log.Error(err)
+		}
+	}))
+	defer stub.Close()
+
+	var pods []model.Pod
+	for i := 0; i < 200; i++ {
+		pods = append(pods, model.Pod{Name: fmt.Sprintf("pod-%d", i), Node: "node-a"})
+	}
+
+	checker := NewHealthChecker(fake.NewSimpleClientset(), instrumentation.SetupMetrics(), stub.URL, WithConcurrency(2, 0))
+	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, len(pods))
+
+	before := runtime.NumGoroutine()
+	_, podErrs := checker.checkPods(context.Background(), pods, svc, newScrapeLimiter(checker.maxConcurrent, checker.maxConcurrentPerNode))
+	for _, err := range podErrs {
+		assert.NoError(t, err)
+	}
+	// the scrapes in flight and their connections, rather than a goroutine for each pod waiting on a slot
+	assert.True(t, maxGoroutines-before < 50, "%d goroutines were started", maxGoroutines-before)
+}
+
+func Test_DoHealthchecksDrainsQueueBeforeReturning(t *testing.T) {
+
+	errs := make(chan error, 10)
+	statusResponses := make(chan model.ServiceStatus, 10)
+	servicesToScrape := make(chan model.Service, 10)
+
+	client, svc := setUpNamespaceWithService(t, 1)
+	err := attachPods(1, svc.Name, client)
+	require.NoError(t, err)
+
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(healthyCheckReponse)); err != nil {
+			log.Error(err)
+		}
+	}))
+	defer stub.Close()
+
+	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), stub.URL, WithConcurrency(2, 0))
+	checker.client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	goroutines := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		servicesToScrape <- svc
+	}
+	close(servicesToScrape)
+
+	done := make(chan struct{})
+	go func() {
+		checker.DoHealthchecks(context.Background(), servicesToScrape, statusResponses, errs)
+		close(done)
+	}()
+
+	received := 0
+	for s := range statusResponses {
+		assert.Equal(t, constants.Healthy, s.AggregatedState)
+		received++
+	}
+	assert.Equal(t, 5, received)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DoHealthchecks did not return after the queue was drained")
+	}
+	assertNoGoroutineLeak(t, goroutines)
+}
+
+func Test_DoHealthchecksAbortsInFlightChecksWhenCancelled(t *testing.T) {
+
+	errs := make(chan error, 10)
+	statusResponses := make(chan model.ServiceStatus, 10)
+	servicesToScrape := make(chan model.Service, 10)
+
+	client, svc := setUpNamespaceWithService(t, 2)
+	err := attachPods(2, svc.Name, client)
+	require.NoError(t, err)
+
+	started := make(chan struct{}, 2)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		// hang until the health checker gives up on the request
+		<-r.Context().Done()
+	}))
+	defer stub.Close()
+
+	checker := NewHealthChecker(client, instrumentation.SetupMetrics(), stub.URL)
+	checker.client = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		checker.DoHealthchecks(ctx, servicesToScrape, statusResponses, errs)
+		close(done)
+	}()
+
+	servicesToScrape <- svc
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DoHealthchecks did not return after the context was cancelled")
+	}
+
+	_, ok := <-statusResponses
+	assert.False(t, ok, "results of aborted checks should be discarded and statusResponses closed")
+	assertNoGoroutineLeak(t, goroutines)
+}
+
+// assertNoGoroutineLeak waits for the number of goroutines to drop back to the given number, failing the test if it
+// does not within a few seconds
+func assertNoGoroutineLeak(t *testing.T, expected int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > expected {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-expected, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func setUpNamespaceWithService(t *testing.T, desiredReplicas int) (*fake.Clientset, model.Service) {
 
 	svc := helpers.GenerateDummyServiceForNamespace(namespaceName, desiredReplicas)
@@ -306,6 +1406,44 @@ func attachPods(numRequired int, serviceName string, client *fake.Clientset) err
 	return nil
 }
 
+func attachPodsWithIP(numRequired int, serviceName string, ip string, client *fake.Clientset) error {
+	for i := 0; i < numRequired; i++ {
+		_, err := client.CoreV1().Pods(namespaceName).Create(
+			&v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("%v-pod%v", serviceName, i),
+					Namespace: namespaceName,
+					Labels:    map[string]string{"app": serviceName},
+				},
+				Status: v1.PodStatus{PodIP: ip},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupGRPCHealthServer(t *testing.T) (string, *health.Server) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	healthServer := health.NewServer()
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+
+	return port, healthServer
+}
+
 func setupServerReturnHealthyPod() {
 	apiStub = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// return some json for the healthy pod
@@ -0,0 +1,127 @@
+package checks
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// credentialsRefreshInterval determines how often auth Secrets are re-read so that rotated tokens are picked up
+const credentialsRefreshInterval = 60 * time.Second
+
+const (
+	// secretKeyToken is sent as a bearer token in the Authorization header
+	secretKeyToken = "token"
+	// secretKeyAuthorization is sent as the Authorization header as is, e.g. "Basic dXNlcjpwYXNz"
+	secretKeyAuthorization = "authorization"
+	// secretKeyHeaderPrefix is stripped from any other key to give the name of the header to send, e.g.
+	// "header.X-Api-Key"
+	secretKeyHeaderPrefix = "header."
+)
+
+// credentials caches the headers to send with health check requests, read from the Kubernetes Secrets referenced by
+// the uw.health.aggregator.auth-secret annotation
+type credentials struct {
+	k8s clusterClients
+	// refreshInterval is how long read headers are used for before the Secret is read again
+	refreshInterval time.Duration
+
+	mu      sync.Mutex
+	secrets map[string]cachedHeaders
+	// fetches shares a read of a Secret between the checks of all the pods of a Service which need it at once
+	fetches singleflight.Group
+}
+
+type cachedHeaders struct {
+	headers   map[string]string
+	fetchedAt time.Time
+}
+
+func newCredentials(k8s clusterClients) *credentials {
+	return &credentials{k8s: k8s, refreshInterval: credentialsRefreshInterval, secrets: make(map[string]cachedHeaders)}
+}
+
+// clusterClients holds the k8s client for each watched cluster
+type clusterClients struct {
+	// local is used when a Service has no cluster, or its cluster has no client
+	local    kubernetes.Interface
+	clusters map[string]kubernetes.Interface
+}
+
+func (k clusterClients) get(cluster string) kubernetes.Interface {
+	if client, ok := k.clusters[cluster]; ok {
+		return client
+	}
+	return k.local
+}
+
+// headers returns the headers for the Secret with the given name, reading it again if it was last read more than
+// refreshInterval ago. If the Secret cannot be re-read the previously read headers are used
+func (c *credentials) headers(cluster string, namespace string, secretName string) (map[string]string, error) {
+	key := namespace + "/" + secretName
+	if cluster != "" {
+		key = cluster + "/" + key
+	}
+
+	c.mu.Lock()
+	cached, ok := c.secrets[key]
+	c.mu.Unlock()
+
+	if ok && time.Since(cached.fetchedAt) < c.refreshInterval {
+		return cached.headers, nil
+	}
+
+	fetched, err, _ := c.fetches.Do(key, func() (interface{}, error) {
+		return c.fetch(cluster, namespace, secretName, key)
+	})
+	if err != nil {
+		if ok {
+			log.WithError(err).WithFields(log.Fields{
+				"secret":    secretName,
+				"namespace": namespace,
+			}).Error("failed to refresh auth secret, continuing to use the previous credentials")
+			return cached.headers, nil
+		}
+		return nil, err
+	}
+	return fetched.(map[string]string), nil
+}
+
+// fetch reads the headers from the Secret and caches them under key
+func (c *credentials) fetch(cluster string, namespace string, secretName string, key string) (map[string]string, error) {
+	secret, err := c.k8s.get(cluster).CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get auth secret %s", key)
+	}
+
+	headers := make(map[string]string)
+	for k, v := range secret.Data {
+		value := strings.TrimSpace(string(v))
+		switch {
+		case k == secretKeyToken:
+			headers["Authorization"] = "Bearer " + value
+		case strings.HasPrefix(k, secretKeyHeaderPrefix) && len(k) > len(secretKeyHeaderPrefix):
+			headers[strings.TrimPrefix(k, secretKeyHeaderPrefix)] = value
+		}
+	}
+	// an explicit authorization value takes precedence over a token
+	if v, ok := secret.Data[secretKeyAuthorization]; ok {
+		headers["Authorization"] = strings.TrimSpace(string(v))
+	}
+
+	if len(headers) == 0 {
+		return nil, errors.Errorf("auth secret %s has no %q, %q or %q prefixed keys", key, secretKeyToken, secretKeyAuthorization, secretKeyHeaderPrefix)
+	}
+
+	c.mu.Lock()
+	c.secrets[key] = cachedHeaders{headers: headers, fetchedAt: time.Now()}
+	c.mu.Unlock()
+
+	return headers, nil
+}
@@ -0,0 +1,327 @@
+package checks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// formatAdapter converts health check responses in a particular format into a UW model.HealthcheckBody
+type formatAdapter interface {
+	// accept returns the Accept header to send when requesting this format
+	accept() string
+	// detect reports whether a response looks like this format
+	detect(contentType string, body []byte) bool
+	// parse normalises a response into a UW health check response
+	parse(body []byte) (model.HealthcheckBody, error)
+}
+
+// formatAdapters is the registry of supported response formats, selected with the uw.health.aggregator.format annotation
+var formatAdapters = map[string]formatAdapter{
+	constants.FormatUW:         uwFormat{},
+	constants.FormatSpring:     springFormat{},
+	constants.FormatHealthJSON: healthJSONFormat{},
+	constants.FormatReadyz:     readyzFormat{},
+}
+
+// formatDetectionOrder is the order in which formats are tried when the format is not given. The UW format accepts
+// any JSON object so is always tried last
+var formatDetectionOrder = []string{constants.FormatHealthJSON, constants.FormatReadyz, constants.FormatSpring, constants.FormatUW}
+
+// selectFormatAdapter returns the adapter for the given format, or detects the format from the response when the
+// format is empty or "auto"
+func selectFormatAdapter(format string, contentType string, body []byte) formatAdapter {
+	if adapter, ok := formatAdapters[format]; ok {
+		return adapter
+	}
+	for _, f := range formatDetectionOrder {
+		if adapter := formatAdapters[f]; adapter.detect(contentType, body) {
+			return adapter
+		}
+	}
+	return formatAdapters[constants.FormatUW]
+}
+
+// acceptHeader returns the Accept header to send for the given format. The UW format header is sent when the format
+// is detected from the response, as it always has been, so that existing health endpoints respond as before
+func acceptHeader(format string) string {
+	if adapter, ok := formatAdapters[format]; ok {
+		return adapter.accept()
+	}
+	return formatAdapters[constants.FormatUW].accept()
+}
+
+// uwFormat is the UW operational health endpoint format
+type uwFormat struct{}
+
+func (uwFormat) accept() string {
+	return "application/json"
+}
+
+func (uwFormat) detect(contentType string, body []byte) bool {
+	return isJSONObject(body)
+}
+
+func (uwFormat) parse(body []byte) (model.HealthcheckBody, error) {
+	health := &model.HealthcheckBody{}
+	if err := json.Unmarshal(body, &health); err != nil {
+		return model.HealthcheckBody{}, err
+	}
+	return *health, nil
+}
+
+// springFormat is the Spring Boot Actuator health endpoint format, e.g.
+// {"status": "UP", "components": {"db": {"status": "UP", "details": {"database": "PostgreSQL"}}}}
+type springFormat struct{}
+
+type springHealth struct {
+	Status     string                  `json:"status"`
+	Components map[string]springHealth `json:"components"`
+	// Details holds components prior to Spring Boot 2.2, or arbitrary details for a single component
+	Details json.RawMessage `json:"details"`
+}
+
+func (springFormat) accept() string {
+	return "application/vnd.spring-boot.actuator.v3+json, application/json"
+}
+
+func (springFormat) detect(contentType string, body []byte) bool {
+	if !isJSONObject(body) {
+		return false
+	}
+	var h springHealth
+	if err := json.Unmarshal(body, &h); err != nil {
+		return false
+	}
+	switch strings.ToUpper(h.Status) {
+	case "UP", "DOWN", "OUT_OF_SERVICE", "UNKNOWN":
+		return true
+	}
+	return false
+}
+
+func (springFormat) parse(body []byte) (model.HealthcheckBody, error) {
+	var h springHealth
+	if err := json.Unmarshal(body, &h); err != nil {
+		return model.HealthcheckBody{}, err
+	}
+	if h.Status == "" {
+		return model.HealthcheckBody{}, errors.New("spring actuator response has no status")
+	}
+
+	components := h.Components
+	if components == nil && len(h.Details) > 0 {
+		// Spring Boot < 2.2 nests components under details
+		var legacy map[string]springHealth
+		if err := json.Unmarshal(h.Details, &legacy); err == nil {
+			components = legacy
+		}
+	}
+
+	checks := []model.Check{}
+	for _, name := range sortedSpringKeys(components) {
+		component := components[name]
+		var output string
+		if len(component.Details) > 0 {
+			output = string(component.Details)
+		}
+		checks = append(checks, model.Check{
+			Name:   name,
+			Health: springStatusToHealth(component.Status),
+			Output: output,
+		})
+	}
+
+	return model.HealthcheckBody{
+		Description: "Spring Boot Actuator health",
+		Health:      springStatusToHealth(h.Status),
+		Checks:      checks,
+	}, nil
+}
+
+func springStatusToHealth(status string) string {
+	switch strings.ToUpper(status) {
+	case "UP":
+		return constants.Healthy
+	case "UNKNOWN":
+		return constants.Degraded
+	}
+	return constants.Unhealthy
+}
+
+// healthJSONFormat is the IETF draft "Health Check Response Format for HTTP APIs" (application/health+json), e.g.
+// {"status": "pass", "checks": {"db:responseTime": [{"status": "pass", "output": ""}]}}
+type healthJSONFormat struct{}
+
+type healthJSON struct {
+	Status      string                        `json:"status"`
+	ServiceID   string                        `json:"serviceId"`
+	Description string                        `json:"description"`
+	Output      string                        `json:"output"`
+	Checks      map[string][]healthJSONDetail `json:"checks"`
+}
+
+type healthJSONDetail struct {
+	ComponentID   string      `json:"componentId"`
+	Status        string      `json:"status"`
+	Output        string      `json:"output"`
+	ObservedValue interface{} `json:"observedValue"`
+	ObservedUnit  string      `json:"observedUnit"`
+}
+
+func (healthJSONFormat) accept() string {
+	return "application/health+json"
+}
+
+func (healthJSONFormat) detect(contentType string, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/health+json" {
+		return true
+	}
+	if !isJSONObject(body) {
+		return false
+	}
+	var h healthJSON
+	if err := json.Unmarshal(body, &h); err != nil {
+		return false
+	}
+	switch strings.ToLower(h.Status) {
+	case "pass", "fail", "warn":
+		return true
+	}
+	return false
+}
+
+func (healthJSONFormat) parse(body []byte) (model.HealthcheckBody, error) {
+	var h healthJSON
+	if err := json.Unmarshal(body, &h); err != nil {
+		return model.HealthcheckBody{}, err
+	}
+	if h.Status == "" {
+		return model.HealthcheckBody{}, errors.New("health+json response has no status")
+	}
+
+	checks := []model.Check{}
+	for _, name := range sortedHealthJSONKeys(h.Checks) {
+		for _, detail := range h.Checks[name] {
+			checkName := name
+			if detail.ComponentID != "" {
+				checkName = name + " (" + detail.ComponentID + ")"
+			}
+			output := detail.Output
+			if output == "" && detail.ObservedValue != nil {
+				output = strings.TrimSpace(fmt.Sprintf("%v %s", detail.ObservedValue, detail.ObservedUnit))
+			}
+			checks = append(checks, model.Check{
+				Name:   checkName,
+				Health: healthJSONStatusToHealth(detail.Status),
+				Output: output,
+			})
+		}
+	}
+
+	return model.HealthcheckBody{
+		Name:        h.ServiceID,
+		Description: h.Description,
+		Health:      healthJSONStatusToHealth(h.Status),
+		Checks:      checks,
+	}, nil
+}
+
+func healthJSONStatusToHealth(status string) string {
+	switch strings.ToLower(status) {
+	case "pass", "ok", "up":
+		return constants.Healthy
+	case "warn":
+		return constants.Degraded
+	}
+	return constants.Unhealthy
+}
+
+// readyzFormat is the plain text output of the Kubernetes /readyz?verbose and /healthz?verbose endpoints, e.g.
+// [+]ping ok
+// [-]etcd failed: reason withheld
+// readyz check failed
+type readyzFormat struct{}
+
+func (readyzFormat) accept() string {
+	return "text/plain"
+}
+
+func (readyzFormat) detect(contentType string, body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return bytes.HasPrefix(trimmed, []byte("[+]")) || bytes.HasPrefix(trimmed, []byte("[-]"))
+}
+
+func (readyzFormat) parse(body []byte) (model.HealthcheckBody, error) {
+	checks := []model.Check{}
+	health := constants.Healthy
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var checkHealth string
+		switch {
+		case strings.HasPrefix(line, "[+]"):
+			checkHealth = constants.Healthy
+		case strings.HasPrefix(line, "[-]"):
+			checkHealth = constants.Unhealthy
+			health = constants.Unhealthy
+		default:
+			continue
+		}
+		name, output := splitReadyzLine(line[3:])
+		checks = append(checks, model.Check{Name: name, Health: checkHealth, Output: output})
+	}
+	if err := scanner.Err(); err != nil {
+		return model.HealthcheckBody{}, err
+	}
+	if len(checks) == 0 {
+		return model.HealthcheckBody{}, errors.New("readyz response has no checks")
+	}
+
+	return model.HealthcheckBody{
+		Description: "Kubernetes readyz",
+		Health:      health,
+		Checks:      checks,
+	}, nil
+}
+
+// splitReadyzLine splits "etcd failed: reason withheld" into the check name and its output
+func splitReadyzLine(line string) (string, string) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func isJSONObject(body []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+}
+
+func sortedSpringKeys(m map[string]springHealth) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHealthJSONKeys(m map[string][]healthJSONDetail) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,149 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// getGRPCHealthCheckForPod calls grpc.health.v1.Health/Check (or the first response from Watch when the
+// uw.health.aggregator.grpc-watch annotation is set) for a pod on the app port, and maps the serving status onto
+// the UW health states so that the response can be stored in the same way as an HTTP health check. Connections use
+// TLS according to the uw.health.aggregator.tls annotation, and failed connections are retried according to the
+// retry policy, as HTTP health checks are
+func (c *HealthChecker) getGRPCHealthCheckForPod(ctx context.Context, pod model.Pod, svc model.Service) (model.PodHealthResponse, error) {
+	log.Debugf("Getting gRPC health check for pod " + pod.Name + " service " + pod.ServiceName)
+	var podHealthResponse model.PodHealthResponse
+	podHealthResponse.CheckTime = time.Now().UTC()
+	podHealthResponse.State = constants.Unhealthy
+	podHealthResponse.StatusCode = 0
+	podHealthResponse.Name = pod.Name
+
+	transport := grpc.WithInsecure()
+	if tlsMode := svc.HealthAnnotations.TLSMode; tlsMode != "" && tlsMode != constants.TLSModeDisabled {
+		creds, err := c.tls.grpc(tlsMode, svc.HealthAnnotations.TLSServerName)
+		if err != nil {
+			podHealthResponse.Error = "error configuring tls for grpc healthcheck request: " + err.Error()
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
+		transport = grpc.WithTransportCredentials(creds)
+	}
+
+	var md metadata.MD
+	if svc.HealthAnnotations.AuthSecret != "" {
+		headers, err := c.creds.headers(svc.Cluster, svc.Namespace, svc.HealthAnnotations.AuthSecret)
+		if err != nil {
+			podHealthResponse.Error = "error getting healthcheck credentials: " + err.Error()
+			return podHealthResponse, errors.New(podHealthResponse.Error)
+		}
+		md = metadata.MD{}
+		for k, v := range headers {
+			md.Append(strings.ToLower(k), v)
+		}
+	}
+
+	req := &healthpb.HealthCheckRequest{Service: svc.HealthAnnotations.GRPCService}
+	method := "grpc.health.v1.Health/Check"
+	if svc.HealthAnnotations.GRPCWatch == "true" {
+		method = "grpc.health.v1.Health/Watch"
+	}
+
+	retryCtx, cancelRetries := c.retryDeadline(ctx)
+	defer cancelRetries()
+
+	timeout := c.requestTimeout()
+	var resp *healthpb.HealthCheckResponse
+	var p peer.Peer
+	var err error
+	podHealthResponse.Attempts, err = c.withRetries(retryCtx, func() error {
+		attemptCtx, cancel := context.WithTimeout(retryCtx, timeout)
+		defer cancel()
+
+		// errors such as a failed TLS handshake are returned immediately rather than retried until the timeout
+		conn, err := grpc.DialContext(attemptCtx, net.JoinHostPort(pod.IP, svc.AppPort), transport, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+		if err != nil {
+			return errors.Wrap(err, "error connecting to grpc health service")
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				log.Errorf("cannot close grpc connection - error was: %v", err.Error())
+			}
+		}()
+
+		if md != nil {
+			attemptCtx = metadata.NewOutgoingContext(attemptCtx, md)
+		}
+		client := healthpb.NewHealthClient(conn)
+		if svc.HealthAnnotations.GRPCWatch == "true" {
+			var stream healthpb.Health_WatchClient
+			stream, err = client.Watch(attemptCtx, req)
+			if err == nil {
+				resp, err = stream.Recv()
+				// the peer of a stream is only recorded by grpc.Peer once the stream ends
+				if streamPeer, ok := peer.FromContext(stream.Context()); ok {
+					p = *streamPeer
+				}
+			}
+		} else {
+			resp, err = client.Check(attemptCtx, req, grpc.Peer(&p))
+		}
+		return errors.Wrap(err, "error performing grpc healthcheck request")
+	})
+	if err != nil {
+		podHealthResponse.Error = err.Error()
+		return podHealthResponse, errors.New(podHealthResponse.Error)
+	}
+
+	if tlsInfo, ok := p.AuthInfo.(grpccredentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+		certExpiry := tlsInfo.State.PeerCertificates[0].NotAfter.UTC()
+		podHealthResponse.CertExpiry = &certExpiry
+		c.certExpiries.set(svc, pod.Name, certExpiry)
+	}
+
+	// there is no HTTP status for a gRPC health check - a completed call is reported as 200 so that it can be
+	// distinguished from a pod that could not be reached
+	podHealthResponse.StatusCode = 200
+
+	health := grpcServingStatusToHealth(resp.Status)
+	podHealthResponse.State = health
+	podHealthResponse.Body = model.HealthcheckBody{
+		Name:        svc.Name,
+		Description: "gRPC Health Checking Protocol",
+		Health:      health,
+		Checks: []model.Check{{
+			Name:   method,
+			Health: health,
+			Output: fmt.Sprintf("service %q is %s", svc.HealthAnnotations.GRPCService, resp.Status.String()),
+		}},
+	}
+
+	if health != constants.Healthy {
+		podHealthResponse.Error = "pod failing one or more health checks"
+		return podHealthResponse, errors.New(podHealthResponse.Error)
+	}
+
+	return podHealthResponse, nil
+}
+
+func grpcServingStatusToHealth(status healthpb.HealthCheckResponse_ServingStatus) string {
+	switch status {
+	case healthpb.HealthCheckResponse_SERVING:
+		return constants.Healthy
+	case healthpb.HealthCheckResponse_UNKNOWN:
+		return constants.Degraded
+	}
+	return constants.Unhealthy
+}
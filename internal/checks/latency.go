@@ -0,0 +1,49 @@
+package checks
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// checkLatency marks an otherwise healthy pod as degraded when its health check took longer than the latency
+// threshold, as a slow health endpoint is often an early warning of a problem
+func (c *HealthChecker) checkLatency(podHealthResponse *model.PodHealthResponse, svc model.Service, duration time.Duration) error {
+	threshold := c.latencyThreshold
+	if svc.HealthAnnotations.LatencyThreshold != "" {
+		if d, err := time.ParseDuration(svc.HealthAnnotations.LatencyThreshold); err == nil {
+			threshold = d
+		}
+	}
+
+	if threshold <= 0 || duration <= threshold {
+		return nil
+	}
+
+	podHealthResponse.State = constants.Degraded
+	podHealthResponse.Error = fmt.Sprintf("health check took %v, above the latency threshold of %v", duration.Round(time.Millisecond), threshold)
+	return errors.New(podHealthResponse.Error)
+}
+
+// latencySummary returns the median and maximum latency of the pod health checks for a Service
+func latencySummary(podHealthResponses []model.PodHealthResponse) (float64, float64) {
+	if len(podHealthResponses) == 0 {
+		return 0, 0
+	}
+
+	latencies := make([]float64, 0, len(podHealthResponses))
+	for _, r := range podHealthResponses {
+		latencies = append(latencies, r.LatencyMs)
+	}
+	sort.Float64s(latencies)
+
+	return latencies[(len(latencies)-1)/2], latencies[len(latencies)-1]
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,190 @@
+package checks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// defaultMaxConcurrentChecks is the number of pods scraped concurrently unless set with WithConcurrency
+const defaultMaxConcurrentChecks = 100
+
+// WithConcurrency limits the number of pods scraped concurrently overall and on any one node. A perNode limit of 0
+// disables the per node limit
+func WithConcurrency(global int, perNode int) Option {
+	return func(c *HealthChecker) {
+		if global > 0 {
+			c.maxConcurrent = global
+		}
+		c.maxConcurrentPerNode = perNode
+	}
+}
+
+// fairQueue queues Services by Namespace and hands them out in round robin order across namespaces, so that a
+// namespace with many Services does not delay the checks of all others
+type fairQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[string][]model.Service
+	order  []string
+	size   int
+	closed bool
+}
+
+func newFairQueue() *fairQueue {
+	q := &fairQueue{queues: make(map[string][]model.Service)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *fairQueue) push(svc model.Service) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.queues[svc.Namespace]) == 0 {
+		q.order = append(q.order, svc.Namespace)
+	}
+	q.queues[svc.Namespace] = append(q.queues[svc.Namespace], svc)
+	q.size++
+	q.cond.Signal()
+}
+
+// pop blocks until a Service is available, returning false once the queue is closed and empty
+func (q *fairQueue) pop() (model.Service, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.size == 0 {
+		return model.Service{}, false
+	}
+
+	namespace := q.order[0]
+	q.order = q.order[1:]
+
+	svc := q.queues[namespace][0]
+	q.queues[namespace] = q.queues[namespace][1:]
+	if len(q.queues[namespace]) > 0 {
+		q.order = append(q.order, namespace)
+	} else {
+		delete(q.queues, namespace)
+	}
+	q.size--
+
+	return svc, true
+}
+
+func (q *fairQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+func (q *fairQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// scrapeLimiter bounds the number of concurrent pod scrapes overall and per node
+type scrapeLimiter struct {
+	global  chan struct{}
+	perNode int
+
+	mu    sync.Mutex
+	nodes map[string]chan struct{}
+}
+
+func newScrapeLimiter(global int, perNode int) *scrapeLimiter {
+	return &scrapeLimiter{
+		global:  make(chan struct{}, global),
+		perNode: perNode,
+		nodes:   make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until a pod on the given node may be scraped or ctx is cancelled, returning a func to release the
+// slot. The node slot is always taken before the global slot so that a scrape holding a global slot is never waiting
+// on another
+func (l *scrapeLimiter) acquire(ctx context.Context, node string) (func(), error) {
+	var nodeSlots chan struct{}
+	if l.perNode > 0 && node != "" {
+		l.mu.Lock()
+		nodeSlots = l.nodes[node]
+		if nodeSlots == nil {
+			nodeSlots = make(chan struct{}, l.perNode)
+			l.nodes[node] = nodeSlots
+		}
+		l.mu.Unlock()
+
+		select {
+		case nodeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	select {
+	case l.global <- struct{}{}:
+	case <-ctx.Done():
+		if nodeSlots != nil {
+			<-nodeSlots
+		}
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-l.global
+		if nodeSlots != nil {
+			<-nodeSlots
+		}
+	}, nil
+}
+
+// checkPods scrapes all pods of a Service in parallel, within the concurrency limits, returning the responses and
+// errors in the same order as the pods. A slot is acquired before the goroutine scraping a pod is started, so that a
+// Service with many pods does not start a goroutine for each of them while waiting for slots
+func (c *HealthChecker) checkPods(ctx context.Context, pods []model.Pod, svc model.Service, limiter *scrapeLimiter) ([]model.PodHealthResponse, []error) {
+	jobsDurationHistogramVec := c.metrics.Histograms[constants.HealthAggregatorJobDurationSeconds]
+
+	podHealthResponses := make([]model.PodHealthResponse, len(pods))
+	podErrs := make([]error, len(pods))
+
+	var wg sync.WaitGroup
+	for i, pod := range pods {
+		release, err := limiter.acquire(ctx, pod.Node)
+		if err != nil {
+			podHealthResponses[i] = model.PodHealthResponse{Name: pod.Name, CheckTime: time.Now().UTC(), State: constants.Unhealthy, Error: err.Error()}
+			podErrs[i] = err
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, pod model.Pod) {
+			defer wg.Done()
+			defer release()
+
+			start := time.Now()
+			podHealthResponse, err := c.checkPod(ctx, pod, svc)
+			duration := time.Since(start)
+			jobsDurationHistogramVec.WithLabelValues("health_scrape").Observe(duration.Seconds())
+
+			podHealthResponse.LatencyMs = durationMillis(duration)
+			if err == nil {
+				err = c.checkLatency(&podHealthResponse, svc, duration)
+			}
+
+			podHealthResponses[i] = podHealthResponse
+			podErrs[i] = err
+		}(i, pod)
+	}
+	wg.Wait()
+
+	return podHealthResponses, podErrs
+}
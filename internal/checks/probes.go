@@ -0,0 +1,76 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// getTCPHealthCheckForPod reports a pod as healthy if a TCP connection can be opened to the app port
+func (c *HealthChecker) getTCPHealthCheckForPod(ctx context.Context, pod model.Pod, svc model.Service) (model.PodHealthResponse, error) {
+	log.Debugf("Getting tcp health check for pod " + pod.Name + " service " + pod.ServiceName)
+	var podHealthResponse model.PodHealthResponse
+	podHealthResponse.CheckTime = time.Now().UTC()
+	podHealthResponse.State = constants.Unhealthy
+	podHealthResponse.StatusCode = 0
+	podHealthResponse.Name = pod.Name
+
+	address := net.JoinHostPort(pod.IP, svc.AppPort)
+	retryCtx, cancelRetries := c.retryDeadline(ctx)
+	defer cancelRetries()
+
+	timeout := c.requestTimeout()
+	var conn net.Conn
+	var err error
+	var dialer net.Dialer
+	podHealthResponse.Attempts, err = c.withRetries(retryCtx, func() error {
+		attemptCtx, cancel := context.WithTimeout(retryCtx, timeout)
+		defer cancel()
+
+		var dialErr error
+		conn, dialErr = dialer.DialContext(attemptCtx, "tcp", address)
+		return dialErr
+	})
+	if err != nil {
+		podHealthResponse.Error = "error connecting to pod: " + err.Error()
+		podHealthResponse.Body = syntheticHealthcheckBody(svc, constants.CheckTypeTCP, constants.Unhealthy, podHealthResponse.Error)
+		return podHealthResponse, errors.New(podHealthResponse.Error)
+	}
+	if err := conn.Close(); err != nil {
+		log.Errorf("cannot close tcp connection - error was: %v", err.Error())
+	}
+
+	podHealthResponse.State = constants.Healthy
+	podHealthResponse.Body = syntheticHealthcheckBody(svc, constants.CheckTypeTCP, constants.Healthy, "connected to "+address)
+
+	return podHealthResponse, nil
+}
+
+// syntheticHealthcheckBody builds a HealthcheckBody with a single Check for check types where the pod does not
+// return a UW health check response itself, so that results are stored and reported in the same way
+func syntheticHealthcheckBody(svc model.Service, checkType string, health string, output string) model.HealthcheckBody {
+	return model.HealthcheckBody{
+		Name:        svc.Name,
+		Description: checkType + " health check",
+		Health:      health,
+		Checks: []model.Check{{
+			Name:   checkType,
+			Health: health,
+			Output: output,
+		}},
+	}
+}
+
+// healthcheckPath returns the path to request for HTTP based check types, defaulting to /__/health
+func healthcheckPath(svc model.Service) string {
+	if svc.HealthAnnotations.Path != "" {
+		return svc.HealthAnnotations.Path
+	}
+	return constants.DefaultPath
+}
@@ -0,0 +1,125 @@
+package checks
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+)
+
+// RetryPolicy configures retries of health check requests which fail with a temporary network error, i.e. a timeout,
+// a refused or reset connection or an unexpected EOF. Other errors such as failed TLS handshakes, non-200 responses and
+// unhealthy bodies are never retried
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first, values below 2 disable retries
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubling for each subsequent retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+	// Deadline is the total time allowed for all attempts of a health check, an attempt in progress at the deadline is
+	// cancelled and a retry is not attempted if it would start after the deadline
+	Deadline time.Duration
+}
+
+// WithRetries retries health check requests which fail with a temporary network error according to the given policy
+func WithRetries(policy RetryPolicy) Option {
+	return func(c *HealthChecker) {
+		c.retries = policy
+	}
+}
+
+// retryDeadline returns a context which is cancelled at the deadline of the retry policy, from which the context of
+// each attempt must be derived. The returned cancel func must be called once any response has been read
+func (c *HealthChecker) retryDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.retries.Deadline > 0 {
+		return context.WithTimeout(ctx, c.retries.Deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// withRetries calls attempt until it succeeds, fails with an error which is not temporary, the retry policy is
+// exhausted or ctx is done, returning the number of attempts made and the last error. ctx should be returned by
+// retryDeadline
+func (c *HealthChecker) withRetries(ctx context.Context, attempt func() error) (int, error) {
+	backoff := c.retries.InitialBackoff
+
+	attempts := 0
+	for {
+		attempts++
+		err := attempt()
+		if err == nil {
+			c.recordAttempts(attempts, "success")
+			return attempts, nil
+		}
+
+		if attempts >= c.retries.MaxAttempts || !temporary(err) {
+			c.recordAttempts(attempts, "failure")
+			return attempts, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			c.recordAttempts(attempts, "failure")
+			return attempts, err
+		}
+
+		select {
+		case <-ctx.Done():
+			c.recordAttempts(attempts, "failure")
+			return attempts, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if c.retries.MaxBackoff > 0 && backoff > c.retries.MaxBackoff {
+			backoff = c.retries.MaxBackoff
+		}
+	}
+}
+
+// temporary reports whether err is worth retrying: a timeout, a refused or reset connection, an unexpected EOF or an
+// unavailable gRPC server. Wrapped errors are unwrapped, including the connection errors of the gRPC transport
+func temporary(err error) bool {
+	for err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == syscall.ECONNREFUSED || err == syscall.ECONNRESET {
+			return true
+		}
+		if s, ok := status.FromError(err); ok && s.Code() == codes.Unavailable {
+			return true
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return true
+		}
+
+		switch wrapped := err.(type) {
+		case interface{ Unwrap() error }:
+			err = wrapped.Unwrap()
+		case interface{ Origin() error }:
+			// the origin of a gRPC connection error without a cause is the error itself
+			origin := wrapped.Origin()
+			if origin == err {
+				return false
+			}
+			err = origin
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func (c *HealthChecker) recordAttempts(attempts int, result string) {
+	counterVec := c.metrics.Counters[constants.HealthAggregatorScrapeAttempts]
+	if counterVec == nil {
+		return
+	}
+	retried := "false"
+	if attempts > 1 {
+		retried = "true"
+	}
+	counterVec.WithLabelValues(result, retried).Inc()
+}
@@ -0,0 +1,330 @@
+package checks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	grpccredentials "google.golang.org/grpc/credentials"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+const (
+	// tlsReloadInterval determines how often the CA bundle and client certificate files are checked for changes
+	tlsReloadInterval = 30 * time.Second
+	// certExpiryTTL is how long the certificate expiry of the pods of a Service is reported for after the Service was
+	// last checked, e.g. once it has been removed
+	certExpiryTTL = time.Hour
+)
+
+// TLSCredentials holds the CA bundle and client certificate used to scrape health endpoints over HTTPS. The files
+// are reloaded when they change on disk so that rotated certificates are picked up without a restart
+type TLSCredentials struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mu         sync.Mutex
+	checkedAt  time.Time
+	modTimes   map[string]time.Time
+	rootCAs    *x509.CertPool
+	clientCert *tls.Certificate
+	clients    map[tlsClientKey]*http.Client
+}
+
+type tlsClientKey struct {
+	mode       string
+	serverName string
+}
+
+// NewTLSCredentials loads the CA bundle and client certificate and key from the given paths. Any path may be empty:
+// without a CA bundle the system roots are used, and without a client certificate the mtls mode is unavailable
+func NewTLSCredentials(caFile, certFile, keyFile string) (*TLSCredentials, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both a client certificate and key are required for mtls")
+	}
+
+	t := &TLSCredentials{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+		clients:  make(map[tlsClientKey]*http.Client),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// client returns an http client for the given TLS mode and server name, reloading the CA bundle and client
+// certificate first if either has changed on disk
+func (t *TLSCredentials) client(mode string, serverName string) (*http.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checkedAt) >= tlsReloadInterval {
+		t.reloadIfChanged()
+	}
+
+	if mode == constants.TLSModeMTLS && t.clientCert == nil {
+		return nil, errors.New("mtls requires a client certificate and key to be configured")
+	}
+
+	key := tlsClientKey{mode: mode, serverName: serverName}
+	if c, ok := t.clients[key]; ok {
+		return c, nil
+	}
+
+	tlsConfig := t.config(mode, serverName)
+
+	// requests are bounded by the request timeout of the HealthChecker rather than the client
+	c := &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: 128,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			Dial: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 10 * time.Second,
+			}).Dial,
+		},
+	}
+	t.clients[key] = c
+	return c, nil
+}
+
+// grpc returns the transport credentials for gRPC health checks in the given TLS mode, built from the same CA bundle
+// and client certificate as the http clients
+func (t *TLSCredentials) grpc(mode string, serverName string) (grpccredentials.TransportCredentials, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.checkedAt) >= tlsReloadInterval {
+		t.reloadIfChanged()
+	}
+
+	if mode == constants.TLSModeMTLS && t.clientCert == nil {
+		return nil, errors.New("mtls requires a client certificate and key to be configured")
+	}
+	return handshakeFailures{grpccredentials.NewTLS(t.config(mode, serverName))}, nil
+}
+
+// handshakeFailures marks failed TLS handshakes as permanent, so that a gRPC dial with FailOnNonTempDialError returns
+// them at once rather than repeating the handshake until the dial times out
+type handshakeFailures struct {
+	grpccredentials.TransportCredentials
+}
+
+func (h handshakeFailures) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, grpccredentials.AuthInfo, error) {
+	conn, authInfo, err := h.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		return nil, nil, handshakeError{err}
+	}
+	return conn, authInfo, nil
+}
+
+func (h handshakeFailures) Clone() grpccredentials.TransportCredentials {
+	return handshakeFailures{h.TransportCredentials.Clone()}
+}
+
+// handshakeError is a failed TLS handshake, which the gRPC client does not retry
+type handshakeError struct {
+	error
+}
+
+func (e handshakeError) Temporary() bool {
+	return false
+}
+
+func (e handshakeError) Unwrap() error {
+	return e.error
+}
+
+// config returns the TLS config for the given mode and server name, and must be called with mu held
+func (t *TLSCredentials) config(mode string, serverName string) *tls.Config {
+	tlsConfig := &tls.Config{
+		RootCAs:            t.rootCAs,
+		ServerName:         serverName,
+		InsecureSkipVerify: mode == constants.TLSModeInsecure,
+	}
+	if mode == constants.TLSModeMTLS {
+		tlsConfig.Certificates = []tls.Certificate{*t.clientCert}
+	}
+	return tlsConfig
+}
+
+func (t *TLSCredentials) reloadIfChanged() {
+	t.checkedAt = time.Now()
+
+	modTimes, err := t.statFiles()
+	if err != nil {
+		log.WithError(err).Error("failed to check tls credentials for changes")
+		return
+	}
+	changed := false
+	for f, modTime := range modTimes {
+		if !modTime.Equal(t.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	if err := t.load(); err != nil {
+		log.WithError(err).Error("failed to reload tls credentials, continuing to use the previous credentials")
+		return
+	}
+	log.Info("reloaded tls credentials")
+}
+
+func (t *TLSCredentials) load() error {
+	modTimes, err := t.statFiles()
+	if err != nil {
+		return err
+	}
+
+	var rootCAs *x509.CertPool
+	if t.caFile != "" {
+		caPEM, err := ioutil.ReadFile(t.caFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to read tls ca file")
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in tls ca file %s", t.caFile)
+		}
+	}
+
+	var clientCert *tls.Certificate
+	if t.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to load tls client certificate")
+		}
+		clientCert = &cert
+	}
+
+	// drop clients built from the previous credentials so that new connections use the new ones
+	for _, c := range t.clients {
+		if transport, ok := c.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+
+	t.modTimes = modTimes
+	t.rootCAs = rootCAs
+	t.clientCert = clientCert
+	t.clients = make(map[tlsClientKey]*http.Client)
+	t.checkedAt = time.Now()
+
+	return nil
+}
+
+func (t *TLSCredentials) statFiles() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, f := range []string{t.caFile, t.certFile, t.keyFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to stat tls credentials file")
+		}
+		modTimes[f] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// certExpiries reports the expiry of the certificate presented by each pod, deleting the series of pods which are no
+// longer checked
+type certExpiries struct {
+	gauge *prometheus.GaugeVec
+
+	mu      sync.Mutex
+	pods    map[model.ServicesStateKey]map[string]bool
+	checked map[model.ServicesStateKey]time.Time
+	swept   time.Time
+}
+
+func newCertExpiries(gauge *prometheus.GaugeVec) *certExpiries {
+	return &certExpiries{
+		gauge:   gauge,
+		pods:    make(map[model.ServicesStateKey]map[string]bool),
+		checked: make(map[model.ServicesStateKey]time.Time),
+		swept:   time.Now(),
+	}
+}
+
+func (e *certExpiries) set(svc model.Service, pod string, expiry time.Time) {
+	if e.gauge == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := model.ServicesStateKey{Cluster: svc.Cluster, Namespace: svc.Namespace, Service: svc.Name}
+	if e.pods[key] == nil {
+		e.pods[key] = make(map[string]bool)
+	}
+	e.pods[key][pod] = true
+	e.gauge.WithLabelValues(svc.Cluster, svc.Namespace, svc.Name, pod).Set(float64(expiry.Unix()))
+}
+
+// checkedPods deletes the series of the pods of a Service which were not among those just checked, and of Services which
+// have not been checked for certExpiryTTL
+func (e *certExpiries) checkedPods(svc model.Service, pods []model.Pod) {
+	if e.gauge == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		current[pod.Name] = true
+	}
+
+	now := time.Now()
+	key := model.ServicesStateKey{Cluster: svc.Cluster, Namespace: svc.Namespace, Service: svc.Name}
+	for pod := range e.pods[key] {
+		if !current[pod] {
+			e.delete(key, pod)
+		}
+	}
+	e.checked[key] = now
+
+	if now.Sub(e.swept) < certExpiryTTL {
+		return
+	}
+	e.swept = now
+	for key, checkedAt := range e.checked {
+		if now.Sub(checkedAt) < certExpiryTTL {
+			continue
+		}
+		for pod := range e.pods[key] {
+			e.delete(key, pod)
+		}
+		delete(e.pods, key)
+		delete(e.checked, key)
+	}
+}
+
+func (e *certExpiries) delete(key model.ServicesStateKey, pod string) {
+	e.gauge.DeleteLabelValues(key.Cluster, key.Namespace, key.Service, pod)
+	delete(e.pods[key], pod)
+}
@@ -0,0 +1,72 @@
+package checks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// validateHealthcheckBody returns a warning for each way in which a UW health check response does not comply with
+// the UW operational health spec. Responses are still used as returned, the warnings are recorded so that the
+// owning teams can be chased to fix them
+func validateHealthcheckBody(body model.HealthcheckBody) []string {
+	var warnings []string
+
+	if body.Name == "" {
+		warnings = append(warnings, "name is missing")
+	}
+	if w := validateHealthValue("health", body.Health); w != "" {
+		warnings = append(warnings, w)
+	}
+
+	if body.Checks == nil {
+		warnings = append(warnings, "checks is missing")
+		return warnings
+	}
+	if len(body.Checks) == 0 {
+		warnings = append(warnings, "checks is empty")
+		return warnings
+	}
+
+	seen := make(map[string]bool)
+	mostSevere := constants.Healthy
+	for i, chk := range body.Checks {
+		if chk.Name == "" {
+			warnings = append(warnings, fmt.Sprintf("check %d has no name", i))
+		} else if seen[chk.Name] {
+			warnings = append(warnings, fmt.Sprintf("check name %q is duplicated", chk.Name))
+		}
+		seen[chk.Name] = true
+
+		if w := validateHealthValue(fmt.Sprintf("check %q health", chk.Name), chk.Health); w != "" {
+			warnings = append(warnings, w)
+		}
+		if assignStatePriority(chk.Health) < assignStatePriority(mostSevere) {
+			mostSevere = strings.ToLower(chk.Health)
+		}
+	}
+
+	if isValidHealth(strings.ToLower(body.Health)) && strings.ToLower(body.Health) != mostSevere {
+		warnings = append(warnings, fmt.Sprintf("health is %q but the most severe check is %q", body.Health, mostSevere))
+	}
+
+	return warnings
+}
+
+func validateHealthValue(field string, health string) string {
+	switch {
+	case health == "":
+		return field + " is missing"
+	case isValidHealth(health):
+		return ""
+	case isValidHealth(strings.ToLower(health)):
+		return fmt.Sprintf("%s %q should be lower case", field, health)
+	}
+	return fmt.Sprintf("%s %q is not one of healthy, degraded or unhealthy", field, health)
+}
+
+func isValidHealth(health string) bool {
+	return health == constants.Healthy || health == constants.Degraded || health == constants.Unhealthy
+}
@@ -0,0 +1,558 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the structured configuration of health-aggregator, loaded from a YAML file over the values of the
+// command line flags
+type Config struct {
+	Scheduling    Scheduling      `yaml:"scheduling"`
+	Defaults      Defaults        `yaml:"defaults"`
+	Storage       Storage         `yaml:"storage"`
+	Notifications Notifications   `yaml:"notifications"`
+	Namespaces    []NamespaceRule `yaml:"namespaces"`
+	Clusters      []Cluster       `yaml:"clusters"`
+	Federation    Federation      `yaml:"federation"`
+	// NamespaceHealth rules roll up the health of the Services in a Namespace, the worst health applies if no rule
+	// matches
+	NamespaceHealth []HealthRule `yaml:"namespaceHealth"`
+	StatusPage      StatusPage   `yaml:"statusPage"`
+	Watchdog        Watchdog     `yaml:"watchdog"`
+}
+
+// Scheduling determines how often the periodic jobs run
+type Scheduling struct {
+	// ScrapeInterval is how often all Services are queued for a health check
+	ScrapeInterval time.Duration `yaml:"scrapeInterval"`
+	// ReloadInterval is how often Namespace and Service annotations are reloaded from k8s. Services which have not
+	// been reloaded for two intervals are deleted
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+	// TidyInterval is how often old health checks and stale Services are deleted
+	TidyInterval time.Duration `yaml:"tidyInterval"`
+	// RollupInterval is how often health checks are downsampled into hourly and daily rollups
+	RollupInterval time.Duration `yaml:"rollupInterval"`
+	// RequestTimeout is the time allowed for each HTTP or gRPC health check request, or TCP connection
+	RequestTimeout time.Duration `yaml:"requestTimeout"`
+}
+
+// Defaults are the health annotations used for Namespaces and Services which do not set them
+type Defaults struct {
+	Enable    string `yaml:"enable"`
+	Port      string `yaml:"port"`
+	Path      string `yaml:"path"`
+	CheckType string `yaml:"checkType"`
+	Format    string `yaml:"format"`
+	TLS       string `yaml:"tls"`
+}
+
+// Storage determines how health check responses are stored and for how long
+type Storage struct {
+	// Mode is either constants.StorageModeFull or constants.StorageModeTransitions, changes require a restart
+	Mode string `yaml:"mode"`
+	// SnapshotInterval is the minimum time between full responses being stored for a Service in
+	// constants.StorageModeTransitions, changes require a restart
+	SnapshotInterval         time.Duration `yaml:"snapshotInterval"`
+	DeleteChecksAfterDays    int           `yaml:"deleteChecksAfterDays"`
+	DeleteRollupsAfterDays   int           `yaml:"deleteRollupsAfterDays"`
+	DeleteIncidentsAfterDays int           `yaml:"deleteIncidentsAfterDays"` // counted from when an incident closed
+}
+
+// Notifications configures where changes in the aggregated state of Services are sent
+type Notifications struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// Route sends changes in the aggregated state of matching Services to a webhook
+type Route struct {
+	Name string `yaml:"name"`
+	// Namespaces are glob patterns matched against the Namespace of the Service, all Namespaces match if empty
+	Namespaces []string `yaml:"namespaces"`
+	// States are the aggregated states which are notified when a Service changes to them, all states if empty
+	States  []string `yaml:"states"`
+	Webhook string   `yaml:"webhook"`
+}
+
+// NamespaceRule applies to Namespaces whose name matches the glob pattern Match. Only the first matching rule applies
+type NamespaceRule struct {
+	Match string `yaml:"match"`
+	// Exclude stops the Namespace and its Services from being discovered
+	Exclude bool `yaml:"exclude"`
+	// Defaults override the global defaults for the Namespace, and are in turn overridden by its annotations
+	Defaults Defaults `yaml:"defaults"`
+}
+
+// Cluster is a k8s cluster to discover and health check Services in. When no clusters are configured only the cluster
+// given by the --kubeconfig flag, or the cluster health-aggregator runs in, is watched. Changes require a restart
+type Cluster struct {
+	// Name identifies the cluster in stored checks, the API and metrics
+	Name string `yaml:"name"`
+	// Context is the kubeconfig context used to connect to the cluster
+	Context string `yaml:"context"`
+	// KubeConfig is the path of the kubeconfig file holding Context, the --kubeconfig flag or the default loading
+	// rules are used if empty
+	KubeConfig string `yaml:"kubeconfig"`
+	// InCluster connects to the cluster health-aggregator runs in, instead of using a kubeconfig context
+	InCluster bool `yaml:"inCluster"`
+}
+
+// HealthRule rolls up the health of the Services in Namespaces whose name matches the glob pattern Match into the
+// health of the Namespace, as served by the namespace health endpoints. Only the first matching rule applies
+type HealthRule struct {
+	Match string `yaml:"match"`
+	// UnhealthyPercent is the percentage of Services which must be unhealthy for the Namespace to be unhealthy rather
+	// than degraded. Any unhealthy Service makes the Namespace unhealthy if zero
+	UnhealthyPercent int `yaml:"unhealthyPercent"`
+	// Critical are glob patterns of Services which make the Namespace unhealthy on their own when unhealthy
+	Critical []string `yaml:"critical"`
+	// Ignore are glob patterns of Services which do not affect the health of the Namespace
+	Ignore []string `yaml:"ignore"`
+}
+
+// Federation pulls the current status of Services from other health-aggregator instances, e.g. those run by teams in
+// their own namespace, and merges them into the statuses of this instance
+type Federation struct {
+	// Interval is how often the current statuses of every source are pulled
+	Interval time.Duration `yaml:"interval"`
+	Sources  []Source      `yaml:"sources"`
+}
+
+// Source is another health-aggregator instance whose current statuses are merged into those of this instance
+type Source struct {
+	// Name identifies the instance in merged statuses and metrics
+	Name string `yaml:"name"`
+	// URL is the base URL of the instance's API
+	URL string `yaml:"url"`
+	// Cluster is set on statuses from the instance which do not name a cluster, as it watches a single cluster
+	Cluster string `yaml:"cluster"`
+	// StaleAfter is how long after its check time a status from the instance is no longer trusted, three intervals
+	// if zero
+	StaleAfter time.Duration `yaml:"staleAfter"`
+}
+
+// StatusPage publishes a simplified, customer facing status page of named Components as static HTML and JSON files
+type StatusPage struct {
+	// Path is the directory the status page is written to, nothing is published if empty
+	Path string `yaml:"path"`
+	// Interval is how often the status page is published
+	Interval time.Duration `yaml:"interval"`
+	// Title heads the HTML status page
+	Title string `yaml:"title"`
+	// Components group Services by pattern. Services with the uw.health.aggregator.component annotation belong to the
+	// Component it names instead, which is added to the page if not listed here
+	Components []Component `yaml:"components"`
+}
+
+// Component is a part of the platform shown on the status page, whose status is derived from its Services
+type Component struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Services are glob patterns of "namespace/service", e.g. "billing/*". A Service belongs to the first matching
+	// Component
+	Services []string `yaml:"services"`
+}
+
+// Watchdog marks Services as stale when their latest check is too old, e.g. because their checks have silently stopped
+type Watchdog struct {
+	// StaleAfterIntervals is the number of scrape intervals after which the latest check of a Service is stale
+	StaleAfterIntervals int `yaml:"staleAfterIntervals"`
+	// AlertPercent is the percentage of stale Services above which health-aggregator reports itself unhealthy
+	AlertPercent int `yaml:"alertPercent"`
+}
+
+// StaleAfter returns how long after its latest check a Service is stale
+func (c Config) StaleAfter() time.Duration {
+	return time.Duration(c.Watchdog.StaleAfterIntervals) * c.Scheduling.ScrapeInterval
+}
+
+// Default returns the built in configuration
+func Default() Config {
+	return Config{
+		Scheduling: Scheduling{
+			ScrapeInterval: 60 * time.Second,
+			ReloadInterval: constants.ReloadServicesIntervalMins * time.Minute,
+			TidyInterval:   60 * time.Minute,
+			RollupInterval: 60 * time.Minute,
+			RequestTimeout: 10 * time.Second,
+		},
+		Defaults: Defaults{
+			Enable:    constants.DefaultEnableScrape,
+			Port:      constants.DefaultPort,
+			Path:      constants.DefaultPath,
+			CheckType: constants.CheckTypeHTTP,
+			Format:    constants.FormatAuto,
+			TLS:       constants.TLSModeDisabled,
+		},
+		Storage: Storage{
+			Mode:                     constants.StorageModeFull,
+			SnapshotInterval:         15 * time.Minute,
+			DeleteChecksAfterDays:    1,
+			DeleteRollupsAfterDays:   90,
+			DeleteIncidentsAfterDays: 90,
+		},
+		Federation: Federation{
+			Interval: 60 * time.Second,
+		},
+		StatusPage: StatusPage{
+			Interval: 60 * time.Second,
+			Title:    "Service status",
+		},
+		Watchdog: Watchdog{
+			StaleAfterIntervals: 3,
+			AlertPercent:        10,
+		},
+	}
+}
+
+// Load reads the YAML file at the given path over base and validates the result. Unknown fields are an error
+func Load(filePath string, base Config) (Config, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return base, errors.Wrapf(err, "failed to read config file %s", filePath)
+	}
+
+	cfg := base
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return base, errors.Wrapf(err, "failed to parse config file %s", filePath)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return base, errors.Wrapf(err, "invalid config file %s", filePath)
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration, returning an error describing every invalid value
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	intervals := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"scrapeInterval", c.Scheduling.ScrapeInterval},
+		{"reloadInterval", c.Scheduling.ReloadInterval},
+		{"tidyInterval", c.Scheduling.TidyInterval},
+		{"rollupInterval", c.Scheduling.RollupInterval},
+		{"requestTimeout", c.Scheduling.RequestTimeout},
+	}
+	for _, interval := range intervals {
+		if interval.value <= 0 {
+			invalid("scheduling.%s must be positive", interval.name)
+		}
+	}
+
+	problems = append(problems, c.Defaults.validate("defaults", true)...)
+
+	switch c.Storage.Mode {
+	case constants.StorageModeFull:
+	case constants.StorageModeTransitions:
+		if c.Storage.SnapshotInterval <= 0 {
+			invalid("storage.snapshotInterval must be positive in %q mode", constants.StorageModeTransitions)
+		}
+	default:
+		invalid("storage.mode %q must be one of %q or %q", c.Storage.Mode, constants.StorageModeFull, constants.StorageModeTransitions)
+	}
+	if c.Storage.DeleteChecksAfterDays < 1 {
+		invalid("storage.deleteChecksAfterDays must be at least 1")
+	}
+	if c.Storage.DeleteRollupsAfterDays < 1 {
+		invalid("storage.deleteRollupsAfterDays must be at least 1")
+	}
+	if c.Storage.DeleteIncidentsAfterDays < 1 {
+		invalid("storage.deleteIncidentsAfterDays must be at least 1")
+	}
+
+	for i, r := range c.Notifications.Routes {
+		field := fmt.Sprintf("notifications.routes[%d]", i)
+		if u, err := url.Parse(r.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("%s.webhook %q must be an http or https URL", field, r.Webhook)
+		}
+		for _, pattern := range r.Namespaces {
+			if !validPattern(pattern) {
+				invalid("%s.namespaces pattern %q is invalid", field, pattern)
+			}
+		}
+		for _, state := range r.States {
+			if !oneOf(state, constants.Healthy, constants.Degraded, constants.Unhealthy) {
+				invalid("%s.states %q must be one of %q, %q or %q", field, state, constants.Healthy, constants.Degraded, constants.Unhealthy)
+			}
+		}
+	}
+
+	for i, rule := range c.Namespaces {
+		field := fmt.Sprintf("namespaces[%d]", i)
+		if rule.Match == "" {
+			invalid("%s.match is required", field)
+		} else if !validPattern(rule.Match) {
+			invalid("%s.match pattern %q is invalid", field, rule.Match)
+		}
+		problems = append(problems, rule.Defaults.validate(field+".defaults", false)...)
+	}
+
+	names := make(map[string]bool)
+	for i, cluster := range c.Clusters {
+		field := fmt.Sprintf("clusters[%d]", i)
+		switch {
+		case !clusterName.MatchString(cluster.Name):
+			invalid("%s.name %q must be lower case alphanumeric characters or '-'", field, cluster.Name)
+		case names[cluster.Name]:
+			invalid("%s.name %q is not unique", field, cluster.Name)
+		}
+		names[cluster.Name] = true
+		if cluster.InCluster == (cluster.Context != "") {
+			invalid("%s must set exactly one of context or inCluster", field)
+		}
+		if cluster.InCluster && cluster.KubeConfig != "" {
+			invalid("%s.kubeconfig cannot be set with inCluster", field)
+		}
+	}
+
+	for i, rule := range c.NamespaceHealth {
+		field := fmt.Sprintf("namespaceHealth[%d]", i)
+		if rule.Match == "" {
+			invalid("%s.match is required", field)
+		} else if !validPattern(rule.Match) {
+			invalid("%s.match pattern %q is invalid", field, rule.Match)
+		}
+		if rule.UnhealthyPercent < 0 || rule.UnhealthyPercent > 100 {
+			invalid("%s.unhealthyPercent must be between 0 and 100", field)
+		}
+		for _, pattern := range append(append([]string{}, rule.Critical...), rule.Ignore...) {
+			if !validPattern(pattern) {
+				invalid("%s service pattern %q is invalid", field, pattern)
+			}
+		}
+	}
+
+	if c.Federation.Interval <= 0 {
+		invalid("federation.interval must be positive")
+	}
+	sources := make(map[string]bool)
+	for i, source := range c.Federation.Sources {
+		field := fmt.Sprintf("federation.sources[%d]", i)
+		switch {
+		case !clusterName.MatchString(source.Name):
+			invalid("%s.name %q must be lower case alphanumeric characters or '-'", field, source.Name)
+		case sources[source.Name]:
+			invalid("%s.name %q is not unique", field, source.Name)
+		}
+		sources[source.Name] = true
+		if u, err := url.Parse(source.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("%s.url %q must be an http or https URL", field, source.URL)
+		}
+		if source.Cluster != "" && !clusterName.MatchString(source.Cluster) {
+			invalid("%s.cluster %q must be lower case alphanumeric characters or '-'", field, source.Cluster)
+		}
+		if source.StaleAfter < 0 {
+			invalid("%s.staleAfter must not be negative", field)
+		}
+	}
+
+	if c.Watchdog.StaleAfterIntervals < 1 {
+		invalid("watchdog.staleAfterIntervals must be at least 1")
+	}
+	if c.Watchdog.AlertPercent < 0 || c.Watchdog.AlertPercent > 100 {
+		invalid("watchdog.alertPercent must be between 0 and 100")
+	}
+
+	if c.StatusPage.Interval <= 0 {
+		invalid("statusPage.interval must be positive")
+	}
+	components := make(map[string]bool)
+	for i, component := range c.StatusPage.Components {
+		field := fmt.Sprintf("statusPage.components[%d]", i)
+		switch {
+		case component.Name == "":
+			invalid("%s.name is required", field)
+		case components[component.Name]:
+			invalid("%s.name %q is not unique", field, component.Name)
+		}
+		components[component.Name] = true
+		for _, pattern := range component.Services {
+			if !validPattern(pattern) || strings.Count(pattern, "/") != 1 {
+				invalid("%s service pattern %q must be a valid namespace/service pattern", field, pattern)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (d Defaults) validate(field string, required bool) []string {
+	var problems []string
+	check := func(name string, value string, valid bool) {
+		if value == "" {
+			if required {
+				problems = append(problems, fmt.Sprintf("%s.%s is required", field, name))
+			}
+			return
+		}
+		if !valid {
+			problems = append(problems, fmt.Sprintf("%s.%s %q is invalid", field, name, value))
+		}
+	}
+
+	_, portErr := strconv.Atoi(d.Port)
+	check("enable", d.Enable, oneOf(d.Enable, "true", "false"))
+	check("port", d.Port, portErr == nil)
+	check("path", d.Path, strings.HasPrefix(d.Path, "/"))
+	check("checkType", d.CheckType, oneOf(d.CheckType, constants.CheckTypeHTTP, constants.CheckTypeGRPC, constants.CheckTypeTCP, constants.CheckTypeHTTPStatus, constants.CheckTypeHTTPRegex))
+	check("format", d.Format, oneOf(d.Format, constants.FormatAuto, constants.FormatUW, constants.FormatSpring, constants.FormatHealthJSON, constants.FormatReadyz))
+	check("tls", d.TLS, oneOf(d.TLS, constants.TLSModeDisabled, constants.TLSModeTLS, constants.TLSModeMTLS, constants.TLSModeInsecure))
+
+	return problems
+}
+
+// Annotations returns the defaults as health annotations, leaving unset values empty so that they can be inherited
+func (d Defaults) Annotations() model.HealthAnnotations {
+	return model.HealthAnnotations{
+		EnableScrape: d.Enable,
+		Port:         d.Port,
+		Path:         d.Path,
+		CheckType:    d.CheckType,
+		Format:       d.Format,
+		TLSMode:      d.TLS,
+	}
+}
+
+// StaleAfter returns how long after its check time a status pulled from the source is no longer trusted
+func (f Federation) StaleAfter(source Source) time.Duration {
+	if source.StaleAfter > 0 {
+		return source.StaleAfter
+	}
+	return 3 * f.Interval
+}
+
+// NamespaceRule returns the first rule matching the given Namespace
+func (c Config) NamespaceRule(namespace string) (NamespaceRule, bool) {
+	for _, rule := range c.Namespaces {
+		if ok, _ := path.Match(rule.Match, namespace); ok {
+			return rule, true
+		}
+	}
+	return NamespaceRule{}, false
+}
+
+// HealthRule returns the first health rule matching the given Namespace, or a rule under which the worst health of
+// its Services applies
+func (c Config) HealthRule(namespace string) HealthRule {
+	for _, rule := range c.NamespaceHealth {
+		if ok, _ := path.Match(rule.Match, namespace); ok {
+			return rule
+		}
+	}
+	return HealthRule{Match: "*"}
+}
+
+// Rollup returns the health of a Namespace given the current status of its Services. Silenced and ignored Services do
+// not affect it. The Namespace is unhealthy when a critical Service, or enough Services, are unhealthy, degraded when
+// any other Service is not healthy or is stale, and healthy otherwise
+func (r HealthRule) Rollup(statuses []model.ServiceStatus) string {
+	considered, unhealthy, notHealthy := 0, 0, 0
+	critical := false
+	for _, status := range statuses {
+		if status.Silenced || matchesAny(status.Service.Name, r.Ignore) {
+			continue
+		}
+		considered++
+		// the last known state of a stale Service may no longer hold, so it is not healthy whatever that state was
+		if status.Stale {
+			notHealthy++
+			continue
+		}
+		switch status.AggregatedState {
+		case constants.Healthy:
+			continue
+		case constants.Unhealthy:
+			unhealthy++
+			critical = critical || matchesAny(status.Service.Name, r.Critical)
+		}
+		notHealthy++
+	}
+
+	switch {
+	case critical, unhealthy > 0 && unhealthy*100 >= r.UnhealthyPercent*considered:
+		return constants.Unhealthy
+	case notHealthy > 0:
+		return constants.Degraded
+	default:
+		return constants.Healthy
+	}
+}
+
+// Component returns the name of the Component the given Service belongs to on the status page, which is empty if it
+// belongs to none
+func (p StatusPage) Component(svc model.Service) string {
+	if svc.HealthAnnotations.Component != "" {
+		return svc.HealthAnnotations.Component
+	}
+	for _, component := range p.Components {
+		if matchesAny(svc.Namespace+"/"+svc.Name, component.Services) {
+			return component.Name
+		}
+	}
+	return ""
+}
+
+// Matches reports whether a change of the given Service to the given aggregated state should be sent to the route
+func (r Route) Matches(namespace string, state string) bool {
+	if len(r.States) > 0 && !oneOf(state, r.States...) {
+		return false
+	}
+	if len(r.Namespaces) == 0 {
+		return true
+	}
+	for _, pattern := range r.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterName is the format of cluster names, which are used in API paths and metric labels
+var clusterName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// validPattern reports whether a glob pattern is well formed. path.Match only reports ErrBadPattern for the part of
+// the pattern it reads, so the pattern is matched against itself to read as much of it as possible
+func validPattern(pattern string) bool {
+	_, err := path.Match(pattern, pattern)
+	return err == nil
+}
+
+func matchesAny(value string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func oneOf(value string, options ...string) bool {
+	for _, o := range options {
+		if value == o {
+			return true
+		}
+	}
+	return false
+}
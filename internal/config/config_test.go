@@ -0,0 +1,210 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+const validConfig = `
+scheduling:
+  scrapeInterval: 30s
+  requestTimeout: 5s
+defaults:
+  port: "8080"
+storage:
+  deleteChecksAfterDays: 7
+notifications:
+  routes:
+    - name: energy
+      namespaces: ["energy", "billing-*"]
+      states: [unhealthy]
+      webhook: https://hooks.example.com/energy
+namespaces:
+  - match: kube-*
+    exclude: true
+  - match: energy
+    defaults:
+      path: /health
+clusters:
+  - name: dev
+    inCluster: true
+  - name: prod-eu
+    context: prod-eu
+federation:
+  sources:
+    - name: energy
+      url: http://health-aggregator.energy
+      cluster: dev
+    - name: billing
+      url: https://health-aggregator.billing.example.com
+      staleAfter: 10m
+namespaceHealth:
+  - match: energy
+    unhealthyPercent: 50
+    critical: [uw-gateway]
+    ignore: [uw-batch-*]
+statusPage:
+  path: /var/www/status
+  components:
+    - name: Billing
+      services: ["billing/*", "energy/uw-invoices"]
+watchdog:
+  staleAfterIntervals: 5
+`
+
+func Test_LoadOverridesBase(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cfg, err := Load(path, Default())
+	require.NoError(t, err)
+
+	assert.Equal(t, 30*time.Second, cfg.Scheduling.ScrapeInterval)
+	assert.Equal(t, 5*time.Second, cfg.Scheduling.RequestTimeout)
+	// values not in the file are kept from the base
+	assert.Equal(t, 60*time.Minute, cfg.Scheduling.ReloadInterval)
+	assert.Equal(t, "8080", cfg.Defaults.Port)
+	assert.Equal(t, constants.DefaultPath, cfg.Defaults.Path)
+	assert.Equal(t, 7, cfg.Storage.DeleteChecksAfterDays)
+	assert.Equal(t, 90, cfg.Storage.DeleteRollupsAfterDays)
+	assert.Equal(t, 90, cfg.Storage.DeleteIncidentsAfterDays)
+
+	rule, ok := cfg.NamespaceRule("kube-system")
+	require.True(t, ok)
+	assert.True(t, rule.Exclude)
+	rule, ok = cfg.NamespaceRule("energy")
+	require.True(t, ok)
+	assert.Equal(t, "/health", rule.Defaults.Annotations().Path)
+	_, ok = cfg.NamespaceRule("telecom")
+	assert.False(t, ok)
+
+	assert.Equal(t, []Cluster{{Name: "dev", InCluster: true}, {Name: "prod-eu", Context: "prod-eu"}}, cfg.Clusters)
+
+	require.Len(t, cfg.Federation.Sources, 2)
+	assert.Equal(t, 3*time.Minute, cfg.Federation.StaleAfter(cfg.Federation.Sources[0]))
+	assert.Equal(t, 10*time.Minute, cfg.Federation.StaleAfter(cfg.Federation.Sources[1]))
+
+	assert.Equal(t, 50, cfg.HealthRule("energy").UnhealthyPercent)
+	assert.Equal(t, HealthRule{Match: "*"}, cfg.HealthRule("telecom"))
+
+	assert.Equal(t, 150*time.Second, cfg.StaleAfter())
+	assert.Equal(t, 10, cfg.Watchdog.AlertPercent)
+
+	assert.Equal(t, "/var/www/status", cfg.StatusPage.Path)
+	assert.Equal(t, 60*time.Second, cfg.StatusPage.Interval)
+	assert.Equal(t, "Billing", cfg.StatusPage.Component(model.Service{Namespace: "billing", Name: "uw-ledger"}))
+	assert.Equal(t, "Billing", cfg.StatusPage.Component(model.Service{Namespace: "energy", Name: "uw-invoices"}))
+	assert.Equal(t, "", cfg.StatusPage.Component(model.Service{Namespace: "energy", Name: "uw-gateway"}))
+	// the annotation takes precedence over the components of the config
+	annotated := model.Service{Namespace: "billing", Name: "uw-ledger", HealthAnnotations: model.HealthAnnotations{Component: "Payments"}}
+	assert.Equal(t, "Payments", cfg.StatusPage.Component(annotated))
+
+	route := cfg.Notifications.Routes[0]
+	assert.True(t, route.Matches("billing-api", constants.Unhealthy))
+	assert.False(t, route.Matches("billing-api", constants.Degraded))
+	assert.False(t, route.Matches("telecom", constants.Unhealthy))
+}
+
+func Test_LoadRejectsInvalidConfig(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{name: "unknown field", config: "scheduling:\n  scrapeIntervl: 30s\n", expected: "field scrapeIntervl not found"},
+		{name: "negative interval", config: "scheduling:\n  scrapeInterval: -1s\n", expected: "scheduling.scrapeInterval must be positive"},
+		{name: "storage mode", config: "storage:\n  mode: sometimes\n", expected: `storage.mode "sometimes" must be one of`},
+		{name: "default check type", config: "defaults:\n  checkType: ping\n", expected: `defaults.checkType "ping" is invalid`},
+		{name: "webhook", config: "notifications:\n  routes:\n    - name: a\n      webhook: not-a-url\n", expected: `notifications.routes[0].webhook "not-a-url" must be an http or https URL`},
+		{name: "route state", config: "notifications:\n  routes:\n    - webhook: http://example.com\n      states: [down]\n", expected: `notifications.routes[0].states "down" must be one of`},
+		{name: "namespace rule", config: "namespaces:\n  - match: \"[\"\n", expected: `namespaces[0].match pattern "[" is invalid`},
+		{name: "namespace rule defaults", config: "namespaces:\n  - match: energy\n    defaults:\n      tls: sometimes\n", expected: `namespaces[0].defaults.tls "sometimes" is invalid`},
+		{name: "cluster name", config: "clusters:\n  - name: Prod EU\n    context: prod\n", expected: `clusters[0].name "Prod EU" must be lower case`},
+		{name: "duplicate cluster", config: "clusters:\n  - name: prod\n    context: prod\n  - name: prod\n    inCluster: true\n", expected: `clusters[1].name "prod" is not unique`},
+		{name: "cluster connection", config: "clusters:\n  - name: prod\n    context: prod\n    inCluster: true\n", expected: "clusters[0] must set exactly one of context or inCluster"},
+		{name: "namespace health percent", config: "namespaceHealth:\n  - match: energy\n    unhealthyPercent: 101\n", expected: "namespaceHealth[0].unhealthyPercent must be between 0 and 100"},
+		{name: "watchdog intervals", config: "watchdog:\n  staleAfterIntervals: 0\n", expected: "watchdog.staleAfterIntervals must be at least 1"},
+		{name: "status page component", config: "statusPage:\n  components:\n    - name: Billing\n      services: [billing]\n", expected: `statusPage.components[0] service pattern "billing" must be a valid namespace/service pattern`},
+		{name: "federation interval", config: "federation:\n  interval: 0s\n", expected: "federation.interval must be positive"},
+		{name: "federation source url", config: "federation:\n  sources:\n    - name: energy\n      url: health-aggregator.energy\n", expected: `federation.sources[0].url "health-aggregator.energy" must be an http or https URL`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.config)
+			defer os.RemoveAll(filepath.Dir(path))
+
+			_, err := Load(path, Default())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func Test_HealthRuleRollup(t *testing.T) {
+	status := func(name string, state string) model.ServiceStatus {
+		return model.ServiceStatus{Service: model.Service{Name: name, Namespace: "energy"}, AggregatedState: state}
+	}
+	silenced := status("uw-bar", constants.Unhealthy)
+	silenced.Silenced = true
+
+	worst := HealthRule{Match: "*"}
+	assert.Equal(t, constants.Healthy, worst.Rollup(nil))
+	assert.Equal(t, constants.Healthy, worst.Rollup([]model.ServiceStatus{status("uw-foo", constants.Healthy), silenced}))
+	assert.Equal(t, constants.Degraded, worst.Rollup([]model.ServiceStatus{status("uw-foo", constants.Healthy), status("uw-bar", constants.Degraded)}))
+	assert.Equal(t, constants.Unhealthy, worst.Rollup([]model.ServiceStatus{status("uw-foo", constants.Healthy), status("uw-bar", constants.Unhealthy)}))
+	stale := status("uw-bar", constants.Healthy)
+	stale.Stale = true
+	assert.Equal(t, constants.Degraded, worst.Rollup([]model.ServiceStatus{status("uw-foo", constants.Healthy), stale}))
+
+	rule := HealthRule{Match: "energy", UnhealthyPercent: 50, Critical: []string{"uw-gateway"}, Ignore: []string{"uw-batch-*"}}
+	assert.Equal(t, constants.Degraded, rule.Rollup([]model.ServiceStatus{
+		status("uw-foo", constants.Healthy), status("uw-bar", constants.Healthy), status("uw-baz", constants.Unhealthy),
+	}))
+	assert.Equal(t, constants.Unhealthy, rule.Rollup([]model.ServiceStatus{
+		status("uw-foo", constants.Healthy), status("uw-bar", constants.Unhealthy), status("uw-baz", constants.Unhealthy),
+	}))
+	assert.Equal(t, constants.Unhealthy, rule.Rollup([]model.ServiceStatus{
+		status("uw-foo", constants.Healthy), status("uw-bar", constants.Healthy), status("uw-gateway", constants.Unhealthy),
+	}))
+	assert.Equal(t, constants.Healthy, rule.Rollup([]model.ServiceStatus{
+		status("uw-foo", constants.Healthy), status("uw-batch-nightly", constants.Unhealthy),
+	}))
+}
+
+func Test_StoreKeepsPreviousConfigWhenReloadFails(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	store, err := NewStore(path, Default())
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, store.Get().Scheduling.ScrapeInterval)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("scheduling:\n  scrapeInterval: 0s\n"), 0600))
+	assert.Error(t, store.reload())
+	assert.Equal(t, 30*time.Second, store.Get().Scheduling.ScrapeInterval)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("scheduling:\n  scrapeInterval: 45s\n"), 0600))
+	require.NoError(t, store.reload())
+	assert.Equal(t, 45*time.Second, store.Get().Scheduling.ScrapeInterval)
+	// values removed from the file revert to the base
+	assert.Equal(t, constants.DefaultPort, store.Get().Defaults.Port)
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// filePollInterval determines how often the config file is checked for changes
+const filePollInterval = 10 * time.Second
+
+// Store holds the current configuration, reloading it from the config file on SIGHUP or when the file changes.
+// If a reload fails the previous configuration is kept
+type Store struct {
+	path string
+	base Config
+
+	mu      sync.RWMutex
+	current Config
+	modTime time.Time
+}
+
+// NewStore loads the config file at the given path over base. Without a path the store only ever holds base
+func NewStore(filePath string, base Config) (*Store, error) {
+	s := &Store{path: filePath, base: base, current: base}
+	if filePath == "" {
+		return s, base.Validate()
+	}
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the current configuration
+func (s *Store) Get() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// Watch reloads the config file on SIGHUP, or when its modification time changes, until ctx is cancelled
+func (s *Store) Watch(ctx context.Context) {
+	if s.path == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info("received SIGHUP, reloading config")
+		case <-ticker.C:
+			info, err := os.Stat(s.path)
+			if err != nil || info.ModTime().Equal(s.lastModTime()) {
+				continue
+			}
+			log.Info("config file changed, reloading config")
+		}
+
+		if err := s.reload(); err != nil {
+			log.WithError(err).Error("failed to reload config, continuing to use the previous config")
+			continue
+		}
+		log.Info("config reloaded")
+	}
+}
+
+func (s *Store) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := Load(s.path, s.base)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the modification time is recorded even if the file is invalid, so that it is not reloaded until it changes again
+	s.modTime = info.ModTime()
+	if err != nil {
+		return err
+	}
+	s.current = cfg
+	return nil
+}
+
+func (s *Store) lastModTime() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.modTime
+}
@@ -9,17 +9,65 @@ const (
 	DefaultEnableScrape = "true"
 	// DefaultPort is the default port for Namespaces and Service Annotation uw.health.aggregator.port
 	DefaultPort = "8081"
+	// CheckTypeHTTP is the default value for Namespaces and Service Annotation uw.health.aggregator.check-type and
+	// scrapes the UW operational health endpoint /__/health over HTTP
+	CheckTypeHTTP = "http"
+	// CheckTypeGRPC calls grpc.health.v1.Health/Check as described by the gRPC Health Checking Protocol
+	CheckTypeGRPC = "grpc"
+	// CheckTypeTCP reports a pod as healthy if a TCP connection can be opened to the app port
+	CheckTypeTCP = "tcp"
+	// CheckTypeHTTPStatus reports a pod as healthy if its health endpoint returns any 2xx status, ignoring the body
+	CheckTypeHTTPStatus = "http-status"
+	// CheckTypeHTTPRegex reports a pod as healthy if its health endpoint returns a 2xx status and the body matches
+	// the Service Annotation uw.health.aggregator.check-regex
+	CheckTypeHTTPRegex = "http-regex"
+	// FormatAuto detects the format of a health check response from its Content-Type and body
+	FormatAuto = "auto"
+	// FormatUW is the UW operational health endpoint format
+	FormatUW = "uw"
+	// FormatSpring is the Spring Boot Actuator health endpoint format
+	FormatSpring = "spring"
+	// FormatHealthJSON is the IETF draft health check response format (application/health+json)
+	FormatHealthJSON = "health+json"
+	// FormatReadyz is the plain text format of the Kubernetes /readyz?verbose and /healthz?verbose endpoints
+	FormatReadyz = "readyz"
+	// TLSModeDisabled scrapes health endpoints over plain HTTP
+	TLSModeDisabled = "disabled"
+	// TLSModeTLS scrapes health endpoints over HTTPS, verifying the server certificate against the CA bundle
+	TLSModeTLS = "tls"
+	// TLSModeMTLS scrapes health endpoints over HTTPS, verifying the server certificate and presenting the client
+	// certificate
+	TLSModeMTLS = "mtls"
+	// TLSModeInsecure scrapes health endpoints over HTTPS without verifying the server certificate
+	TLSModeInsecure = "insecure"
+	// DefaultPath is the default value for Namespaces and Service Annotation uw.health.aggregator.path
+	DefaultPath = "/__/health"
 	// ServicesCollection is the name of the mongo collection that stores k8s Services alongside annotations
 	ServicesCollection = "services"
 	// NamespacesCollection is the name of the mongo collection that stores k8s Namespaces alongside annotations
 	NamespacesCollection = "namespaces"
 	// HealthchecksCollection is the name of the mongo collection that stores health check responses for k8s Services
 	HealthchecksCollection = "checks"
+	// StatusCollection is the name of the mongo collection that stores the current status of each k8s Service
+	StatusCollection = "status"
+	// TransitionsCollection is the name of the mongo collection that stores changes in the aggregated state of k8s Services
+	TransitionsCollection = "transitions"
+	// SilencesCollection is the name of the mongo collection that stores silences created via the API
+	SilencesCollection = "silences"
+	// IncidentsCollection is the name of the mongo collection that stores incidents opened when a k8s Service becomes unhealthy
+	IncidentsCollection = "incidents"
+	// RollupsCollection is the name of the mongo collection that stores hourly and daily summaries of health check responses
+	RollupsCollection = "rollups"
+	// RollupProgressCollection is the name of the mongo collection that stores the last period of each type rolled up
+	RollupProgressCollection = "rollupProgress"
 	// DBName is the mongo database name
 	DBName = "healthaggregator"
 	// HealthAggregatorOutcome is the name of the metrics counter for health check results
 	// i.e. was the check made successfully or not?
 	HealthAggregatorOutcome = "health_aggregator_outcome"
+	// HealthAggregatorScrapeAttempts is the name of the metrics counter for health check requests by whether they
+	// succeeded and whether they were retried after a network error
+	HealthAggregatorScrapeAttempts = "health_aggregator_scrape_requests_total"
 	// PerformedHealthcheckResult represents the result of the healthcheck e.g. was the healthcheck successfully called or not
 	PerformedHealthcheckResult = "performed_healthcheck_result"
 	// HealthAggregatorInFlight records the number of health checks which are currently in flight
@@ -30,12 +78,45 @@ const (
 	// HealthAggregatorJobDurationSeconds is the name of the metrics gauge for queued services
 	// i.e. how many services are queued right now?
 	HealthAggregatorJobDurationSeconds = "health_aggregator_job_duration_seconds"
+	// HealthAggregatorServiceUnhealthy is the name of the metrics gauge which is 1 for each service that is not
+	// healthy and not silenced, and 0 otherwise
+	HealthAggregatorServiceUnhealthy = "health_aggregator_service_unhealthy"
+	// HealthAggregatorNonCompliantServices is the name of the metrics gauge for the number of services in each
+	// namespace whose latest health check responses do not comply with the UW operational health spec
+	HealthAggregatorNonCompliantServices = "health_aggregator_non_compliant_services"
+	// HealthAggregatorCertExpiry is the name of the metrics gauge for the expiry time of the certificate presented
+	// by each pod scraped over HTTPS
+	HealthAggregatorCertExpiry = "health_aggregator_target_cert_expiry_timestamp_seconds"
+	// HealthAggregatorFederationSourceUp is the name of the metrics gauge which is 1 for each federation source whose
+	// statuses were pulled successfully the last time, and 0 otherwise
+	HealthAggregatorFederationSourceUp = "health_aggregator_federation_source_up"
+	// HealthAggregatorShardServices is the name of the metrics gauge for the number of services assigned to each
+	// shard in its latest scheduling round
+	HealthAggregatorShardServices = "health_aggregator_shard_services"
+	// HealthAggregatorServiceStale is the name of the metrics gauge which is 1 for each service whose latest check is
+	// stale, as its checks have stopped, and 0 otherwise
+	HealthAggregatorServiceStale = "health_aggregator_service_stale"
+	// HealthAggregatorStaleServicesPercent is the name of the metrics gauge for the percentage of the services checked
+	// by this instance whose latest check is stale
+	HealthAggregatorStaleServicesPercent = "health_aggregator_stale_services_percent"
 	// Unhealthy reprents the unhealthy state from the UW operational health endpoint spec
 	Unhealthy = "unhealthy"
 	// Healthy reprents the healthy state from the UW operational health endpoint spec
 	Healthy = "healthy"
 	// Degraded reprents the degraded state from the UW operational health endpoint spec
 	Degraded = "degraded"
+	// StorageModeFull stores every health check response
+	StorageModeFull = "full"
+	// StorageModeTransitions stores state transitions and only periodic snapshots of health check responses
+	StorageModeTransitions = "transitions"
+	// IncidentOpen is the state of an Incident for a Service which has not yet recovered
+	IncidentOpen = "open"
+	// IncidentClosed is the state of an Incident for a Service which has recovered
+	IncidentClosed = "closed"
+	// RollupHourly identifies a summary of health check responses covering one hour
+	RollupHourly = "hourly"
+	// RollupDaily identifies a summary of health check responses covering one day
+	RollupDaily = "daily"
 	// ReloadServicesIntervalMins determines how often to attempt refreshing service
 	// configurations from k8s
 	ReloadServicesIntervalMins = 60
@@ -0,0 +1,22 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// static holds the dashboard, a single page app built on the API of the main router
+//
+//go:embed static
+var static embed.FS
+
+// Handler serves the dashboard embedded in the binary, mounted under prefix
+func Handler(prefix string) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		// static is embedded at build time, so this only fails if the directory above is renamed
+		panic(err)
+	}
+	return http.StripPrefix(prefix, http.FileServer(http.FS(files)))
+}
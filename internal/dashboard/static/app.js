@@ -0,0 +1,211 @@
+"use strict";
+
+// The dashboard is served under /ui/, so the API of the main router is one level up
+const api = "../";
+const view = document.getElementById("view");
+const clusterSelect = document.getElementById("cluster");
+
+const severity = { healthy: 0, degraded: 1, unhealthy: 2 };
+
+function escape(value) {
+  return String(value === undefined || value === null ? "" : value).replace(/[&<>"']/g, (c) => ({
+    "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;",
+  })[c]);
+}
+
+function since(time) {
+  const minutes = Math.floor((Date.now() - new Date(time).getTime()) / 60000);
+  if (minutes >= 1440) return Math.floor(minutes / 1440) + "d";
+  if (minutes >= 60) return Math.floor(minutes / 60) + "h";
+  if (minutes >= 1) return minutes + "m";
+  return "<1m";
+}
+
+function stateClass(status) {
+  return status.stale ? "stale" : (status.aggregatedState || "unknown");
+}
+
+function worst(states) {
+  return states.reduce((a, b) => (severity[b] > severity[a] ? b : a), "healthy");
+}
+
+async function get(path) {
+  const res = await fetch(api + path);
+  if (!res.ok) throw new Error(path + " returned " + res.status);
+  return res.json();
+}
+
+function withCluster(path) {
+  const cluster = clusterSelect.value;
+  if (!cluster) return path;
+  return path + (path.includes("?") ? "&" : "?") + "cluster=" + encodeURIComponent(cluster);
+}
+
+async function statuses(namespace) {
+  return get(withCluster("api/v1/statuses" + (namespace ? "?namespace=" + encodeURIComponent(namespace) : "")));
+}
+
+function serviceLink(status) {
+  const s = status.service;
+  const cluster = s.cluster ? "?cluster=" + encodeURIComponent(s.cluster) : "";
+  return "#/ns/" + encodeURIComponent(s.namespace) + "/" + encodeURIComponent(s.name) + cluster;
+}
+
+async function namespacesView() {
+  const byNamespace = new Map();
+  for (const status of await statuses()) {
+    const ns = status.service.namespace;
+    if (!byNamespace.has(ns)) byNamespace.set(ns, []);
+    byNamespace.get(ns).push(status);
+  }
+
+  const tiles = [...byNamespace.entries()].map(([ns, list]) => {
+    const counts = { healthy: 0, degraded: 0, unhealthy: 0 };
+    list.forEach((s) => { counts[s.aggregatedState] = (counts[s.aggregatedState] || 0) + 1; });
+    const state = worst(list.filter((s) => !s.silenced).map((s) => s.aggregatedState));
+    return `<a class="tile ${state}" href="#/ns/${encodeURIComponent(ns)}">
+      <div class="name">${escape(ns)}</div>
+      <div class="meta">${list.length} services: ${counts.healthy} healthy, ${counts.degraded} degraded, ${counts.unhealthy} unhealthy</div>
+    </a>`;
+  });
+
+  view.innerHTML = `<h1>Namespaces</h1>` +
+    (tiles.length ? `<div class="grid">${tiles.join("")}</div>` : "<p>No services have been checked yet.</p>");
+}
+
+async function namespaceView(namespace) {
+  const tiles = (await statuses(namespace)).map((status) => `<a class="tile ${stateClass(status)}" href="${serviceLink(status)}">
+      <div class="name">${escape(status.service.name)}</div>
+      <div class="meta">${escape(status.aggregatedState)} for ${since(status.stateSince)}
+        ${status.service.cluster ? " &middot; " + escape(status.service.cluster) : ""}
+        ${status.silenced ? " &middot; silenced" : ""}${status.stale ? " &middot; stale" : ""}
+        ${status.source ? " &middot; via " + escape(status.source) : ""}</div>
+    </a>`);
+
+  view.innerHTML = `<h1>${escape(namespace)}</h1>
+    <p><a href="../namespaces/${encodeURIComponent(namespace)}/__/health">Namespace health</a></p>` +
+    (tiles.length ? `<div class="grid">${tiles.join("")}</div>` : "<p>No services found.</p>");
+}
+
+function timeline(transitions) {
+  // transitions are newest first, each segment lasts until the next transition
+  const ordered = [...transitions].reverse();
+  if (!ordered.length) return "<p>No state changes recorded.</p>";
+  const start = new Date(ordered[0].time).getTime();
+  const total = Math.max(Date.now() - start, 1);
+  const segments = ordered.map((t, i) => {
+    const from = new Date(t.time).getTime();
+    const to = i + 1 < ordered.length ? new Date(ordered[i + 1].time).getTime() : Date.now();
+    const width = ((to - from) / total) * 100;
+    return `<div class="${escape(t.to)}" style="width: ${width}%" title="${escape(t.to)} from ${escape(new Date(t.time).toLocaleString())}"></div>`;
+  });
+  const rows = transitions.map((t) => `<tr>
+      <td>${escape(new Date(t.time).toLocaleString())}</td>
+      <td>${escape(t.from || "-")} &rarr; <span class="pill ${escape(t.to)}">${escape(t.to)}</span></td>
+      <td>${escape(t.healthyPods)}</td>
+      <td class="error">${escape(t.error)}</td>
+    </tr>`);
+  return `<div class="timeline">${segments.join("")}</div>
+    <table><tr><th>Time</th><th>Change</th><th>Healthy pods</th><th>Error</th></tr>${rows.join("")}</table>`;
+}
+
+function podCheck(pod) {
+  const checks = ((pod.body && pod.body.checks) || []).map((c) => `<tr>
+      <td>${escape(c.name)}</td>
+      <td><span class="pill ${escape(c.health)}">${escape(c.health)}</span></td>
+      <td>${escape(c.output)}</td>
+      <td>${escape(c.action)}</td>
+      <td>${escape(c.impact)}</td>
+    </tr>`);
+  return `<div class="pod">
+    <h3>${escape(pod.name)} <span class="pill ${escape(pod.state)}">${escape(pod.state)}</span></h3>
+    <p>Checked ${escape(new Date(pod.checkTime).toLocaleString())}, status ${escape(pod.statusCode)}, ${escape(Math.round(pod.latencyMs))}ms</p>
+    ${pod.error ? `<p class="error">${escape(pod.error)}</p>` : ""}
+    ${(pod.warnings || []).map((w) => `<p>&#9888; ${escape(w)}</p>`).join("")}
+    ${checks.length ? `<table><tr><th>Check</th><th>Health</th><th>Output</th><th>Action</th><th>Impact</th></tr>${checks.join("")}</table>` : ""}
+  </div>`;
+}
+
+async function serviceView(namespace, service, cluster) {
+  const query = cluster ? "?cluster=" + encodeURIComponent(cluster) : "";
+  const [current, transitions] = await Promise.all([
+    get("api/v1/statuses?namespace=" + encodeURIComponent(namespace) + (cluster ? "&cluster=" + encodeURIComponent(cluster) : "")),
+    get("api/v1/namespaces/" + encodeURIComponent(namespace) + "/services/" + encodeURIComponent(service) + "/transitions" + query),
+  ]);
+  const status = current.find((s) => s.service.name === service);
+  if (!status) {
+    view.innerHTML = `<h1>${escape(service)}</h1><p>No status found.</p>`;
+    return;
+  }
+
+  view.innerHTML = `<h1><a href="#/ns/${encodeURIComponent(namespace)}">${escape(namespace)}</a> / ${escape(service)}
+      <span class="pill ${stateClass(status)}">${escape(status.aggregatedState)}${status.stale ? ", stale" : ""}</span></h1>
+    <p>${escape(status.aggregatedState)} for ${since(status.stateSince)}, last checked ${escape(new Date(status.checkTime).toLocaleString())},
+      ${escape(status.healthyPods)} healthy pods${status.silenced ? ", silenced" : ""}</p>
+    ${status.error ? `<p class="error">${escape(status.error)}</p>` : ""}
+    <p><img alt="badge" src="../badge/${encodeURIComponent(namespace)}/${encodeURIComponent(service)}${query}"></p>
+    <h2>History</h2>
+    ${timeline(transitions)}
+    <h2>Pods</h2>
+    ${(status.podChecks || []).map(podCheck).join("") || "<p>No pods checked.</p>"}`;
+}
+
+async function adminView() {
+  const silences = await get("api/v1/silences");
+  const rows = silences.map((s) => `<tr>
+      <td>${escape(s.cluster || "*")}</td><td>${escape(s.namespace || "*")}</td><td>${escape(s.service || "*")}</td>
+      <td>${escape(s.createdBy)}</td><td>${escape(s.comment)}</td><td>${escape(new Date(s.expiresAt).toLocaleString())}</td>
+    </tr>`);
+
+  view.innerHTML = `<h1>Admin</h1>
+    <h2>Reload</h2>
+    <p>Reload namespace and service annotations from k8s now, rather than waiting for the next reload.</p>
+    <button id="reload">Reload</button> <span id="reload-result"></span>
+    <h2>Active silences</h2>
+    ${rows.length ? `<table><tr><th>Cluster</th><th>Namespace</th><th>Service</th><th>Created by</th><th>Comment</th><th>Expires</th></tr>${rows.join("")}</table>` : "<p>None.</p>"}`;
+
+  document.getElementById("reload").addEventListener("click", async () => {
+    const result = document.getElementById("reload-result");
+    const res = await fetch(api + "reload", { method: "POST" });
+    const body = await res.text();
+    result.textContent = res.ok ? JSON.parse(body).message : "Reload failed: " + body;
+  });
+}
+
+async function route() {
+  const [path, query] = location.hash.replace(/^#/, "").split("?");
+  const parts = path.split("/").filter(Boolean).map(decodeURIComponent);
+  const params = new URLSearchParams(query);
+  try {
+    if (parts[0] === "admin") {
+      await adminView();
+    } else if (parts[0] === "ns" && parts.length === 3) {
+      await serviceView(parts[1], parts[2], params.get("cluster"));
+    } else if (parts[0] === "ns" && parts.length === 2) {
+      await namespaceView(parts[1]);
+    } else {
+      await namespacesView();
+    }
+  } catch (err) {
+    view.innerHTML = `<p class="error">${escape(err.message)}</p>`;
+  }
+}
+
+async function loadClusters() {
+  try {
+    const clusters = await get("api/v1/clusters");
+    if (clusters.length) {
+      clusterSelect.innerHTML = `<option value="">All clusters</option>` +
+        clusters.map((c) => `<option>${escape(c)}</option>`).join("");
+      clusterSelect.hidden = false;
+    }
+  } catch (err) {
+    // a single cluster is watched, so there is nothing to select
+  }
+}
+
+clusterSelect.addEventListener("change", route);
+window.addEventListener("hashchange", route);
+loadClusters().then(route);
+// keep the current view up to date without reloading the page
+setInterval(route, 30000);
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// FindComplianceForNamespace reports which Services within a Namespace returned health check responses that do not
+// comply with the UW operational health spec in their latest health check. An empty cluster reports on the Namespace
+// in every cluster
+func FindComplianceForNamespace(mgoRepo *MongoRepository, cluster string, n string) (model.ComplianceReport, error) {
+	report := model.ComplianceReport{Namespace: n, Cluster: cluster, Services: []model.ServiceCompliance{}}
+
+	statuses, err := FindLatestChecksForNamespace(mgoRepo, cluster, n)
+	if err != nil {
+		return report, errors.Wrapf(err, "failed to get compliance for namespace %s", n)
+	}
+
+	for _, status := range statuses {
+		compliance := model.ServiceCompliance{
+			Service:   status.Service.Name,
+			CheckTime: status.CheckTime,
+			Compliant: isCompliant(status),
+		}
+		for _, podCheck := range status.PodChecks {
+			if len(podCheck.Warnings) == 0 {
+				continue
+			}
+			if compliance.PodWarnings == nil {
+				compliance.PodWarnings = make(map[string][]string)
+			}
+			compliance.PodWarnings[podCheck.Name] = podCheck.Warnings
+		}
+
+		report.CheckedServices++
+		if !compliance.Compliant {
+			report.NonCompliantServices++
+		}
+		report.Services = append(report.Services, compliance)
+	}
+
+	// list non-compliant services first
+	sort.SliceStable(report.Services, func(i, j int) bool {
+		if report.Services[i].Compliant != report.Services[j].Compliant {
+			return !report.Services[i].Compliant
+		}
+		return report.Services[i].Service < report.Services[j].Service
+	})
+
+	return report, nil
+}
+
+// setNonCompliantServices sets the number of non-compliant Services of a Namespace from the current status of its
+// Services, so that Services which are removed or no longer checked are not counted. The gauge of a Namespace without
+// any checked Service is deleted
+func setNonCompliantServices(mgoRepo *MongoRepository, gaugeVec *prometheus.GaugeVec, cluster string, n string) error {
+	report, err := FindComplianceForNamespace(mgoRepo, cluster, n)
+	if err != nil {
+		return err
+	}
+	if report.CheckedServices == 0 {
+		gaugeVec.DeleteLabelValues(cluster, n)
+		return nil
+	}
+	gaugeVec.WithLabelValues(cluster, n).Set(float64(report.NonCompliantServices))
+	return nil
+}
+
+// isCompliant reports whether none of the pods checked for a Service returned spec violations
+func isCompliant(status model.ServiceStatus) bool {
+	for _, podCheck := range status.PodChecks {
+		if len(podCheck.Warnings) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// FindCurrentStatuses returns the current ServiceStatus of every Service, both checked locally and pulled from
+// federated instances, in the given cluster and Namespace or in any if empty. The statuses of local Services which are
+// no longer checked, e.g. deleted, disabled or scaled to zero, are left out, so that federated instances stop pulling
+// them
+func FindCurrentStatuses(mgoRepo *MongoRepository, cluster string, n string) ([]model.ServiceStatus, error) {
+	if n != "" {
+		return FindLatestChecks(mgoRepo, cluster, n)
+	}
+	return FindLatestChecks(mgoRepo, cluster)
+}
+
+// UpsertFederatedStatus stores a ServiceStatus pulled from a federated instance as the current status of its Service,
+// returning false if the existing status is kept instead. Statuses checked before staleBefore are stale
+func UpsertFederatedStatus(mgoRepo *MongoRepository, status model.ServiceStatus, staleBefore time.Time) (bool, error) {
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	// the status is only in conflict with one for the same Service in the same cluster, so an empty cluster is matched
+	// exactly rather than as any cluster
+	query := bson.M{"service.namespace": status.Service.Namespace, "service.name": status.Service.Name, "service.cluster": status.Service.Cluster}
+	if status.Service.Cluster == "" {
+		query["service.cluster"] = bson.M{"$exists": false}
+	}
+
+	var existing model.ServiceStatus
+	err := collection.Find(query).One(&existing)
+	if err != nil && err != ErrNotFound {
+		return false, errors.Wrapf(err, "failed to get current status of service %s in namespace %s", status.Service.Name, status.Service.Namespace)
+	}
+	if err == nil && !replaces(status, existing, staleBefore) {
+		return false, nil
+	}
+
+	if _, err := collection.Upsert(query, status); err != nil {
+		return false, errors.Wrapf(err, "failed to upsert federated status of service %s in namespace %s", status.Service.Name, status.Service.Namespace)
+	}
+	return true, nil
+}
+
+// replaces resolves a conflict between a federated status and the existing status of the same Service, when both
+// instances check it. A fresh status beats a stale one. Otherwise a status checked locally is kept, and between
+// federated instances the most recently checked status wins
+func replaces(status model.ServiceStatus, existing model.ServiceStatus, staleBefore time.Time) bool {
+	existingStale := existing.Stale || existing.CheckTime.Before(staleBefore)
+	switch {
+	case existing.Source == status.Source:
+		return true
+	case existingStale != status.Stale:
+		return existingStale
+	case existing.Source == "":
+		return false
+	default:
+		return status.CheckTime.After(existing.CheckTime)
+	}
+}
+
+// MarkFederatedStatusesStale marks the statuses pulled from the named source which were checked before staleBefore
+// as stale, e.g. because the source could not be reached
+func MarkFederatedStatusesStale(mgoRepo *MongoRepository, source string, staleBefore time.Time) error {
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	if _, err := collection.UpdateAll(bson.M{"source": source, "checkTime": bson.M{"$lt": staleBefore}, "stale": bson.M{"$ne": true}}, bson.M{"$set": bson.M{"stale": true}}); err != nil {
+		return errors.Wrapf(err, "failed to mark statuses from %s as stale", source)
+	}
+	return nil
+}
+
+// RemoveFederatedStatusesNotPulled deletes the statuses pulled from the source for Services which were not in its
+// latest pull, as the source no longer checks them
+func RemoveFederatedStatusesNotPulled(mgoRepo *MongoRepository, source string, pulled []model.ServiceStatus) error {
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	query := bson.M{"source": source}
+	var services []bson.M
+	for _, status := range pulled {
+		service := bson.M{"service.namespace": status.Service.Namespace, "service.name": status.Service.Name, "service.cluster": status.Service.Cluster}
+		if status.Service.Cluster == "" {
+			service["service.cluster"] = bson.M{"$exists": false}
+		}
+		services = append(services, service)
+	}
+	if len(services) > 0 {
+		query["$nor"] = services
+	}
+
+	if _, err := collection.RemoveAll(query); err != nil {
+		return errors.Wrapf(err, "failed to remove statuses no longer pulled from %s", source)
+	}
+	return nil
+}
+
+// RemoveFederatedStatusesNotFrom deletes the statuses pulled from sources other than those named, as they are no
+// longer federated
+func RemoveFederatedStatusesNotFrom(mgoRepo *MongoRepository, sources []string) error {
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	if _, err := collection.RemoveAll(bson.M{"source": bson.M{"$gt": "", "$nin": sources}}); err != nil {
+		return errors.Wrap(err, "failed to remove statuses from sources no longer federated")
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// RecordIncidentTransition updates incidents following a change in the aggregated state of a Service. An Incident is
+// opened when the Service becomes unhealthy unless it is silenced, every subsequent change is added to its timeline,
+// and it is closed when the Service becomes healthy again
+func RecordIncidentTransition(mgoRepo *MongoRepository, status model.ServiceStatus) error {
+	collection := mgoRepo.Db().C(constants.IncidentsCollection)
+
+	event := incidentEvent(status)
+
+	var incident model.Incident
+	err := collection.Find(inCluster(bson.M{"namespace": status.Service.Namespace, "service": status.Service.Name, "state": constants.IncidentOpen}, "cluster", status.Service.Cluster)).One(&incident)
+	if err != nil && err != ErrNotFound {
+		return errors.Wrap(err, "failed to get open incident")
+	}
+
+	if err == ErrNotFound {
+		if status.AggregatedState != constants.Unhealthy || status.Silenced {
+			return nil
+		}
+		incident = model.Incident{
+			ID:        uuid.New().String(),
+			Namespace: status.Service.Namespace,
+			Service:   status.Service.Name,
+			Cluster:   status.Service.Cluster,
+			State:     constants.IncidentOpen,
+			OpenedAt:  status.CheckTime,
+			Notes:     []model.IncidentNote{},
+			Timeline:  []model.IncidentEvent{event},
+		}
+		if err := collection.Insert(incident); err != nil {
+			return errors.Wrap(err, "failed to open incident")
+		}
+		return nil
+	}
+
+	update := bson.M{"$push": bson.M{"timeline": event}}
+	if status.AggregatedState == constants.Healthy {
+		update["$set"] = bson.M{"state": constants.IncidentClosed, "closedAt": status.CheckTime}
+	}
+	if err := collection.UpdateId(incident.ID, update); err != nil {
+		return errors.Wrapf(err, "failed to update incident %s", incident.ID)
+	}
+	return nil
+}
+
+// CloseIncidentsOfServices closes the open incidents of Services which have been removed, as they will never become
+// healthy again
+func CloseIncidentsOfServices(mgoRepo *MongoRepository, services []model.Service, closedAt time.Time) error {
+	collection := mgoRepo.Db().C(constants.IncidentsCollection)
+
+	for _, svc := range services {
+		query := inCluster(bson.M{"namespace": svc.Namespace, "service": svc.Name, "state": constants.IncidentOpen}, "cluster", svc.Cluster)
+		if _, err := collection.UpdateAll(query, bson.M{"$set": bson.M{"state": constants.IncidentClosed, "closedAt": closedAt}}); err != nil {
+			return errors.Wrapf(err, "failed to close incidents of service %s in namespace %s", svc.Name, svc.Namespace)
+		}
+	}
+	return nil
+}
+
+// DeleteIncidentsOlderThan deletes incidents closed more than the given number of days ago
+func DeleteIncidentsOlderThan(removeAfterDays int, mgoRepo *MongoRepository) error {
+	collection := mgoRepo.Db().C(constants.IncidentsCollection)
+
+	query := bson.M{"state": constants.IncidentClosed, "closedAt": bson.M{"$lt": time.Now().AddDate(0, 0, -removeAfterDays)}}
+	if _, err := collection.RemoveAll(query); err != nil {
+		return errors.Wrap(err, "failed to delete old incidents")
+	}
+	return nil
+}
+
+// RemoveIncidentsOlderThan deletes incidents closed more than the given number of days ago, sending any error to a
+// channel of type error
+func RemoveIncidentsOlderThan(removeAfterDays int, mgoRepo *MongoRepository, errs chan error) {
+	err := DeleteIncidentsOlderThan(removeAfterDays, mgoRepo)
+	if err != nil {
+		select {
+		case errs <- fmt.Errorf("Could not delete old incidents (%v)", err):
+		default:
+		}
+		return
+	}
+}
+
+// AcknowledgeIncident records the user investigating an Incident, returning ErrNotFound if it does not exist
+func AcknowledgeIncident(mgoRepo *MongoRepository, id string, user string) (model.Incident, error) {
+	if user == "" {
+		return model.Incident{}, errors.New("a user is required to acknowledge an incident")
+	}
+
+	update := bson.M{"$set": bson.M{"acknowledgedBy": user, "acknowledgedAt": time.Now().UTC()}}
+	return updateIncident(mgoRepo, id, update)
+}
+
+// AddIncidentNote adds a free-text note to an Incident, returning ErrNotFound if it does not exist
+func AddIncidentNote(mgoRepo *MongoRepository, id string, note model.IncidentNote) (model.Incident, error) {
+	if note.User == "" || note.Text == "" {
+		return model.Incident{}, errors.New("a note requires a user and text")
+	}
+
+	note.CreatedAt = time.Now().UTC()
+	update := bson.M{"$push": bson.M{"notes": note}}
+	return updateIncident(mgoRepo, id, update)
+}
+
+// FindIncident returns the Incident with the given ID, returning ErrNotFound if it does not exist
+func FindIncident(mgoRepo *MongoRepository, id string) (model.Incident, error) {
+	collection := mgoRepo.Db().C(constants.IncidentsCollection)
+
+	var incident model.Incident
+	if err := collection.FindId(id).One(&incident); err != nil {
+		if err == ErrNotFound {
+			return incident, err
+		}
+		return incident, errors.Wrapf(err, "failed to get incident %s", id)
+	}
+	return incident, nil
+}
+
+// FindIncidents returns the last 100 incidents in OpenedAt descending order, optionally filtered by state
+// ("open" or "closed"), cluster and Namespace
+func FindIncidents(mgoRepo *MongoRepository, state string, cluster string, n string) ([]model.Incident, error) {
+	collection := mgoRepo.Db().C(constants.IncidentsCollection)
+
+	query := bson.M{}
+	if state != "" {
+		query["state"] = state
+	}
+	if n != "" {
+		query["namespace"] = n
+	}
+	inCluster(query, "cluster", cluster)
+
+	var incidents []model.Incident
+	if err := collection.Find(query).Sort("-openedAt").Limit(100).All(&incidents); err != nil {
+		return nil, fmt.Errorf("failed to get incidents, err: %v", err)
+	}
+
+	if incidents == nil {
+		incidents = []model.Incident{}
+	}
+	return incidents, nil
+}
+
+func updateIncident(mgoRepo *MongoRepository, id string, update bson.M) (model.Incident, error) {
+	collection := mgoRepo.Db().C(constants.IncidentsCollection)
+
+	if err := collection.UpdateId(id, update); err != nil {
+		if err == ErrNotFound {
+			return model.Incident{}, err
+		}
+		return model.Incident{}, errors.Wrapf(err, "failed to update incident %s", id)
+	}
+	return FindIncident(mgoRepo, id)
+}
+
+func incidentEvent(status model.ServiceStatus) model.IncidentEvent {
+	event := model.IncidentEvent{
+		Time:  status.CheckTime,
+		State: status.AggregatedState,
+		Error: status.Error,
+	}
+
+	for _, podCheck := range status.PodChecks {
+		if podCheck.Error != "" {
+			event.PodErrors = append(event.PodErrors, fmt.Sprintf("%s: %s", podCheck.Name, podCheck.Error))
+		}
+		for _, chk := range podCheck.Body.Checks {
+			if chk.Health != constants.Healthy {
+				event.PodErrors = append(event.PodErrors, fmt.Sprintf("%s: check %q is %s: %s", podCheck.Name, chk.Name, chk.Health, chk.Output))
+			}
+		}
+	}
+	return event
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/globalsign/mgo"
 )
 
+// ErrNotFound is returned when a requested document does not exist
+var ErrNotFound = mgo.ErrNotFound
+
 //MongoConnector provides way interact with mongo connection
 type MongoConnector interface {
 	Close()
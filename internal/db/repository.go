@@ -1,12 +1,13 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	log "github.com/sirupsen/logrus"
 	"github.com/utilitywarehouse/health-aggregator/internal/constants"
@@ -61,8 +62,8 @@ func NewK8sNamespacesConfigUpdater(namespaces chan model.Namespace, repo *MongoR
 	}
 }
 
-// UpsertServiceConfigs inserts or updates Services from a provided cannel of type Service, sending any
-// errors to a channel of type error
+// UpsertServiceConfigs inserts or updates Services from a provided cannel of type Service, logging any
+// errors, until the channel is closed
 func (k K8sServicesConfigUpdater) UpsertServiceConfigs() {
 
 	defer k.Repo.Close()
@@ -71,10 +72,10 @@ func (k K8sServicesConfigUpdater) UpsertServiceConfigs() {
 
 		s.UpdatedAt = time.Now().UTC()
 
-		_, err := collection.Upsert(bson.M{"name": s.Name, "namespace": s.Namespace}, s)
+		_, err := collection.Upsert(inCluster(bson.M{"name": s.Name, "namespace": s.Namespace}, "cluster", s.Cluster), s)
 		if err != nil {
 			log.WithError(err).Errorf("failed to insert service %s in namespace %s", s.Name, s.Namespace)
-			return
+			continue
 		}
 	}
 }
@@ -89,13 +90,13 @@ func GetServicesState(mgoRepo *MongoRepository) (map[model.ServicesStateKey]mode
 		return state, errors.New("unable to retrieve services state")
 	}
 	for _, service := range services {
-		state[model.ServicesStateKey{Namespace: service.Namespace, Service: service.Name}] = service
+		state[model.ServicesStateKey{Cluster: service.Cluster, Namespace: service.Namespace, Service: service.Name}] = service
 	}
 	return state, nil
 }
 
-// UpsertNamespaceConfigs inserts or updates Namespaces from a provided cannel of type Namespace, sending any
-// errors to a channel of type error
+// UpsertNamespaceConfigs inserts or updates Namespaces from a provided cannel of type Namespace, logging any
+// errors, until the channel is closed
 func (k K8sNamespacesConfigUpdater) UpsertNamespaceConfigs() {
 
 	defer k.Repo.Close()
@@ -103,18 +104,28 @@ func (k K8sNamespacesConfigUpdater) UpsertNamespaceConfigs() {
 
 		collection := k.Repo.Db().C(constants.NamespacesCollection)
 
-		_, err := collection.Upsert(bson.M{"name": n.Name}, n)
+		_, err := collection.Upsert(inCluster(bson.M{"name": n.Name}, "cluster", n.Cluster), n)
 		if err != nil {
 			log.WithError(err).Errorf("failed to insert namespace %s", n.Name)
-			return
+			continue
 		}
 	}
 }
 
 // DoUpdates takes items (model.UpdateItem) from the UpdatesQueue channel and updates
-// those items in Mongo accordingly
-func (u *UpdaterService) DoUpdates() {
-	for updateItem := range u.UpdatesQueue {
+// those items in Mongo accordingly, until the channel is closed or ctx is cancelled
+func (u *UpdaterService) DoUpdates(ctx context.Context) {
+	for {
+		var updateItem model.UpdateItem
+		select {
+		case <-ctx.Done():
+			return
+		case item, ok := <-u.UpdatesQueue:
+			if !ok {
+				return
+			}
+			updateItem = item
+		}
 
 		log.WithFields(log.Fields{
 			"type": updateItem.Type,
@@ -131,7 +142,6 @@ func (u *UpdaterService) DoUpdates() {
 			continue
 		}
 	}
-	return
 }
 
 func (u *UpdaterService) processDeployment(updateItem model.UpdateItem) {
@@ -184,13 +194,16 @@ func (u *UpdaterService) deleteDeployment(updatedDeployment model.Deployment) {
 func (u *UpdaterService) updateDeployment(updatedDeployment model.Deployment, desiredReplicas int32) {
 	collection := u.Repo.Db().C(constants.ServicesCollection)
 
+	query := inCluster(bson.M{"namespace": updatedDeployment.Namespace, "name": updatedDeployment.Service}, "cluster", updatedDeployment.Cluster)
+
 	var service model.Service
-	if err := collection.Find(bson.M{"namespace": updatedDeployment.Namespace, "name": updatedDeployment.Service}).One(&service); err != nil {
+	if err := collection.Find(query).One(&service); err != nil {
 		if err != nil {
 
 			log.WithFields(log.Fields{
 				"service":   updatedDeployment.Service,
 				"namespace": updatedDeployment.Namespace,
+				"cluster":   updatedDeployment.Cluster,
 			}).WithError(err).Error("failed to modify deployment")
 
 			return
@@ -199,63 +212,138 @@ func (u *UpdaterService) updateDeployment(updatedDeployment model.Deployment, de
 
 	service.Deployment.DesiredReplicas = desiredReplicas
 
-	_, err := collection.Upsert(bson.M{"name": updatedDeployment.Service, "namespace": updatedDeployment.Namespace}, service)
+	_, err := collection.Upsert(query, service)
 	if err != nil {
 
 		log.WithFields(log.Fields{
 			"service":   updatedDeployment.Service,
 			"namespace": updatedDeployment.Namespace,
+			"cluster":   updatedDeployment.Cluster,
 		}).WithError(err).Error("failed to modify deployment")
 
 		return
 	}
 }
 
-// InsertHealthcheckResponses inserts health check responses picked from a channel of type ServiceStatus, sending any
-// errors to a channel of type error
-func InsertHealthcheckResponses(mgoRepo *MongoRepository, statusResponses chan model.ServiceStatus, errs chan error, metrics instrumentation.Metrics) {
+// InsertHealthcheckResponses persists health check responses picked from a channel of type ServiceStatus, sending any
+// errors to a channel of type error. The current status of each Service is updated in place and state transitions are
+// appended to the transitions collection. Full responses are inserted into the checks collection on every check, or in
+// constants.StorageModeTransitions only on a transition and then once per StorageOptions.SnapshotInterval
+func InsertHealthcheckResponses(mgoRepo *MongoRepository, statusResponses chan model.ServiceStatus, errs chan error, metrics instrumentation.Metrics, opts StorageOptions) {
 
 	repoCopy := mgoRepo.WithNewSession()
 	defer repoCopy.Close()
 	jobsDurationHistogramVec := metrics.Histograms[constants.HealthAggregatorJobDurationSeconds]
+	serviceUnhealthyGaugeVec := metrics.Gauges[constants.HealthAggregatorServiceUnhealthy]
+	nonCompliantGaugeVec := metrics.Gauges[constants.HealthAggregatorNonCompliantServices]
+
+	states := newServiceStates(repoCopy)
+	silences := newActiveSilences(repoCopy)
+	evicted := time.Now()
 
 	for r := range statusResponses {
 		start := time.Now()
 
-		collection := repoCopy.Db().C(constants.HealthchecksCollection)
-
-		var prevCheckResponse model.ServiceStatus
-		if err := collection.Find(bson.M{"service.namespace": r.Service.Namespace, "service.name": r.Service.Name}).Sort("-checkTime").Limit(1).One(&prevCheckResponse); err != nil {
-			if err != mgo.ErrNotFound {
+		if start.Sub(evicted) >= serviceStateTTL {
+			states.evict(start.Add(-serviceStateTTL))
+			evicted = start
+		}
 
-				log.WithError(err).WithFields(log.Fields{
-					"service":   r.Service.Name,
-					"namespace": r.Service.Namespace,
-				}).Error("failed to get previous healthcheck response")
-			}
+		select {
+		case <-opts.Reassigned:
+			states = newServiceStates(repoCopy)
+		default:
 		}
 
-		if prevCheckResponse.AggregatedState != r.AggregatedState {
+		key := model.ServicesStateKey{Cluster: r.Service.Cluster, Namespace: r.Service.Namespace, Service: r.Service.Name}
+		prev := states.get(key)
+
+		transitioned := prev.AggregatedState != r.AggregatedState
+		if transitioned {
 			r.StateSince = r.CheckTime
-			r.PreviousState = prevCheckResponse.AggregatedState
+			r.PreviousState = prev.AggregatedState
 		} else {
-			r.StateSince = prevCheckResponse.StateSince
-			r.PreviousState = prevCheckResponse.PreviousState
+			r.StateSince = prev.StateSince
+			r.PreviousState = prev.PreviousState
 		}
 
-		err := collection.Insert(r)
-		if err != nil {
+		r.Silenced = isSilenced(r, silences.get(), time.Now().UTC())
+
+		unhealthy := 0.0
+		if r.AggregatedState != constants.Healthy && !r.Silenced {
+			unhealthy = 1
+		}
+		serviceUnhealthyGaugeVec.WithLabelValues(r.Service.Cluster, r.Service.Namespace, r.Service.Name).Set(unhealthy)
+
+		if err := upsertCurrentStatus(repoCopy, r); err != nil {
 
 			log.WithError(err).WithFields(log.Fields{
 				"service":   r.Service.Name,
 				"namespace": r.Service.Namespace,
-			}).Error("failed to insert healthcheck response")
+			}).Error("failed to update current healthcheck status")
 
 			duration := time.Since(start)
 			jobsDurationHistogramVec.WithLabelValues("persist_result").Observe(duration.Seconds())
 
 			continue
 		}
+
+		if err := setNonCompliantServices(repoCopy, nonCompliantGaugeVec, r.Service.Cluster, r.Service.Namespace); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"service":   r.Service.Name,
+				"namespace": r.Service.Namespace,
+			}).Error("failed to count non-compliant services")
+		}
+
+		if transitioned {
+			if err := insertTransition(repoCopy, prev.AggregatedState, r); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"service":   r.Service.Name,
+					"namespace": r.Service.Namespace,
+				}).Error("failed to insert healthcheck state transition")
+			}
+			if err := RecordIncidentTransition(repoCopy, r); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"service":   r.Service.Name,
+					"namespace": r.Service.Namespace,
+				}).Error("failed to record incident")
+			}
+			if opts.Transitions != nil {
+				select {
+				case opts.Transitions <- r:
+				default:
+					log.WithFields(log.Fields{
+						"service":   r.Service.Name,
+						"namespace": r.Service.Namespace,
+					}).Warn("transitions channel is full, dropping state transition")
+				}
+			}
+		}
+
+		snapshot := opts.Mode != constants.StorageModeTransitions || transitioned || r.CheckTime.Sub(prev.LastSnapshot) >= opts.SnapshotInterval
+		lastSnapshot := prev.LastSnapshot
+		if snapshot {
+			collection := repoCopy.Db().C(constants.HealthchecksCollection)
+			err := collection.Insert(r)
+			if err != nil {
+
+				log.WithError(err).WithFields(log.Fields{
+					"service":   r.Service.Name,
+					"namespace": r.Service.Namespace,
+				}).Error("failed to insert healthcheck response")
+
+			} else {
+				lastSnapshot = r.CheckTime
+			}
+		}
+
+		states.set(key, serviceState{
+			AggregatedState: r.AggregatedState,
+			StateSince:      r.StateSince,
+			PreviousState:   r.PreviousState,
+			LastSnapshot:    lastSnapshot,
+		})
+
 		duration := time.Since(start)
 		jobsDurationHistogramVec.WithLabelValues("persist_result").Observe(duration.Seconds())
 	}
@@ -291,13 +379,33 @@ func FindAllNamespaces(mgoRepo *MongoRepository) ([]model.Namespace, error) {
 	return ns, nil
 }
 
-// FindAllServicesForNamespace finds all Services for a given Namespace Name
-func FindAllServicesForNamespace(mgoRepo *MongoRepository, ns string) ([]model.Service, error) {
+// FindAllClusters returns the names of the clusters Services have been discovered in, in alphabetical order. It is
+// empty when a single cluster is watched
+func FindAllClusters(mgoRepo *MongoRepository) ([]string, error) {
+
+	collection := mgoRepo.Db().C(constants.ServicesCollection)
+
+	var clusters []string
+	if err := collection.Find(bson.M{"cluster": bson.M{"$gt": ""}}).Distinct("cluster", &clusters); err != nil {
+		return nil, errors.Wrap(err, "failed to get all clusters")
+	}
+
+	if clusters == nil {
+		clusters = []string{}
+	}
+	sort.Strings(clusters)
+
+	return clusters, nil
+}
+
+// FindAllServicesForNamespace finds all Services for a given Namespace Name, in the given cluster or in any cluster
+// if empty
+func FindAllServicesForNamespace(mgoRepo *MongoRepository, cluster string, ns string) ([]model.Service, error) {
 
 	collection := mgoRepo.Db().C(constants.ServicesCollection)
 
 	var svcs []model.Service
-	if err := collection.Find(bson.M{"namespace": ns}).All(&svcs); err != nil {
+	if err := collection.Find(inCluster(bson.M{"namespace": ns}, "cluster", cluster)).All(&svcs); err != nil {
 		return nil, fmt.Errorf("failed to get all services for namespace %s", ns)
 	}
 
@@ -308,18 +416,19 @@ func FindAllServicesForNamespace(mgoRepo *MongoRepository, ns string) ([]model.S
 	return svcs, nil
 }
 
-// FindAllServicesWithHealthScrapeEnabled finds all Services where the EnableScrape from HealthAnnotations is true
-func FindAllServicesWithHealthScrapeEnabled(mgoRepo *MongoRepository, restrictToNamespace ...string) ([]model.Service, error) {
+// FindAllServicesWithHealthScrapeEnabled finds all Services where the EnableScrape from HealthAnnotations is true, in
+// the given cluster or in any cluster if empty
+func FindAllServicesWithHealthScrapeEnabled(mgoRepo *MongoRepository, cluster string, restrictToNamespace ...string) ([]model.Service, error) {
 
 	collection := mgoRepo.Db().C(constants.ServicesCollection)
 	svcs := []model.Service{}
 	if len(restrictToNamespace) > 0 {
-		if err := collection.Find(bson.M{"namespace": bson.M{"$in": restrictToNamespace}, "healthAnnotations.enableScrape": "true", "deployment.desiredReplicas": bson.M{"$gt": 0}}).Sort("namespace").All(&svcs); err != nil {
+		if err := collection.Find(inCluster(bson.M{"namespace": bson.M{"$in": restrictToNamespace}, "healthAnnotations.enableScrape": "true", "deployment.desiredReplicas": bson.M{"$gt": 0}}, "cluster", cluster)).Sort("namespace").All(&svcs); err != nil {
 			return nil, errors.Wrap(err, "failed to get all service healthcheck endpoints with scrape enabled")
 		}
 		return svcs, nil
 	}
-	if err := collection.Find(bson.M{"healthAnnotations.enableScrape": "true"}).Sort("namespace").All(&svcs); err != nil {
+	if err := collection.Find(inCluster(bson.M{"healthAnnotations.enableScrape": "true"}, "cluster", cluster)).Sort("namespace").All(&svcs); err != nil {
 		return nil, errors.Wrap(err, "failed to get all service healthcheck endpoints with scrape enabled")
 	}
 
@@ -327,13 +436,13 @@ func FindAllServicesWithHealthScrapeEnabled(mgoRepo *MongoRepository, restrictTo
 }
 
 // FindAllChecksForService returns the last 50 ServiceStatus for a given Service and Namespace string in CheckTime
-// descending order
-func FindAllChecksForService(mgoRepo *MongoRepository, n string, s string) ([]model.ServiceStatus, error) {
+// descending order, in the given cluster or in any cluster if empty
+func FindAllChecksForService(mgoRepo *MongoRepository, cluster string, n string, s string) ([]model.ServiceStatus, error) {
 
 	collection := mgoRepo.Db().C(constants.HealthchecksCollection)
 
 	var checks []model.ServiceStatus
-	if err := collection.Find(bson.M{"service.namespace": n, "service.name": s}).Limit(50).Sort("-checkTime").All(&checks); err != nil {
+	if err := collection.Find(inCluster(bson.M{"service.namespace": n, "service.name": s}, "service.cluster", cluster)).Limit(50).Sort("-checkTime").All(&checks); err != nil {
 		return nil, fmt.Errorf("failed to get all healthcheck responses for service %v in namespace %v", s, n)
 	}
 
@@ -344,11 +453,12 @@ func FindAllChecksForService(mgoRepo *MongoRepository, n string, s string) ([]mo
 	return checks, nil
 }
 
-// FindLatestChecksForNamespace returns the latest ServiceStatus for all services in a given Namespace Name
-func FindLatestChecksForNamespace(mgoRepo *MongoRepository, n string) ([]model.ServiceStatus, error) {
+// FindLatestChecksForNamespace returns the latest ServiceStatus for all services in a given Namespace Name, in the given
+// cluster or in any cluster if empty
+func FindLatestChecksForNamespace(mgoRepo *MongoRepository, cluster string, n string) ([]model.ServiceStatus, error) {
 
 	var servicesToReturn []model.Service
-	servicesToReturn, err := FindAllServicesWithHealthScrapeEnabled(mgoRepo, n)
+	servicesToReturn, err := FindAllServicesWithHealthScrapeEnabled(mgoRepo, cluster, n)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get checks, err: %v", err)
 	}
@@ -358,18 +468,10 @@ func FindLatestChecksForNamespace(mgoRepo *MongoRepository, n string) ([]model.S
 		serviceNamesToReturn = append(serviceNamesToReturn, svc.Name)
 	}
 
-	collection := mgoRepo.Db().C(constants.HealthchecksCollection)
-
-	pipeline := []bson.M{
-		{"$match": bson.M{"service.name": bson.M{"$in": serviceNamesToReturn}, "service.namespace": n, "service.deployment.desiredReplicas": bson.M{"$gt": 0}}},
-		{"$sort": bson.M{"checkTime": -1}},
-		{"$group": bson.M{"_id": "$service.name", "checks": bson.M{"$first": "$$ROOT"}}},
-		{"$replaceRoot": bson.M{"newRoot": "$checks"}}}
-
-	pipe := collection.Pipe(pipeline).AllowDiskUse()
+	collection := mgoRepo.Db().C(constants.StatusCollection)
 
 	var checks []model.ServiceStatus
-	if err := pipe.All(&checks); err != nil {
+	if err := collection.Find(inCluster(bson.M{"service.name": bson.M{"$in": serviceNamesToReturn}, "service.namespace": n, "service.deployment.desiredReplicas": bson.M{"$gt": 0}}, "service.cluster", cluster)).All(&checks); err != nil {
 		return nil, fmt.Errorf("failed to get all healthcheck responses for service within namespace %v err: %v", n, err)
 	}
 
@@ -379,6 +481,45 @@ func FindLatestChecksForNamespace(mgoRepo *MongoRepository, n string) ([]model.S
 	return checks, nil
 }
 
+// FindLatestChecks returns the latest ServiceStatus of every Service with health scraping enabled and desired
+// replicas, along with those merged from federation sources, in the given cluster (or any if empty) and Namespaces (or
+// all if none), ordered by Namespace and Service name
+func FindLatestChecks(mgoRepo *MongoRepository, cluster string, restrictToNamespace ...string) ([]model.ServiceStatus, error) {
+
+	services, err := FindAllServicesWithHealthScrapeEnabled(mgoRepo, cluster, restrictToNamespace...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get checks, err: %v", err)
+	}
+
+	enabled := make(map[model.ServicesStateKey]bool)
+	for _, svc := range services {
+		if svc.Deployment.DesiredReplicas > 0 {
+			enabled[model.ServicesStateKey{Cluster: svc.Cluster, Namespace: svc.Namespace, Service: svc.Name}] = true
+		}
+	}
+
+	query := inCluster(bson.M{}, "service.cluster", cluster)
+	if len(restrictToNamespace) > 0 {
+		query["service.namespace"] = bson.M{"$in": restrictToNamespace}
+	}
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	var statuses []model.ServiceStatus
+	if err := collection.Find(query).Sort("service.namespace", "service.name").All(&statuses); err != nil {
+		return nil, fmt.Errorf("failed to get latest healthcheck responses err: %v", err)
+	}
+
+	checks := []model.ServiceStatus{}
+	for _, status := range statuses {
+		key := model.ServicesStateKey{Cluster: status.Service.Cluster, Namespace: status.Service.Namespace, Service: status.Service.Name}
+		if status.Source != "" || enabled[key] {
+			checks = append(checks, status)
+		}
+	}
+	return checks, nil
+}
+
 // DeleteHealthchecksOlderThan deletes health check responses older than the given number of days
 func DeleteHealthchecksOlderThan(removeAfterDays int, mgoRepo *MongoRepository) error {
 
@@ -391,38 +532,86 @@ func DeleteHealthchecksOlderThan(removeAfterDays int, mgoRepo *MongoRepository)
 	return nil
 }
 
-// RemoveServicesNotReloadedRecently deletes services with a non-recent updatedAt age
-func RemoveServicesNotReloadedRecently(mgoRepo *MongoRepository) error {
+// RemoveServicesNotReloadedRecently deletes services with a non-recent updatedAt age, given how often services are
+// reloaded, returning the deleted services. Each cluster is tidied separately, so that services are not deleted from a
+// cluster which cannot be reloaded
+func RemoveServicesNotReloadedRecently(mgoRepo *MongoRepository, reloadInterval time.Duration) ([]model.Service, error) {
+
+	clusters, err := FindAllClusters(mgoRepo)
+	if err != nil {
+		return nil, err
+	}
+	if len(clusters) == 0 {
+		clusters = []string{""}
+	}
+
+	var removed []model.Service
+	for _, cluster := range clusters {
+		clusterRemoved, err := removeClusterServicesNotReloadedRecently(mgoRepo, cluster, reloadInterval)
+		removed = append(removed, clusterRemoved...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func removeClusterServicesNotReloadedRecently(mgoRepo *MongoRepository, cluster string, reloadInterval time.Duration) ([]model.Service, error) {
 
 	collection := mgoRepo.Db().C(constants.ServicesCollection)
 
 	now := time.Now().UTC()
 
-	safetyMarginMinutes := 20
-	latestRefreshCompletedTime := now.Add(time.Duration(-(constants.ReloadServicesIntervalMins + safetyMarginMinutes)) * time.Minute)
+	safetyMargin := 20 * time.Minute
+	latestRefreshCompletedTime := now.Add(-(reloadInterval + safetyMargin))
 
-	recentlyUpdated, err := collection.Find(bson.M{"updatedAt": bson.M{"$gt": latestRefreshCompletedTime}}).Count()
+	recentlyUpdated, err := collection.Find(inCluster(bson.M{"updatedAt": bson.M{"$gt": latestRefreshCompletedTime}}, "cluster", cluster)).Count()
 	if err != nil {
-		return errors.Wrap(err, "failed to count recently updated services")
+		return nil, errors.Wrap(err, "failed to count recently updated services")
 	}
-	log.Infof("found %d recently updated services", recentlyUpdated)
+	log.Infof("found %d recently updated services in cluster %q", recentlyUpdated, cluster)
 
 	// we don't want to delete services if the most recent reload did not succeed
-	if recentlyUpdated > 0 {
-		log.Infof("%d services were updated recently - deleting stale services", recentlyUpdated)
+	if recentlyUpdated == 0 {
+		log.Warn("no services were updated recently - skipping delete stale services")
+		return nil, nil
+	}
 
-		deleteStaleServicesAfterMinutes := (2 * constants.ReloadServicesIntervalMins) + safetyMarginMinutes
-		deleteStaleServicesSinceTime := now.Add(time.Duration(-deleteStaleServicesAfterMinutes) * time.Minute)
+	log.Infof("%d services were updated recently - deleting stale services", recentlyUpdated)
 
-		if _, err := collection.RemoveAll(bson.M{"updatedAt": bson.M{"$lt": deleteStaleServicesSinceTime}}); err != nil {
-			return errors.Wrap(err, "failed to remove stale services")
-		}
-		log.Info("services deleted successfully")
-	} else {
-		log.Warn("no services were updated recently - skipping delete stale services")
+	deleteStaleServicesSinceTime := now.Add(-(2*reloadInterval + safetyMargin))
+	query := inCluster(bson.M{"updatedAt": bson.M{"$lt": deleteStaleServicesSinceTime}}, "cluster", cluster)
+
+	var stale []model.Service
+	if err := collection.Find(query).All(&stale); err != nil {
+		return nil, errors.Wrap(err, "failed to find stale services")
+	}
+	if _, err := collection.RemoveAll(query); err != nil {
+		return nil, errors.Wrap(err, "failed to remove stale services")
 	}
+	log.Info("services deleted successfully")
 
-	return nil
+	return stale, nil
+}
+
+// inCluster restricts a query to the given cluster, held in the named field. An empty cluster does not restrict the
+// query, as nothing has a cluster when a single cluster is watched and every cluster is named otherwise
+func inCluster(query bson.M, field string, cluster string) bson.M {
+	if cluster != "" {
+		query[field] = cluster
+	}
+	return query
+}
+
+// ofCluster restricts a query to the given cluster, held in the named field. Unlike inCluster, an empty cluster only
+// matches documents without a cluster, so that a document of a Service is never matched by one of another cluster
+func ofCluster(query bson.M, field string, cluster string) bson.M {
+	if cluster == "" {
+		query[field] = bson.M{"$exists": false}
+		return query
+	}
+	query[field] = cluster
+	return query
 }
 
 // DropDB drops the database
@@ -430,13 +619,14 @@ func DropDB(mgoRepo *MongoRepository) error {
 	return mgoRepo.Db().DropDatabase()
 }
 
-// GetHealthchecks retrieves the list of Services (and their health annotations) from the DB and places them on a channel
-// of type Service
-func GetHealthchecks(mgoRepo *MongoRepository, healthchecks chan model.Service, errs chan error, metrics instrumentation.Metrics, restrictToNamespace ...string) {
+// GetHealthchecks retrieves the list of Services (and their health annotations) in a cluster from the DB and places
+// those for which owns returns true, or every Service if owns is nil, on a channel of type Service, stopping early if
+// ctx is cancelled
+func GetHealthchecks(ctx context.Context, mgoRepo *MongoRepository, healthchecks chan model.Service, errs chan error, metrics instrumentation.Metrics, owns func(model.Service) bool, cluster string, restrictToNamespace ...string) {
 
 	queuedServicesGaugeVec := metrics.Gauges[constants.HealthAggregatorQueuedServices]
 
-	services, err := FindAllServicesWithHealthScrapeEnabled(mgoRepo, restrictToNamespace...)
+	services, err := FindAllServicesWithHealthScrapeEnabled(mgoRepo, cluster, restrictToNamespace...)
 	if err != nil {
 		select {
 		case errs <- fmt.Errorf("Could not get services (%v)", err):
@@ -448,7 +638,14 @@ func GetHealthchecks(mgoRepo *MongoRepository, healthchecks chan model.Service,
 	log.Debugf("Adding %v service to channel with %v elements\n", len(services), len(healthchecks))
 
 	for _, s := range services {
-		healthchecks <- s
+		if owns != nil && !owns(s) {
+			continue
+		}
+		select {
+		case healthchecks <- s:
+		case <-ctx.Done():
+			return
+		}
 	}
 	queuedServicesGaugeVec.With(map[string]string{}).Set(float64(len(healthchecks)))
 }
@@ -465,11 +662,46 @@ func RemoveChecksOlderThan(removeAfterDays int, mgoRepo *MongoRepository, errs c
 	}
 }
 
-// RemoveStaleServices deletes services that have not been reloaded in the last 150 minutes
-// If they have not been reloaded (which happens every 1hr) then they were likely removed
-// from k8s
-func RemoveStaleServices(mgoRepo *MongoRepository, errs chan error) {
-	err := RemoveServicesNotReloadedRecently(mgoRepo)
+// RemoveStaleServices deletes services that have not been reloaded in the last two reload intervals (plus 20 minutes)
+// If they have not been reloaded (which happens every reload interval) then they were likely removed
+// from k8s, so their metrics are deleted and their open incidents closed too
+func RemoveStaleServices(mgoRepo *MongoRepository, reloadInterval time.Duration, errs chan error, metrics instrumentation.Metrics) {
+	removed, err := RemoveServicesNotReloadedRecently(mgoRepo, reloadInterval)
+
+	serviceUnhealthyGaugeVec := metrics.Gauges[constants.HealthAggregatorServiceUnhealthy]
+	for _, svc := range removed {
+		serviceUnhealthyGaugeVec.DeleteLabelValues(svc.Cluster, svc.Namespace, svc.Name)
+	}
+
+	if closeErr := CloseIncidentsOfServices(mgoRepo, removed, time.Now().UTC()); closeErr != nil {
+		select {
+		case errs <- fmt.Errorf("Could not close incidents of stale services (%v)", closeErr):
+		default:
+		}
+	}
+
+	if removeErr := RemoveStatusesOfServices(mgoRepo, removed); removeErr != nil {
+		select {
+		case errs <- fmt.Errorf("Could not remove statuses of stale services (%v)", removeErr):
+		default:
+		}
+	}
+
+	// the removed Services are no longer counted as non-compliant
+	nonCompliantGaugeVec := metrics.Gauges[constants.HealthAggregatorNonCompliantServices]
+	namespaces := make(map[[2]string]bool)
+	for _, svc := range removed {
+		namespaces[[2]string{svc.Cluster, svc.Namespace}] = true
+	}
+	for namespace := range namespaces {
+		if countErr := setNonCompliantServices(mgoRepo, nonCompliantGaugeVec, namespace[0], namespace[1]); countErr != nil {
+			select {
+			case errs <- fmt.Errorf("Could not count non-compliant services in namespace %s (%v)", namespace[1], countErr):
+			default:
+			}
+		}
+	}
+
 	if err != nil {
 		select {
 		case errs <- fmt.Errorf("Could not remove stale services (%v)", err):
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"math/rand"
 	"strconv"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/utilitywarehouse/health-aggregator/internal/constants"
@@ -86,6 +88,7 @@ func Test_GetHealthchecks(t *testing.T) {
 	healthchecksNS1 := make(chan model.Service, 10)
 	healthchecksNS2 := make(chan model.Service, 10)
 	healthchecksAll := make(chan model.Service, 10)
+	healthchecksOwned := make(chan model.Service, 10)
 
 	// Restricted to Namespace 1
 	expectedServicesNS1 := []model.Service{s1}
@@ -96,14 +99,20 @@ func Test_GetHealthchecks(t *testing.T) {
 	// Unrestricted
 	expectedServicesAll := []model.Service{s1, s3}
 
+	// Only those owned, e.g. by a shard
+	expectedServicesOwned := []model.Service{s3}
+	owns := func(svc model.Service) bool { return svc.Name == s3.Name }
+
 	done := make(chan struct{})
 	go func() {
-		GetHealthchecks(s.repo, healthchecksNS1, errsChan, metrics, ns1Name)
+		GetHealthchecks(context.Background(), s.repo, healthchecksNS1, errsChan, metrics, nil, "", ns1Name)
 		close(healthchecksNS1)
-		GetHealthchecks(s.repo, healthchecksNS2, errsChan, metrics, ns2Name)
+		GetHealthchecks(context.Background(), s.repo, healthchecksNS2, errsChan, metrics, nil, "", ns2Name)
 		close(healthchecksNS2)
-		GetHealthchecks(s.repo, healthchecksAll, errsChan, metrics)
+		GetHealthchecks(context.Background(), s.repo, healthchecksAll, errsChan, metrics, nil, "")
 		close(healthchecksAll)
+		GetHealthchecks(context.Background(), s.repo, healthchecksOwned, errsChan, metrics, owns, "")
+		close(healthchecksOwned)
 		close(done)
 	}()
 
@@ -134,6 +143,12 @@ func Test_GetHealthchecks(t *testing.T) {
 		returnedServices = append(returnedServices, check)
 	}
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesAll, returnedServices))
+	returnedServices = returnedServices[:0]
+
+	for check := range healthchecksOwned {
+		returnedServices = append(returnedServices, check)
+	}
+	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesOwned, returnedServices))
 
 	close(errsChan)
 }
@@ -179,32 +194,82 @@ func Test_FindAllServicesWithHealthScrapeEnabled(t *testing.T) {
 	// Unrestricted
 	expectedServicesAll := []model.Service{s1, s3, s4}
 
-	returnedServices, err := FindAllServicesWithHealthScrapeEnabled(s.repo, ns1Name)
+	returnedServices, err := FindAllServicesWithHealthScrapeEnabled(s.repo, "", ns1Name)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesNS1, returnedServices))
 
-	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, ns2Name)
+	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, "", ns2Name)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesNS2, returnedServices))
 
-	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, ns1Name, ns3Name)
+	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, "", ns1Name, ns3Name)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesNS1NS3, returnedServices))
 
-	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, ns4Name)
+	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, "", ns4Name)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesNS4, returnedServices))
 
-	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo)
+	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, "")
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesAll, returnedServices))
 
 	allNamespaces := []string{}
-	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, allNamespaces...)
+	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, "", allNamespaces...)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesAll, returnedServices))
 }
 
+func Test_ServicesAreKeptApartByCluster(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	dev := generateDummyService(helpers.String(10))
+	dev.Cluster = "dev"
+	prod := dev
+	prod.Cluster = "prod"
+
+	services := make(chan model.Service, 2)
+	services <- dev
+	services <- prod
+	close(services)
+	NewK8sServicesConfigUpdater(services, s.repo.WithNewSession()).UpsertServiceConfigs()
+
+	returnedServices, err := FindAllServicesWithHealthScrapeEnabled(s.repo, "prod")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(returnedServices))
+	assert.Equal(t, "prod", returnedServices[0].Cluster)
+
+	returnedServices, err = FindAllServicesWithHealthScrapeEnabled(s.repo, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(returnedServices))
+
+	clusters, err := FindAllClusters(s.repo)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dev", "prod"}, clusters)
+
+	statuses := make(chan model.ServiceStatus, 2)
+	statuses <- model.ServiceStatus{Service: dev, CheckTime: time.Now().UTC(), AggregatedState: constants.Healthy}
+	statuses <- model.ServiceStatus{Service: prod, CheckTime: time.Now().UTC(), AggregatedState: constants.Unhealthy}
+	close(statuses)
+	InsertHealthcheckResponses(s.repo, statuses, make(chan error, 10), instrumentation.SetupMetrics(), StorageOptions{Mode: constants.StorageModeFull})
+
+	latest, err := FindLatestChecksForNamespace(s.repo, "dev", dev.Namespace)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(latest))
+	assert.Equal(t, constants.Healthy, latest[0].AggregatedState)
+
+	latest, err = FindLatestChecksForNamespace(s.repo, "prod", dev.Namespace)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(latest))
+	assert.Equal(t, constants.Unhealthy, latest[0].AggregatedState)
+
+	transitions, err := FindTransitionsForService(s.repo, "prod", prod.Namespace, prod.Name)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(transitions))
+	assert.Equal(t, "prod", transitions[0].Cluster)
+}
+
 func Test_FindAllServices(t *testing.T) {
 	s.SetUpTest()
 	defer s.TearDownTest()
@@ -264,11 +329,11 @@ func Test_FindAllServicesForNamespace(t *testing.T) {
 	expectedServicesForNS1 := []model.Service{s1, s2}
 	expectedServicesForNS2 := []model.Service{s3}
 
-	returnedServicesForNS1, err := FindAllServicesForNamespace(s.repo, ns1Name)
+	returnedServicesForNS1, err := FindAllServicesForNamespace(s.repo, "", ns1Name)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesForNS1, returnedServicesForNS1))
 
-	returnedServicesForNS2, err := FindAllServicesForNamespace(s.repo, ns2Name)
+	returnedServicesForNS2, err := FindAllServicesForNamespace(s.repo, "", ns2Name)
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServicesForNS2, returnedServicesForNS2))
 }
@@ -279,7 +344,7 @@ func Test_FindAllServicesForNamespaceReturnsEmptySliceWhenNoneExist(t *testing.T
 
 	expectedServices := []model.Service{}
 
-	returnedServicesForNonExistentNamespace, err := FindAllServicesForNamespace(s.repo, "madeUpNamespace")
+	returnedServicesForNonExistentNamespace, err := FindAllServicesForNamespace(s.repo, "", "madeUpNamespace")
 	require.NoError(t, err)
 	assert.NoError(t, helpers.TestSliceServicesEquality(expectedServices, returnedServicesForNonExistentNamespace))
 }
@@ -453,7 +518,7 @@ func Test_InsertHealthcheckResponses(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		InsertHealthcheckResponses(s.repo, servicesChan, errsChan, metrics)
+		InsertHealthcheckResponses(s.repo, servicesChan, errsChan, metrics, StorageOptions{Mode: constants.StorageModeFull})
 		close(done)
 	}()
 
@@ -471,6 +536,300 @@ func Test_InsertHealthcheckResponses(t *testing.T) {
 	close(errsChan)
 }
 
+func Test_InsertHealthcheckResponsesTransitionsMode(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	metrics := instrumentation.SetupMetrics()
+
+	sName := helpers.String(10)
+	nsName := helpers.String(10)
+	podNames := []string{"pod-a", "pod-b"}
+
+	check1 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	check1.CheckTime = time.Now().Add(-3 * time.Minute).UTC()
+	check2 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	check2.CheckTime = time.Now().Add(-2 * time.Minute).UTC()
+	check3 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Unhealthy)
+	check3.CheckTime = time.Now().Add(-1 * time.Minute).UTC()
+
+	insertItems(s.repo, check1.Service)
+
+	servicesChan := make(chan model.ServiceStatus, 10)
+	errsChan := make(chan error, 10)
+
+	servicesChan <- check1
+	servicesChan <- check2
+	servicesChan <- check3
+	close(servicesChan)
+
+	transitionsChan := make(chan model.ServiceStatus, 10)
+
+	InsertHealthcheckResponses(s.repo, servicesChan, errsChan, metrics, StorageOptions{Mode: constants.StorageModeTransitions, SnapshotInterval: time.Hour, Transitions: transitionsChan})
+
+	select {
+	case <-errsChan:
+		t.Errorf("Should not get an error")
+	default:
+	}
+
+	// only the first check and the transition to unhealthy are stored in full
+	assert.NoError(t, helpers.TestServiceStatusesEquality([]model.ServiceStatus{check1, check3}, findAllServiceStatuses()))
+
+	// both transitions are published once persisted
+	require.Equal(t, 2, len(transitionsChan))
+	<-transitionsChan
+	published := <-transitionsChan
+	assert.Equal(t, constants.Healthy, published.PreviousState)
+	assert.Equal(t, constants.Unhealthy, published.AggregatedState)
+
+	transitions, err := FindTransitionsForService(s.repo, "", nsName, sName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(transitions))
+	assert.Equal(t, constants.Healthy, transitions[0].From)
+	assert.Equal(t, constants.Unhealthy, transitions[0].To)
+
+	latest, err := FindLatestChecksForNamespace(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(latest))
+	assert.Equal(t, constants.Unhealthy, latest[0].AggregatedState)
+	assert.Equal(t, constants.Healthy, latest[0].PreviousState)
+	assert.Equal(t, check3.CheckTime.Format("2006-01-02T15:04:05.000Z"), latest[0].StateSince.Format("2006-01-02T15:04:05.000Z"))
+}
+
+func Test_FindComplianceForNamespace(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	nsName := helpers.String(10)
+	podNames := []string{"pod-a", "pod-b"}
+
+	compliant := helpers.GenerateDummyServiceStatus(helpers.String(10), nsName, podNames, constants.Healthy)
+	nonCompliant := helpers.GenerateDummyServiceStatus(helpers.String(10), nsName, podNames, constants.Healthy)
+	nonCompliant.PodChecks[1].Warnings = []string{`health "Healthy" should be lower case`}
+
+	insertItems(s.repo, compliant.Service, nonCompliant.Service)
+
+	servicesChan := make(chan model.ServiceStatus, 10)
+	errsChan := make(chan error, 10)
+
+	servicesChan <- compliant
+	servicesChan <- nonCompliant
+	close(servicesChan)
+
+	metrics := instrumentation.SetupMetrics()
+	InsertHealthcheckResponses(s.repo, servicesChan, errsChan, metrics, StorageOptions{Mode: constants.StorageModeFull})
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.Gauges[constants.HealthAggregatorNonCompliantServices].WithLabelValues("", nsName)))
+
+	report, err := FindComplianceForNamespace(s.repo, "", nsName)
+	require.NoError(t, err)
+	assert.Equal(t, nsName, report.Namespace)
+	assert.Equal(t, 2, report.CheckedServices)
+	assert.Equal(t, 1, report.NonCompliantServices)
+	require.Equal(t, 2, len(report.Services))
+
+	assert.Equal(t, nonCompliant.Service.Name, report.Services[0].Service)
+	assert.False(t, report.Services[0].Compliant)
+	assert.Equal(t, map[string][]string{"pod-b": {`health "Healthy" should be lower case`}}, report.Services[0].PodWarnings)
+
+	assert.Equal(t, compliant.Service.Name, report.Services[1].Service)
+	assert.True(t, report.Services[1].Compliant)
+	assert.Nil(t, report.Services[1].PodWarnings)
+}
+
+func Test_UpsertCurrentStatusMatchesTheClusterExactly(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	nsName := helpers.String(10)
+	clustered := helpers.GenerateDummyServiceStatus("uw-foo", nsName, []string{"pod-a"}, constants.Unhealthy)
+	clustered.Service.Cluster = "prod"
+	require.NoError(t, upsertCurrentStatus(s.repo, clustered))
+
+	// a Service without a cluster neither replaces nor takes the state of the Service of the same name in a cluster
+	states := newServiceStates(s.repo)
+	assert.Equal(t, "", states.get(model.ServicesStateKey{Namespace: nsName, Service: "uw-foo"}).AggregatedState)
+	assert.Equal(t, constants.Unhealthy, states.get(model.ServicesStateKey{Cluster: "prod", Namespace: nsName, Service: "uw-foo"}).AggregatedState)
+
+	unclustered := helpers.GenerateDummyServiceStatus("uw-foo", nsName, []string{"pod-a"}, constants.Healthy)
+	require.NoError(t, upsertCurrentStatus(s.repo, unclustered))
+	require.NoError(t, upsertCurrentStatus(s.repo, unclustered))
+
+	var statuses []model.ServiceStatus
+	require.NoError(t, s.repo.Db().C(constants.StatusCollection).Find(bson.M{"service.namespace": nsName}).Sort("service.cluster").All(&statuses))
+	require.Equal(t, 2, len(statuses))
+	assert.Equal(t, "", statuses[0].Service.Cluster)
+	assert.Equal(t, constants.Healthy, statuses[0].AggregatedState)
+	assert.Equal(t, "prod", statuses[1].Service.Cluster)
+	assert.Equal(t, constants.Unhealthy, statuses[1].AggregatedState)
+}
+
+func Test_UpsertFederatedStatus(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	now := time.Now().UTC()
+	staleBefore := now.Add(-10 * time.Minute)
+	nsName := helpers.String(10)
+
+	// a Service checked locally is kept over a federated status while it is fresh
+	local := helpers.GenerateDummyServiceStatus("uw-foo", nsName, []string{"pod-a"}, constants.Healthy)
+	insertItems(s.repo, local.Service)
+	require.NoError(t, upsertCurrentStatus(s.repo, local))
+
+	federated := helpers.GenerateDummyServiceStatus("uw-foo", nsName, []string{"pod-a"}, constants.Unhealthy)
+	federated.Source = "energy"
+	merged, err := UpsertFederatedStatus(s.repo, federated, staleBefore)
+	require.NoError(t, err)
+	assert.False(t, merged)
+
+	// a Service only checked by federated instances takes the most recently checked status
+	other := helpers.GenerateDummyServiceStatus("uw-bar", nsName, []string{"pod-a"}, constants.Healthy)
+	other.Source = "energy"
+	other.CheckTime = now.Add(-time.Minute)
+	merged, err = UpsertFederatedStatus(s.repo, other, staleBefore)
+	require.NoError(t, err)
+	assert.True(t, merged)
+
+	older := other
+	older.Source = "billing"
+	older.AggregatedState = constants.Unhealthy
+	older.CheckTime = now.Add(-2 * time.Minute)
+	merged, err = UpsertFederatedStatus(s.repo, older, staleBefore)
+	require.NoError(t, err)
+	assert.False(t, merged)
+
+	// once the source stops refreshing its status, it is marked stale and loses to a fresh one
+	require.NoError(t, MarkFederatedStatusesStale(s.repo, "energy", now))
+	merged, err = UpsertFederatedStatus(s.repo, older, staleBefore)
+	require.NoError(t, err)
+	assert.True(t, merged)
+
+	statuses, err := FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+	assert.Equal(t, "uw-bar", statuses[0].Service.Name)
+	assert.Equal(t, "billing", statuses[0].Source)
+	assert.False(t, statuses[0].Stale)
+	assert.Equal(t, "uw-foo", statuses[1].Service.Name)
+	assert.Equal(t, "", statuses[1].Source)
+	assert.Equal(t, constants.Healthy, statuses[1].AggregatedState)
+
+	require.NoError(t, RemoveFederatedStatusesNotFrom(s.repo, []string{"energy"}))
+	statuses, err = FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(statuses))
+	assert.Equal(t, "uw-foo", statuses[0].Service.Name)
+}
+
+func Test_FindCurrentStatusesOfCheckedServices(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	nsName := helpers.String(10)
+	status := func(name string) model.ServiceStatus {
+		return helpers.GenerateDummyServiceStatus(name, nsName, []string{"pod-a"}, constants.Healthy)
+	}
+
+	checked := status("uw-foo")
+	disabled := status("uw-bar")
+	disabled.Service.HealthAnnotations.EnableScrape = "false"
+	scaledDown := status("uw-baz")
+	scaledDown.Service.Deployment.DesiredReplicas = 0
+	deleted := status("uw-qux")
+	federated := status("uw-quux")
+	federated.Source = "energy"
+
+	insertItems(s.repo, checked.Service, disabled.Service, scaledDown.Service)
+	for _, st := range []model.ServiceStatus{checked, disabled, scaledDown, deleted, federated} {
+		require.NoError(t, upsertCurrentStatus(s.repo, st))
+	}
+
+	statuses, err := FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+	assert.Equal(t, "uw-foo", statuses[0].Service.Name)
+	assert.Equal(t, "uw-quux", statuses[1].Service.Name)
+}
+
+func Test_RemoveFederatedStatusesNotPulled(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	staleBefore := time.Now().UTC().Add(-10 * time.Minute)
+	nsName := helpers.String(10)
+
+	var pulled []model.ServiceStatus
+	for _, name := range []string{"uw-foo", "uw-bar"} {
+		status := helpers.GenerateDummyServiceStatus(name, nsName, []string{"pod-a"}, constants.Healthy)
+		status.Source = "energy"
+		_, err := UpsertFederatedStatus(s.repo, status, staleBefore)
+		require.NoError(t, err)
+		pulled = append(pulled, status)
+	}
+	// the same Service checked by another source is kept
+	other := helpers.GenerateDummyServiceStatus("uw-baz", nsName, []string{"pod-a"}, constants.Healthy)
+	other.Source = "billing"
+	_, err := UpsertFederatedStatus(s.repo, other, staleBefore)
+	require.NoError(t, err)
+
+	// uw-bar is no longer checked by the source
+	require.NoError(t, RemoveFederatedStatusesNotPulled(s.repo, "energy", pulled[:1]))
+	statuses, err := FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+	assert.Equal(t, "uw-baz", statuses[0].Service.Name)
+	assert.Equal(t, "uw-foo", statuses[1].Service.Name)
+
+	// an empty pull removes every status of the source
+	require.NoError(t, RemoveFederatedStatusesNotPulled(s.repo, "energy", nil))
+	statuses, err = FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(statuses))
+	assert.Equal(t, "uw-baz", statuses[0].Service.Name)
+}
+
+func Test_MarkStaleStatuses(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	now := time.Now().UTC()
+	nsName := helpers.String(10)
+
+	fresh := helpers.GenerateDummyServiceStatus("uw-foo", nsName, []string{"pod-a"}, constants.Healthy)
+	require.NoError(t, upsertCurrentStatus(s.repo, fresh))
+
+	stopped := helpers.GenerateDummyServiceStatus("uw-bar", nsName, []string{"pod-a"}, constants.Healthy)
+	stopped.CheckTime = now.Add(-time.Hour)
+	require.NoError(t, upsertCurrentStatus(s.repo, stopped))
+
+	// federated statuses are marked stale by the federation instead
+	federated := helpers.GenerateDummyServiceStatus("uw-baz", nsName, []string{"pod-a"}, constants.Healthy)
+	federated.Source = "energy"
+	federated.CheckTime = now.Add(-time.Hour)
+	require.NoError(t, upsertCurrentStatus(s.repo, federated))
+
+	insertItems(s.repo, fresh.Service, stopped.Service)
+	require.NoError(t, MarkStaleStatuses(s.repo, now.Add(-3*time.Minute)))
+
+	statuses, err := FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(statuses))
+	assert.Equal(t, "uw-bar", statuses[0].Service.Name)
+	assert.True(t, statuses[0].Stale)
+	assert.Equal(t, "uw-baz", statuses[1].Service.Name)
+	assert.False(t, statuses[1].Stale)
+	assert.Equal(t, "uw-foo", statuses[2].Service.Name)
+	assert.False(t, statuses[2].Stale)
+
+	// checking the Service again clears the flag
+	stopped.CheckTime = now
+	require.NoError(t, upsertCurrentStatus(s.repo, stopped))
+	statuses, err = FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	assert.False(t, statuses[0].Stale)
+}
+
 func Test_RemoveChecksOlderThan(t *testing.T) {
 	s.SetUpTest()
 	defer s.TearDownTest()
@@ -511,6 +870,70 @@ func Test_RemoveChecksOlderThan(t *testing.T) {
 	close(errsChan)
 }
 
+func Test_RemoveTransitionsOlderThan(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	oldTransition := model.StateTransition{Namespace: helpers.String(10), Service: helpers.String(10), Time: time.Now().Add(time.Hour * -25).UTC()}
+	newTransition := model.StateTransition{Namespace: helpers.String(10), Service: helpers.String(10), Time: time.Now().Add(time.Hour * -23).UTC()}
+
+	require.NoError(t, s.repo.Db().C(constants.TransitionsCollection).Insert(oldTransition, newTransition))
+
+	errsChan := make(chan error, 10)
+	RemoveTransitionsOlderThan(1, s.repo, errsChan)
+
+	select {
+	case <-errsChan:
+		t.Errorf("Should not get an error")
+	default:
+	}
+
+	var remaining []model.StateTransition
+	require.NoError(t, s.repo.Db().C(constants.TransitionsCollection).Find(bson.M{}).All(&remaining))
+	require.Equal(t, 1, len(remaining))
+	assert.Equal(t, newTransition.Service, remaining[0].Service)
+}
+
+func Test_BackfillCurrentStatuses(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	nsName := helpers.String(10)
+	podNames := []string{"pod-a", "pod-b"}
+
+	// only responses were stored, before the current status collection existed
+	sName := helpers.String(10)
+	olderCheck := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Unhealthy)
+	olderCheck.CheckTime = time.Now().Add(-2 * time.Minute).UTC()
+	latestCheck := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	latestCheck.CheckTime = time.Now().Add(-time.Minute).UTC()
+	other := helpers.GenerateDummyServiceStatus(helpers.String(10), nsName, podNames, constants.Degraded)
+	other.CheckTime = time.Now().Add(-time.Minute).UTC()
+
+	insertItems(s.repo, olderCheck, latestCheck, other, latestCheck.Service, other.Service)
+
+	backfilled, err := BackfillCurrentStatuses(s.repo)
+	require.NoError(t, err)
+	assert.Equal(t, 2, backfilled)
+
+	statuses, err := FindCurrentStatuses(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+	for _, status := range statuses {
+		if status.Service.Name == sName {
+			assert.Equal(t, constants.Healthy, status.AggregatedState)
+		} else {
+			assert.Equal(t, constants.Degraded, status.AggregatedState)
+		}
+	}
+
+	// once statuses are stored nothing is backfilled, the current status is kept as each Service is checked
+	insertItems(s.repo, helpers.GenerateDummyServiceStatus(helpers.String(10), nsName, podNames, constants.Healthy))
+	backfilled, err = BackfillCurrentStatuses(s.repo)
+	require.NoError(t, err)
+	assert.Equal(t, 0, backfilled)
+}
+
 func Test_DropDB(t *testing.T) {
 	s.SetUpTest()
 	defer s.TearDownTest()
@@ -602,7 +1025,7 @@ func Test_DoUpdates(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		updater.DoUpdates()
+		updater.DoUpdates(context.Background())
 		close(done)
 	}()
 
@@ -619,6 +1042,32 @@ func Test_DoUpdates(t *testing.T) {
 	assert.Equal(t, int32(0), findService(service3.Name, nsName).Deployment.DesiredReplicas)
 }
 
+func Test_DoUpdatesReturnsWhenContextCancelled(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	repo := s.repo.WithNewSession()
+
+	updateItems := make(chan model.UpdateItem, 10)
+	errs := make(chan error, 10)
+	updater := NewUpdaterService(updateItems, errs, repo)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		updater.DoUpdates(ctx)
+		close(done)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DoUpdates did not return after the context was cancelled")
+	}
+}
+
 func Test_DoUpdatesUnsupportedObject(t *testing.T) {
 	s.SetUpTest()
 	defer s.TearDownTest()
@@ -638,7 +1087,7 @@ func Test_DoUpdatesUnsupportedObject(t *testing.T) {
 
 	done := make(chan struct{})
 	go func() {
-		updater.DoUpdates()
+		updater.DoUpdates(context.Background())
 		close(done)
 		close(errs)
 	}()
@@ -666,9 +1115,24 @@ func Test_DeleteStaleServices(t *testing.T) {
 
 	insertItems(s.repo, s1, s2, s3)
 
+	// the statuses of removed Services are removed, unless pulled from a federation source
+	federated := model.ServiceStatus{Service: s3, Source: "energy"}
+	nonCompliant := model.ServiceStatus{Service: s2, PodChecks: []model.PodHealthResponse{{Name: "pod-a", Warnings: []string{"missing checks"}}}}
+	for _, status := range []model.ServiceStatus{{Service: s1}, nonCompliant, federated} {
+		require.NoError(t, s.repo.Db().C(constants.StatusCollection).Insert(status))
+	}
+
+	metrics := instrumentation.SetupMetrics()
+	nonCompliantGaugeVec := metrics.Gauges[constants.HealthAggregatorNonCompliantServices]
+	nonCompliantGaugeVec.WithLabelValues(s2.Cluster, ns1Name).Set(1)
+	serviceUnhealthyGaugeVec := metrics.Gauges[constants.HealthAggregatorServiceUnhealthy]
+	for _, svc := range []model.Service{s1, s2, s3} {
+		serviceUnhealthyGaugeVec.WithLabelValues(svc.Cluster, svc.Namespace, svc.Name).Set(1)
+	}
+
 	errsChan := make(chan error, 10)
 
-	RemoveStaleServices(s.repo, errsChan)
+	RemoveStaleServices(s.repo, constants.ReloadServicesIntervalMins*time.Minute, errsChan, metrics)
 
 	select {
 	case <-errsChan:
@@ -684,6 +1148,21 @@ func Test_DeleteStaleServices(t *testing.T) {
 		assert.Equal(t, s1.Name, service.Name)
 	}
 
+	// only the metrics of the removed services are deleted
+	assert.True(t, serviceUnhealthyGaugeVec.DeleteLabelValues(s1.Cluster, s1.Namespace, s1.Name))
+	assert.False(t, serviceUnhealthyGaugeVec.DeleteLabelValues(s2.Cluster, s2.Namespace, s2.Name))
+	assert.False(t, serviceUnhealthyGaugeVec.DeleteLabelValues(s3.Cluster, s3.Namespace, s3.Name))
+
+	var statuses []model.ServiceStatus
+	require.NoError(t, s.repo.Db().C(constants.StatusCollection).Find(nil).All(&statuses))
+	sources := make(map[string]string)
+	for _, status := range statuses {
+		sources[status.Service.Name] = status.Source
+	}
+	assert.Equal(t, map[string]string{s1.Name: "", s3.Name: "energy"}, sources)
+
+	// the removed non-compliant Service is no longer counted
+	assert.Equal(t, 0.0, testutil.ToFloat64(nonCompliantGaugeVec.WithLabelValues(s2.Cluster, ns1Name)))
 }
 
 func Test_DeleteStaleServicesNoServicesUpdatedRecently(t *testing.T) {
@@ -705,7 +1184,7 @@ func Test_DeleteStaleServicesNoServicesUpdatedRecently(t *testing.T) {
 
 	errsChan := make(chan error, 10)
 
-	RemoveStaleServices(s.repo, errsChan)
+	RemoveStaleServices(s.repo, constants.ReloadServicesIntervalMins*time.Minute, errsChan, instrumentation.SetupMetrics())
 
 	select {
 	case <-errsChan:
@@ -719,6 +1198,334 @@ func Test_DeleteStaleServicesNoServicesUpdatedRecently(t *testing.T) {
 
 }
 
+func Test_RollupHourly(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	sName := helpers.String(10)
+	nsName := helpers.String(10)
+	podNames := []string{"pod-a", "pod-b"}
+
+	periodStart := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+
+	check1 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	check1.CheckTime = periodStart.Add(time.Minute)
+	check1.HealthyPods = 2
+
+	check2 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Unhealthy)
+	check2.CheckTime = periodStart.Add(2 * time.Minute)
+	check2.HealthyPods = 0
+	failingCheck := model.Check{Name: "Database connectivity", Health: constants.Unhealthy}
+	for i := range check2.PodChecks {
+		check2.PodChecks[i].Body.Checks = []model.Check{failingCheck}
+	}
+
+	check3 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	check3.CheckTime = periodStart.Add(4 * time.Minute)
+	check3.HealthyPods = 2
+
+	// outside of the period and should be ignored
+	check4 := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Unhealthy)
+	check4.CheckTime = periodStart.Add(-time.Minute)
+
+	insertItems(s.repo, check1, check2, check3, check4)
+
+	err := RollupHourly(s.repo, periodStart, StorageOptions{Mode: constants.StorageModeFull})
+	require.NoError(t, err)
+
+	rollups, err := FindRollupsForService(s.repo, "", nsName, sName, constants.RollupHourly, periodStart)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rollups))
+
+	rollup := rollups[0]
+	assert.Equal(t, 3, rollup.Checks)
+	assert.Equal(t, 2, rollup.Transitions)
+	assert.Equal(t, 0, rollup.MinHealthyPods)
+	assert.Equal(t, 2, rollup.MaxHealthyPods)
+	assert.Equal(t, float64(60+300), rollup.SecondsInState[constants.Healthy])
+	assert.Equal(t, float64(120), rollup.SecondsInState[constants.Unhealthy])
+	assert.Equal(t, []model.FailingCheck{{Name: failingCheck.Name, Failures: 2}}, rollup.TopFailingChecks)
+}
+
+func Test_RollupDaily(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	sName := helpers.String(10)
+	nsName := helpers.String(10)
+
+	now := time.Now().UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+
+	hour1 := model.ServiceRollup{Namespace: nsName, Service: sName, Period: constants.RollupHourly, PeriodStart: dayStart, PeriodEnd: dayStart.Add(time.Hour),
+		Checks: 60, Transitions: 2, MinHealthyPods: 1, MaxHealthyPods: 3, SecondsInState: map[string]float64{constants.Healthy: 3000, constants.Unhealthy: 600},
+		TopFailingChecks: []model.FailingCheck{{Name: "db", Failures: 10}}}
+	hour2 := model.ServiceRollup{Namespace: nsName, Service: sName, Period: constants.RollupHourly, PeriodStart: dayStart.Add(time.Hour), PeriodEnd: dayStart.Add(2 * time.Hour),
+		Checks: 60, Transitions: 1, MinHealthyPods: 0, MaxHealthyPods: 2, SecondsInState: map[string]float64{constants.Healthy: 3600},
+		TopFailingChecks: []model.FailingCheck{{Name: "db", Failures: 5}, {Name: "kafka", Failures: 20}}}
+
+	require.NoError(t, s.repo.Db().C(constants.RollupsCollection).Insert(hour1, hour2))
+
+	err := RollupDaily(s.repo, dayStart)
+	require.NoError(t, err)
+
+	rollups, err := FindRollupsForService(s.repo, "", nsName, sName, constants.RollupDaily, dayStart)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rollups))
+
+	rollup := rollups[0]
+	assert.Equal(t, 120, rollup.Checks)
+	assert.Equal(t, 3, rollup.Transitions)
+	assert.Equal(t, 0, rollup.MinHealthyPods)
+	assert.Equal(t, 3, rollup.MaxHealthyPods)
+	assert.Equal(t, float64(6600), rollup.SecondsInState[constants.Healthy])
+	assert.Equal(t, float64(600), rollup.SecondsInState[constants.Unhealthy])
+	assert.Equal(t, []model.FailingCheck{{Name: "kafka", Failures: 20}, {Name: "db", Failures: 15}}, rollup.TopFailingChecks)
+}
+
+func Test_RollupCompletedPeriodsCatchesUp(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	sName := helpers.String(10)
+	nsName := helpers.String(10)
+
+	thisHour := time.Now().UTC().Truncate(time.Hour)
+	lastRolledUp := thisHour.Add(-4 * time.Hour)
+	_, err := s.repo.Db().C(constants.RollupProgressCollection).UpsertId(constants.RollupHourly, rollupProgress{Period: constants.RollupHourly, PeriodStart: lastRolledUp})
+	require.NoError(t, err)
+
+	// a check in each of the hours missed since the last rollup
+	var checks []interface{}
+	for hour := lastRolledUp.Add(time.Hour); hour.Before(thisHour); hour = hour.Add(time.Hour) {
+		check := helpers.GenerateDummyServiceStatus(sName, nsName, []string{"pod-a"}, constants.Healthy)
+		check.CheckTime = hour.Add(time.Minute)
+		checks = append(checks, check)
+	}
+	insertItems(s.repo, checks...)
+
+	errsChan := make(chan error, 10)
+	RollupCompletedPeriods(s.repo, errsChan, instrumentation.SetupMetrics(), StorageOptions{Mode: constants.StorageModeFull})
+
+	select {
+	case err := <-errsChan:
+		t.Errorf("Should not get an error, got %v", err)
+	default:
+	}
+
+	rollups, err := FindRollupsForService(s.repo, "", nsName, sName, constants.RollupHourly, lastRolledUp)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(rollups))
+
+	var progress rollupProgress
+	require.NoError(t, s.repo.Db().C(constants.RollupProgressCollection).FindId(constants.RollupHourly).One(&progress))
+	assert.Equal(t, thisHour.Add(-time.Hour), progress.PeriodStart.UTC())
+
+	// nothing is rolled up again until another hour completes
+	RollupCompletedPeriods(s.repo, errsChan, instrumentation.SetupMetrics(), StorageOptions{Mode: constants.StorageModeFull})
+	require.NoError(t, s.repo.Db().C(constants.RollupProgressCollection).FindId(constants.RollupHourly).One(&progress))
+	assert.Equal(t, thisHour.Add(-time.Hour), progress.PeriodStart.UTC())
+}
+
+func Test_RemoveRollupsOlderThan(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	// the first day of the status page uptime is kept whole
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	oldRollup := model.ServiceRollup{Namespace: helpers.String(10), Service: helpers.String(10), Period: constants.RollupDaily, PeriodStart: today.AddDate(0, 0, -91)}
+	newRollup := model.ServiceRollup{Namespace: helpers.String(10), Service: helpers.String(10), Period: constants.RollupDaily, PeriodStart: today.AddDate(0, 0, -90)}
+
+	require.NoError(t, s.repo.Db().C(constants.RollupsCollection).Insert(oldRollup, newRollup))
+
+	errsChan := make(chan error, 10)
+	RemoveRollupsOlderThan(90, s.repo, errsChan)
+
+	select {
+	case <-errsChan:
+		t.Errorf("Should not get an error")
+	default:
+	}
+
+	var remaining []model.ServiceRollup
+	require.NoError(t, s.repo.Db().C(constants.RollupsCollection).Find(bson.M{}).All(&remaining))
+	require.Equal(t, 1, len(remaining))
+	assert.Equal(t, newRollup.Service, remaining[0].Service)
+}
+
+func Test_IsSilenced(t *testing.T) {
+	now := time.Now().UTC()
+	status := helpers.GenerateDummyServiceStatus("uw-foo", "energy", []string{"pod-a"}, constants.Unhealthy)
+	status.PodChecks[0].Body.Checks = []model.Check{{Name: "kafka", Health: constants.Unhealthy}, {Name: "db", Health: constants.Healthy}}
+
+	assert.False(t, isSilenced(status, []model.Silence{}, now))
+	assert.True(t, isSilenced(status, []model.Silence{{Namespace: "energy", ExpiresAt: now.Add(time.Hour)}}, now))
+	assert.True(t, isSilenced(status, []model.Silence{{Namespace: "energy", Service: "uw-foo", ExpiresAt: now.Add(time.Hour)}}, now))
+	assert.False(t, isSilenced(status, []model.Silence{{Namespace: "energy", Service: "uw-bar", ExpiresAt: now.Add(time.Hour)}}, now))
+	assert.False(t, isSilenced(status, []model.Silence{{Namespace: "energy", ExpiresAt: now.Add(-time.Hour)}}, now))
+	assert.False(t, isSilenced(status, []model.Silence{{Cluster: "prod", Namespace: "energy", ExpiresAt: now.Add(time.Hour)}}, now))
+
+	// check level silences only apply when all failing checks are silenced
+	assert.True(t, isSilenced(status, []model.Silence{{Check: "kafka", ExpiresAt: now.Add(time.Hour)}}, now))
+	status.PodChecks[0].Body.Checks[1].Health = constants.Degraded
+	assert.False(t, isSilenced(status, []model.Silence{{Check: "kafka", ExpiresAt: now.Add(time.Hour)}}, now))
+
+	status.Service.HealthAnnotations.SilenceUntil = now.Add(time.Hour).Format(time.RFC3339)
+	assert.True(t, isSilenced(status, []model.Silence{}, now))
+}
+
+func Test_InsertAndExpireSilences(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	_, err := InsertSilence(s.repo, model.Silence{CreatedBy: "jane.doe", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.Error(t, err)
+
+	_, err = InsertSilence(s.repo, model.Silence{Namespace: "energy", CreatedBy: "jane.doe", ExpiresAt: time.Now().Add(-time.Hour)})
+	assert.Error(t, err)
+
+	silence, err := InsertSilence(s.repo, model.Silence{Namespace: "energy", CreatedBy: "jane.doe", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.NotEmpty(t, silence.ID)
+
+	svc := generateDummyService("energy")
+	svc.HealthAnnotations.SilenceUntil = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	insertItems(s.repo, svc)
+
+	active, err := FindActiveSilences(s.repo)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(active))
+	assert.Equal(t, silence.ID, active[0].ID)
+	assert.Equal(t, svc.Name, active[1].Service)
+
+	require.NoError(t, ExpireSilence(s.repo, silence.ID))
+	assert.Equal(t, ErrNotFound, ExpireSilence(s.repo, "unknown"))
+
+	active, err = FindActiveSilences(s.repo)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(active))
+	assert.Equal(t, svc.Name, active[0].Service)
+}
+
+func Test_IncidentLifecycle(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	metrics := instrumentation.SetupMetrics()
+
+	sName := helpers.String(10)
+	nsName := helpers.String(10)
+	podNames := []string{"pod-a", "pod-b"}
+
+	healthy := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	healthy.CheckTime = time.Now().Add(-4 * time.Minute).UTC()
+	degraded := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Degraded)
+	degraded.CheckTime = time.Now().Add(-3 * time.Minute).UTC()
+	unhealthy := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Unhealthy)
+	unhealthy.CheckTime = time.Now().Add(-2 * time.Minute).UTC()
+	recovered := helpers.GenerateDummyServiceStatus(sName, nsName, podNames, constants.Healthy)
+	recovered.CheckTime = time.Now().Add(-1 * time.Minute).UTC()
+
+	servicesChan := make(chan model.ServiceStatus, 10)
+	errsChan := make(chan error, 10)
+
+	servicesChan <- healthy
+	servicesChan <- degraded
+	servicesChan <- unhealthy
+	close(servicesChan)
+
+	InsertHealthcheckResponses(s.repo, servicesChan, errsChan, metrics, StorageOptions{Mode: constants.StorageModeFull})
+
+	// degraded does not open an incident, unhealthy does
+	incidents, err := FindIncidents(s.repo, constants.IncidentOpen, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(incidents))
+	assert.Equal(t, sName, incidents[0].Service)
+	require.Equal(t, 1, len(incidents[0].Timeline))
+	assert.Equal(t, constants.Unhealthy, incidents[0].Timeline[0].State)
+	assert.Equal(t, len(podNames)*4, len(incidents[0].Timeline[0].PodErrors))
+
+	incident, err := AcknowledgeIncident(s.repo, incidents[0].ID, "jane.doe")
+	require.NoError(t, err)
+	assert.Equal(t, "jane.doe", incident.AcknowledgedBy)
+
+	incident, err = AddIncidentNote(s.repo, incidents[0].ID, model.IncidentNote{User: "jane.doe", Text: "rolling back"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(incident.Notes))
+	assert.Equal(t, "rolling back", incident.Notes[0].Text)
+
+	_, err = AcknowledgeIncident(s.repo, "unknown", "jane.doe")
+	assert.Equal(t, ErrNotFound, err)
+
+	servicesChan = make(chan model.ServiceStatus, 10)
+	servicesChan <- recovered
+	close(servicesChan)
+
+	InsertHealthcheckResponses(s.repo, servicesChan, errsChan, metrics, StorageOptions{Mode: constants.StorageModeFull})
+
+	incident, err = FindIncident(s.repo, incidents[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, constants.IncidentClosed, incident.State)
+	assert.Equal(t, recovered.CheckTime.Format("2006-01-02T15:04:05.000Z"), incident.ClosedAt.Format("2006-01-02T15:04:05.000Z"))
+	assert.Equal(t, 2, len(incident.Timeline))
+
+	select {
+	case <-errsChan:
+		t.Errorf("Should not get an error")
+	default:
+	}
+}
+
+func Test_IncidentsOfSilencedAndRemovedServices(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	nsName := helpers.String(10)
+	podNames := []string{"pod-a", "pod-b"}
+
+	// a silenced Service does not open an incident
+	silenced := helpers.GenerateDummyServiceStatus(helpers.String(10), nsName, podNames, constants.Unhealthy)
+	silenced.Silenced = true
+	require.NoError(t, RecordIncidentTransition(s.repo, silenced))
+
+	unhealthy := helpers.GenerateDummyServiceStatus(helpers.String(10), nsName, podNames, constants.Unhealthy)
+	unhealthy.CheckTime = time.Now().Add(-time.Minute).UTC()
+	require.NoError(t, RecordIncidentTransition(s.repo, unhealthy))
+
+	incidents, err := FindIncidents(s.repo, constants.IncidentOpen, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(incidents))
+	assert.Equal(t, unhealthy.Service.Name, incidents[0].Service)
+
+	// the incident is closed once its Service is removed
+	require.NoError(t, CloseIncidentsOfServices(s.repo, []model.Service{unhealthy.Service}, time.Now().UTC()))
+
+	incidents, err = FindIncidents(s.repo, constants.IncidentOpen, "", nsName)
+	require.NoError(t, err)
+	assert.Empty(t, incidents)
+
+	// and deleted once it has been closed for longer than the retention period
+	old := model.Incident{ID: helpers.String(10), Namespace: nsName, Service: helpers.String(10), State: constants.IncidentClosed, ClosedAt: time.Now().AddDate(0, 0, -91).UTC()}
+	open := model.Incident{ID: helpers.String(10), Namespace: nsName, Service: helpers.String(10), State: constants.IncidentOpen, OpenedAt: time.Now().AddDate(0, 0, -91).UTC()}
+	require.NoError(t, s.repo.Db().C(constants.IncidentsCollection).Insert(old, open))
+
+	errsChan := make(chan error, 10)
+	RemoveIncidentsOlderThan(90, s.repo, errsChan)
+
+	select {
+	case <-errsChan:
+		t.Errorf("Should not get an error")
+	default:
+	}
+
+	incidents, err = FindIncidents(s.repo, "", "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(incidents))
+	for _, incident := range incidents {
+		assert.NotEqual(t, old.ID, incident.ID)
+	}
+}
+
 func findNamespace(name string) model.Namespace {
 	var n model.Namespace
 	if err := s.repo.Db().C(constants.NamespacesCollection).Find(bson.M{"name": name}).One(&n); err != nil {
@@ -0,0 +1,388 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+const (
+	// rollupMaxCheckGap caps how long a single check result is assumed to hold for, so that periods where a
+	// service was not being checked are not counted towards time spent in its last known state
+	rollupMaxCheckGap = 5 * time.Minute
+	// rollupTopFailingChecks is the number of failing checks retained against each rollup
+	rollupTopFailingChecks = 5
+)
+
+// rollupProgress records the start of the last period of each type which was rolled up, so that periods missed while
+// no replica was rolling up, e.g. during a restart, are caught up
+type rollupProgress struct {
+	Period      string    `bson:"_id"`
+	PeriodStart time.Time `bson:"periodStart"`
+}
+
+// RollupCompletedPeriods creates or refreshes the hourly rollups of every completed hour, and the daily rollups of
+// every completed day, since those last rolled up, sending any errors to a channel of type error
+func RollupCompletedPeriods(mgoRepo *MongoRepository, errs chan error, metrics instrumentation.Metrics, opts StorageOptions) {
+	jobsDurationHistogramVec := metrics.Histograms[constants.HealthAggregatorJobDurationSeconds]
+
+	start := time.Now()
+	defer func() {
+		jobsDurationHistogramVec.WithLabelValues("rollup").Observe(time.Since(start).Seconds())
+	}()
+
+	now := time.Now().UTC()
+	thisHour := now.Truncate(time.Hour)
+	if err := catchUpRollups(mgoRepo, constants.RollupHourly, thisHour, func(hour time.Time) time.Time { return hour.Add(time.Hour) }, func(hour time.Time) error {
+		return RollupHourly(mgoRepo, hour, opts)
+	}); err != nil {
+		select {
+		case errs <- fmt.Errorf("Could not create hourly rollups (%v)", err):
+		default:
+		}
+		return
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if err := catchUpRollups(mgoRepo, constants.RollupDaily, today, func(day time.Time) time.Time { return day.AddDate(0, 0, 1) }, func(day time.Time) error {
+		return RollupDaily(mgoRepo, day)
+	}); err != nil {
+		select {
+		case errs <- fmt.Errorf("Could not create daily rollups (%v)", err):
+		default:
+		}
+		return
+	}
+}
+
+// catchUpRollups rolls up every period of the given type which ends by the given time, starting after the last one
+// rolled up. Without any progress recorded it starts from the period of the oldest data to roll up, or the previous
+// period if there is none
+func catchUpRollups(mgoRepo *MongoRepository, period string, end time.Time, next func(time.Time) time.Time, rollup func(time.Time) error) error {
+	progress := mgoRepo.Db().C(constants.RollupProgressCollection)
+
+	var last rollupProgress
+	err := progress.FindId(period).One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return errors.Wrapf(err, "failed to get progress of %s rollups", period)
+	}
+
+	var periodStart time.Time
+	if err == nil {
+		periodStart = next(last.PeriodStart)
+	} else if periodStart, err = oldestToRollUp(mgoRepo, period); err != nil {
+		return err
+	}
+	if periodStart.IsZero() {
+		if period == constants.RollupHourly {
+			periodStart = end.Add(-time.Hour)
+		} else {
+			periodStart = end.AddDate(0, 0, -1)
+		}
+	}
+
+	for ; !next(periodStart).After(end); periodStart = next(periodStart) {
+		if err := rollup(periodStart); err != nil {
+			return err
+		}
+		if _, err := progress.UpsertId(period, rollupProgress{Period: period, PeriodStart: periodStart}); err != nil {
+			return errors.Wrapf(err, "failed to record progress of %s rollups", period)
+		}
+	}
+	return nil
+}
+
+// oldestToRollUp returns the start of the period of the oldest health check response, for hourly rollups, or of the
+// oldest hourly rollup, for daily rollups. It is zero if there is nothing to roll up
+func oldestToRollUp(mgoRepo *MongoRepository, period string) (time.Time, error) {
+	if period == constants.RollupHourly {
+		var oldest model.ServiceStatus
+		err := mgoRepo.Db().C(constants.HealthchecksCollection).Find(nil).Select(bson.M{"checkTime": 1}).Sort("checkTime").One(&oldest)
+		if err == mgo.ErrNotFound {
+			return time.Time{}, nil
+		}
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "failed to get the oldest healthcheck response to roll up")
+		}
+		return oldest.CheckTime.UTC().Truncate(time.Hour), nil
+	}
+
+	var oldest model.ServiceRollup
+	err := mgoRepo.Db().C(constants.RollupsCollection).Find(bson.M{"period": constants.RollupHourly}).Sort("periodStart").One(&oldest)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to get the oldest hourly rollup to roll up")
+	}
+	start := oldest.PeriodStart.UTC()
+	return time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// RollupHourly summarises the raw health check responses for every Service within the hour starting at the
+// given time and upserts one hourly ServiceRollup per Service
+func RollupHourly(mgoRepo *MongoRepository, periodStart time.Time, opts StorageOptions) error {
+	periodStart = periodStart.UTC().Truncate(time.Hour)
+	periodEnd := periodStart.Add(time.Hour)
+
+	collection := mgoRepo.Db().C(constants.HealthchecksCollection)
+
+	var checks []model.ServiceStatus
+	if err := collection.Find(bson.M{"checkTime": bson.M{"$gte": periodStart, "$lt": periodEnd}}).
+		Select(bson.M{
+			"service.name":                 1,
+			"service.namespace":            1,
+			"service.cluster":              1,
+			"checkTime":                    1,
+			"aggregatedState":              1,
+			"healthyPods":                  1,
+			"podChecks.body.checks.name":   1,
+			"podChecks.body.checks.health": 1,
+		}).
+		Sort("checkTime").
+		All(&checks); err != nil {
+		return errors.Wrap(err, "failed to get healthcheck responses to roll up")
+	}
+
+	checksByService := make(map[model.ServicesStateKey][]model.ServiceStatus)
+	for _, c := range checks {
+		key := model.ServicesStateKey{Cluster: c.Service.Cluster, Namespace: c.Service.Namespace, Service: c.Service.Name}
+		checksByService[key] = append(checksByService[key], c)
+	}
+
+	log.Debugf("rolling up %d healthcheck responses for %d services for the hour starting %v", len(checks), len(checksByService), periodStart)
+
+	for key, serviceChecks := range checksByService {
+		rollup := summariseChecks(key, serviceChecks, constants.RollupHourly, periodStart, periodEnd, opts.maxCheckGap())
+		if err := upsertRollup(mgoRepo, rollup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RollupDaily combines the hourly rollups for every Service within the day starting at the given time and upserts
+// one daily ServiceRollup per Service
+func RollupDaily(mgoRepo *MongoRepository, periodStart time.Time) error {
+	periodStart = periodStart.UTC()
+	periodStart = time.Date(periodStart.Year(), periodStart.Month(), periodStart.Day(), 0, 0, 0, 0, time.UTC)
+	periodEnd := periodStart.AddDate(0, 0, 1)
+
+	collection := mgoRepo.Db().C(constants.RollupsCollection)
+
+	var hourly []model.ServiceRollup
+	if err := collection.Find(bson.M{"period": constants.RollupHourly, "periodStart": bson.M{"$gte": periodStart, "$lt": periodEnd}}).
+		Sort("periodStart").
+		All(&hourly); err != nil {
+		return errors.Wrap(err, "failed to get hourly rollups to roll up")
+	}
+
+	rollupsByService := make(map[model.ServicesStateKey][]model.ServiceRollup)
+	for _, r := range hourly {
+		key := model.ServicesStateKey{Cluster: r.Cluster, Namespace: r.Namespace, Service: r.Service}
+		rollupsByService[key] = append(rollupsByService[key], r)
+	}
+
+	for key, serviceRollups := range rollupsByService {
+		rollup := mergeRollups(key, serviceRollups, constants.RollupDaily, periodStart, periodEnd)
+		if err := upsertRollup(mgoRepo, rollup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindRollupsForService returns the rollups of the given period type ("hourly" or "daily") for a given Service and
+// Namespace which started on or after the given time, in PeriodStart ascending order. An empty cluster matches rollups
+// in any cluster
+func FindRollupsForService(mgoRepo *MongoRepository, cluster string, n string, s string, period string, since time.Time) ([]model.ServiceRollup, error) {
+
+	collection := mgoRepo.Db().C(constants.RollupsCollection)
+
+	var rollups []model.ServiceRollup
+	if err := collection.Find(inCluster(bson.M{"namespace": n, "service": s, "period": period, "periodStart": bson.M{"$gte": since}}, "cluster", cluster)).Sort("periodStart").All(&rollups); err != nil {
+		return nil, fmt.Errorf("failed to get %s rollups for service %v in namespace %v", period, s, n)
+	}
+
+	if rollups == nil {
+		rollups = []model.ServiceRollup{}
+	}
+
+	return rollups, nil
+}
+
+// FindRollups returns the rollups of the given period type ("hourly" or "daily") for every Service which started on or
+// after the given time, in PeriodStart ascending order
+func FindRollups(mgoRepo *MongoRepository, period string, since time.Time) ([]model.ServiceRollup, error) {
+
+	collection := mgoRepo.Db().C(constants.RollupsCollection)
+
+	var rollups []model.ServiceRollup
+	if err := collection.Find(bson.M{"period": period, "periodStart": bson.M{"$gte": since}}).Sort("periodStart").All(&rollups); err != nil {
+		return nil, fmt.Errorf("failed to get %s rollups since %v", period, since)
+	}
+
+	if rollups == nil {
+		rollups = []model.ServiceRollup{}
+	}
+
+	return rollups, nil
+}
+
+// DeleteRollupsOlderThan deletes rollups for periods that started before midnight UTC the given number of days ago, so
+// that whole days are kept for the uptime of the status page, whose first day starts at the same midnight
+func DeleteRollupsOlderThan(removeAfterDays int, mgoRepo *MongoRepository) error {
+
+	collection := mgoRepo.Db().C(constants.RollupsCollection)
+
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if _, err := collection.RemoveAll(bson.M{"periodStart": bson.M{"$lt": today.AddDate(0, 0, -removeAfterDays)}}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveRollupsOlderThan deletes rollups older than the given number of days
+func RemoveRollupsOlderThan(removeAfterDays int, mgoRepo *MongoRepository, errs chan error) {
+	err := DeleteRollupsOlderThan(removeAfterDays, mgoRepo)
+	if err != nil {
+		select {
+		case errs <- fmt.Errorf("Could not delete old rollups (%v)", err):
+		default:
+		}
+		return
+	}
+}
+
+func upsertRollup(mgoRepo *MongoRepository, rollup model.ServiceRollup) error {
+	collection := mgoRepo.Db().C(constants.RollupsCollection)
+
+	// the key matches the unique index exactly, so a rollup without a cluster never replaces one of a cluster
+	key := bson.M{"namespace": rollup.Namespace, "service": rollup.Service, "cluster": bson.M{"$exists": false}, "period": rollup.Period, "periodStart": rollup.PeriodStart}
+	if rollup.Cluster != "" {
+		key["cluster"] = rollup.Cluster
+	}
+	_, err := collection.Upsert(key, rollup)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upsert %s rollup for service %s in namespace %s", rollup.Period, rollup.Service, rollup.Namespace)
+	}
+	return nil
+}
+
+// summariseChecks builds a ServiceRollup from health check responses for a single Service sorted by CheckTime
+func summariseChecks(key model.ServicesStateKey, checks []model.ServiceStatus, period string, periodStart, periodEnd time.Time, maxCheckGap time.Duration) model.ServiceRollup {
+	rollup := model.ServiceRollup{
+		Namespace:      key.Namespace,
+		Service:        key.Service,
+		Cluster:        key.Cluster,
+		Period:         period,
+		PeriodStart:    periodStart,
+		PeriodEnd:      periodEnd,
+		Checks:         len(checks),
+		SecondsInState: map[string]float64{},
+	}
+
+	failures := make(map[string]int)
+	for i, c := range checks {
+		// a check result holds until the next check, the end of the period or the maximum gap - whichever is first
+		until := periodEnd
+		if i+1 < len(checks) {
+			until = checks[i+1].CheckTime
+		}
+		if maxUntil := c.CheckTime.Add(maxCheckGap); until.After(maxUntil) {
+			until = maxUntil
+		}
+		if until.After(c.CheckTime) {
+			rollup.SecondsInState[c.AggregatedState] += until.Sub(c.CheckTime).Seconds()
+		}
+
+		if i > 0 && checks[i-1].AggregatedState != c.AggregatedState {
+			rollup.Transitions++
+		}
+
+		if i == 0 || c.HealthyPods < rollup.MinHealthyPods {
+			rollup.MinHealthyPods = c.HealthyPods
+		}
+		if c.HealthyPods > rollup.MaxHealthyPods {
+			rollup.MaxHealthyPods = c.HealthyPods
+		}
+
+		for _, podCheck := range c.PodChecks {
+			for _, chk := range podCheck.Body.Checks {
+				if chk.Health != constants.Healthy {
+					failures[chk.Name]++
+				}
+			}
+		}
+	}
+
+	rollup.TopFailingChecks = topFailingChecks(failures)
+
+	return rollup
+}
+
+// mergeRollups combines rollups for a single Service sorted by PeriodStart into a single rollup covering a longer period
+func mergeRollups(key model.ServicesStateKey, rollups []model.ServiceRollup, period string, periodStart, periodEnd time.Time) model.ServiceRollup {
+	merged := model.ServiceRollup{
+		Namespace:      key.Namespace,
+		Service:        key.Service,
+		Cluster:        key.Cluster,
+		Period:         period,
+		PeriodStart:    periodStart,
+		PeriodEnd:      periodEnd,
+		SecondsInState: map[string]float64{},
+	}
+
+	failures := make(map[string]int)
+	for i, r := range rollups {
+		merged.Checks += r.Checks
+		merged.Transitions += r.Transitions
+		for state, seconds := range r.SecondsInState {
+			merged.SecondsInState[state] += seconds
+		}
+		if i == 0 || r.MinHealthyPods < merged.MinHealthyPods {
+			merged.MinHealthyPods = r.MinHealthyPods
+		}
+		if r.MaxHealthyPods > merged.MaxHealthyPods {
+			merged.MaxHealthyPods = r.MaxHealthyPods
+		}
+		for _, f := range r.TopFailingChecks {
+			failures[f.Name] += f.Failures
+		}
+	}
+
+	merged.TopFailingChecks = topFailingChecks(failures)
+
+	return merged
+}
+
+func topFailingChecks(failures map[string]int) []model.FailingCheck {
+	failing := []model.FailingCheck{}
+	for name, count := range failures {
+		failing = append(failing, model.FailingCheck{Name: name, Failures: count})
+	}
+
+	sort.Slice(failing, func(i, j int) bool {
+		if failing[i].Failures == failing[j].Failures {
+			return failing[i].Name < failing[j].Name
+		}
+		return failing[i].Failures > failing[j].Failures
+	})
+
+	if len(failing) > rollupTopFailingChecks {
+		failing = failing[:rollupTopFailingChecks]
+	}
+	return failing
+}
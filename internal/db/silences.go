@@ -0,0 +1,172 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// silencesRefreshInterval determines how often active silences are reloaded while persisting health check responses
+const silencesRefreshInterval = 30 * time.Second
+
+// InsertSilence validates and stores a new Silence, returning it with its generated ID
+func InsertSilence(mgoRepo *MongoRepository, silence model.Silence) (model.Silence, error) {
+	if silence.Cluster == "" && silence.Namespace == "" && silence.Service == "" && silence.Check == "" {
+		return silence, errors.New("a silence must match on at least one of cluster, namespace, service or check")
+	}
+	if silence.CreatedBy == "" {
+		return silence, errors.New("a silence must include createdBy")
+	}
+	now := time.Now().UTC()
+	if !silence.ExpiresAt.After(now) {
+		return silence, errors.New("a silence must expire in the future")
+	}
+
+	silence.ID = uuid.New().String()
+	silence.CreatedAt = now
+	silence.ExpiresAt = silence.ExpiresAt.UTC()
+
+	collection := mgoRepo.Db().C(constants.SilencesCollection)
+	if err := collection.Insert(silence); err != nil {
+		return silence, errors.Wrap(err, "failed to insert silence")
+	}
+
+	return silence, nil
+}
+
+// ExpireSilence ends the Silence with the given ID immediately, returning ErrNotFound if it does not exist
+func ExpireSilence(mgoRepo *MongoRepository, id string) error {
+	collection := mgoRepo.Db().C(constants.SilencesCollection)
+
+	if err := collection.UpdateId(id, bson.M{"$set": bson.M{"expiresAt": time.Now().UTC()}}); err != nil {
+		if err == ErrNotFound {
+			return err
+		}
+		return errors.Wrapf(err, "failed to expire silence %s", id)
+	}
+	return nil
+}
+
+// FindActiveSilences returns all silences which have not yet expired, including those set on Services via the
+// uw.health.aggregator.silence-until annotation
+func FindActiveSilences(mgoRepo *MongoRepository) ([]model.Silence, error) {
+	now := time.Now().UTC()
+
+	var silences []model.Silence
+	if err := mgoRepo.Db().C(constants.SilencesCollection).Find(bson.M{"expiresAt": bson.M{"$gt": now}}).Sort("expiresAt").All(&silences); err != nil {
+		return nil, errors.Wrap(err, "failed to get active silences")
+	}
+
+	var services []model.Service
+	if err := mgoRepo.Db().C(constants.ServicesCollection).Find(bson.M{"healthAnnotations.silenceUntil": bson.M{"$gt": ""}}).All(&services); err != nil {
+		return nil, errors.Wrap(err, "failed to get services with silence annotations")
+	}
+
+	for _, svc := range services {
+		until, err := time.Parse(time.RFC3339, svc.HealthAnnotations.SilenceUntil)
+		if err != nil || !until.After(now) {
+			continue
+		}
+		silences = append(silences, model.Silence{
+			ID:        annotationSilenceID(svc),
+			Cluster:   svc.Cluster,
+			Namespace: svc.Namespace,
+			Service:   svc.Name,
+			CreatedBy: "uw.health.aggregator.silence-until",
+			ExpiresAt: until.UTC(),
+		})
+	}
+
+	if silences == nil {
+		silences = []model.Silence{}
+	}
+
+	return silences, nil
+}
+
+func annotationSilenceID(svc model.Service) string {
+	if svc.Cluster == "" {
+		return fmt.Sprintf("annotation/%s/%s", svc.Namespace, svc.Name)
+	}
+	return fmt.Sprintf("annotation/%s/%s/%s", svc.Cluster, svc.Namespace, svc.Name)
+}
+
+// isSilenced reports whether a ServiceStatus is covered by any of the given silences or by the silence-until
+// annotation on its Service
+func isSilenced(status model.ServiceStatus, silences []model.Silence, now time.Time) bool {
+	if until, err := time.Parse(time.RFC3339, status.Service.HealthAnnotations.SilenceUntil); err == nil && now.Before(until) {
+		return true
+	}
+
+	silencedChecks := make(map[string]bool)
+	for _, s := range silences {
+		if !now.Before(s.ExpiresAt) {
+			continue
+		}
+		if s.Cluster != "" && s.Cluster != status.Service.Cluster {
+			continue
+		}
+		if s.Namespace != "" && s.Namespace != status.Service.Namespace {
+			continue
+		}
+		if s.Service != "" && s.Service != status.Service.Name {
+			continue
+		}
+		if s.Check == "" {
+			return true
+		}
+		silencedChecks[s.Check] = true
+	}
+
+	if len(silencedChecks) == 0 {
+		return false
+	}
+
+	// a check level silence only applies if every failing check is silenced
+	failing := 0
+	for _, podCheck := range status.PodChecks {
+		for _, chk := range podCheck.Body.Checks {
+			if chk.Health == constants.Healthy {
+				continue
+			}
+			if !silencedChecks[chk.Name] {
+				return false
+			}
+			failing++
+		}
+	}
+	return failing > 0
+}
+
+// activeSilences caches the active silences, reloading them at most every silencesRefreshInterval
+type activeSilences struct {
+	repo        *MongoRepository
+	silences    []model.Silence
+	refreshedAt time.Time
+}
+
+func newActiveSilences(repo *MongoRepository) *activeSilences {
+	return &activeSilences{repo: repo}
+}
+
+func (a *activeSilences) get() []model.Silence {
+	if time.Since(a.refreshedAt) < silencesRefreshInterval {
+		return a.silences
+	}
+
+	silences, err := FindActiveSilences(a.repo)
+	if err != nil {
+		log.WithError(err).Error("failed to refresh active silences")
+		return a.silences
+	}
+
+	a.silences = silences
+	a.refreshedAt = time.Now()
+	return a.silences
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// StorageOptions determines how health check responses are persisted by InsertHealthcheckResponses
+type StorageOptions struct {
+	// Mode is either constants.StorageModeFull (every response is stored) or constants.StorageModeTransitions
+	// (only the current status and state transitions are stored, plus periodic snapshots)
+	Mode string
+	// SnapshotInterval is the minimum time between full responses being stored for a Service in
+	// constants.StorageModeTransitions
+	SnapshotInterval time.Duration
+	// Transitions, when set, receives every change in the aggregated state of a Service once it has been persisted,
+	// e.g. to be notified. Transitions are dropped if the channel is full
+	Transitions chan model.ServiceStatus
+	// Reassigned, when set, receives a value whenever Services may have been persisted by another replica since they
+	// were last persisted here, so that the cached state of every Service is read again
+	Reassigned <-chan struct{}
+}
+
+// maxCheckGap returns how long a stored response can be assumed to hold for, given how often responses are stored
+func (o StorageOptions) maxCheckGap() time.Duration {
+	if o.Mode == constants.StorageModeTransitions && o.SnapshotInterval+time.Minute > rollupMaxCheckGap {
+		return o.SnapshotInterval + time.Minute
+	}
+	return rollupMaxCheckGap
+}
+
+// serviceState is the subset of the last known ServiceStatus required to persist the next response for a Service
+type serviceState struct {
+	AggregatedState string
+	StateSince      time.Time
+	PreviousState   string
+	LastSnapshot    time.Time
+	// seen is when the state was last set, so that Services which are no longer checked here can be evicted
+	seen time.Time
+}
+
+// serviceStateTTL is how long the state of a Service which is not checked is cached for, after which it is read again
+// from mongo if the Service is checked once more
+const serviceStateTTL = time.Hour
+
+// serviceStates caches the last known state of each Service so that the previous response does not need to be
+// read back from mongo each time a new response is persisted
+type serviceStates struct {
+	repo   *MongoRepository
+	states map[model.ServicesStateKey]serviceState
+}
+
+func newServiceStates(repo *MongoRepository) *serviceStates {
+	return &serviceStates{repo: repo, states: make(map[model.ServicesStateKey]serviceState)}
+}
+
+// get returns the cached state for a Service, loading it from the current status collection the first time
+// the Service is seen, and falling back to the latest stored response
+func (s *serviceStates) get(key model.ServicesStateKey) serviceState {
+	if state, ok := s.states[key]; ok {
+		return state
+	}
+
+	query := ofCluster(bson.M{"service.namespace": key.Namespace, "service.name": key.Service}, "service.cluster", key.Cluster)
+
+	var prev model.ServiceStatus
+	err := s.repo.Db().C(constants.StatusCollection).Find(query).One(&prev)
+	if err == mgo.ErrNotFound {
+		err = s.repo.Db().C(constants.HealthchecksCollection).Find(query).Sort("-checkTime").Limit(1).One(&prev)
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		log.WithError(err).WithFields(log.Fields{
+			"service":   key.Service,
+			"namespace": key.Namespace,
+		}).Error("failed to get previous healthcheck response")
+	}
+
+	state := serviceState{
+		AggregatedState: prev.AggregatedState,
+		StateSince:      prev.StateSince,
+		PreviousState:   prev.PreviousState,
+	}
+	s.states[key] = state
+	return state
+}
+
+func (s *serviceStates) set(key model.ServicesStateKey, state serviceState) {
+	state.seen = time.Now()
+	s.states[key] = state
+}
+
+// evict removes the states not set since the given time, e.g. of Services deleted from k8s or checked by another
+// replica, so that the cache does not grow with every Service ever checked
+func (s *serviceStates) evict(notSeenSince time.Time) {
+	for key, state := range s.states {
+		if state.seen.Before(notSeenSince) {
+			delete(s.states, key)
+		}
+	}
+}
+
+func upsertCurrentStatus(mgoRepo *MongoRepository, status model.ServiceStatus) error {
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	_, err := collection.Upsert(ofCluster(bson.M{"service.namespace": status.Service.Namespace, "service.name": status.Service.Name}, "service.cluster", status.Service.Cluster), status)
+	return err
+}
+
+// RemoveStatusesOfServices deletes the current status of each of the given Services checked by this instance, e.g. once
+// they are deleted from k8s. Statuses pulled from federation sources are removed by the federation instead
+func RemoveStatusesOfServices(mgoRepo *MongoRepository, services []model.Service) error {
+	if len(services) == 0 {
+		return nil
+	}
+
+	var matchers []bson.M
+	for _, svc := range services {
+		matchers = append(matchers, ofCluster(bson.M{"service.namespace": svc.Namespace, "service.name": svc.Name}, "service.cluster", svc.Cluster))
+	}
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+	if _, err := collection.RemoveAll(bson.M{"source": bson.M{"$exists": false}, "$or": matchers}); err != nil {
+		return fmt.Errorf("failed to remove the statuses of %d services, err: %v", len(services), err)
+	}
+	return nil
+}
+
+// MarkStaleStatuses marks the statuses of Services checked by this instance which were last checked before staleBefore
+// as stale, as their checks have stopped. A status is no longer stale once its Service is checked again
+func MarkStaleStatuses(mgoRepo *MongoRepository, staleBefore time.Time) error {
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+
+	if _, err := collection.UpdateAll(bson.M{"source": bson.M{"$exists": false}, "checkTime": bson.M{"$lt": staleBefore}, "stale": bson.M{"$ne": true}}, bson.M{"$set": bson.M{"stale": true}}); err != nil {
+		return fmt.Errorf("failed to mark statuses checked before %v as stale, err: %v", staleBefore, err)
+	}
+	return nil
+}
+
+func insertTransition(mgoRepo *MongoRepository, from string, status model.ServiceStatus) error {
+	collection := mgoRepo.Db().C(constants.TransitionsCollection)
+
+	return collection.Insert(model.StateTransition{
+		Namespace:   status.Service.Namespace,
+		Service:     status.Service.Name,
+		Cluster:     status.Service.Cluster,
+		Time:        status.CheckTime,
+		From:        from,
+		To:          status.AggregatedState,
+		HealthyPods: status.HealthyPods,
+		Error:       status.Error,
+	})
+}
+
+// DeleteTransitionsOlderThan deletes state transitions older than the given number of days
+func DeleteTransitionsOlderThan(removeAfterDays int, mgoRepo *MongoRepository) error {
+
+	collection := mgoRepo.Db().C(constants.TransitionsCollection)
+
+	if _, err := collection.RemoveAll(bson.M{"time": bson.M{"$lt": time.Now().AddDate(0, 0, -removeAfterDays)}}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RemoveTransitionsOlderThan deletes state transitions older than the given number of days, sending any error to a
+// channel of type error
+func RemoveTransitionsOlderThan(removeAfterDays int, mgoRepo *MongoRepository, errs chan error) {
+	err := DeleteTransitionsOlderThan(removeAfterDays, mgoRepo)
+	if err != nil {
+		select {
+		case errs <- fmt.Errorf("Could not delete old transitions (%v)", err):
+		default:
+		}
+		return
+	}
+}
+
+// BackfillCurrentStatuses inserts the current status of each Service from its latest stored health check response
+// when the current status collection is empty, i.e. for responses stored before it existed. Once any status is stored
+// the current status of each Service is kept up to date as it is checked, so nothing is backfilled
+func BackfillCurrentStatuses(mgoRepo *MongoRepository) (int, error) {
+
+	collection := mgoRepo.Db().C(constants.StatusCollection)
+	count, err := collection.Count()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count current statuses, err: %v", err)
+	}
+	if count > 0 {
+		return 0, nil
+	}
+
+	var latest []struct {
+		Status model.ServiceStatus `bson:"status"`
+	}
+	pipeline := []bson.M{
+		{"$sort": bson.M{"checkTime": -1}},
+		{"$group": bson.M{
+			"_id":    bson.M{"namespace": "$service.namespace", "name": "$service.name", "cluster": "$service.cluster"},
+			"status": bson.M{"$first": "$$ROOT"},
+		}},
+	}
+	if err := mgoRepo.Db().C(constants.HealthchecksCollection).Pipe(pipeline).AllowDiskUse().All(&latest); err != nil {
+		return 0, fmt.Errorf("failed to get latest healthcheck responses, err: %v", err)
+	}
+
+	backfilled := 0
+	for _, l := range latest {
+		// another replica may have inserted the status since
+		if err := collection.Insert(l.Status); err != nil && !mgo.IsDup(err) {
+			return backfilled, fmt.Errorf("failed to backfill current status of service %v in namespace %v, err: %v", l.Status.Service.Name, l.Status.Service.Namespace, err)
+		}
+		backfilled++
+	}
+	return backfilled, nil
+}
+
+// FindTransitionsForService returns the last 50 state transitions for a given Service and Namespace string in
+// Time descending order, in the given cluster or in any cluster if empty
+func FindTransitionsForService(mgoRepo *MongoRepository, cluster string, n string, s string) ([]model.StateTransition, error) {
+
+	collection := mgoRepo.Db().C(constants.TransitionsCollection)
+
+	var transitions []model.StateTransition
+	if err := collection.Find(inCluster(bson.M{"namespace": n, "service": s}, "cluster", cluster)).Limit(50).Sort("-time").All(&transitions); err != nil {
+		return nil, fmt.Errorf("failed to get state transitions for service %v in namespace %v", s, n)
+	}
+
+	if transitions == nil {
+		transitions = []model.StateTransition{}
+	}
+
+	return transitions, nil
+}
@@ -1,17 +1,24 @@
 package discovery
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
 	"github.com/utilitywarehouse/health-aggregator/internal/constants"
 	"github.com/utilitywarehouse/health-aggregator/internal/db"
 	"github.com/utilitywarehouse/health-aggregator/internal/model"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	watch "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
@@ -19,6 +26,9 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// maxConcurrentReloads is the number of reloads of a cluster or newly selected Namespace run at once
+const maxConcurrentReloads = 5
+
 // KubeDiscoveryService is responsible for Kubernetes Namespace, Service and Deployment discovery
 type KubeDiscoveryService struct {
 	K8sClient      kubernetes.Interface
@@ -28,6 +38,21 @@ type KubeDiscoveryService struct {
 	ServicesState  map[model.ServicesStateKey]model.Service
 	UpdatesQueue   chan model.UpdateItem
 	Errors         chan error
+	// Cluster is the name of the cluster K8sClient connects to, set on everything discovered. It is empty when a
+	// single cluster is watched
+	Cluster string
+	// Config provides the default annotations and namespace rules, the built in defaults are used if nil
+	Config *config.Store
+	// Selector determines which Namespaces are discovered, all Namespaces are selected if empty
+	Selector NamespaceSelector
+
+	// stateMu guards ServicesState, which is updated by a watcher per namespace
+	stateMu sync.Mutex
+	// namespaceReloads receives Namespaces which have just been selected, to be reloaded without waiting for the
+	// next full reload
+	namespaceReloads chan string
+	selectedMu       sync.Mutex
+	selected         map[string]bool
 }
 
 // NewKubeDiscoveryService created a new
@@ -36,130 +61,202 @@ func NewKubeDiscoveryService(kubeClient kubernetes.Interface, state map[model.Se
 	services := make(chan model.Service, 10)
 	watchEvents := make(chan model.UpdateItem, 10)
 	return &KubeDiscoveryService{
-		K8sClient:      kubeClient,
-		K8sWatchEvents: watchEvents,
-		Namespaces:     namespaces,
-		Services:       services,
-		ServicesState:  state,
-		UpdatesQueue:   updatesQueue,
-		Errors:         errs,
+		K8sClient:        kubeClient,
+		K8sWatchEvents:   watchEvents,
+		Namespaces:       namespaces,
+		Services:         services,
+		ServicesState:    state,
+		UpdatesQueue:     updatesQueue,
+		Errors:           errs,
+		namespaceReloads: make(chan string, 100),
 	}
 }
 
 // ReloadServiceConfigs gets the latest Namespace and Service configs from k8s and
-// persists them
-func (d *KubeDiscoveryService) ReloadServiceConfigs(reloadQueue chan uuid.UUID, mgoRepo *db.MongoRepository) {
-
-	for reqID := range reloadQueue {
-
-		log.Infof("reloading k8s configs for request %v", reqID.String())
-		go func(errs chan error) {
-			for e := range errs {
-				log.Printf("ERROR: %v", e)
-			}
-		}(d.Errors)
-
-		servicesUpdater := db.NewK8sServicesConfigUpdater(d.Services, mgoRepo.WithNewSession())
-		namespacesUpdater := db.NewK8sNamespacesConfigUpdater(d.Namespaces, mgoRepo.WithNewSession())
-
-		go func() {
-			namespacesUpdater.UpsertNamespaceConfigs()
-		}()
-
+// persists them. It returns once ctx is cancelled and any in-progress reload has been persisted
+func (d *KubeDiscoveryService) ReloadServiceConfigs(ctx context.Context, reloadQueue chan uuid.UUID, mgoRepo *db.MongoRepository) {
+
+	servicesUpdater := db.NewK8sServicesConfigUpdater(d.Services, mgoRepo.WithNewSession())
+	namespacesUpdater := db.NewK8sNamespacesConfigUpdater(d.Namespaces, mgoRepo.WithNewSession())
+
+	var updaters sync.WaitGroup
+	updaters.Add(2)
+	go func() {
+		defer updaters.Done()
+		namespacesUpdater.UpsertNamespaceConfigs()
+	}()
+	go func() {
+		defer updaters.Done()
+		servicesUpdater.UpsertServiceConfigs()
+	}()
+
+	// reloads are bounded, so that selecting many namespaces at once does not start a goroutine for each of them
+	var reloads sync.WaitGroup
+	slots := make(chan struct{}, maxConcurrentReloads)
+	reload := func(fn func()) {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		reloads.Add(1)
 		go func() {
-			servicesUpdater.UpsertServiceConfigs()
+			defer reloads.Done()
+			defer func() { <-slots }()
+			fn()
 		}()
+	}
 
-		go func() {
-			d.GetClusterHealthcheckConfig()
-		}()
+	for {
+		select {
+		case <-ctx.Done():
+			// the updaters return once the channels are closed and everything already discovered is persisted
+			reloads.Wait()
+			close(d.Namespaces)
+			close(d.Services)
+			updaters.Wait()
+			return
+		case reqID := <-reloadQueue:
+			log.Infof("reloading k8s configs for request %v", reqID.String())
+			reload(func() { d.GetClusterHealthcheckConfig(ctx) })
+		case namespace := <-d.namespaceReloads:
+			log.Infof("reloading k8s configs for newly selected namespace %s", namespace)
+			reload(func() { d.reloadNamespace(ctx, namespace) })
+		}
 	}
 }
 
-// UpdateDeployments processes model.UpdateItem before adding them to the UpdatesQueue
-func (d *KubeDiscoveryService) UpdateDeployments() {
+// UpdateDeployments processes model.UpdateItem before adding them to the UpdatesQueue until ctx is cancelled
+func (d *KubeDiscoveryService) UpdateDeployments(ctx context.Context) {
 
-	for watchEvent := range d.K8sWatchEvents {
-		if watchEvent.Type == string(watch.Error) {
-			log.Errorf("k8s watch event returned error")
-			continue
-		}
-		switch v := watchEvent.Object.(type) {
-		case model.Deployment:
-			d.UpdatesQueue <- model.UpdateItem{Type: watchEvent.Type, Object: v}
-		default:
-			log.Debugf("unsupported type %T!\n", v)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case watchEvent := <-d.K8sWatchEvents:
+			if watchEvent.Type == string(watch.Error) {
+				log.Errorf("k8s watch event returned error")
+				continue
+			}
+			switch v := watchEvent.Object.(type) {
+			case model.Deployment:
+				select {
+				case d.UpdatesQueue <- model.UpdateItem{Type: watchEvent.Type, Object: v}:
+				case <-ctx.Done():
+					return
+				}
+			default:
+				log.Debugf("unsupported type %T!\n", v)
+			}
 		}
 	}
 }
 
-// WatchDeployments sets up Kubernetes API watchers which listen for changes to objects within a
-// list of provided namespaces
-func (d *KubeDiscoveryService) WatchDeployments(namespaces []string) {
-
-	go d.UpdateDeployments()
+func (d *KubeDiscoveryService) watchDeployments(ctx context.Context, watcher watch.Interface) {
+	defer watcher.Stop()
 
-	for _, namespace := range namespaces {
+	for {
+		var event watch.Event
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-watcher.ResultChan():
+			if !ok {
+				return
+			}
+			event = e
+		}
 
-		watcher, err := d.K8sClient.AppsV1().Deployments(namespace).Watch(metav1.ListOptions{ResourceVersion: "0"})
-		if err != nil {
-			panic(err)
+		// an error, e.g. when the resource version is too old, ends the watch so that it is re-established
+		if event.Type == watch.Error {
+			log.Errorf("deployment watch error: %v", apierrors.FromObject(event.Object))
+			return
+		}
+		k8sDeployment, ok := event.Object.(*appsv1.Deployment)
+		if !ok {
+			log.Debugf("unsupported type %T in deployment watch", event.Object)
+			continue
 		}
-		log.Debugf("watching deployments for namespace %s", namespace)
 
-		for event := range watcher.ResultChan() {
-			k8sDeployment, ok := event.Object.(*appsv1.Deployment)
-			if !ok {
-				log.Fatal("unexpected type")
-			}
+		log.Debugf("received event of type %s for service %s in namespace %s", string(event.Type), k8sDeployment.Spec.Template.Labels["app"], k8sDeployment.Namespace)
 
-			log.Debugf("received event of type %s for service %s in namespace %s", string(event.Type), k8sDeployment.Spec.Template.Labels["app"], k8sDeployment.Namespace)
+		var deployment model.Deployment
+		deployment.Namespace = k8sDeployment.Namespace
+		deployment.Cluster = d.Cluster
+		deployment.Service = k8sDeployment.Spec.Template.Labels["app"]
+		deployment.DesiredReplicas = *k8sDeployment.Spec.Replicas
 
-			var deployment model.Deployment
-			deployment.Namespace = k8sDeployment.Namespace
-			deployment.Service = k8sDeployment.Spec.Template.Labels["app"]
-			deployment.DesiredReplicas = *k8sDeployment.Spec.Replicas
+		servicesStateKey := model.ServicesStateKey{Cluster: deployment.Cluster, Namespace: deployment.Namespace, Service: deployment.Service}
 
-			servicesStateKey := model.ServicesStateKey{Namespace: deployment.Namespace, Service: deployment.Service}
+		log.WithFields(log.Fields{
+			"service":   deployment.Service,
+			"namespace": deployment.Namespace,
+		}).Debugf("searching for service in state object with key: %+v", servicesStateKey)
 
+		d.stateMu.Lock()
+		serviceState, exists := d.ServicesState[servicesStateKey]
+		changed := exists && serviceState.Deployment.DesiredReplicas != deployment.DesiredReplicas
+		if changed {
+			serviceState.Deployment.DesiredReplicas = deployment.DesiredReplicas
+			d.ServicesState[servicesStateKey] = serviceState
+		}
+		d.stateMu.Unlock()
+
+		if exists {
 			log.WithFields(log.Fields{
 				"service":   deployment.Service,
 				"namespace": deployment.Namespace,
-			}).Debugf("searching for service in state object with key: %+v", servicesStateKey)
-
-			_, exists := d.ServicesState[servicesStateKey]
-
-			if exists {
+			}).Debug("found service in state object")
+			if changed {
 				log.WithFields(log.Fields{
 					"service":   deployment.Service,
 					"namespace": deployment.Namespace,
-				}).Debug("found service in state object")
-				serviceState := d.ServicesState[servicesStateKey]
-				if serviceState.Deployment.DesiredReplicas != deployment.DesiredReplicas {
-					log.WithFields(log.Fields{
-						"service":   deployment.Service,
-						"namespace": deployment.Namespace,
-					}).Debugf("event of type %s received - service state updated (change in deployment)", string(event.Type))
-					serviceState.Deployment.DesiredReplicas = deployment.DesiredReplicas
-					d.ServicesState[servicesStateKey] = serviceState
-					d.K8sWatchEvents <- model.UpdateItem{Type: string(event.Type), Object: deployment}
-					continue
+				}).Debugf("event of type %s received - service state updated (change in deployment)", string(event.Type))
+				select {
+				case d.K8sWatchEvents <- model.UpdateItem{Type: string(event.Type), Object: deployment}:
+				case <-ctx.Done():
+					return
 				}
-				log.WithFields(log.Fields{
-					"service":   deployment.Service,
-					"namespace": deployment.Namespace,
-				}).Debugf("event of type %s received - service state unchanged (no change in deployment)", string(event.Type))
 				continue
 			}
 			log.WithFields(log.Fields{
 				"service":   deployment.Service,
 				"namespace": deployment.Namespace,
-			}).Debug("service not found service in state object")
+			}).Debugf("event of type %s received - service state unchanged (no change in deployment)", string(event.Type))
+			continue
+		}
+		log.WithFields(log.Fields{
+			"service":   deployment.Service,
+			"namespace": deployment.Namespace,
+		}).Debug("service not found service in state object")
 
-			// TODO it's service we don't know about (probably new) and we need to do something about that
+		// TODO it's service we don't know about (probably new) and we need to do something about that
+	}
+}
+
+// NewKubeClientForCluster returns a KubeClient for a configured cluster, using either the in cluster config or a
+// context from a kubeconfig file. The kubeconfig file of the cluster takes precedence over kubeConfigPath
+func NewKubeClientForCluster(cluster config.Cluster, kubeConfigPath string) (*kubernetes.Clientset, error) {
 
+	var restConfig *rest.Config
+	var err error
+	if cluster.InCluster {
+		restConfig, err = rest.InClusterConfig()
+	} else {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if cluster.KubeConfig != "" {
+			rules.ExplicitPath = cluster.KubeConfig
+		} else if kubeConfigPath != "" {
+			rules.ExplicitPath = kubeConfigPath
 		}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: cluster.Context}
+		restConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client for cluster %s: %v", cluster.Name, err)
 	}
+
+	return kubernetes.NewForConfig(restConfig)
 }
 
 // NewKubeClient returns a KubeClient for in cluster or out of cluster operation depending on whether or
@@ -186,12 +283,17 @@ func NewKubeClient(kubeConfigPath string) *kubernetes.Clientset {
 }
 
 // GetClusterHealthcheckConfig method retrieves Namespace and Service annotations specific to health aggregator
-func (d *KubeDiscoveryService) GetClusterHealthcheckConfig() {
+// The selected Namespaces and their Services are sent to the Namespaces and Services channels, stopping early if ctx
+// is cancelled
+func (d *KubeDiscoveryService) GetClusterHealthcheckConfig(ctx context.Context) {
 
 	log.Info("loading namespace and service annotations")
-	defaultAnnotations := model.HealthAnnotations{EnableScrape: constants.DefaultEnableScrape, Port: constants.DefaultPort}
 
-	namespaces, err := d.K8sClient.CoreV1().Namespaces().List(metav1.ListOptions{})
+	// the client-go version in use does not accept a context, so cancellation is checked between calls
+	if ctx.Err() != nil {
+		return
+	}
+	namespaces, err := d.K8sClient.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: d.Selector.labelSelector()})
 	if err != nil {
 		select {
 		case d.Errors <- fmt.Errorf("Could not get namespaces via kubernetes api 1: (%v)", err):
@@ -200,74 +302,113 @@ func (d *KubeDiscoveryService) GetClusterHealthcheckConfig() {
 		return
 	}
 
+	cfg := d.config()
 	for _, n := range namespaces.Items {
-		namespaceAnnotations, err := getHealthAnnotations(n)
-		if err != nil {
-			select {
-			case d.Errors <- fmt.Errorf("Could not get namespace annotations via kubernetes api 2: (%v)", err):
-			default:
-			}
+		if !d.Selector.Matches(n) {
+			log.Debugf("namespace %s is not selected", n.Name)
+			continue
+		}
+		if !d.discoverNamespace(ctx, n, cfg) {
 			return
 		}
+	}
+}
 
-		namespaceAnnotations = overrideParentAnnotations(namespaceAnnotations, defaultAnnotations)
+// discoverNamespace sends a Namespace and its Services to the Namespaces and Services channels, returning false if
+// discovery should stop
+func (d *KubeDiscoveryService) discoverNamespace(ctx context.Context, n corev1.Namespace, cfg config.Config) bool {
+	defaultAnnotations := cfg.Defaults.Annotations()
 
-		d.Namespaces <- model.Namespace{
-			Name:              n.Name,
-			HealthAnnotations: namespaceAnnotations,
+	rule, _ := cfg.NamespaceRule(n.Name)
+	if rule.Exclude {
+		log.Debugf("namespace %s is excluded by namespace rule %q", n.Name, rule.Match)
+		return true
+	}
+
+	namespaceAnnotations, err := getHealthAnnotations(n)
+	if err != nil {
+		select {
+		case d.Errors <- fmt.Errorf("Could not get namespace annotations via kubernetes api 2: (%v)", err):
+		default:
 		}
+		return false
+	}
 
-		log.Debugf("Added namespace %v to channel\n", n.Name)
+	namespaceAnnotations = overrideParentAnnotations(namespaceAnnotations, overrideParentAnnotations(rule.Defaults.Annotations(), defaultAnnotations))
 
-		services, err := d.K8sClient.CoreV1().Services(n.Name).List(metav1.ListOptions{})
-		if err != nil {
-			select {
-			case d.Errors <- fmt.Errorf("Could not get services via kubernetes api: (%v)", err):
-			default:
-			}
-			return
-		}
+	select {
+	case d.Namespaces <- model.Namespace{
+		Name:              n.Name,
+		Cluster:           d.Cluster,
+		HealthAnnotations: namespaceAnnotations,
+	}:
+	case <-ctx.Done():
+		return false
+	}
 
-		// exclude those services where no pods are intended to run
-		deployments, depErr := d.getDeployments(n.Name)
-		if depErr != nil {
-			log.Errorf("Failed getting deployments, err: %v", depErr)
+	log.Debugf("Added namespace %v to channel\n", n.Name)
+
+	services, err := d.K8sClient.CoreV1().Services(n.Name).List(metav1.ListOptions{})
+	if err != nil {
+		select {
+		case d.Errors <- fmt.Errorf("Could not get services via kubernetes api: (%v)", err):
+		default:
 		}
+		return false
+	}
 
-		for _, svc := range services.Items {
+	// exclude those services where no pods are intended to run
+	deployments, depErr := d.getDeployments(n.Name)
+	if depErr != nil {
+		log.Errorf("Failed getting deployments, err: %v", depErr)
+	}
 
-			if _, exists := deployments[svc.Name]; !exists {
-				log.Debugf("cannot find deployment for service with name %s", svc.Name)
-				continue
-			}
+	for _, svc := range services.Items {
 
-			serviceAnnotations, err := getHealthAnnotations(svc)
-			if err != nil {
-				select {
-				case d.Errors <- fmt.Errorf("Could not get service annotations via kubernetes api: (%v)", err):
-				default:
-				}
-				continue
-			}
-			serviceAnnotations = overrideParentAnnotations(serviceAnnotations, namespaceAnnotations)
+		if _, exists := deployments[svc.Name]; !exists {
+			log.Debugf("cannot find deployment for service with name %s", svc.Name)
+			continue
+		}
 
-			appPort, err := getAppPortForService(&svc, serviceAnnotations.Port)
-			if err != nil {
-				log.Errorf("failed to get app port for service %s, err: %v", svc.Name, err)
-				continue
+		serviceAnnotations, err := getHealthAnnotations(svc)
+		if err != nil {
+			select {
+			case d.Errors <- fmt.Errorf("Could not get service annotations via kubernetes api: (%v)", err):
+			default:
 			}
+			continue
+		}
+		serviceAnnotations = overrideParentAnnotations(serviceAnnotations, namespaceAnnotations)
 
-			d.Services <- model.Service{
-				Name:              svc.Name,
-				Namespace:         n.Name,
-				HealthcheckURL:    fmt.Sprintf("http://%s.%s:%s/__/health", svc.Name, n.Name, serviceAnnotations.Port),
-				HealthAnnotations: serviceAnnotations,
-				AppPort:           appPort,
-				Deployment:        deployments[svc.Name],
-			}
-			log.Debugf("Added service %v to channel\n", svc.Name)
+		appPort, err := getAppPortForService(&svc, serviceAnnotations.Port)
+		if err != nil {
+			log.Errorf("failed to get app port for service %s, err: %v", svc.Name, err)
+			continue
+		}
+
+		select {
+		case d.Services <- model.Service{
+			Name:              svc.Name,
+			Namespace:         n.Name,
+			Cluster:           d.Cluster,
+			HealthcheckURL:    fmt.Sprintf("http://%s.%s:%s%s", svc.Name, n.Name, serviceAnnotations.Port, serviceAnnotations.Path),
+			HealthAnnotations: serviceAnnotations,
+			AppPort:           appPort,
+			Deployment:        deployments[svc.Name],
+		}:
+		case <-ctx.Done():
+			return false
 		}
+		log.Debugf("Added service %v to channel\n", svc.Name)
 	}
+	return true
+}
+
+func (d *KubeDiscoveryService) config() config.Config {
+	if d.Config == nil {
+		return config.Default()
+	}
+	return d.Config.Get()
 }
 
 func (d *KubeDiscoveryService) getDeployments(namespaceName string) (map[string]model.Deployment, error) {
@@ -289,47 +430,105 @@ func getHealthAnnotations(k8sObject interface{}) (model.HealthAnnotations, error
 
 	switch k8sObject.(type) {
 	case corev1.Namespace:
-		var h model.HealthAnnotations
 		ns, ok := k8sObject.(corev1.Namespace)
 		if !ok {
-			return h, errors.New("failed to cast k8sObject to corev1.Namespace")
-		}
-		annotations := ns.Annotations
-		for k, v := range annotations {
-			if k == "uw.health.aggregator.port" {
-				h.Port = v
-			}
-			if k == "uw.health.aggregator.enable" {
-				if v == "true" || v == "false" {
-					h.EnableScrape = v
-				}
-			}
+			return model.HealthAnnotations{}, errors.New("failed to cast k8sObject to corev1.Namespace")
 		}
-		return h, nil
+		return parseHealthAnnotations(ns.Annotations), nil
 	case corev1.Service:
-		var h model.HealthAnnotations
 		svc, ok := k8sObject.(corev1.Service)
 		if !ok {
-			return h, errors.New("failed to cast k8sObject to corev1.Service")
-		}
-		annotations := svc.Annotations
-		for k, v := range annotations {
-			if k == "uw.health.aggregator.port" {
-				h.Port = v
-			}
-			if k == "uw.health.aggregator.enable" {
-				if v == "true" || v == "false" {
-					h.EnableScrape = v
-				}
-			}
+			return model.HealthAnnotations{}, errors.New("failed to cast k8sObject to corev1.Service")
 		}
-		return h, nil
+		return parseHealthAnnotations(svc.Annotations), nil
 	default:
 		err := fmt.Errorf("no health aggregator annotations found - passed type %T unknown", k8sObject)
 		return model.HealthAnnotations{}, err
 	}
 }
 
+func parseHealthAnnotations(annotations map[string]string) model.HealthAnnotations {
+	var h model.HealthAnnotations
+	for k, v := range annotations {
+		if k == "uw.health.aggregator.port" {
+			h.Port = v
+		}
+		if k == "uw.health.aggregator.enable" {
+			if v == "true" || v == "false" {
+				h.EnableScrape = v
+			}
+		}
+		if k == "uw.health.aggregator.silence-until" {
+			h.SilenceUntil = parseSilenceUntil(v)
+		}
+		if k == "uw.health.aggregator.check-type" {
+			switch v {
+			case constants.CheckTypeHTTP, constants.CheckTypeGRPC, constants.CheckTypeTCP, constants.CheckTypeHTTPStatus, constants.CheckTypeHTTPRegex:
+				h.CheckType = v
+			default:
+				log.Warnf("ignoring unsupported uw.health.aggregator.check-type annotation %q", v)
+			}
+		}
+		if k == "uw.health.aggregator.grpc-service" {
+			h.GRPCService = v
+		}
+		if k == "uw.health.aggregator.grpc-watch" {
+			if v == "true" || v == "false" {
+				h.GRPCWatch = v
+			}
+		}
+		if k == "uw.health.aggregator.check-regex" {
+			if v == "" {
+				log.Warn("ignoring empty uw.health.aggregator.check-regex annotation, which would match every response")
+			} else if _, err := regexp.Compile(v); err != nil {
+				log.Warnf("ignoring invalid uw.health.aggregator.check-regex annotation %q, err: %v", v, err)
+			} else {
+				h.CheckRegex = v
+			}
+		}
+		if k == "uw.health.aggregator.path" {
+			if strings.HasPrefix(v, "/") {
+				h.Path = v
+			} else {
+				log.Warnf("ignoring uw.health.aggregator.path annotation %q - must start with /", v)
+			}
+		}
+		if k == "uw.health.aggregator.format" {
+			switch v {
+			case constants.FormatAuto, constants.FormatUW, constants.FormatSpring, constants.FormatHealthJSON, constants.FormatReadyz:
+				h.Format = v
+			default:
+				log.Warnf("ignoring unsupported uw.health.aggregator.format annotation %q", v)
+			}
+		}
+		if k == "uw.health.aggregator.tls" {
+			switch v {
+			case constants.TLSModeDisabled, constants.TLSModeTLS, constants.TLSModeMTLS, constants.TLSModeInsecure:
+				h.TLSMode = v
+			default:
+				log.Warnf("ignoring unsupported uw.health.aggregator.tls annotation %q", v)
+			}
+		}
+		if k == "uw.health.aggregator.tls-server-name" {
+			h.TLSServerName = v
+		}
+		if k == "uw.health.aggregator.auth-secret" {
+			h.AuthSecret = v
+		}
+		if k == "uw.health.aggregator.latency-threshold" {
+			if _, err := time.ParseDuration(v); err != nil {
+				log.Warnf("ignoring invalid uw.health.aggregator.latency-threshold annotation %q, err: %v", v, err)
+			} else {
+				h.LatencyThreshold = v
+			}
+		}
+		if k == "uw.health.aggregator.component" {
+			h.Component = v
+		}
+	}
+	return h
+}
+
 func overrideParentAnnotations(h model.HealthAnnotations, overrides model.HealthAnnotations) model.HealthAnnotations {
 	if h.Port == "" {
 		h.Port = overrides.Port
@@ -337,9 +536,56 @@ func overrideParentAnnotations(h model.HealthAnnotations, overrides model.Health
 	if h.EnableScrape == "" {
 		h.EnableScrape = overrides.EnableScrape
 	}
+	if h.SilenceUntil == "" {
+		h.SilenceUntil = overrides.SilenceUntil
+	}
+	if h.CheckType == "" {
+		h.CheckType = overrides.CheckType
+	}
+	if h.GRPCService == "" {
+		h.GRPCService = overrides.GRPCService
+	}
+	if h.GRPCWatch == "" {
+		h.GRPCWatch = overrides.GRPCWatch
+	}
+	if h.CheckRegex == "" {
+		h.CheckRegex = overrides.CheckRegex
+	}
+	if h.Path == "" {
+		h.Path = overrides.Path
+	}
+	if h.Format == "" {
+		h.Format = overrides.Format
+	}
+	if h.TLSMode == "" {
+		h.TLSMode = overrides.TLSMode
+	}
+	if h.TLSServerName == "" {
+		h.TLSServerName = overrides.TLSServerName
+	}
+	if h.AuthSecret == "" {
+		h.AuthSecret = overrides.AuthSecret
+	}
+	if h.LatencyThreshold == "" {
+		h.LatencyThreshold = overrides.LatencyThreshold
+	}
+	if h.Component == "" {
+		h.Component = overrides.Component
+	}
 	return h
 }
 
+// parseSilenceUntil normalises the value of a uw.health.aggregator.silence-until annotation to RFC3339 in UTC,
+// returning an empty string if it is not a valid RFC3339 timestamp
+func parseSilenceUntil(v string) string {
+	until, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Warnf("ignoring invalid uw.health.aggregator.silence-until annotation %q, err: %v", v, err)
+		return ""
+	}
+	return until.UTC().Format(time.RFC3339)
+}
+
 func getAppPortForService(k8sService *corev1.Service, serviceScrapePort string) (string, error) {
 	servicePorts := k8sService.Spec.Ports
 	for _, port := range servicePorts {
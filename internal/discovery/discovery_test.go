@@ -1,15 +1,23 @@
 package discovery
 
 import (
+	"context"
+	"net/http"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
 	"github.com/utilitywarehouse/health-aggregator/internal/model"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func Test_OverrideParentAnnotations(t *testing.T) {
@@ -65,6 +73,28 @@ func Test_GetHealthAnnotations(t *testing.T) {
 	assert.Equal(t, "false", retrievedAnnotations.EnableScrape)
 	assert.Equal(t, "8081", retrievedAnnotations.Port)
 }
+
+func Test_GetHealthAnnotationsSilenceUntil(t *testing.T) {
+	ns := v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy", Annotations: map[string]string{
+		"uw.health.aggregator.silence-until": "2020-02-01T19:00:00+01:00",
+	}}}
+
+	retrievedAnnotations, err := getHealthAnnotations(ns)
+	require.NoError(t, err)
+	assert.Equal(t, "2020-02-01T18:00:00Z", retrievedAnnotations.SilenceUntil)
+
+	svc := v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test-service", Namespace: "energy", Annotations: map[string]string{
+		"uw.health.aggregator.silence-until": "tomorrow",
+	}}}
+
+	retrievedAnnotations, err = getHealthAnnotations(svc)
+	require.NoError(t, err)
+	assert.Equal(t, "", retrievedAnnotations.SilenceUntil)
+
+	overriddenAnnotations := overrideParentAnnotations(retrievedAnnotations, model.HealthAnnotations{SilenceUntil: "2020-02-01T18:00:00Z"})
+	assert.Equal(t, "2020-02-01T18:00:00Z", overriddenAnnotations.SilenceUntil)
+}
+
 func Test_GetClusterHealthcheckConfig(t *testing.T) {
 	client := setUpTest(t)
 
@@ -75,7 +105,7 @@ func Test_GetClusterHealthcheckConfig(t *testing.T) {
 	s := &KubeDiscoveryService{K8sClient: client, Namespaces: namespaces, Services: services, Errors: errs}
 
 	go func() {
-		s.GetClusterHealthcheckConfig()
+		s.GetClusterHealthcheckConfig(context.Background())
 		close(errs)
 	}()
 
@@ -97,6 +127,274 @@ func Test_GetClusterHealthcheckConfig(t *testing.T) {
 	}
 }
 
+func Test_GetClusterHealthcheckConfigSetsCluster(t *testing.T) {
+	namespaces := make(chan model.Namespace, 10)
+	errs := make(chan error, 10)
+
+	// the same namespace exists in both clusters
+	for _, cluster := range []string{"dev", "prod"} {
+		s := &KubeDiscoveryService{K8sClient: setUpTest(t), Namespaces: namespaces, Services: make(chan model.Service, 10), Errors: errs, Cluster: cluster}
+		s.GetClusterHealthcheckConfig(context.Background())
+	}
+	close(namespaces)
+
+	select {
+	case err := <-errs:
+		t.Errorf("Should not get an error, got %v", err)
+	default:
+	}
+
+	clusters := []string{}
+	for n := range namespaces {
+		assert.Equal(t, "energy", n.Name)
+		clusters = append(clusters, n.Cluster)
+	}
+	assert.Equal(t, []string{"dev", "prod"}, clusters)
+}
+
+func Test_GetClusterHealthcheckConfigAppliesNamespaceRules(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		rule         config.NamespaceRule
+		expectedNS   bool
+		expectedPath string
+	}{
+		{name: "rule defaults", rule: config.NamespaceRule{Match: "en*", Defaults: config.Defaults{Path: "/health"}}, expectedNS: true, expectedPath: "/health"},
+		{name: "no matching rule", rule: config.NamespaceRule{Match: "telecom", Defaults: config.Defaults{Path: "/health"}}, expectedNS: true, expectedPath: "/__/health"},
+		{name: "excluded", rule: config.NamespaceRule{Match: "energy", Exclude: true}, expectedNS: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Namespaces = []config.NamespaceRule{tt.rule}
+			store, err := config.NewStore("", cfg)
+			require.NoError(t, err)
+
+			namespaces := make(chan model.Namespace, 10)
+			s := &KubeDiscoveryService{K8sClient: setUpTest(t), Namespaces: namespaces, Services: make(chan model.Service, 10), Errors: make(chan error, 10), Config: store}
+
+			s.GetClusterHealthcheckConfig(context.Background())
+
+			if !tt.expectedNS {
+				assert.Equal(t, 0, len(namespaces))
+				return
+			}
+			require.Equal(t, 1, len(namespaces))
+			n := <-namespaces
+			assert.Equal(t, tt.expectedPath, n.HealthAnnotations.Path)
+			assert.Equal(t, "8080", n.HealthAnnotations.Port)
+		})
+	}
+}
+
+func Test_WatchDeploymentsStopsWhenContextCancelled(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	namespaces := watch.NewFake()
+	client.PrependWatchReactor("namespaces", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, namespaces, nil
+	})
+	watchers := map[string]*watch.FakeWatcher{"energy": watch.NewFake(), "telecom": watch.NewFake()}
+	client.PrependWatchReactor("deployments", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, watchers[action.GetNamespace()], nil
+	})
+
+	state := map[model.ServicesStateKey]model.Service{
+		{Namespace: "telecom", Service: "test-service"}: {Name: "test-service", Namespace: "telecom", Deployment: model.Deployment{DesiredReplicas: 1}},
+	}
+	updates := make(chan model.UpdateItem, 10)
+	s := NewKubeDiscoveryService(client, state, updates, make(chan error, 10))
+
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.WatchDeployments(ctx)
+		close(done)
+	}()
+
+	namespaces.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy"}})
+	namespaces.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "telecom"}})
+
+	// namespaces are watched concurrently, so an event in the second namespace is seen while the first is idle
+	replicas := int32(3)
+	watchers["telecom"].Modify(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-service", Namespace: "telecom"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: v1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "test-service"}}},
+		},
+	})
+
+	select {
+	case u := <-updates:
+		assert.Equal(t, string(watch.Modified), u.Type)
+		assert.Equal(t, int32(3), u.Object.(model.Deployment).DesiredReplicas)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an update for the modified deployment")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchDeployments did not return after the context was cancelled")
+	}
+	assert.True(t, namespaces.IsStopped())
+	assert.True(t, watchers["energy"].IsStopped())
+	assert.True(t, watchers["telecom"].IsStopped())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines, "goroutines leaked")
+}
+
+func Test_WatchDeploymentsRewatchesAfterAnError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	namespaces := watch.NewFake()
+	client.PrependWatchReactor("namespaces", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, namespaces, nil
+	})
+	watches := make(chan *watch.FakeWatcher, 2)
+	client.PrependWatchReactor("deployments", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher := watch.NewFake()
+		watches <- watcher
+		return true, watcher, nil
+	})
+
+	s := NewKubeDiscoveryService(client, map[model.ServicesStateKey]model.Service{}, make(chan model.UpdateItem, 10), make(chan error, 10))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchDeployments(ctx)
+
+	namespaces.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy"}})
+
+	var first *watch.FakeWatcher
+	select {
+	case first = <-watches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the deployments of the namespace to be watched")
+	}
+	first.Error(&metav1.Status{Status: metav1.StatusFailure, Code: http.StatusGone, Reason: metav1.StatusReasonExpired, Message: "too old resource version"})
+
+	select {
+	case <-watches:
+	case <-time.After(rewatchDelay + 5*time.Second):
+		t.Fatal("expected the deployment watch to be re-established after an error")
+	}
+	assert.True(t, first.IsStopped())
+}
+
+func Test_NamespaceSelectorMatches(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		names     []string
+		selector  string
+		optIn     bool
+		namespace v1.Namespace
+		expected  bool
+	}{
+		{name: "empty selector", namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy"}}, expected: true},
+		{name: "listed name", names: []string{"energy", "telecom"}, namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy"}}, expected: true},
+		{name: "unlisted name", names: []string{"telecom"}, namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy"}}, expected: false},
+		{name: "matching labels", selector: "team=energy,env!=dev", namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy", Labels: map[string]string{"team": "energy"}}}, expected: true},
+		{name: "labels not matching", selector: "team=energy", namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "telecom", Labels: map[string]string{"team": "telecom"}}}, expected: false},
+		{name: "opted in", optIn: true, namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy", Annotations: map[string]string{"uw.health.aggregator.enable": "true"}}}, expected: true},
+		{name: "not opted in", optIn: true, namespace: v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy", Annotations: map[string]string{"uw.health.aggregator.enable": "false"}}}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := NewNamespaceSelector(tt.names, tt.selector, tt.optIn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, selector.Matches(tt.namespace))
+		})
+	}
+
+	_, err := NewNamespaceSelector(nil, "team in (energy", false)
+	assert.Error(t, err)
+}
+
+func Test_WatchDeploymentsFollowsNamespaceSelection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	namespaces := watch.NewFake()
+	client.PrependWatchReactor("namespaces", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, namespaces, nil
+	})
+	deployments := watch.NewFake()
+	client.PrependWatchReactor("deployments", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, deployments, nil
+	})
+
+	s := NewKubeDiscoveryService(client, map[model.ServicesStateKey]model.Service{}, make(chan model.UpdateItem, 10), make(chan error, 10))
+	selector, err := NewNamespaceSelector(nil, "", true)
+	require.NoError(t, err)
+	s.Selector = selector
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchDeployments(ctx)
+
+	optedIn := map[string]string{"uw.health.aggregator.enable": "true"}
+	namespaces.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "telecom"}})
+	namespaces.Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy", Annotations: optedIn}})
+
+	select {
+	case name := <-s.namespaceReloads:
+		assert.Equal(t, "energy", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the newly selected namespace to be reloaded")
+	}
+	assert.Equal(t, []string{"energy"}, s.SelectedNamespaces())
+
+	// removing the annotation deselects the namespace and stops watching its deployments
+	namespaces.Modify(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy"}})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !deployments.IsStopped() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, deployments.IsStopped())
+	assert.Empty(t, s.SelectedNamespaces())
+}
+
+func Test_ForgetUnlistedNamespaces(t *testing.T) {
+	optedIn := map[string]string{"uw.health.aggregator.enable": "true"}
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "energy", Annotations: optedIn}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "telecom"}},
+	)
+
+	s := NewKubeDiscoveryService(client, map[model.ServicesStateKey]model.Service{}, make(chan model.UpdateItem, 10), make(chan error, 10))
+	selector, err := NewNamespaceSelector(nil, "", true)
+	require.NoError(t, err)
+	s.Selector = selector
+
+	// telecom opted out and billing was deleted while the namespace watch was down
+	cancelled := make(map[string]bool)
+	watchers := make(map[string]context.CancelFunc)
+	for _, name := range []string{"energy", "telecom", "billing"} {
+		name := name
+		watchers[name] = func() { cancelled[name] = true }
+		s.setSelected(name, true)
+	}
+
+	require.NoError(t, s.forgetUnlistedNamespaces(watchers))
+	assert.Equal(t, []string{"energy"}, s.SelectedNamespaces())
+	assert.Equal(t, map[string]bool{"telecom": true, "billing": true}, cancelled)
+	assert.Equal(t, 1, len(watchers))
+}
+
 func setUpTest(t *testing.T) *fake.Clientset {
 
 	annotations := make(map[string]string)
@@ -0,0 +1,275 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	watch "k8s.io/apimachinery/pkg/watch"
+)
+
+// rewatchDelay is how long to wait before re-establishing a k8s watch which has been closed or failed
+const rewatchDelay = 5 * time.Second
+
+// optInAnnotation is the Namespace annotation required when a NamespaceSelector is opt in
+const optInAnnotation = "uw.health.aggregator.enable"
+
+// NamespaceSelector determines which Namespaces are discovered and health checked
+type NamespaceSelector struct {
+	// Names restricts selection to the listed Namespaces, any Namespace may be selected if empty
+	Names []string
+	// Labels must match the labels of the Namespace, any labels match if nil
+	Labels labels.Selector
+	// OptIn requires the Namespace to be annotated with uw.health.aggregator.enable: "true"
+	OptIn bool
+}
+
+// NewNamespaceSelector returns a NamespaceSelector for the given Namespace names and label selector, as accepted by
+// kubectl --selector
+func NewNamespaceSelector(names []string, labelSelector string, optIn bool) (NamespaceSelector, error) {
+	s := NamespaceSelector{Names: names, OptIn: optIn}
+	if labelSelector == "" {
+		return s, nil
+	}
+
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return s, fmt.Errorf("invalid namespace label selector %q: %v", labelSelector, err)
+	}
+	s.Labels = selector
+	return s, nil
+}
+
+// Matches reports whether the Namespace is selected
+func (s NamespaceSelector) Matches(ns corev1.Namespace) bool {
+	if len(s.Names) > 0 && !oneOf(ns.Name, s.Names...) {
+		return false
+	}
+	if s.Labels != nil && !s.Labels.Matches(labels.Set(ns.Labels)) {
+		return false
+	}
+	if s.OptIn && ns.Annotations[optInAnnotation] != "true" {
+		return false
+	}
+	return true
+}
+
+func (s NamespaceSelector) labelSelector() string {
+	if s.Labels == nil {
+		return ""
+	}
+	return s.Labels.String()
+}
+
+// SelectedNamespaces returns the names of the Namespaces currently selected by WatchDeployments
+func (d *KubeDiscoveryService) SelectedNamespaces() []string {
+	d.selectedMu.Lock()
+	defer d.selectedMu.Unlock()
+
+	namespaces := make([]string, 0, len(d.selected))
+	for name := range d.selected {
+		namespaces = append(namespaces, name)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// WatchDeployments watches the Namespaces matching the Selector, and watches for changes to the Deployments of each
+// one while it remains selected. Newly selected Namespaces are reloaded straight away by ReloadServiceConfigs, which
+// must be running as the namespace watch waits for it to accept them. It returns once ctx is cancelled and all
+// watchers have been stopped
+func (d *KubeDiscoveryService) WatchDeployments(ctx context.Context) {
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d.UpdateDeployments(ctx)
+	}()
+
+	watchers := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, cancel := range watchers {
+			cancel()
+		}
+		wg.Wait()
+	}()
+
+	for {
+		// namespaces deleted or deselected while the namespace watch was down are not replayed by the next watch
+		if len(watchers) > 0 {
+			if err := d.forgetUnlistedNamespaces(watchers); err != nil {
+				select {
+				case d.Errors <- fmt.Errorf("Could not list namespaces via kubernetes api: (%v)", err):
+				default:
+				}
+			}
+		}
+
+		watcher, err := d.K8sClient.CoreV1().Namespaces().Watch(metav1.ListOptions{ResourceVersion: "0", LabelSelector: d.Selector.labelSelector()})
+		if err != nil {
+			select {
+			case d.Errors <- fmt.Errorf("Could not watch namespaces via kubernetes api: (%v)", err):
+			default:
+			}
+		} else {
+			d.watchNamespaces(ctx, watcher, watchers, &wg)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rewatchDelay):
+		}
+	}
+}
+
+func (d *KubeDiscoveryService) watchNamespaces(ctx context.Context, watcher watch.Interface, watchers map[string]context.CancelFunc, wg *sync.WaitGroup) {
+	defer watcher.Stop()
+
+	for {
+		var event watch.Event
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-watcher.ResultChan():
+			if !ok {
+				log.Debug("namespace watch closed")
+				return
+			}
+			event = e
+		}
+
+		ns, ok := event.Object.(*corev1.Namespace)
+		if !ok {
+			log.Debugf("unsupported type %T in namespace watch", event.Object)
+			continue
+		}
+
+		_, watching := watchers[ns.Name]
+		selected := event.Type != watch.Deleted && d.Selector.Matches(*ns)
+
+		if watching && !selected {
+			d.deselect(ns.Name, watchers)
+			continue
+		}
+		if watching || !selected {
+			continue
+		}
+
+		log.Infof("namespace %s is selected", ns.Name)
+		nsCtx, cancel := context.WithCancel(ctx)
+		watchers[ns.Name] = cancel
+		d.setSelected(ns.Name, true)
+
+		wg.Add(1)
+		go func(namespace string) {
+			defer wg.Done()
+			d.watchNamespaceDeployments(nsCtx, namespace)
+		}(ns.Name)
+
+		select {
+		case d.namespaceReloads <- ns.Name:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forgetUnlistedNamespaces stops watching the Deployments of the watched Namespaces which are no longer listed or
+// selected
+func (d *KubeDiscoveryService) forgetUnlistedNamespaces(watchers map[string]context.CancelFunc) error {
+	list, err := d.K8sClient.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: d.Selector.labelSelector()})
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool)
+	for _, ns := range list.Items {
+		if d.Selector.Matches(ns) {
+			listed[ns.Name] = true
+		}
+	}
+	for name := range watchers {
+		if !listed[name] {
+			d.deselect(name, watchers)
+		}
+	}
+	return nil
+}
+
+// deselect stops watching the Deployments of a Namespace which is no longer selected
+func (d *KubeDiscoveryService) deselect(namespace string, watchers map[string]context.CancelFunc) {
+	log.Infof("namespace %s is no longer selected", namespace)
+	d.setSelected(namespace, false)
+	watchers[namespace]()
+	delete(watchers, namespace)
+}
+
+// watchNamespaceDeployments watches the Deployments of a Namespace, re-establishing the watch if it is closed, until
+// ctx is cancelled
+func (d *KubeDiscoveryService) watchNamespaceDeployments(ctx context.Context, namespace string) {
+	for {
+		watcher, err := d.K8sClient.AppsV1().Deployments(namespace).Watch(metav1.ListOptions{ResourceVersion: "0"})
+		if err != nil {
+			select {
+			case d.Errors <- fmt.Errorf("Could not watch deployments in namespace %s via kubernetes api: (%v)", namespace, err):
+			default:
+			}
+		} else {
+			log.Debugf("watching deployments for namespace %s", namespace)
+			d.watchDeployments(ctx, watcher)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rewatchDelay):
+		}
+	}
+}
+
+// reloadNamespace discovers a single Namespace and its Services
+func (d *KubeDiscoveryService) reloadNamespace(ctx context.Context, name string) {
+	ns, err := d.K8sClient.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		select {
+		case d.Errors <- fmt.Errorf("Could not get namespace %s via kubernetes api: (%v)", name, err):
+		default:
+		}
+		return
+	}
+	if !d.Selector.Matches(*ns) {
+		return
+	}
+	d.discoverNamespace(ctx, *ns, d.config())
+}
+
+func (d *KubeDiscoveryService) setSelected(namespace string, selected bool) {
+	d.selectedMu.Lock()
+	defer d.selectedMu.Unlock()
+
+	if d.selected == nil {
+		d.selected = make(map[string]bool)
+	}
+	if selected {
+		d.selected[namespace] = true
+	} else {
+		delete(d.selected, namespace)
+	}
+}
+
+func oneOf(value string, options ...string) bool {
+	for _, o := range options {
+		if value == o {
+			return true
+		}
+	}
+	return false
+}
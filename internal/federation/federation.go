@@ -0,0 +1,140 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// statusesPath is the API path serving the current statuses of a health-aggregator instance
+const statusesPath = "/api/v1/statuses"
+
+// Federator merges the current statuses of Services checked by other health-aggregator instances into the statuses
+// of this instance
+type Federator struct {
+	config  *config.Store
+	repo    *db.MongoRepository
+	client  *http.Client
+	errs    chan error
+	metrics instrumentation.Metrics
+}
+
+// NewFederator returns a Federator which reads its sources from the current config each time it pulls
+func NewFederator(cfg *config.Store, repo *db.MongoRepository, errs chan error, metrics instrumentation.Metrics) *Federator {
+	return &Federator{config: cfg, repo: repo, client: &http.Client{Timeout: 10 * time.Second}, errs: errs, metrics: metrics}
+}
+
+// Pull merges the current statuses of every source, removes the statuses of Services a source no longer checks, marks
+// the statuses of each source which have not been refreshed as stale, and removes those of sources which are no longer
+// configured
+func (f *Federator) Pull(ctx context.Context) {
+	federation := f.config.Get().Federation
+
+	sources := []string{}
+	for _, source := range federation.Sources {
+		sources = append(sources, source.Name)
+		if ctx.Err() != nil {
+			return
+		}
+		f.pullSource(ctx, source, time.Now().UTC().Add(-federation.StaleAfter(source)))
+	}
+
+	if err := db.RemoveFederatedStatusesNotFrom(f.repo, sources); err != nil {
+		select {
+		case f.errs <- fmt.Errorf("Could not remove statuses of removed federation sources (%v)", err):
+		default:
+		}
+	}
+}
+
+func (f *Federator) pullSource(ctx context.Context, source config.Source, staleBefore time.Time) {
+	up := f.metrics.Gauges[constants.HealthAggregatorFederationSourceUp].WithLabelValues(source.Name)
+
+	statuses, err := f.fetch(ctx, source)
+	if err != nil {
+		up.Set(0)
+		select {
+		case f.errs <- fmt.Errorf("Could not pull statuses from federation source %s (%v)", source.Name, err):
+		default:
+		}
+	} else {
+		up.Set(1)
+		merged := 0
+		for _, status := range statuses {
+			status.Stale = status.CheckTime.Before(staleBefore)
+			ok, err := db.UpsertFederatedStatus(f.repo, status, staleBefore)
+			if err != nil {
+				select {
+				case f.errs <- fmt.Errorf("Could not merge status from federation source %s (%v)", source.Name, err):
+				default:
+				}
+				continue
+			}
+			if ok {
+				merged++
+			}
+		}
+		log.Infof("merged %d of %d statuses from federation source %s", merged, len(statuses), source.Name)
+
+		if err := db.RemoveFederatedStatusesNotPulled(f.repo, source.Name, statuses); err != nil {
+			select {
+			case f.errs <- fmt.Errorf("Could not remove statuses no longer pulled from federation source %s (%v)", source.Name, err):
+			default:
+			}
+		}
+	}
+
+	if err := db.MarkFederatedStatusesStale(f.repo, source.Name, staleBefore); err != nil {
+		select {
+		case f.errs <- fmt.Errorf("Could not mark statuses from federation source %s as stale (%v)", source.Name, err):
+		default:
+		}
+	}
+}
+
+// fetch returns the current statuses of the Services checked by the source itself, tagged with its name. Statuses
+// the source pulled from its own sources are skipped, so that they are only ever merged from where they were checked
+func (f *Federator) fetch(ctx context.Context, source config.Source) ([]model.ServiceStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(source.URL, "/")+statusesPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", statusesPath, resp.StatusCode)
+	}
+
+	var statuses []model.ServiceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, fmt.Errorf("invalid statuses: %v", err)
+	}
+
+	own := []model.ServiceStatus{}
+	for _, status := range statuses {
+		if status.Source != "" {
+			continue
+		}
+		status.Source = source.Name
+		if status.Service.Cluster == "" {
+			status.Service.Cluster = source.Cluster
+		}
+		own = append(own, status)
+	}
+	return own, nil
+}
@@ -0,0 +1,52 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+func Test_FetchTagsStatusesCheckedBySource(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, statusesPath, r.URL.Path)
+		json.NewEncoder(w).Encode([]model.ServiceStatus{
+			{Service: model.Service{Name: "uw-foo", Namespace: "energy"}, AggregatedState: constants.Healthy},
+			{Service: model.Service{Name: "uw-bar", Namespace: "energy", Cluster: "prod"}, AggregatedState: constants.Degraded},
+			// pulled by the source from another instance
+			{Service: model.Service{Name: "uw-baz", Namespace: "billing"}, AggregatedState: constants.Healthy, Source: "billing"},
+		})
+	}))
+	defer stub.Close()
+
+	f := &Federator{client: http.DefaultClient}
+	statuses, err := f.fetch(context.Background(), config.Source{Name: "energy", URL: stub.URL + "/", Cluster: "dev"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+
+	assert.Equal(t, "uw-foo", statuses[0].Service.Name)
+	assert.Equal(t, "dev", statuses[0].Service.Cluster)
+	assert.Equal(t, "energy", statuses[0].Source)
+
+	assert.Equal(t, "uw-bar", statuses[1].Service.Name)
+	assert.Equal(t, "prod", statuses[1].Service.Cluster)
+	assert.Equal(t, "energy", statuses[1].Source)
+}
+
+func Test_FetchFailsWhenSourceErrors(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer stub.Close()
+
+	f := &Federator{client: http.DefaultClient}
+	_, err := f.fetch(context.Background(), config.Source{Name: "energy", URL: stub.URL})
+	assert.Error(t, err)
+}
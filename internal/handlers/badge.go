@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/badge"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// getBadge serves an SVG badge of the health of a Namespace, or of a single Service when the service route variable is
+// set, optionally restricted to the cluster query parameter
+func getBadge(cfg *config.Store) func(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(mgoRepo *db.MongoRepository) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			namespace, service := mux.Vars(r)["namespace"], mux.Vars(r)["service"]
+			statuses, err := db.FindLatestChecks(mgoRepo, r.URL.Query().Get("cluster"), namespace)
+			if err != nil {
+				log.WithError(err).Errorf("failed to get badge for namespace %s", namespace)
+				errorWithJSON(w, "failed to get badge", http.StatusInternalServerError)
+				return
+			}
+
+			label, rule := namespace, cfg.Get().HealthRule(namespace)
+			if service != "" {
+				var matched []model.ServiceStatus
+				for _, status := range statuses {
+					if status.Service.Name == service {
+						matched = append(matched, status)
+					}
+				}
+				// a Service in several clusters takes the worst of its states
+				label, rule, statuses = service, config.HealthRule{}, matched
+			}
+			if len(statuses) == 0 {
+				errorWithJSON(w, "no services found for badge "+label, http.StatusNotFound)
+				return
+			}
+
+			// the state has held since the latest change of any of the Services, and is stale if any of their latest
+			// checks are
+			now := time.Now()
+			staleBefore := now.Add(-cfg.Get().StaleAfter())
+			var since time.Time
+			stale := false
+			for _, status := range statuses {
+				if status.StateSince.After(since) {
+					since = status.StateSince
+				}
+				stale = stale || status.Stale || status.CheckTime.Before(staleBefore)
+			}
+			state := rule.Rollup(statuses)
+			if service != "" && len(statuses) == 1 {
+				state = statuses[0].AggregatedState
+			}
+
+			svg, err := badge.ForState(label, state, since, stale, now).SVG()
+			if err != nil {
+				log.WithError(err).Errorf("failed to render badge %s", label)
+				errorWithJSON(w, "failed to render badge", http.StatusInternalServerError)
+				return
+			}
+
+			etag := badge.ETag(svg)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			if _, err := w.Write(svg); err != nil {
+				log.Errorf("failed to write response body, err: %v", err)
+			}
+		}
+	}
+}
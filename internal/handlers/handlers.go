@@ -4,18 +4,52 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/dashboard"
 	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
 )
 
-// NewRouter returned a *mux.Router and sets up all required routes and handlers
-func NewRouter(reloadQueue chan uuid.UUID) *mux.Router {
+// NewRouter returned a *mux.Router and sets up all required routes and handlers. Reloads are only accepted while
+// leading reports true, as only the leader discovers services. The health of namespaces is rolled up by the rules of cfg
+func NewRouter(reloadQueue chan uuid.UUID, mgoRepo *db.MongoRepository, leading func() bool, cfg *config.Store) *mux.Router {
 	r := mux.NewRouter()
 
-	r.Handle("/reload", reloader(reloadQueue)).Methods(http.MethodPost)
+	r.Handle("/reload", reloader(reloadQueue, leading)).Methods(http.MethodPost)
+
+	r.Handle("/api/v1/silences", withRepoCopy(mgoRepo, getSilences)).Methods(http.MethodGet)
+	r.Handle("/api/v1/silences", withRepoCopy(mgoRepo, createSilence)).Methods(http.MethodPost)
+	r.Handle("/api/v1/silences/{id}", withRepoCopy(mgoRepo, expireSilence)).Methods(http.MethodDelete)
+
+	r.Handle("/api/v1/incidents", withRepoCopy(mgoRepo, getIncidents)).Methods(http.MethodGet)
+	r.Handle("/api/v1/incidents/{id}", withRepoCopy(mgoRepo, getIncident)).Methods(http.MethodGet)
+	r.Handle("/api/v1/incidents/{id}/acknowledge", withRepoCopy(mgoRepo, acknowledgeIncident)).Methods(http.MethodPost)
+	r.Handle("/api/v1/incidents/{id}/notes", withRepoCopy(mgoRepo, addIncidentNote)).Methods(http.MethodPost)
+
+	r.Handle("/api/v1/namespaces/{namespace}/compliance", withRepoCopy(mgoRepo, getCompliance)).Methods(http.MethodGet)
+
+	r.Handle("/api/v1/statuses", withRepoCopy(mgoRepo, getStatuses)).Methods(http.MethodGet)
+	r.Handle("/api/v1/namespaces/{namespace}/services/{service}/transitions", withRepoCopy(mgoRepo, getTransitions)).Methods(http.MethodGet)
+
+	r.Handle("/namespaces/{namespace}/__/health", withRepoCopy(mgoRepo, getNamespaceHealth(cfg))).Methods(http.MethodGet)
+	r.Handle("/cluster/__/health", withRepoCopy(mgoRepo, getClusterHealth(cfg))).Methods(http.MethodGet)
+
+	r.Handle("/badge/{namespace}", withRepoCopy(mgoRepo, getBadge(cfg))).Methods(http.MethodGet)
+	r.Handle("/badge/{namespace}/{service}", withRepoCopy(mgoRepo, getBadge(cfg))).Methods(http.MethodGet)
+
+	// routes scoped to a cluster, when several clusters are watched. The routes above cover every cluster
+	r.Handle("/api/v1/clusters", withRepoCopy(mgoRepo, getClusters)).Methods(http.MethodGet)
+	r.Handle("/api/v1/clusters/{cluster}/namespaces/{namespace}/compliance", withRepoCopy(mgoRepo, getCompliance)).Methods(http.MethodGet)
+	r.Handle("/clusters/{cluster}/namespaces/{namespace}/__/health", withRepoCopy(mgoRepo, getNamespaceHealth(cfg))).Methods(http.MethodGet)
+	r.Handle("/clusters/{cluster}/__/health", withRepoCopy(mgoRepo, getClusterHealth(cfg))).Methods(http.MethodGet)
+
+	r.PathPrefix("/ui/").Handler(dashboard.Handler("/ui/")).Methods(http.MethodGet)
+	r.Handle("/", http.RedirectHandler("/ui/", http.StatusFound)).Methods(http.MethodGet)
 
 	return r
 }
@@ -28,14 +62,195 @@ func withRepoCopy(mgoRepo *db.MongoRepository, next func(mgoRepo *db.MongoReposi
 	})
 }
 
-func reloader(reloadQueue chan uuid.UUID) http.HandlerFunc {
+func reloader(reloadQueue chan uuid.UUID, leading func() bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !leading() {
+			errorWithJSON(w, "reloads are handled by the leader, this replica is not leading", http.StatusServiceUnavailable)
+			return
+		}
 		reqID := uuid.New()
 		reloadQueue <- uuid.New()
 		responseWithJSON(w, http.StatusOK, map[string]string{"message": "reload request received for id " + reqID.String()})
 	}
 }
 
+func getSilences(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		silences, err := db.FindActiveSilences(mgoRepo)
+		if err != nil {
+			log.WithError(err).Error("failed to get silences")
+			errorWithJSON(w, "failed to get silences", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, silences)
+	}
+}
+
+func createSilence(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			model.Silence
+			// Duration may be given instead of ExpiresAt, e.g. "2h30m"
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorWithJSON(w, "invalid silence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		silence := req.Silence
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				errorWithJSON(w, "invalid silence duration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			silence.ExpiresAt = time.Now().Add(d)
+		}
+
+		silence, err := db.InsertSilence(mgoRepo, silence)
+		if err != nil {
+			errorWithJSON(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		responseWithJSON(w, http.StatusCreated, silence)
+	}
+}
+
+func expireSilence(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := db.ExpireSilence(mgoRepo, id); err != nil {
+			if err == db.ErrNotFound {
+				errorWithJSON(w, "silence not found", http.StatusNotFound)
+				return
+			}
+			log.WithError(err).Errorf("failed to expire silence %s", id)
+			errorWithJSON(w, "failed to expire silence", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, map[string]string{"message": "silence " + id + " expired"})
+	}
+}
+
+func getIncidents(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		incidents, err := db.FindIncidents(mgoRepo, r.URL.Query().Get("state"), r.URL.Query().Get("cluster"), r.URL.Query().Get("namespace"))
+		if err != nil {
+			log.WithError(err).Error("failed to get incidents")
+			errorWithJSON(w, "failed to get incidents", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, incidents)
+	}
+}
+
+func getIncident(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		incident, err := db.FindIncident(mgoRepo, mux.Vars(r)["id"])
+		respondWithIncident(w, incident, err)
+	}
+}
+
+func acknowledgeIncident(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			User string `json:"user"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorWithJSON(w, "invalid acknowledgement: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.User == "" {
+			errorWithJSON(w, "a user is required to acknowledge an incident", http.StatusBadRequest)
+			return
+		}
+
+		incident, err := db.AcknowledgeIncident(mgoRepo, mux.Vars(r)["id"], req.User)
+		respondWithIncident(w, incident, err)
+	}
+}
+
+func addIncidentNote(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var note model.IncidentNote
+		if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
+			errorWithJSON(w, "invalid note: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if note.User == "" || note.Text == "" {
+			errorWithJSON(w, "a note requires a user and text", http.StatusBadRequest)
+			return
+		}
+
+		incident, err := db.AddIncidentNote(mgoRepo, mux.Vars(r)["id"], note)
+		respondWithIncident(w, incident, err)
+	}
+}
+
+func respondWithIncident(w http.ResponseWriter, incident model.Incident, err error) {
+	if err != nil {
+		if err == db.ErrNotFound {
+			errorWithJSON(w, "incident not found", http.StatusNotFound)
+			return
+		}
+		log.WithError(err).Error("failed to get incident")
+		errorWithJSON(w, "failed to get incident", http.StatusInternalServerError)
+		return
+	}
+	responseWithJSON(w, http.StatusOK, incident)
+}
+
+func getCompliance(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace := mux.Vars(r)["namespace"]
+		report, err := db.FindComplianceForNamespace(mgoRepo, mux.Vars(r)["cluster"], namespace)
+		if err != nil {
+			log.WithError(err).Errorf("failed to get compliance for namespace %s", namespace)
+			errorWithJSON(w, "failed to get compliance report", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, report)
+	}
+}
+
+func getStatuses(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses, err := db.FindCurrentStatuses(mgoRepo, r.URL.Query().Get("cluster"), r.URL.Query().Get("namespace"))
+		if err != nil {
+			log.WithError(err).Error("failed to get statuses")
+			errorWithJSON(w, "failed to get statuses", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, statuses)
+	}
+}
+
+func getTransitions(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, service := mux.Vars(r)["namespace"], mux.Vars(r)["service"]
+		transitions, err := db.FindTransitionsForService(mgoRepo, r.URL.Query().Get("cluster"), namespace, service)
+		if err != nil {
+			log.WithError(err).Errorf("failed to get state transitions for service %s in namespace %s", service, namespace)
+			errorWithJSON(w, "failed to get state transitions", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, transitions)
+	}
+}
+
+func getClusters(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clusters, err := db.FindAllClusters(mgoRepo)
+		if err != nil {
+			log.WithError(err).Error("failed to get clusters")
+			errorWithJSON(w, "failed to get clusters", http.StatusInternalServerError)
+			return
+		}
+		responseWithJSON(w, http.StatusOK, clusters)
+	}
+}
+
 func errorWithJSON(w http.ResponseWriter, message string, code int) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(code)
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/helpers"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+const (
+	dbURL = "localhost:27017"
+)
+
+type TestSuite struct {
+	repo    *db.MongoRepository
+	session *mgo.Session
+	dbName  string
+}
+
+var s TestSuite
+
+func (s *TestSuite) SetUpTest() {
+	sess, err := mgo.Dial(dbURL)
+	if err != nil {
+		log.Fatalf("failed to create mongo session: %s", err.Error())
+	}
+	s.session = sess
+	s.dbName = uuid.New().String()
+	s.repo = db.NewMongoRepository(s.session, s.dbName)
+}
+
+func (s *TestSuite) TearDownTest() {
+	if err := s.session.DB(s.dbName).DropDatabase(); err != nil {
+		log.Fatalf("failed to drop database, err: %v", err)
+	}
+	s.repo.Close()
+}
+
+// newTestRouter returns the router of a leading replica with the given config
+func newTestRouter(t *testing.T, cfg config.Config) *mux.Router {
+	store, err := config.NewStore("", cfg)
+	require.NoError(t, err)
+	return NewRouter(make(chan uuid.UUID), s.repo, func() bool { return true }, store)
+}
+
+func serve(router http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// insertStatuses stores the Service of each status as discovered, and the status as its current one
+func insertStatuses(t *testing.T, statuses ...model.ServiceStatus) {
+	for _, status := range statuses {
+		require.NoError(t, s.repo.Db().C(constants.ServicesCollection).Insert(status.Service))
+		require.NoError(t, s.repo.Db().C(constants.StatusCollection).Insert(status))
+	}
+}
+
+// clusterStatus returns a status of a Service in the given cluster and Namespace
+func clusterStatus(cluster string, namespace string, service string, state string) model.ServiceStatus {
+	status := helpers.GenerateDummyServiceStatus(service, namespace, []string{"pod-a"}, state)
+	status.Service.Cluster = cluster
+	return status
+}
+
+func getHealth(t *testing.T, router http.Handler, target string) model.HealthcheckBody {
+	rec := serve(router, http.MethodGet, target, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body model.HealthcheckBody
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return body
+}
+
+func checkNames(body model.HealthcheckBody) []string {
+	names := []string{}
+	for _, check := range body.Checks {
+		names = append(names, check.Name)
+	}
+	return names
+}
+
+func Test_GetClusterHealth(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	router := newTestRouter(t, config.Default())
+	insertStatuses(t,
+		clusterStatus("prod", "energy", "uw-foo", constants.Healthy),
+		clusterStatus("prod", "energy", "uw-bar", constants.Unhealthy),
+		clusterStatus("prod", "billing", "uw-baz", constants.Healthy),
+		clusterStatus("dev", "energy", "uw-foo", constants.Healthy),
+	)
+
+	// the same namespace in different clusters is checked separately
+	body := getHealth(t, router, "/cluster/__/health")
+	assert.Equal(t, "all clusters", body.Name)
+	assert.Equal(t, []string{"prod/billing", "dev/energy", "prod/energy"}, checkNames(body))
+	assert.Equal(t, constants.Healthy, body.Checks[1].Health)
+	assert.NotEqual(t, constants.Healthy, body.Checks[2].Health)
+	assert.Equal(t, "uw-bar is unhealthy", body.Checks[2].Output)
+	assert.Equal(t, body.Checks[2].Health, body.Health)
+
+	body = getHealth(t, router, "/clusters/prod/__/health")
+	assert.Equal(t, "prod", body.Name)
+	assert.Equal(t, []string{"billing", "energy"}, checkNames(body))
+	assert.NotEqual(t, constants.Healthy, body.Health)
+
+	body = getHealth(t, router, "/clusters/dev/__/health")
+	assert.Equal(t, []string{"energy"}, checkNames(body))
+	assert.Equal(t, constants.Healthy, body.Health)
+}
+
+func Test_GetNamespaceHealth(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	router := newTestRouter(t, config.Default())
+	insertStatuses(t,
+		clusterStatus("prod", "energy", "uw-foo", constants.Healthy),
+		clusterStatus("prod", "energy", "uw-bar", constants.Unhealthy),
+		clusterStatus("dev", "energy", "uw-foo", constants.Healthy),
+	)
+
+	body := getHealth(t, router, "/namespaces/energy/__/health")
+	assert.Equal(t, "energy", body.Name)
+	assert.ElementsMatch(t, []string{"prod/uw-bar", "dev/uw-foo", "prod/uw-foo"}, checkNames(body))
+	assert.NotEqual(t, constants.Healthy, body.Health)
+
+	body = getHealth(t, router, "/clusters/dev/namespaces/energy/__/health")
+	assert.Equal(t, []string{"uw-foo"}, checkNames(body))
+	assert.Equal(t, constants.Healthy, body.Health)
+
+	rec := serve(router, http.MethodGet, "/namespaces/telecom/__/health", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	stale := clusterStatus("dev", "telecom", "uw-baz", constants.Healthy)
+	stale.Stale = true
+	insertStatuses(t, stale)
+
+	body = getHealth(t, router, "/clusters/dev/namespaces/telecom/__/health")
+	require.Equal(t, 1, len(body.Checks))
+	assert.Equal(t, constants.Degraded, body.Checks[0].Health)
+	assert.Contains(t, body.Checks[0].Output, "stale, last checked at")
+	assert.Equal(t, constants.Degraded, body.Health)
+}
+
+func Test_CreateSilence(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	router := newTestRouter(t, config.Default())
+
+	rec := serve(router, http.MethodPost, "/api/v1/silences", `{"namespace": "energy", "createdBy": "jane", "duration": "2h"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var created model.Silence
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, "energy", created.Namespace)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), created.ExpiresAt, time.Minute)
+
+	silences, err := db.FindActiveSilences(s.repo)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(silences))
+	assert.Equal(t, created.ID, silences[0].ID)
+}
+
+func Test_CreateSilenceRejectsInvalidSilences(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	router := newTestRouter(t, config.Default())
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "invalid json", body: `{"namespace": `},
+		{name: "invalid duration", body: `{"namespace": "energy", "createdBy": "jane", "duration": "a while"}`},
+		{name: "no matchers", body: `{"createdBy": "jane", "duration": "2h"}`},
+		{name: "no creator", body: `{"namespace": "energy", "duration": "2h"}`},
+		{name: "already expired", body: `{"namespace": "energy", "createdBy": "jane", "duration": "-1h"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(router, http.MethodPost, "/api/v1/silences", tt.body)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+
+	silences, err := db.FindActiveSilences(s.repo)
+	require.NoError(t, err)
+	assert.Empty(t, silences)
+}
+
+func Test_GetSilences(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	router := newTestRouter(t, config.Default())
+
+	rec := serve(router, http.MethodGet, "/api/v1/silences", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	silence, err := db.InsertSilence(s.repo, model.Silence{Service: "uw-foo", CreatedBy: "jane", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	rec = serve(router, http.MethodGet, "/api/v1/silences", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var silences []model.Silence
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &silences))
+	require.Equal(t, 1, len(silences))
+	assert.Equal(t, silence.ID, silences[0].ID)
+	assert.Equal(t, "uw-foo", silences[0].Service)
+}
+
+func Test_ExpireSilence(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	router := newTestRouter(t, config.Default())
+
+	silence, err := db.InsertSilence(s.repo, model.Silence{Namespace: "energy", CreatedBy: "jane", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	rec := serve(router, http.MethodDelete, "/api/v1/silences/"+silence.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	silences, err := db.FindActiveSilences(s.repo)
+	require.NoError(t, err)
+	assert.Empty(t, silences)
+
+	rec = serve(router, http.MethodDelete, "/api/v1/silences/"+uuid.New().String(), "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
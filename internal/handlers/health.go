@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// getNamespaceHealth serves the health of a Namespace in the UW operational health format, with a check for each of
+// its Services, so that it can be scraped like the health endpoint of any Service
+func getNamespaceHealth(cfg *config.Store) func(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(mgoRepo *db.MongoRepository) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			cluster, namespace := mux.Vars(r)["cluster"], mux.Vars(r)["namespace"]
+			statuses, err := db.FindLatestChecks(mgoRepo, cluster, namespace)
+			if err != nil {
+				log.WithError(err).Errorf("failed to get health of namespace %s", namespace)
+				errorWithJSON(w, "failed to get namespace health", http.StatusInternalServerError)
+				return
+			}
+			if len(statuses) == 0 {
+				errorWithJSON(w, "no services found in namespace "+namespace, http.StatusNotFound)
+				return
+			}
+
+			checks := []model.Check{}
+			for _, status := range statuses {
+				check := model.Check{
+					Name:   checkName(status, cluster),
+					Health: status.AggregatedState,
+					Output: status.Error,
+				}
+				// the last known state of a stale Service may no longer hold, so it is degraded and the output says when it
+				// was last checked and in which state
+				if status.Stale {
+					check.Health = constants.Degraded
+					check.Output = "stale, last checked at " + status.CheckTime.UTC().Format(time.RFC3339) + " when " + status.AggregatedState
+					if status.Error != "" {
+						check.Output += ", " + status.Error
+					}
+				}
+				checks = append(checks, check)
+			}
+			responseWithJSON(w, http.StatusOK, model.HealthcheckBody{
+				Name:        namespace,
+				Description: fmt.Sprintf("Health of the %d services in namespace %s", len(statuses), namespace),
+				Health:      cfg.Get().HealthRule(namespace).Rollup(statuses),
+				Checks:      checks,
+			})
+		}
+	}
+}
+
+// getClusterHealth serves the health of a cluster, or of every cluster watched, in the UW operational health format,
+// with a check for each Namespace of each cluster whose health is rolled up by its rule. The health of the cluster is
+// the worst health of its Namespaces
+func getClusterHealth(cfg *config.Store) func(mgoRepo *db.MongoRepository) http.HandlerFunc {
+	return func(mgoRepo *db.MongoRepository) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			cluster := mux.Vars(r)["cluster"]
+			statuses, err := db.FindLatestChecks(mgoRepo, cluster)
+			if err != nil {
+				log.WithError(err).Error("failed to get health of cluster")
+				errorWithJSON(w, "failed to get cluster health", http.StatusInternalServerError)
+				return
+			}
+
+			// the same Namespace in different clusters is checked separately. statuses are ordered by Namespace
+			var namespaces []clusterNamespace
+			byNamespace := make(map[clusterNamespace][]model.ServiceStatus)
+			for _, status := range statuses {
+				ns := clusterNamespace{cluster: status.Service.Cluster, namespace: status.Service.Namespace}
+				if _, ok := byNamespace[ns]; !ok {
+					namespaces = append(namespaces, ns)
+				}
+				byNamespace[ns] = append(byNamespace[ns], status)
+			}
+			sort.SliceStable(namespaces, func(i, j int) bool {
+				if namespaces[i].namespace != namespaces[j].namespace {
+					return namespaces[i].namespace < namespaces[j].namespace
+				}
+				return namespaces[i].cluster < namespaces[j].cluster
+			})
+
+			rules := cfg.Get()
+			health := constants.Healthy
+			checks := []model.Check{}
+			for _, ns := range namespaces {
+				check := model.Check{Name: ns.checkName(cluster), Health: rules.HealthRule(ns.namespace).Rollup(byNamespace[ns])}
+				var failing []string
+				for _, status := range byNamespace[ns] {
+					switch {
+					case status.Stale:
+						failing = append(failing, status.Service.Name+" is stale")
+					case status.AggregatedState != constants.Healthy:
+						failing = append(failing, status.Service.Name+" is "+status.AggregatedState)
+					}
+				}
+				check.Output = strings.Join(failing, ", ")
+				checks = append(checks, check)
+				health = worst(health, check.Health)
+			}
+
+			name := cluster
+			if name == "" {
+				name = "all clusters"
+			}
+			responseWithJSON(w, http.StatusOK, model.HealthcheckBody{
+				Name:        name,
+				Description: fmt.Sprintf("Health of the %d namespaces in %s", len(namespaces), name),
+				Health:      health,
+				Checks:      checks,
+			})
+		}
+	}
+}
+
+type clusterNamespace struct {
+	cluster   string
+	namespace string
+}
+
+// checkName names the check of a Namespace, prefixed by its cluster unless the response is scoped to one
+func (ns clusterNamespace) checkName(cluster string) string {
+	if cluster == "" && ns.cluster != "" {
+		return ns.cluster + "/" + ns.namespace
+	}
+	return ns.namespace
+}
+
+// checkName names the check of a Service, prefixed by its cluster unless the response is scoped to one
+func checkName(status model.ServiceStatus, cluster string) string {
+	if cluster == "" && status.Service.Cluster != "" {
+		return status.Service.Cluster + "/" + status.Service.Name
+	}
+	return status.Service.Name
+}
+
+func worst(a string, b string) string {
+	for _, health := range []string{constants.Unhealthy, constants.Degraded} {
+		if a == health || b == health {
+			return health
+		}
+	}
+	return constants.Healthy
+}
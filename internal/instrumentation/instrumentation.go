@@ -32,6 +32,11 @@ func setupCounters() map[string]*prometheus.CounterVec {
 		Help: "Counts health checks performed including the outcome (whether or not the healthcheck call was successful or not)",
 	}, []string{constants.PerformedHealthcheckResult})
 
+	counters[constants.HealthAggregatorScrapeAttempts] = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: constants.HealthAggregatorScrapeAttempts,
+		Help: "Counts health check requests by whether a response was received (success) or not (failure), and whether it took more than one attempt (retried)",
+	}, []string{"result", "retried"})
+
 	return counters
 }
 
@@ -49,6 +54,41 @@ func setupGauges() map[string]*prometheus.GaugeVec {
 		Help: "Records the number of services queued awaiting health agrgegator to scrape /__/health",
 	}, []string{})
 
+	gauges[constants.HealthAggregatorServiceUnhealthy] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorServiceUnhealthy,
+		Help: "Set to 1 when the aggregated state of a service is not healthy and the service is not silenced, otherwise 0",
+	}, []string{"cluster", "namespace", "service"})
+
+	gauges[constants.HealthAggregatorNonCompliantServices] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorNonCompliantServices,
+		Help: "Records the number of services in each namespace whose health check responses do not comply with the UW operational health spec",
+	}, []string{"cluster", "namespace"})
+
+	gauges[constants.HealthAggregatorCertExpiry] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorCertExpiry,
+		Help: "Records the expiry time (unix seconds) of the certificate presented by each pod scraped over HTTPS",
+	}, []string{"cluster", "namespace", "service", "pod"})
+
+	gauges[constants.HealthAggregatorFederationSourceUp] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorFederationSourceUp,
+		Help: "Set to 1 when the statuses of a federation source were pulled successfully the last time, otherwise 0",
+	}, []string{"source"})
+
+	gauges[constants.HealthAggregatorShardServices] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorShardServices,
+		Help: "Records the number of services assigned to a shard in its latest scheduling round",
+	}, []string{"shard"})
+
+	gauges[constants.HealthAggregatorServiceStale] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorServiceStale,
+		Help: "Set to 1 when the latest check of a service is older than the watchdog allows, as its checks have stopped, otherwise 0",
+	}, []string{"cluster", "namespace", "service"})
+
+	gauges[constants.HealthAggregatorStaleServicesPercent] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: constants.HealthAggregatorStaleServicesPercent,
+		Help: "Records the percentage of the services checked by this instance whose latest check is stale",
+	}, []string{})
+
 	return gauges
 }
 
@@ -0,0 +1,122 @@
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Config determines the Lease replicas campaign for, and how it is held. Zero durations take the defaults used by
+// k8s controllers
+type Config struct {
+	// Namespace and Name identify the Lease
+	Namespace string
+	Name      string
+	// Identity distinguishes this replica from the others, e.g. its pod name
+	Identity string
+	// LeaseDuration is how long other replicas wait after the Lease was last renewed before taking it over
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps retrying to renew the Lease before it stops leading
+	RenewDeadline time.Duration
+	// RetryPeriod is how often the Lease is renewed, or tried for when not leading
+	RetryPeriod time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = 15 * time.Second
+	}
+	if c.RenewDeadline == 0 {
+		c.RenewDeadline = 10 * time.Second
+	}
+	if c.RetryPeriod == 0 {
+		c.RetryPeriod = 2 * time.Second
+	}
+	return c
+}
+
+// Elector elects a single leader among the replicas of health-aggregator through a k8s Lease
+type Elector struct {
+	client  kubernetes.Interface
+	config  Config
+	leading int32
+}
+
+// NewElector returns an Elector campaigning for the Lease described by cfg
+func NewElector(client kubernetes.Interface, cfg Config) *Elector {
+	return &Elector{client: client, config: cfg.withDefaults()}
+}
+
+// IsLeader reports whether this replica currently holds the Lease and is leading
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// Run campaigns for the Lease until ctx is cancelled. Each time the Lease is acquired lead is called with a context
+// which is cancelled once the Lease is lost or ctx is cancelled, and the Lease is only campaigned for again after lead
+// has returned. On cancellation the Lease is released once lead has returned, so that another replica takes over
+// straight away
+func (e *Elector) Run(ctx context.Context, lead func(ctx context.Context)) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: e.config.Namespace, Name: e.config.Name},
+		Client:     e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: e.config.Identity},
+	}
+
+	for ctx.Err() == nil {
+		// the campaign outlives ctx while leading, so that the Lease is held until lead has returned, and only then
+		// released for another replica to take over
+		campaignCtx, stopCampaign := context.WithCancel(context.Background())
+		leadCtx, stopLeading := context.WithCancel(ctx)
+		acquired := make(chan struct{})
+
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   e.config.LeaseDuration,
+			RenewDeadline:   e.config.RenewDeadline,
+			RetryPeriod:     e.config.RetryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) { close(acquired) },
+				OnStoppedLeading: stopLeading,
+				OnNewLeader: func(identity string) {
+					log.Infof("%s is the leader of lease %s/%s", identity, e.config.Namespace, e.config.Name)
+				},
+			},
+		})
+		if err != nil {
+			stopCampaign()
+			stopLeading()
+			return err
+		}
+
+		// lead is run here rather than in OnStartedLeading, which is not waited for, so that leading has stopped
+		// before the Lease is released or campaigned for again
+		campaigned := make(chan struct{})
+		go func() {
+			defer close(campaigned)
+			elector.Run(campaignCtx)
+		}()
+
+		select {
+		case <-acquired:
+			log.Infof("started leading as %s", e.config.Identity)
+			atomic.StoreInt32(&e.leading, 1)
+			lead(leadCtx)
+			atomic.StoreInt32(&e.leading, 0)
+			log.Infof("stopped leading as %s", e.config.Identity)
+		case <-campaigned:
+		case <-ctx.Done():
+		}
+		stopCampaign()
+		<-campaigned
+		stopLeading()
+	}
+	return nil
+}
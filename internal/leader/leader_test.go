@@ -0,0 +1,75 @@
+package leader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_ElectorFailsOverWhenLeaderStops(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	config := func(identity string) Config {
+		return Config{
+			Namespace:     "health-aggregator",
+			Name:          "health-aggregator",
+			Identity:      identity,
+			LeaseDuration: time.Second,
+			RenewDeadline: 500 * time.Millisecond,
+			RetryPeriod:   100 * time.Millisecond,
+		}
+	}
+
+	leaders := make(chan string, 10)
+	campaign := func(e *Elector, identity string) (context.CancelFunc, chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.NoError(t, e.Run(ctx, func(ctx context.Context) {
+				leaders <- identity
+				<-ctx.Done()
+			}))
+		}()
+		return cancel, done
+	}
+	nextLeader := func() string {
+		select {
+		case identity := <-leaders:
+			return identity
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no replica started leading")
+			return ""
+		}
+	}
+
+	a := NewElector(client, config("a"))
+	stopA, aDone := campaign(a, "a")
+	require.Equal(t, "a", nextLeader())
+
+	b := NewElector(client, config("b"))
+	stopB, bDone := campaign(b, "b")
+
+	// b does not lead while a keeps renewing the lease
+	select {
+	case identity := <-leaders:
+		require.FailNow(t, "unexpected leader", identity)
+	case <-time.After(2 * time.Second):
+	}
+	assert.True(t, a.IsLeader())
+	assert.False(t, b.IsLeader())
+
+	// a releases the lease when stopped, so b takes over
+	stopA()
+	<-aDone
+	assert.False(t, a.IsLeader())
+	require.Equal(t, "b", nextLeader())
+	assert.True(t, b.IsLeader())
+
+	stopB()
+	<-bDone
+	assert.False(t, b.IsLeader())
+}
@@ -2,10 +2,12 @@ package model
 
 import "time"
 
-// Service describes a k8s Service including the associated Health Aggregator configuration
+// Service describes a k8s Service including the associated Health Aggregator configuration. Cluster is the name of
+// the cluster the Service was discovered in, and is empty when a single cluster is watched
 type Service struct {
 	Name              string            `json:"name" bson:"name"`
 	Namespace         string            `json:"namespace" bson:"namespace"`
+	Cluster           string            `json:"cluster,omitempty" bson:"cluster,omitempty"`
 	HealthcheckURL    string            `json:"healthcheckURL" bson:"healthcheckURL"`
 	HealthAnnotations HealthAnnotations `json:"healthAnnotations" bson:"healthAnnotations"`
 	AppPort           string            `json:"appPort" bson:"appPort"`
@@ -25,12 +27,14 @@ type Pod struct {
 type Deployment struct {
 	Service         string `json:"-"`
 	Namespace       string `json:"-"`
+	Cluster         string `json:"-"`
 	DesiredReplicas int32  `json:"desiredReplicas" bson:"desiredReplicas"`
 }
 
 // Namespace desribes a k8s Namespace including the associated Health Aggregator configuration
 type Namespace struct {
 	Name              string            `json:"name" bson:"name"`
+	Cluster           string            `json:"cluster,omitempty" bson:"cluster,omitempty"`
 	HealthAnnotations HealthAnnotations `json:"healthAnnotations" bson:"healthAnnotations"`
 }
 
@@ -42,8 +46,20 @@ type UpdateItem struct {
 
 // HealthAnnotations matching the associated annotations against the resource in k8s
 type HealthAnnotations struct {
-	EnableScrape string `json:"enableScrape" bson:"enableScrape"` // k8s annotation: uw.health.aggregator.enable
-	Port         string `json:"port" bson:"port"`                 // k8s annotation: uw.health.aggregator.port
+	EnableScrape     string `json:"enableScrape" bson:"enableScrape"`         // k8s annotation: uw.health.aggregator.enable
+	Port             string `json:"port" bson:"port"`                         // k8s annotation: uw.health.aggregator.port
+	SilenceUntil     string `json:"silenceUntil" bson:"silenceUntil"`         // k8s annotation: uw.health.aggregator.silence-until
+	CheckType        string `json:"checkType" bson:"checkType"`               // k8s annotation: uw.health.aggregator.check-type
+	GRPCService      string `json:"grpcService" bson:"grpcService"`           // k8s annotation: uw.health.aggregator.grpc-service
+	GRPCWatch        string `json:"grpcWatch" bson:"grpcWatch"`               // k8s annotation: uw.health.aggregator.grpc-watch
+	CheckRegex       string `json:"checkRegex" bson:"checkRegex"`             // k8s annotation: uw.health.aggregator.check-regex
+	Path             string `json:"path" bson:"path"`                         // k8s annotation: uw.health.aggregator.path
+	Format           string `json:"format" bson:"format"`                     // k8s annotation: uw.health.aggregator.format
+	TLSMode          string `json:"tlsMode" bson:"tlsMode"`                   // k8s annotation: uw.health.aggregator.tls
+	TLSServerName    string `json:"tlsServerName" bson:"tlsServerName"`       // k8s annotation: uw.health.aggregator.tls-server-name
+	AuthSecret       string `json:"authSecret" bson:"authSecret"`             // k8s annotation: uw.health.aggregator.auth-secret
+	LatencyThreshold string `json:"latencyThreshold" bson:"latencyThreshold"` // k8s annotation: uw.health.aggregator.latency-threshold
+	Component        string `json:"component" bson:"component"`               // k8s annotation: uw.health.aggregator.component
 }
 
 // ServiceStatus describes the state of a service, including the results of all pods related to the service,
@@ -59,7 +75,12 @@ type ServiceStatus struct {
 	PreviousState       string              `json:"previousState" bson:"previousState"`
 	HumanisedStateSince string              `json:"-"`
 	Error               string              `json:"error" bson:"error"`
+	Silenced            bool                `json:"silenced" bson:"silenced"`
+	LatencyP50Ms        float64             `json:"latencyP50Ms" bson:"latencyP50Ms"`
+	LatencyMaxMs        float64             `json:"latencyMaxMs" bson:"latencyMaxMs"`
 	PodChecks           []PodHealthResponse `json:"podChecks" bson:"podChecks"`
+	Source              string              `json:"source,omitempty" bson:"source,omitempty"` // federated instance the status was pulled from, empty if checked locally
+	Stale               bool                `json:"stale,omitempty" bson:"stale,omitempty"`   // set once the status has not been refreshed for too long, whether checked locally or pulled from a federation source
 }
 
 // PodHealthResponse describes the result of a health check for an individual pod, including
@@ -72,6 +93,12 @@ type PodHealthResponse struct {
 	StatusCode         int             `json:"statusCode" bson:"statusCode"`
 	Error              string          `json:"error" bson:"error"`
 	Body               HealthcheckBody `json:"body,omitempty" bson:"body"`
+	Warnings           []string        `json:"warnings,omitempty" bson:"warnings,omitempty"`     // UW operational health spec violations
+	CertExpiry         *time.Time      `json:"certExpiry,omitempty" bson:"certExpiry,omitempty"` // expiry of the certificate presented over HTTPS
+	LatencyMs          float64         `json:"latencyMs" bson:"latencyMs"`                       // total duration of the health check
+	TTFBMs             float64         `json:"ttfbMs,omitempty" bson:"ttfbMs,omitempty"`         // time to first byte of HTTP health checks
+	BodySize           int64           `json:"bodySize,omitempty" bson:"bodySize,omitempty"`     // size of the HTTP response body in bytes
+	Attempts           int             `json:"attempts" bson:"attempts"`                         // number of requests made, including retries
 }
 
 // HealthcheckBody describes the actual json response for a UW health check
@@ -91,7 +118,106 @@ type Check struct {
 	Impact string `json:"impact,omitempty" bson:"impact"`
 }
 
+// Silence describes a maintenance window during which matching Services are still checked but are not alerted on.
+// Empty Cluster, Namespace, Service or Check fields match any value. A Silence with a Check only applies when every failing
+// check for a Service has that name
+type Silence struct {
+	ID        string    `json:"id" bson:"_id"`
+	Cluster   string    `json:"cluster,omitempty" bson:"cluster,omitempty"`
+	Namespace string    `json:"namespace,omitempty" bson:"namespace"`
+	Service   string    `json:"service,omitempty" bson:"service"`
+	Check     string    `json:"check,omitempty" bson:"check"`
+	CreatedBy string    `json:"createdBy" bson:"createdBy"`
+	Comment   string    `json:"comment,omitempty" bson:"comment"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+}
+
+// Incident describes a period during which a Service was unhealthy, including who is investigating it
+type Incident struct {
+	ID             string          `json:"id" bson:"_id"`
+	Namespace      string          `json:"namespace" bson:"namespace"`
+	Service        string          `json:"service" bson:"service"`
+	Cluster        string          `json:"cluster,omitempty" bson:"cluster,omitempty"`
+	State          string          `json:"state" bson:"state"`
+	OpenedAt       time.Time       `json:"openedAt" bson:"openedAt"`
+	ClosedAt       time.Time       `json:"closedAt" bson:"closedAt,omitempty"`
+	AcknowledgedBy string          `json:"acknowledgedBy,omitempty" bson:"acknowledgedBy,omitempty"`
+	AcknowledgedAt time.Time       `json:"acknowledgedAt" bson:"acknowledgedAt,omitempty"`
+	Notes          []IncidentNote  `json:"notes" bson:"notes"`
+	Timeline       []IncidentEvent `json:"timeline" bson:"timeline"`
+}
+
+// IncidentNote is a free-text note added to an Incident by an engineer
+type IncidentNote struct {
+	User      string    `json:"user" bson:"user"`
+	Text      string    `json:"text" bson:"text"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+}
+
+// IncidentEvent records a change in the aggregated state of a Service during an Incident, alongside the
+// errors reported by its pods at that time
+type IncidentEvent struct {
+	Time      time.Time `json:"time" bson:"time"`
+	State     string    `json:"state" bson:"state"`
+	Error     string    `json:"error,omitempty" bson:"error,omitempty"`
+	PodErrors []string  `json:"podErrors,omitempty" bson:"podErrors,omitempty"`
+}
+
+// StateTransition describes a change in the aggregated state of a Service
+type StateTransition struct {
+	Namespace   string    `json:"namespace" bson:"namespace"`
+	Service     string    `json:"service" bson:"service"`
+	Cluster     string    `json:"cluster,omitempty" bson:"cluster,omitempty"`
+	Time        time.Time `json:"time" bson:"time"`
+	From        string    `json:"from" bson:"from"`
+	To          string    `json:"to" bson:"to"`
+	HealthyPods int       `json:"healthyPods" bson:"healthyPods"`
+	Error       string    `json:"error" bson:"error"`
+}
+
+// ServiceRollup describes a downsampled summary of the health checks made for a Service over an hourly or daily period
+type ServiceRollup struct {
+	Namespace        string             `json:"namespace" bson:"namespace"`
+	Service          string             `json:"service" bson:"service"`
+	Cluster          string             `json:"cluster,omitempty" bson:"cluster,omitempty"`
+	Period           string             `json:"period" bson:"period"`
+	PeriodStart      time.Time          `json:"periodStart" bson:"periodStart"`
+	PeriodEnd        time.Time          `json:"periodEnd" bson:"periodEnd"`
+	Checks           int                `json:"checks" bson:"checks"`
+	SecondsInState   map[string]float64 `json:"secondsInState" bson:"secondsInState"`
+	Transitions      int                `json:"transitions" bson:"transitions"`
+	MinHealthyPods   int                `json:"minHealthyPods" bson:"minHealthyPods"`
+	MaxHealthyPods   int                `json:"maxHealthyPods" bson:"maxHealthyPods"`
+	TopFailingChecks []FailingCheck     `json:"topFailingChecks" bson:"topFailingChecks"`
+}
+
+// ComplianceReport summarises which Services within a Namespace return health check responses that do not comply
+// with the UW operational health spec
+type ComplianceReport struct {
+	Namespace            string              `json:"namespace"`
+	Cluster              string              `json:"cluster,omitempty"`
+	CheckedServices      int                 `json:"checkedServices"`
+	NonCompliantServices int                 `json:"nonCompliantServices"`
+	Services             []ServiceCompliance `json:"services"`
+}
+
+// ServiceCompliance lists the spec violations reported for each pod of a Service in its latest health check
+type ServiceCompliance struct {
+	Service     string              `json:"service"`
+	CheckTime   time.Time           `json:"checkTime"`
+	Compliant   bool                `json:"compliant"`
+	PodWarnings map[string][]string `json:"podWarnings,omitempty"`
+}
+
+// FailingCheck records how many times an individual Check was reported as not healthy within a ServiceRollup
+type FailingCheck struct {
+	Name     string `json:"name" bson:"name"`
+	Failures int    `json:"failures" bson:"failures"`
+}
+
 // ServicesStateKey is a struct that acts as a key for the state map: map[model.ServicesStateKey]model.Service
+// Cluster is empty when a single cluster is watched
 type ServicesStateKey struct {
-	Namespace, Service string
+	Cluster, Namespace, Service string
 }
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// Notification is the body posted to the webhook of a notification route when a Service changes aggregated state
+type Notification struct {
+	Route       string    `json:"route"`
+	Cluster     string    `json:"cluster,omitempty"`
+	Namespace   string    `json:"namespace"`
+	Service     string    `json:"service"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Time        time.Time `json:"time"`
+	HealthyPods int       `json:"healthyPods"`
+	Error       string    `json:"error"`
+}
+
+// Notifier sends changes in the aggregated state of Services to the webhooks of the matching notification routes
+type Notifier struct {
+	config *config.Store
+	client *http.Client
+	errs   chan error
+}
+
+// NewNotifier returns a Notifier which reads its routes from the current config on every notification
+func NewNotifier(cfg *config.Store, errs chan error) *Notifier {
+	return &Notifier{config: cfg, client: &http.Client{Timeout: 10 * time.Second}, errs: errs}
+}
+
+// Run notifies each state transition received on the channel, until the channel is closed. Transitions of
+// silenced Services are not notified
+func (n *Notifier) Run(transitions chan model.ServiceStatus) {
+	for status := range transitions {
+		if status.Silenced {
+			log.WithFields(log.Fields{
+				"service":   status.Service.Name,
+				"namespace": status.Service.Namespace,
+			}).Debug("not notifying state transition of silenced service")
+			continue
+		}
+
+		for _, route := range n.config.Get().Notifications.Routes {
+			if !route.Matches(status.Service.Namespace, status.AggregatedState) {
+				continue
+			}
+			if err := n.send(route, status); err != nil {
+				select {
+				case n.errs <- fmt.Errorf("Could not send notification to route %s (%v)", route.Name, err):
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (n *Notifier) send(route config.Route, status model.ServiceStatus) error {
+	body, err := json.Marshal(Notification{
+		Route:       route.Name,
+		Cluster:     status.Service.Cluster,
+		Namespace:   status.Service.Namespace,
+		Service:     status.Service.Name,
+		From:        status.PreviousState,
+		To:          status.AggregatedState,
+		Time:        status.StateSince,
+		HealthyPods: status.HealthyPods,
+		Error:       status.Error,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(route.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
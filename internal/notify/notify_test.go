@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+func Test_NotifierSendsMatchingTransitions(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string][]Notification{}
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		mu.Lock()
+		received[r.URL.Path] = append(received[r.URL.Path], n)
+		mu.Unlock()
+	}))
+	defer stub.Close()
+
+	cfg := config.Default()
+	cfg.Notifications.Routes = []config.Route{
+		{Name: "energy", Namespaces: []string{"energy"}, Webhook: stub.URL + "/energy"},
+		{Name: "unhealthy", States: []string{constants.Unhealthy}, Webhook: stub.URL + "/unhealthy"},
+	}
+	store, err := config.NewStore("", cfg)
+	require.NoError(t, err)
+
+	errs := make(chan error, 10)
+	transitions := make(chan model.ServiceStatus, 10)
+
+	now := time.Now().UTC()
+	transitions <- model.ServiceStatus{Service: model.Service{Name: "api", Namespace: "energy"}, AggregatedState: constants.Unhealthy, PreviousState: constants.Healthy, StateSince: now}
+	transitions <- model.ServiceStatus{Service: model.Service{Name: "api", Namespace: "telecom"}, AggregatedState: constants.Degraded, PreviousState: constants.Healthy, StateSince: now}
+	transitions <- model.ServiceStatus{Service: model.Service{Name: "db", Namespace: "telecom"}, AggregatedState: constants.Unhealthy, PreviousState: constants.Healthy, StateSince: now, Silenced: true}
+	close(transitions)
+
+	NewNotifier(store, errs).Run(transitions)
+
+	select {
+	case err := <-errs:
+		t.Errorf("Should not get an error, got %v", err)
+	default:
+	}
+
+	require.Equal(t, 1, len(received["/energy"]))
+	assert.Equal(t, Notification{Route: "energy", Namespace: "energy", Service: "api", From: constants.Healthy, To: constants.Unhealthy, Time: now}, received["/energy"][0])
+
+	// the degraded service does not match the states of the route and the silenced service is not notified
+	require.Equal(t, 1, len(received["/unhealthy"]))
+	assert.Equal(t, "energy", received["/unhealthy"][0].Namespace)
+}
+
+func Test_NotifierReportsWebhookErrors(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer stub.Close()
+
+	cfg := config.Default()
+	cfg.Notifications.Routes = []config.Route{{Name: "all", Webhook: stub.URL}}
+	store, err := config.NewStore("", cfg)
+	require.NoError(t, err)
+
+	errs := make(chan error, 10)
+	transitions := make(chan model.ServiceStatus, 10)
+	transitions <- model.ServiceStatus{Service: model.Service{Name: "api", Namespace: "energy"}, AggregatedState: constants.Unhealthy}
+	close(transitions)
+
+	NewNotifier(store, errs).Run(transitions)
+
+	require.Equal(t, 1, len(errs))
+	assert.Contains(t, (<-errs).Error(), "webhook returned status 500")
+}
@@ -0,0 +1,55 @@
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points each member has on the ring, which evens out the share of each member
+const virtualNodes = 100
+
+// Ring assigns keys to members by consistent hashing, so that when a member joins or leaves only the keys it gains
+// or loses are reassigned
+type Ring struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+// NewRing returns a Ring of the given members
+func NewRing(members ...string) *Ring {
+	r := &Ring{members: make(map[uint32]string)}
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+			// on the rare collision the lowest member wins, so that every replica builds the same ring
+			if existing, ok := r.members[point]; ok && existing < member {
+				continue
+			} else if !ok {
+				r.points = append(r.points, point)
+			}
+			r.members[point] = member
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the member a key is assigned to, or an empty string if the ring has no members
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
+
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
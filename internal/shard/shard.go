@@ -0,0 +1,248 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// groupLabel is the label of the Leases of the replicas sharing scrape work, whose value is the name of their group
+const groupLabel = "uw.health.aggregator.shard-group"
+
+// Config determines how a replica takes part in sharding. Zero durations take the defaults
+type Config struct {
+	// Namespace holds the Lease of every member of the group
+	Namespace string
+	// Group is shared by the replicas sharding work between them, and prefixes the names of their Leases
+	Group string
+	// Identity distinguishes this replica from the others, e.g. its pod name
+	Identity string
+	// LeaseDuration is how long after its Lease was last renewed a member is considered to have left
+	LeaseDuration time.Duration
+	// RenewInterval is how often this replica renews its Lease and refreshes the members of the group
+	RenewInterval time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = 15 * time.Second
+	}
+	if c.RenewInterval == 0 {
+		c.RenewInterval = 5 * time.Second
+	}
+	return c
+}
+
+// Membership keeps a Lease renewed for this replica, and assigns each Service to one of the live members of its group
+// through a consistent hash Ring of their identities
+type Membership struct {
+	client  kubernetes.Interface
+	config  Config
+	errs    chan error
+	changes chan struct{}
+
+	// renewedAt is when the Lease of this replica was last renewed, and observed when the renewal of each Lease of the
+	// group was last seen, by the local clock. Leases expire by the local clock rather than by their renew time, as the
+	// clocks of the replicas may differ
+	renewedAt time.Time
+	observed  map[string]observedLease
+
+	mu      sync.RWMutex
+	members []string
+	ring    *Ring
+}
+
+type observedLease struct {
+	renewTime  metav1.MicroTime
+	observedAt time.Time
+}
+
+// NewMembership returns a Membership which joins the group once Run is called
+func NewMembership(client kubernetes.Interface, cfg Config, errs chan error) *Membership {
+	return &Membership{
+		client:   client,
+		config:   cfg.withDefaults(),
+		errs:     errs,
+		changes:  make(chan struct{}, 1),
+		observed: make(map[string]observedLease),
+		ring:     NewRing(),
+	}
+}
+
+// Key identifies a Service on the Ring
+func Key(svc model.Service) string {
+	return svc.Cluster + "/" + svc.Namespace + "/" + svc.Name
+}
+
+// Run renews the Lease of this replica and refreshes the members of the group every RenewInterval until ctx is
+// cancelled, then deletes the Lease so that the Services of this replica are reassigned straight away
+func (m *Membership) Run(ctx context.Context) {
+	for {
+		if err := m.sync(time.Now()); err != nil {
+			select {
+			case m.errs <- fmt.Errorf("Could not refresh members of shard group %s (%v)", m.config.Group, err):
+			default:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			m.leave()
+			return
+		case <-time.After(m.config.RenewInterval):
+		}
+	}
+}
+
+// Owns reports whether the Service is assigned to this replica. Nothing is owned until this replica has joined
+func (m *Membership) Owns(svc model.Service) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ring.Owner(Key(svc)) == m.config.Identity
+}
+
+// Members returns the identities of the live members of the group
+func (m *Membership) Members() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string{}, m.members...)
+}
+
+// Changes receives a value whenever the members of the group change, and so Services may have been reassigned
+func (m *Membership) Changes() <-chan struct{} {
+	return m.changes
+}
+
+func (m *Membership) leaseName() string {
+	return m.config.Group + "-" + m.config.Identity
+}
+
+// sync renews the Lease of this replica and refreshes the members of the group. Once the Lease has not been renewed
+// for LeaseDuration the other members no longer count this replica, so it owns nothing until it is renewed again
+func (m *Membership) sync(now time.Time) error {
+	if err := m.renew(now); err != nil {
+		if now.Sub(m.renewedAt) >= m.config.LeaseDuration {
+			m.setMembers([]string{})
+		}
+		return err
+	}
+	m.renewedAt = now
+	return m.refresh(now)
+}
+
+// renew creates or renews the Lease of this replica
+func (m *Membership) renew(renewTime time.Time) error {
+	leases := m.client.CoordinationV1().Leases(m.config.Namespace)
+	now := metav1.NewMicroTime(renewTime)
+	identity := m.config.Identity
+	duration := int32(m.config.LeaseDuration / time.Second)
+
+	lease, err := leases.Get(m.leaseName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(&coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      m.leaseName(),
+				Namespace: m.config.Namespace,
+				Labels:    map[string]string{groupLabel: m.config.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(lease)
+	return err
+}
+
+// refresh lists the Leases of the group, and rebuilds the Ring from those which have not expired. As in client-go leader
+// election, a Lease expires once its renew time has not changed for its duration, as observed at now
+func (m *Membership) refresh(now time.Time) error {
+	leases, err := m.client.CoordinationV1().Leases(m.config.Namespace).List(metav1.ListOptions{LabelSelector: groupLabel + "=" + m.config.Group})
+	if err != nil {
+		return err
+	}
+
+	observed := make(map[string]observedLease)
+	members := []string{}
+	for _, lease := range leases.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+
+		o, ok := m.observed[lease.Name]
+		if !ok || !o.renewTime.Equal(spec.RenewTime) {
+			o = observedLease{renewTime: *spec.RenewTime, observedAt: now}
+		}
+		observed[lease.Name] = o
+
+		if now.Before(o.observedAt.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)) {
+			members = append(members, *spec.HolderIdentity)
+		}
+	}
+	m.observed = observed
+	sort.Strings(members)
+	m.setMembers(members)
+	return nil
+}
+
+// leave deletes the Lease of this replica, after which it owns nothing
+func (m *Membership) leave() {
+	err := m.client.CoordinationV1().Leases(m.config.Namespace).Delete(m.leaseName(), &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		select {
+		case m.errs <- fmt.Errorf("Could not delete lease of shard group %s (%v)", m.config.Group, err):
+		default:
+		}
+	}
+	m.setMembers([]string{})
+}
+
+func (m *Membership) setMembers(members []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if equal(m.members, members) {
+		return
+	}
+	log.Infof("shard group %s has members %v", m.config.Group, members)
+	m.members = members
+	m.ring = NewRing(members...)
+
+	select {
+	case m.changes <- struct{}{}:
+	default:
+	}
+}
+
+func equal(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
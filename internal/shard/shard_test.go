@@ -0,0 +1,139 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_RingOnlyReassignsKeysOfJoiningMember(t *testing.T) {
+	before := NewRing("a", "b", "c")
+	after := NewRing("a", "b", "c", "d")
+
+	shares := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("cluster/namespace/service-%d", i)
+		owner := before.Owner(key)
+		shares[owner]++
+
+		if moved := after.Owner(key); moved != owner {
+			assert.Equal(t, "d", moved, "key %s moved between existing members", key)
+		}
+	}
+
+	// every member takes a reasonable share
+	for _, member := range []string{"a", "b", "c"} {
+		assert.True(t, shares[member] > 500, "member %s owns %d of 3000 keys", member, shares[member])
+	}
+	assert.Equal(t, "", NewRing().Owner("cluster/namespace/service"))
+}
+
+func Test_MembershipReassignsServicesWhenMemberLeaves(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	errs := make(chan error, 10)
+	a := NewMembership(client, Config{Namespace: "health-aggregator", Group: "health-aggregator", Identity: "a"}, errs)
+	b := NewMembership(client, Config{Namespace: "health-aggregator", Group: "health-aggregator", Identity: "b"}, errs)
+
+	// another group sharing the namespace is ignored
+	other := NewMembership(client, Config{Namespace: "health-aggregator", Group: "other", Identity: "c"}, errs)
+	now := time.Now()
+	require.NoError(t, other.sync(now))
+
+	require.NoError(t, a.renew(now))
+	require.NoError(t, b.renew(now))
+	require.NoError(t, a.refresh(now))
+	require.NoError(t, b.refresh(now))
+	assert.Equal(t, []string{"a", "b"}, a.Members())
+	assert.Equal(t, []string{"a", "b"}, b.Members())
+	<-a.Changes()
+
+	services := make([]model.Service, 100)
+	owned := map[string]int{}
+	for i := range services {
+		services[i] = model.Service{Name: fmt.Sprintf("service-%d", i), Namespace: "energy"}
+		require.True(t, a.Owns(services[i]) != b.Owns(services[i]), "service %s must be owned by exactly one member", services[i].Name)
+		if a.Owns(services[i]) {
+			owned["a"]++
+		} else {
+			owned["b"]++
+		}
+	}
+	assert.True(t, owned["a"] > 0 && owned["b"] > 0)
+
+	// b deletes its lease when stopped, so a takes over all services
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Run(ctx)
+	assert.Empty(t, b.Members())
+	assert.False(t, b.Owns(services[0]))
+
+	require.NoError(t, a.refresh(now))
+	assert.Equal(t, []string{"a"}, a.Members())
+	select {
+	case <-a.Changes():
+	default:
+		assert.Fail(t, "membership change not signalled")
+	}
+	for _, svc := range services {
+		assert.True(t, a.Owns(svc))
+	}
+	assert.Empty(t, errs)
+}
+
+func Test_MembershipExpiresLeasesByObservedRenewals(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	errs := make(chan error, 10)
+	a := NewMembership(client, Config{Namespace: "health-aggregator", Group: "health-aggregator", Identity: "a", LeaseDuration: 15 * time.Second}, errs)
+	b := NewMembership(client, Config{Namespace: "health-aggregator", Group: "health-aggregator", Identity: "b", LeaseDuration: 15 * time.Second}, errs)
+
+	// the clock of b is an hour behind, so its renew time is always in the past for a
+	now := time.Now()
+	skew := -time.Hour
+	require.NoError(t, b.renew(now.Add(skew)))
+	require.NoError(t, a.sync(now))
+	assert.Equal(t, []string{"a", "b"}, a.Members())
+
+	// b is a member while it keeps renewing
+	require.NoError(t, b.renew(now.Add(10*time.Second+skew)))
+	require.NoError(t, a.sync(now.Add(10*time.Second)))
+	assert.Equal(t, []string{"a", "b"}, a.Members())
+
+	// and expires once its renew time has not changed for the lease duration
+	require.NoError(t, a.sync(now.Add(20*time.Second)))
+	assert.Equal(t, []string{"a", "b"}, a.Members())
+	require.NoError(t, a.sync(now.Add(25*time.Second)))
+	assert.Equal(t, []string{"a"}, a.Members())
+	assert.Empty(t, errs)
+}
+
+func Test_MembershipOwnsNothingOnceItsLeaseCannotBeRenewed(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := NewMembership(client, Config{Namespace: "health-aggregator", Group: "health-aggregator", Identity: "a", LeaseDuration: 15 * time.Second}, make(chan error, 10))
+	svc := model.Service{Name: "service", Namespace: "energy"}
+
+	now := time.Now()
+	require.NoError(t, a.sync(now))
+	assert.True(t, a.Owns(svc))
+
+	client.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+
+	// the lease has not expired yet, so the other members still count this replica
+	assert.Error(t, a.sync(now.Add(10*time.Second)))
+	assert.Equal(t, []string{"a"}, a.Members())
+	assert.True(t, a.Owns(svc))
+
+	assert.Error(t, a.sync(now.Add(15*time.Second)))
+	assert.Empty(t, a.Members())
+	assert.False(t, a.Owns(svc))
+}
@@ -0,0 +1,326 @@
+package statuspage
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+const (
+	// Operational, Degraded, PartialOutage and MajorOutage are the customer facing statuses of a Component, or of a
+	// day on its uptime bar. Unknown applies when none of its Services have a trusted status, or a day has no rollups
+	Operational   = "operational"
+	Degraded      = "degraded_performance"
+	PartialOutage = "partial_outage"
+	MajorOutage   = "major_outage"
+	Unknown       = "unknown"
+
+	// days is the length of the uptime bar, which ends with the last completed day
+	days = 90
+	// outageUptime is the uptime percentage of a day below which it is a major rather than partial outage
+	outageUptime = 95
+)
+
+// severity orders statuses from best to worst
+var severity = map[string]int{Operational: 0, Unknown: 1, Degraded: 2, PartialOutage: 3, MajorOutage: 4}
+
+//go:embed page.html
+var templates embed.FS
+
+var page = template.Must(template.New("page.html").Funcs(template.FuncMap{
+	"percent": func(pct *float64) string {
+		if pct == nil {
+			return "no data"
+		}
+		return fmt.Sprintf("%.2f%%", *pct)
+	},
+	"describe": func(status string) string { return descriptions[status] },
+}).ParseFS(templates, "page.html"))
+
+// descriptions of each status on the HTML page
+var descriptions = map[string]string{
+	Operational:   "Operational",
+	Degraded:      "Degraded performance",
+	PartialOutage: "Partial outage",
+	MajorOutage:   "Major outage",
+	Unknown:       "No data",
+}
+
+// Page is the status page, as published in status.json
+type Page struct {
+	Title      string      `json:"title"`
+	Status     string      `json:"status"`
+	UpdatedAt  time.Time   `json:"updatedAt"`
+	Components []Component `json:"components"`
+}
+
+// Component is the status of a group of Services, and its daily uptime over the last 90 days
+type Component struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Status      string   `json:"status"`
+	Uptime      *float64 `json:"uptime,omitempty"` // percentage of the days below, nil without rollups
+	Days        []Day    `json:"days"`
+}
+
+// Day is one bar of the uptime of a Component
+type Day struct {
+	Date   string   `json:"date"`
+	Status string   `json:"status"`
+	Uptime *float64 `json:"uptime,omitempty"` // percentage of the day its Services were healthy or degraded
+}
+
+// Publisher writes the status page to the directory configured under statusPage.path
+type Publisher struct {
+	config *config.Store
+	repo   *db.MongoRepository
+	errs   chan error
+}
+
+// NewPublisher returns a Publisher which reads the status page config each time it publishes
+func NewPublisher(cfg *config.Store, repo *db.MongoRepository, errs chan error) *Publisher {
+	return &Publisher{config: cfg, repo: repo, errs: errs}
+}
+
+// Publish builds the status page from the current statuses and the daily rollups of every Service, and writes it as
+// index.html and status.json. Nothing is published if no path is configured
+func (p *Publisher) Publish() {
+	cfg := p.config.Get().StatusPage
+	if cfg.Path == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	statuses, err := db.FindLatestChecks(p.repo, "")
+	if err == nil {
+		var rollups []model.ServiceRollup
+		rollups, err = db.FindRollups(p.repo, constants.RollupDaily, firstDay(now))
+		if err == nil {
+			err = write(cfg.Path, Build(cfg, statuses, rollups, now))
+		}
+	}
+	if err != nil {
+		select {
+		case p.errs <- fmt.Errorf("Could not publish status page (%v)", err):
+		default:
+		}
+		return
+	}
+	log.Debugf("published status page to %s", cfg.Path)
+}
+
+// Build returns the status page of the Components of cfg, and of those named by Service annotations. A Component
+// takes the worst status of its Services which are neither silenced nor stale, and is a partial rather than a major
+// outage while some of them are not unhealthy
+func Build(cfg config.StatusPage, statuses []model.ServiceStatus, rollups []model.ServiceRollup, now time.Time) Page {
+	var names []string
+	components := make(map[string]*Component)
+	add := func(name string, description string) {
+		if _, ok := components[name]; !ok {
+			components[name] = &Component{Name: name, Description: description}
+			names = append(names, name)
+		}
+	}
+	for _, c := range cfg.Components {
+		add(c.Name, c.Description)
+	}
+
+	// Components named only by annotations follow those of the config in alphabetical order
+	members := make(map[string][]model.ServiceStatus)
+	owners := make(map[model.ServicesStateKey]string)
+	var annotated []string
+	for _, status := range statuses {
+		name := cfg.Component(status.Service)
+		if name == "" {
+			continue
+		}
+		if _, ok := components[name]; !ok && !contains(annotated, name) {
+			annotated = append(annotated, name)
+		}
+		members[name] = append(members[name], status)
+		owners[model.ServicesStateKey{Cluster: status.Service.Cluster, Namespace: status.Service.Namespace, Service: status.Service.Name}] = name
+	}
+	sort.Strings(annotated)
+	for _, name := range annotated {
+		add(name, "")
+	}
+
+	// rollups of Services which no longer have a status still count towards the Components matching them in the config
+	seconds := make(map[string]map[string]map[string]float64)
+	for _, r := range rollups {
+		name, ok := owners[model.ServicesStateKey{Cluster: r.Cluster, Namespace: r.Namespace, Service: r.Service}]
+		if !ok {
+			name = cfg.Component(model.Service{Namespace: r.Namespace, Name: r.Service})
+		}
+		if _, ok := components[name]; !ok {
+			continue
+		}
+		if seconds[name] == nil {
+			seconds[name] = make(map[string]map[string]float64)
+		}
+		date := r.PeriodStart.UTC().Format("2006-01-02")
+		if seconds[name][date] == nil {
+			seconds[name][date] = make(map[string]float64)
+		}
+		for state, s := range r.SecondsInState {
+			seconds[name][date][state] += s
+		}
+	}
+
+	p := Page{Title: cfg.Title, Status: Operational, UpdatedAt: now, Components: []Component{}}
+	for _, name := range names {
+		c := components[name]
+		c.Status = componentStatus(members[name])
+		c.Days, c.Uptime = uptime(seconds[name], now)
+		p.Components = append(p.Components, *c)
+		p.Status = worst(p.Status, c.Status)
+	}
+	return p
+}
+
+func componentStatus(members []model.ServiceStatus) string {
+	considered, unhealthy, degraded := 0, 0, 0
+	for _, m := range members {
+		if m.Silenced || m.Stale {
+			continue
+		}
+		considered++
+		switch m.AggregatedState {
+		case constants.Unhealthy:
+			unhealthy++
+		case constants.Degraded:
+			degraded++
+		}
+	}
+
+	switch {
+	case considered == 0:
+		return Unknown
+	case unhealthy == considered:
+		return MajorOutage
+	case unhealthy > 0:
+		return PartialOutage
+	case degraded > 0:
+		return Degraded
+	default:
+		return Operational
+	}
+}
+
+// uptime returns a Day for each of the last 90 completed days, given the seconds spent in each state by date, and the
+// uptime over all of them
+func uptime(seconds map[string]map[string]float64, now time.Time) ([]Day, *float64) {
+	var up, total float64
+	result := make([]Day, 0, days)
+	for day := firstDay(now); len(result) < days; day = day.AddDate(0, 0, 1) {
+		d := Day{Date: day.Format("2006-01-02"), Status: Unknown}
+		inState := seconds[d.Date]
+
+		var dayTotal float64
+		for _, s := range inState {
+			dayTotal += s
+		}
+		if dayTotal > 0 {
+			dayUp := inState[constants.Healthy] + inState[constants.Degraded]
+			pct := dayUp * 100 / dayTotal
+			d.Uptime = &pct
+			switch {
+			case inState[constants.Unhealthy] == 0 && inState[constants.Degraded] == 0:
+				d.Status = Operational
+			case inState[constants.Unhealthy] == 0:
+				d.Status = Degraded
+			case pct >= outageUptime:
+				d.Status = PartialOutage
+			default:
+				d.Status = MajorOutage
+			}
+			up += dayUp
+			total += dayTotal
+		}
+		result = append(result, d)
+	}
+
+	if total == 0 {
+		return result, nil
+	}
+	pct := up * 100 / total
+	return result, &pct
+}
+
+// firstDay returns the start of the first day of the uptime bar
+func firstDay(now time.Time) time.Time {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return today.AddDate(0, 0, -days)
+}
+
+// write replaces index.html and status.json in dir, each through a rename so that they are never served partly
+// written
+func write(dir string, p Page) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, "status.json"), data); err != nil {
+		return err
+	}
+
+	var html bytes.Buffer
+	if err := page.Execute(&html, p); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "index.html"), html.Bytes())
+}
+
+func writeFile(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func worst(a string, b string) string {
+	if severity[b] > severity[a] {
+		return b
+	}
+	return a
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package statuspage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+func status(namespace string, name string, state string, component string) model.ServiceStatus {
+	return model.ServiceStatus{
+		Service:         model.Service{Namespace: namespace, Name: name, HealthAnnotations: model.HealthAnnotations{Component: component}},
+		AggregatedState: state,
+	}
+}
+
+func Test_Build(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	cfg := config.StatusPage{
+		Title: "Status",
+		Components: []config.Component{
+			{Name: "Billing", Description: "Bills and payments", Services: []string{"billing/*"}},
+			{Name: "Energy", Services: []string{"energy/*"}},
+			{Name: "Telecom", Services: []string{"telecom/*"}},
+		},
+	}
+
+	silenced := status("energy", "uw-meters", constants.Unhealthy, "")
+	silenced.Silenced = true
+	statuses := []model.ServiceStatus{
+		status("billing", "uw-invoices", constants.Healthy, ""),
+		status("billing", "uw-ledger", constants.Unhealthy, ""),
+		status("energy", "uw-tariffs", constants.Degraded, ""),
+		silenced,
+		// the annotation moves a Service to a Component not in the config
+		status("billing", "uw-payments", constants.Unhealthy, "Payments"),
+	}
+
+	yesterday := time.Date(2020, 3, 9, 0, 0, 0, 0, time.UTC)
+	rollups := []model.ServiceRollup{
+		{Namespace: "billing", Service: "uw-invoices", PeriodStart: yesterday, SecondsInState: map[string]float64{constants.Healthy: 86400}},
+		{Namespace: "billing", Service: "uw-ledger", PeriodStart: yesterday, SecondsInState: map[string]float64{constants.Healthy: 43200, constants.Unhealthy: 43200}},
+		// a Service which no longer has a status still counts towards its Component
+		{Namespace: "billing", Service: "uw-removed", PeriodStart: yesterday.AddDate(0, 0, -1), SecondsInState: map[string]float64{constants.Degraded: 86400}},
+		{Namespace: "billing", Service: "uw-payments", PeriodStart: yesterday, SecondsInState: map[string]float64{constants.Healthy: 86400}},
+	}
+
+	p := Build(cfg, statuses, rollups, now)
+	assert.Equal(t, "Status", p.Title)
+	assert.Equal(t, MajorOutage, p.Status)
+	require.Len(t, p.Components, 4)
+
+	billing := p.Components[0]
+	assert.Equal(t, "Billing", billing.Name)
+	assert.Equal(t, "Bills and payments", billing.Description)
+	assert.Equal(t, PartialOutage, billing.Status)
+	require.Len(t, billing.Days, 90)
+	assert.Equal(t, "2019-12-11", billing.Days[0].Date)
+	assert.Equal(t, Unknown, billing.Days[0].Status)
+	assert.Nil(t, billing.Days[0].Uptime)
+
+	last := billing.Days[89]
+	assert.Equal(t, "2020-03-09", last.Date)
+	assert.Equal(t, MajorOutage, last.Status)
+	require.NotNil(t, last.Uptime)
+	assert.Equal(t, 75.0, *last.Uptime)
+	assert.Equal(t, Degraded, billing.Days[88].Status)
+	require.NotNil(t, billing.Uptime)
+	assert.InDelta(t, 100*(86400+43200+86400)/(3*86400.0), *billing.Uptime, 0.001)
+
+	energy := p.Components[1]
+	assert.Equal(t, Degraded, energy.Status)
+	assert.Nil(t, energy.Uptime)
+
+	telecom := p.Components[2]
+	assert.Equal(t, Unknown, telecom.Status)
+
+	payments := p.Components[3]
+	assert.Equal(t, "Payments", payments.Name)
+	assert.Equal(t, MajorOutage, payments.Status)
+	assert.Equal(t, Operational, payments.Days[89].Status)
+}
+
+func Test_WritePublishesHTMLAndJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statuspage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	p := Build(config.StatusPage{Title: "<Service status>", Components: []config.Component{{Name: "Billing", Services: []string{"billing/*"}}}},
+		[]model.ServiceStatus{status("billing", "uw-invoices", constants.Healthy, "")}, nil, now)
+	require.NoError(t, write(filepath.Join(dir, "status"), p))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "status", "status.json"))
+	require.NoError(t, err)
+	var published Page
+	require.NoError(t, json.Unmarshal(data, &published))
+	assert.Equal(t, Operational, published.Status)
+	assert.Equal(t, "Billing", published.Components[0].Name)
+
+	html, err := ioutil.ReadFile(filepath.Join(dir, "status", "index.html"))
+	require.NoError(t, err)
+	assert.Contains(t, string(html), "All systems operational")
+	assert.Contains(t, string(html), "&lt;Service status&gt;")
+
+	// only the published files are left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "status"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
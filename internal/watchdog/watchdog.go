@@ -0,0 +1,141 @@
+package watchdog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/go-operational/op"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+// Watchdog marks Services whose latest check is older than the config allows as stale, so that a Service whose checks
+// have silently stopped is not reported in its last known state forever
+type Watchdog struct {
+	config  *config.Store
+	repo    *db.MongoRepository
+	errs    chan error
+	metrics instrumentation.Metrics
+
+	mu      sync.RWMutex
+	watched bool
+	result  Result
+}
+
+// Result is the outcome of the latest watch
+type Result struct {
+	// Checked is the number of Services checked by this instance, and Stale how many of them are stale
+	Checked int
+	Stale   int
+	// Percent of Checked which are Stale, and Alert whether it is above the alert percentage of the config
+	Percent float64
+	Alert   bool
+}
+
+// NewWatchdog returns a Watchdog which reads its thresholds from the current config each time it watches
+func NewWatchdog(cfg *config.Store, repo *db.MongoRepository, errs chan error, metrics instrumentation.Metrics) *Watchdog {
+	return &Watchdog{config: cfg, repo: repo, errs: errs, metrics: metrics}
+}
+
+// Watch marks the statuses checked before the stale period as stale, and records which Services are stale in metrics.
+// An error is raised when the percentage of stale Services checked by this instance is above the alert percentage
+func (w *Watchdog) Watch() {
+	cfg := w.config.Get()
+	staleBefore := time.Now().UTC().Add(-cfg.StaleAfter())
+
+	if err := db.MarkStaleStatuses(w.repo, staleBefore); err != nil {
+		select {
+		case w.errs <- fmt.Errorf("Could not mark stale statuses (%v)", err):
+		default:
+		}
+		return
+	}
+
+	statuses, err := db.FindLatestChecks(w.repo, "")
+	if err != nil {
+		select {
+		case w.errs <- fmt.Errorf("Could not find stale statuses (%v)", err):
+		default:
+		}
+		return
+	}
+
+	staleGaugeVec := w.metrics.Gauges[constants.HealthAggregatorServiceStale]
+	staleGaugeVec.Reset()
+	for _, status := range statuses {
+		stale := 0.0
+		if status.Stale {
+			stale = 1
+		}
+		staleGaugeVec.WithLabelValues(status.Service.Cluster, status.Service.Namespace, status.Service.Name).Set(stale)
+	}
+
+	result := evaluate(statuses, cfg.Watchdog.AlertPercent)
+	w.metrics.Gauges[constants.HealthAggregatorStaleServicesPercent].WithLabelValues().Set(result.Percent)
+	if result.Alert {
+		select {
+		case w.errs <- fmt.Errorf("%d of %d services (%.1f%%) have not been checked for %v, checks may have stopped", result.Stale, result.Checked, result.Percent, cfg.StaleAfter()):
+		default:
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watched = true
+	w.result = result
+}
+
+// Stop resets the metrics of the Watchdog, as another replica may watch instead
+func (w *Watchdog) Stop() {
+	w.metrics.Gauges[constants.HealthAggregatorServiceStale].Reset()
+	w.metrics.Gauges[constants.HealthAggregatorStaleServicesPercent].Reset()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watched = false
+	w.result = Result{}
+}
+
+// Check reports the latest watch on the operational health endpoint of health-aggregator, which is unhealthy while
+// too many Services are stale
+func (w *Watchdog) Check(cr *op.CheckResponse) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	switch {
+	case !w.watched:
+		cr.Healthy("services are not being watched by this replica")
+	case w.result.Alert:
+		cr.Unhealthy(
+			fmt.Sprintf("%d of %d services (%.1f%%) are stale", w.result.Stale, w.result.Checked, w.result.Percent),
+			"Check the logs for scrape errors, and that the scrape queue is being drained",
+			"The health of stale services is unknown, so failures may go unnoticed",
+		)
+	default:
+		cr.Healthy(fmt.Sprintf("%d of %d services are stale", w.result.Stale, w.result.Checked))
+	}
+}
+
+// evaluate counts the stale statuses among those checked by this instance, as federated statuses go stale when their
+// source does
+func evaluate(statuses []model.ServiceStatus, alertPercent int) Result {
+	var r Result
+	for _, status := range statuses {
+		if status.Source != "" {
+			continue
+		}
+		r.Checked++
+		if status.Stale {
+			r.Stale++
+		}
+	}
+	if r.Checked > 0 {
+		r.Percent = float64(r.Stale) * 100 / float64(r.Checked)
+	}
+	r.Alert = r.Stale > 0 && r.Percent > float64(alertPercent)
+	return r
+}
@@ -0,0 +1,118 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
+	"github.com/utilitywarehouse/health-aggregator/internal/constants"
+	"github.com/utilitywarehouse/health-aggregator/internal/db"
+	"github.com/utilitywarehouse/health-aggregator/internal/helpers"
+	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
+	"github.com/utilitywarehouse/health-aggregator/internal/model"
+)
+
+const (
+	dbURL = "localhost:27017"
+)
+
+type TestSuite struct {
+	repo    *db.MongoRepository
+	session *mgo.Session
+	dbName  string
+}
+
+var s TestSuite
+
+func (s *TestSuite) SetUpTest() {
+	sess, err := mgo.Dial(dbURL)
+	if err != nil {
+		log.Fatalf("failed to create mongo session: %s", err.Error())
+	}
+	s.session = sess
+	s.dbName = uuid.New().String()
+	s.repo = db.NewMongoRepository(s.session, s.dbName)
+}
+
+func (s *TestSuite) TearDownTest() {
+	if err := s.session.DB(s.dbName).DropDatabase(); err != nil {
+		log.Fatalf("failed to drop database, err: %v", err)
+	}
+	s.repo.Close()
+}
+
+func Test_WatchMarksStatusesStaleUntilChecked(t *testing.T) {
+	s.SetUpTest()
+	defer s.TearDownTest()
+
+	store, err := config.NewStore("", config.Default())
+	require.NoError(t, err)
+	metrics := instrumentation.SetupMetrics()
+	errs := make(chan error, 10)
+	w := NewWatchdog(store, s.repo, errs, metrics)
+
+	nsName := helpers.String(10)
+	stopped := helpers.GenerateDummyServiceStatus("uw-foo", nsName, []string{"pod-a"}, constants.Healthy)
+	stopped.CheckTime = time.Now().UTC().Add(-time.Hour)
+	checked := helpers.GenerateDummyServiceStatus("uw-bar", nsName, []string{"pod-a"}, constants.Healthy)
+	for _, status := range []model.ServiceStatus{stopped, checked} {
+		require.NoError(t, s.repo.Db().C(constants.ServicesCollection).Insert(status.Service))
+		require.NoError(t, s.repo.Db().C(constants.StatusCollection).Insert(status))
+	}
+
+	w.Watch()
+	statuses, err := db.FindLatestChecks(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+	assert.Equal(t, "uw-bar", statuses[0].Service.Name)
+	assert.False(t, statuses[0].Stale)
+	assert.Equal(t, "uw-foo", statuses[1].Service.Name)
+	assert.True(t, statuses[1].Stale)
+	assert.Equal(t, Result{Checked: 2, Stale: 1, Percent: 50, Alert: true}, w.result)
+	assert.Error(t, <-errs)
+
+	// the next check of the service clears the flag
+	stopped.CheckTime = time.Now().UTC()
+	responses := make(chan model.ServiceStatus, 1)
+	responses <- stopped
+	close(responses)
+	db.InsertHealthcheckResponses(s.repo, responses, errs, metrics, db.StorageOptions{Mode: constants.StorageModeFull})
+
+	w.Watch()
+	statuses, err = db.FindLatestChecks(s.repo, "", nsName)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(statuses))
+	assert.False(t, statuses[0].Stale)
+	assert.False(t, statuses[1].Stale)
+	assert.Equal(t, Result{Checked: 2}, w.result)
+	assert.Empty(t, errs)
+}
+func Test_Evaluate(t *testing.T) {
+	status := func(stale bool, source string) model.ServiceStatus {
+		return model.ServiceStatus{Stale: stale, Source: source}
+	}
+
+	tests := []struct {
+		name     string
+		statuses []model.ServiceStatus
+		expected Result
+	}{
+		{name: "none checked", expected: Result{}},
+		{name: "none stale", statuses: []model.ServiceStatus{status(false, ""), status(false, "")}, expected: Result{Checked: 2}},
+		{name: "below alert", statuses: []model.ServiceStatus{status(true, ""), status(false, ""), status(false, ""), status(false, "")}, expected: Result{Checked: 4, Stale: 1, Percent: 25}},
+		{name: "above alert", statuses: []model.ServiceStatus{status(true, ""), status(true, ""), status(false, "")}, expected: Result{Checked: 3, Stale: 2, Percent: 200.0 / 3, Alert: true}},
+		// federated statuses go stale when their source does, not when this instance stops checking
+		{name: "federated ignored", statuses: []model.ServiceStatus{status(true, "energy"), status(false, "")}, expected: Result{Checked: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, evaluate(tt.statuses, 50))
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,13 +20,21 @@ import (
 	"github.com/utilitywarehouse/go-operational-health-checks/healthcheck"
 	"github.com/utilitywarehouse/go-operational/op"
 	"github.com/utilitywarehouse/health-aggregator/internal/checks"
+	"github.com/utilitywarehouse/health-aggregator/internal/config"
 	"github.com/utilitywarehouse/health-aggregator/internal/constants"
 	"github.com/utilitywarehouse/health-aggregator/internal/db"
 	"github.com/utilitywarehouse/health-aggregator/internal/discovery"
+	"github.com/utilitywarehouse/health-aggregator/internal/federation"
 	"github.com/utilitywarehouse/health-aggregator/internal/handlers"
 	"github.com/utilitywarehouse/health-aggregator/internal/httpserver"
 	"github.com/utilitywarehouse/health-aggregator/internal/instrumentation"
+	"github.com/utilitywarehouse/health-aggregator/internal/leader"
 	"github.com/utilitywarehouse/health-aggregator/internal/model"
+	"github.com/utilitywarehouse/health-aggregator/internal/notify"
+	"github.com/utilitywarehouse/health-aggregator/internal/shard"
+	"github.com/utilitywarehouse/health-aggregator/internal/statuspage"
+	"github.com/utilitywarehouse/health-aggregator/internal/watchdog"
+	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 )
 
@@ -79,28 +88,207 @@ func main() {
 	})
 	removeAfterDays := app.Int(cli.IntOpt{
 		Name:   "delete-checks-after-days",
-		Desc:   "Age of check results in days after which they are deleted",
+		Desc:   "Age of check results and state transitions in days after which they are deleted",
 		EnvVar: "DELETE_CHECKS_AFTER_DAYS",
 		Value:  1,
 	})
+	removeRollupsAfterDays := app.Int(cli.IntOpt{
+		Name:   "delete-rollups-after-days",
+		Desc:   "Age of hourly and daily check rollups in days, counted from midnight UTC, after which they are deleted",
+		EnvVar: "DELETE_ROLLUPS_AFTER_DAYS",
+		Value:  90,
+	})
+	removeIncidentsAfterDays := app.Int(cli.IntOpt{
+		Name:   "delete-incidents-after-days",
+		Desc:   "Age of closed incidents in days after which they are deleted",
+		EnvVar: "DELETE_INCIDENTS_AFTER_DAYS",
+		Value:  90,
+	})
+	storageMode := app.String(cli.StringOpt{
+		Name:   "storage-mode",
+		Desc:   "How check results are stored: 'full' stores every result, 'transitions' stores state transitions plus periodic snapshots",
+		EnvVar: "STORAGE_MODE",
+		Value:  constants.StorageModeFull,
+	})
+	snapshotIntervalMins := app.Int(cli.IntOpt{
+		Name:   "snapshot-interval-mins",
+		Desc:   "Minutes between full check result snapshots for a service when storage-mode is 'transitions'",
+		EnvVar: "SNAPSHOT_INTERVAL_MINS",
+		Value:  15,
+	})
 	restrictToNamespaces := app.Strings(cli.StringsOpt{
 		Name:   "restrict-namespace",
-		Desc:   "Restrict checks to one or more namespaces - e.g. export RESTRICT_NAMESPACE=\"auth\",\"redis\"",
+		Desc:   "Deprecated, use namespace-selector or namespace-opt-in. Restrict checks to one or more namespaces - e.g. export RESTRICT_NAMESPACE=\"auth\",\"redis\"",
 		EnvVar: "RESTRICT_NAMESPACE",
 		Value:  []string{},
 	})
+	namespaceSelector := app.String(cli.StringOpt{
+		Name:   "namespace-selector",
+		Desc:   "Only check namespaces whose labels match this label selector - e.g. export NAMESPACE_SELECTOR=\"health-aggregator=enabled\"",
+		EnvVar: "NAMESPACE_SELECTOR",
+		Value:  "",
+	})
+	namespaceOptIn := app.Bool(cli.BoolOpt{
+		Name:   "namespace-opt-in",
+		Desc:   "Only check namespaces annotated with uw.health.aggregator.enable: 'true'",
+		EnvVar: "NAMESPACE_OPT_IN",
+		Value:  false,
+	})
+	latencyThresholdMs := app.Int(cli.IntOpt{
+		Name:   "latency-threshold-ms",
+		Desc:   "Health checks taking longer than this many milliseconds mark the pod as degraded, 0 to disable",
+		EnvVar: "LATENCY_THRESHOLD_MS",
+		Value:  0,
+	})
+	retryMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "retry-max-attempts",
+		Desc:   "Maximum attempts for a pod health check which fails with a temporary network error, including the first, 1 to disable retries",
+		EnvVar: "RETRY_MAX_ATTEMPTS",
+		Value:  3,
+	})
+	retryInitialBackoffMs := app.Int(cli.IntOpt{
+		Name:   "retry-initial-backoff-ms",
+		Desc:   "Milliseconds to wait before the first retry, doubling for each subsequent retry",
+		EnvVar: "RETRY_INITIAL_BACKOFF_MS",
+		Value:  200,
+	})
+	retryMaxBackoffMs := app.Int(cli.IntOpt{
+		Name:   "retry-max-backoff-ms",
+		Desc:   "Maximum milliseconds to wait between retries",
+		EnvVar: "RETRY_MAX_BACKOFF_MS",
+		Value:  2000,
+	})
+	retryDeadlineSecs := app.Int(cli.IntOpt{
+		Name:   "retry-deadline-secs",
+		Desc:   "Total seconds allowed for all attempts of a pod health check",
+		EnvVar: "RETRY_DEADLINE_SECS",
+		Value:  20,
+	})
+	maxConcurrentChecks := app.Int(cli.IntOpt{
+		Name:   "max-concurrent-checks",
+		Desc:   "Maximum number of pods scraped concurrently",
+		EnvVar: "MAX_CONCURRENT_CHECKS",
+		Value:  100,
+	})
+	maxConcurrentChecksPerNode := app.Int(cli.IntOpt{
+		Name:   "max-concurrent-checks-per-node",
+		Desc:   "Maximum number of pods scraped concurrently on any one node, 0 for no limit",
+		EnvVar: "MAX_CONCURRENT_CHECKS_PER_NODE",
+		Value:  10,
+	})
+	shutdownTimeoutSecs := app.Int(cli.IntOpt{
+		Name:   "shutdown-timeout-secs",
+		Desc:   "Time allowed on shutdown for queued and in-flight health checks to finish before they are aborted",
+		EnvVar: "SHUTDOWN_TIMEOUT_SECS",
+		Value:  30,
+	})
+	tlsCAFile := app.String(cli.StringOpt{
+		Name:   "tls-ca-file",
+		Desc:   "(optional) path to a PEM CA bundle used to verify services scraped over HTTPS, defaults to the system roots",
+		EnvVar: "TLS_CA_FILE",
+		Value:  "",
+	})
+	tlsCertFile := app.String(cli.StringOpt{
+		Name:   "tls-cert-file",
+		Desc:   "(optional) path to a PEM client certificate presented to services scraped with mtls",
+		EnvVar: "TLS_CERT_FILE",
+		Value:  "",
+	})
+	tlsKeyFile := app.String(cli.StringOpt{
+		Name:   "tls-key-file",
+		Desc:   "(optional) path to the PEM key for tls-cert-file",
+		EnvVar: "TLS_KEY_FILE",
+		Value:  "",
+	})
+	configFile := app.String(cli.StringOpt{
+		Name:   "config",
+		Desc:   "(optional) path to a YAML config file, whose values take precedence over flags. Reloaded on SIGHUP or when the file changes",
+		EnvVar: "CONFIG_FILE",
+		Value:  "",
+	})
+	validateConfig := app.Bool(cli.BoolOpt{
+		Name:   "validate-config",
+		Desc:   "Validate the config file and flags, then exit",
+		EnvVar: "VALIDATE_CONFIG",
+		Value:  false,
+	})
 	kubeConfigPath := app.String(cli.StringOpt{
 		Name:   "kubeconfig",
 		Desc:   "(optional) absolute path to the kubeconfig file",
 		EnvVar: "KUBECONFIG_FILEPATH",
 		Value:  "",
 	})
+	leaderElect := app.Bool(cli.BoolOpt{
+		Name:   "leader-elect",
+		Desc:   "Elect a leader through a Lease so that only one replica discovers, checks and tidies services, while every replica serves the API",
+		EnvVar: "LEADER_ELECT",
+		Value:  false,
+	})
+	leaderElectionNamespace := app.String(cli.StringOpt{
+		Name:   "leader-election-namespace",
+		Desc:   "Namespace of the leader election and shard Leases, required with leader-elect",
+		EnvVar: "LEADER_ELECTION_NAMESPACE",
+		Value:  "",
+	})
+	leaderElectionKubeConfigPath := app.String(cli.StringOpt{
+		Name:   "leader-election-kubeconfig",
+		Desc:   "(optional) absolute path to the kubeconfig file of the cluster holding the leader election and shard Leases, the cluster health-aggregator runs in if empty",
+		EnvVar: "LEADER_ELECTION_KUBECONFIG_FILEPATH",
+		Value:  "",
+	})
+	leaderElectionLease := app.String(cli.StringOpt{
+		Name:   "leader-election-lease",
+		Desc:   "Name of the leader election Lease",
+		EnvVar: "LEADER_ELECTION_LEASE",
+		Value:  "health-aggregator",
+	})
+	shardGroup := app.String(cli.StringOpt{
+		Name:   "shard-group",
+		Desc:   "(optional) shard health checks across the live replicas sharing this group name, requires leader-elect",
+		EnvVar: "SHARD_GROUP",
+		Value:  "",
+	})
 
 	app.Before = func() {
 		setLogger(logLevel)
 	}
 
 	app.Action = func() {
+		base := config.Default()
+		base.Storage.Mode = *storageMode
+		base.Storage.SnapshotInterval = time.Duration(*snapshotIntervalMins) * time.Minute
+		base.Storage.DeleteChecksAfterDays = *removeAfterDays
+		base.Storage.DeleteRollupsAfterDays = *removeRollupsAfterDays
+		base.Storage.DeleteIncidentsAfterDays = *removeIncidentsAfterDays
+
+		cfg, err := config.NewStore(*configFile, base)
+		if err != nil {
+			log.WithError(err).Fatal("invalid config")
+		}
+		selector, err := discovery.NewNamespaceSelector(*restrictToNamespaces, *namespaceSelector, *namespaceOptIn)
+		if err != nil {
+			log.WithError(err).Fatal("invalid namespace selection")
+		}
+		if *validateConfig {
+			log.Info("config is valid")
+			return
+		}
+
+		tlsCreds, err := checks.NewTLSCredentials(*tlsCAFile, *tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			log.WithError(err).Fatal("failed to load tls credentials")
+		}
+		if *leaderElect && *leaderElectionNamespace == "" {
+			log.Fatal("leader-election-namespace is required when leader-elect is enabled")
+		}
+		if *shardGroup != "" && !*leaderElect {
+			log.Fatal("leader-elect is required when shard-group is set")
+		}
+		identity, err := os.Hostname()
+		if err != nil {
+			log.WithError(err).Fatal("failed to get hostname to identify this replica")
+		}
+
 		log.Debug("dialling mongo")
 
 		// Create new session
@@ -110,110 +298,351 @@ func main() {
 		// Create new repository
 		mgoRepo := createMongoRepoAndIndex(mgoSess, *dropDB, constants.DBName)
 
-		// Set up services state
-		servicesState, stateErr := db.GetServicesState(mgoRepo)
-		if stateErr != nil {
-			log.Panicf("unable to load services state: %v", stateErr)
-		}
-
-		errs := make(chan error, 10)
-		updateItems := make(chan model.UpdateItem, 10)
-
-		// Create new kube client
-		kubeClient := discovery.NewKubeClient(*kubeConfigPath)
+		// ctx is cancelled on shutdown to stop leading and watching the config file
+		ctx, cancel := context.WithCancel(context.Background())
+		var jobs sync.WaitGroup
 
-		// Create new discoveryService - responsible for watching k8s deployments and getting
-		// Namespace and Service annotations
-		discoveryService := discovery.NewKubeDiscoveryService(kubeClient, servicesState, updateItems, errs)
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			cfg.Watch(ctx)
+		}()
 
-		// Watch for updates to deployments for known k8s namespaces and add
-		// updated objects to the updateItems channel
-		go discoveryService.WatchDeployments(*restrictToNamespaces)
+		errs := make(chan error, 10)
 
-		// Create new updaterService - listens for objects to update - updateItems are put on the
-		// channel by the k8s deployments watcher (discoveryService.WatchDeployments)
-		updaterService := db.NewUpdaterService(updateItems, errs, mgoRepo)
+		// Log any errors that appear on the errs chan
+		go func() {
+			for e := range errs {
+				log.Errorf("%v", e)
+			}
+		}()
 
-		// Persist any objects added to the updateItems channel
-		go updaterService.DoUpdates()
+		metrics := instrumentation.SetupMetrics()
 
 		// The reloadQueue receives a request UUID.
 		// Items on the reloadQueue triggers the retrieval of the latest Namespace and Service
-		// health-aggregator annotations and persists them in the data store.
+		// health-aggregator annotations from every cluster and persists them in the data store.
 		reloadQueue := make(chan uuid.UUID)
 
-		// Range over the reload queue (persists k8s services and namespaces configs)
-		go discoveryService.ReloadServiceConfigs(reloadQueue, mgoRepo)
+		// Watch the clusters from the config file, or only the cluster given by the kubeconfig flag (or the
+		// cluster health-aggregator runs in) without a cluster name if none are configured
+		clusters := cfg.Get().Clusters
+		if len(clusters) == 0 {
+			clusters = []config.Cluster{{}}
+		}
+		kubeClients := make(map[string]kubernetes.Interface)
+		for _, cluster := range clusters {
+			kubeClient, err := newKubeClient(cluster, *kubeConfigPath)
+			if err != nil {
+				log.WithError(err).Fatal("failed to create kubernetes client")
+			}
+			kubeClients[cluster.Name] = kubeClient
+		}
 
-		// Place a new request (UUID) onto the reload queue every 60 minutes.
-		reloadTicker := time.NewTicker(constants.ReloadServicesIntervalMins * time.Minute)
-		go func() {
-			for t := range reloadTicker.C {
+		storageOpts := db.StorageOptions{
+			Mode:             cfg.Get().Storage.Mode,
+			SnapshotInterval: cfg.Get().Storage.SnapshotInterval,
+		}
 
-				log.Infof("scheduling reload of k8s annotations at %v", t)
-				reloadQueue <- uuid.New()
+		// check discovers the selected namespaces of every cluster, then schedules, checks and persists the services
+		// for which owns returns true (every service if owns is nil) and sends notifications, until ctx is cancelled.
+		// It then drains in-flight health checks before returning
+		check := func(ctx context.Context, owns func(model.Service) bool, reassigned <-chan struct{}) {
+			// Set up services state, which may have been changed by another replica. If ctx is cancelled before it
+			// can be loaded there is nothing to drain, so the lease or shard is given up straight away
+			servicesState, ok := loadServicesState(ctx, mgoRepo, errs)
+			if !ok {
+				return
 			}
-		}()
 
-		// Schedule deletion services that were not updated in recent reloads
-		serviceTidyTicker := time.NewTicker((constants.ReloadServicesIntervalMins) * time.Minute)
-		go func() {
-			for t := range serviceTidyTicker.C {
-				log.Infof("tidying stale services %v", t)
-				db.RemoveStaleServices(mgoRepo, errs)
+			// checksCtx is cancelled separately from ctx, once the shutdown timeout is reached, to abort health checks
+			// that are still queued or in flight
+			checksCtx, cancelChecks := context.WithCancel(context.Background())
+			var jobs sync.WaitGroup
+
+			// transitions are sent to the notifier once persisted
+			transitions := make(chan model.ServiceStatus, 100)
+			opts := storageOpts
+			opts.Transitions = transitions
+			opts.Reassigned = reassigned
+
+			updateItems := make(chan model.UpdateItem, 10)
+
+			// Create new updaterService - listens for objects to update - updateItems are put on the
+			// channel by the k8s deployments watchers (discoveryService.WatchDeployments)
+			updaterService := db.NewUpdaterService(updateItems, errs, mgoRepo)
+
+			// Persist any objects added to the updateItems channel
+			jobs.Add(1)
+			go func() {
+				defer jobs.Done()
+				updaterService.DoUpdates(ctx)
+			}()
+
+			var clusterReloadQueues []chan uuid.UUID
+			var discoveryServices []*discovery.KubeDiscoveryService
+			for _, cluster := range clusters {
+				// Create new discoveryService - responsible for watching k8s deployments and getting
+				// Namespace and Service annotations
+				discoveryService := discovery.NewKubeDiscoveryService(kubeClients[cluster.Name], clusterServicesState(servicesState, cluster.Name), updateItems, errs)
+				discoveryService.Cluster = cluster.Name
+				discoveryService.Config = cfg
+				discoveryService.Selector = selector
+				discoveryServices = append(discoveryServices, discoveryService)
+
+				// Watch for namespaces being selected or deselected, and for updates to deployments in the
+				// selected namespaces, adding updated objects to the updateItems channel
+				jobs.Add(1)
+				go func() {
+					defer jobs.Done()
+					discoveryService.WatchDeployments(ctx)
+				}()
+
+				// Range over the reload queue of the cluster (persists k8s services and namespaces configs)
+				clusterReloadQueue := make(chan uuid.UUID)
+				clusterReloadQueues = append(clusterReloadQueues, clusterReloadQueue)
+				jobs.Add(1)
+				go func() {
+					defer jobs.Done()
+					discoveryService.ReloadServiceConfigs(ctx, clusterReloadQueue, mgoRepo)
+				}()
 			}
-		}()
-
-		metrics := instrumentation.SetupMetrics()
 
-		// Schedule health check scraping every 60 seconds
-		servicesToScrape := make(chan model.Service, 1000)
-		ticker := time.NewTicker(60 * time.Second)
-		go func() {
-			for t := range ticker.C {
+			// Pass each reload request on to every cluster
+			jobs.Add(1)
+			go func() {
+				defer jobs.Done()
+				fanOutReloads(ctx, reloadQueue, clusterReloadQueues)
+			}()
+
+			// Schedule health check scraping every scrape interval
+			// servicesToScrape is closed once scheduling stops, so that the health checker drains the queue and returns
+			servicesToScrape := make(chan model.Service, 1000)
+			var scheduler sync.WaitGroup
+			every(ctx, &scheduler, func() time.Duration { return cfg.Get().Scheduling.ScrapeInterval }, func(t time.Time) {
 				log.Infof("scheduling healthchecks at %v", t)
-				db.GetHealthchecks(mgoRepo, servicesToScrape, errs, metrics, *restrictToNamespaces...)
+				scheduled := 0
+				schedule := func(svc model.Service) bool {
+					if owns != nil && !owns(svc) {
+						return false
+					}
+					scheduled++
+					return true
+				}
+				for _, discoveryService := range discoveryServices {
+					// no namespaces would check every stored service, so nothing is scheduled until a namespace is selected
+					namespaces := discoveryService.SelectedNamespaces()
+					if len(namespaces) == 0 {
+						log.Infof("no namespaces selected in cluster %q, skipping healthchecks", discoveryService.Cluster)
+						continue
+					}
+					db.GetHealthchecks(ctx, mgoRepo, servicesToScrape, errs, metrics, schedule, discoveryService.Cluster, namespaces...)
+				}
+				metrics.Gauges[constants.HealthAggregatorShardServices].WithLabelValues(identity).Set(float64(scheduled))
+			})
+			go func() {
+				scheduler.Wait()
+				close(servicesToScrape)
+			}()
+
+			// Channel used to store the status of a health check response
+			statusResponses := make(chan model.ServiceStatus, 1000)
+
+			// Scrape health check endpoints for services that appear on the servicesToScrape channel
+			// and send responses to the statusResponses chan
+			healthChecker := checks.NewHealthChecker(kubeClients[clusters[0].Name], metrics, "",
+				checks.WithConfig(cfg),
+				checks.WithClusters(kubeClients),
+				checks.WithTLSCredentials(tlsCreds),
+				checks.WithLatencyThreshold(time.Duration(*latencyThresholdMs)*time.Millisecond),
+				checks.WithConcurrency(*maxConcurrentChecks, *maxConcurrentChecksPerNode),
+				checks.WithRetries(checks.RetryPolicy{
+					MaxAttempts:    *retryMaxAttempts,
+					InitialBackoff: time.Duration(*retryInitialBackoffMs) * time.Millisecond,
+					MaxBackoff:     time.Duration(*retryMaxBackoffMs) * time.Millisecond,
+					Deadline:       time.Duration(*retryDeadlineSecs) * time.Second,
+				}),
+			)
+			go healthChecker.DoHealthchecks(checksCtx, servicesToScrape, statusResponses, errs)
+
+			// Send state transitions to the webhooks of matching notification routes
+			notifier := notify.NewNotifier(cfg, errs)
+			notified := make(chan struct{})
+			go func() {
+				notifier.Run(transitions)
+				close(notified)
+			}()
+
+			// Insert health check reponses into mongo that appear on the statusResponses chan. persisted is closed once
+			// the health checker has closed statusResponses, all pending responses have been written and their
+			// transitions notified
+			persisted := make(chan struct{})
+			go func() {
+				db.InsertHealthcheckResponses(mgoRepo, statusResponses, errs, metrics, opts)
+				close(transitions)
+				<-notified
+				close(persisted)
+			}()
+
+			<-ctx.Done()
+			drain(cancelChecks, &jobs, persisted, time.Duration(*shutdownTimeoutSecs)*time.Second)
+
+			// the gauges describe the services checked here, so are cleared for the replica taking over to report
+			for _, name := range []string{constants.HealthAggregatorServiceUnhealthy, constants.HealthAggregatorNonCompliantServices, constants.HealthAggregatorCertExpiry, constants.HealthAggregatorShardServices} {
+				metrics.Gauges[name].Reset()
 			}
-		}()
+		}
 
-		// Schedule deletion of older health checks every...
-		tidyTicker := time.NewTicker(60 * time.Minute)
-		go func() {
-			for t := range tidyTicker.C {
-				log.Infof("tidying old healthchecks %v", t)
-				db.RemoveChecksOlderThan(*removeAfterDays, mgoRepo, errs)
-			}
-		}()
+		// The watchdog is shared with the ops server, which reports too many stale services as unhealthy
+		staleWatchdog := watchdog.NewWatchdog(cfg, mgoRepo, errs, metrics)
 
-		// Channel used to store the status of a health check response
-		statusResponses := make(chan model.ServiceStatus, 1000)
+		// housekeep schedules reloads, tidies stale services and old checks, rolls up checks, pulls federation
+		// sources, publishes the status page and watches for stale services until ctx is cancelled. Only one replica
+		// housekeeps at a time when leader election is enabled
+		housekeep := func(ctx context.Context) {
+			var jobs sync.WaitGroup
 
-		// Scrape health check endpoints for services that appear on the servicesToScrape channel
-		// and send responses to the statusResponses chan
-		healthChecker := checks.NewHealthChecker(kubeClient, metrics, "")
-		go healthChecker.DoHealthchecks(servicesToScrape, statusResponses, errs)
+			// Place a new request (UUID) onto the reload queue every reload interval
+			every(ctx, &jobs, func() time.Duration { return cfg.Get().Scheduling.ReloadInterval }, func(t time.Time) {
+				log.Infof("scheduling reload of k8s annotations at %v", t)
+				select {
+				case reloadQueue <- uuid.New():
+				case <-ctx.Done():
+				}
+			})
+
+			// Schedule deletion services that were not updated in recent reloads
+			every(ctx, &jobs, func() time.Duration { return cfg.Get().Scheduling.ReloadInterval }, func(t time.Time) {
+				log.Infof("tidying stale services %v", t)
+				db.RemoveStaleServices(mgoRepo, cfg.Get().Scheduling.ReloadInterval, errs, metrics)
+			})
 
-		// Insert health check reponses into mongo that appear on the statusResponses chan
-		go db.InsertHealthcheckResponses(mgoRepo, statusResponses, errs, metrics)
+			// Schedule deletion of older health checks every tidy interval
+			every(ctx, &jobs, func() time.Duration { return cfg.Get().Scheduling.TidyInterval }, func(t time.Time) {
+				log.Infof("tidying old healthchecks %v", t)
+				db.RemoveChecksOlderThan(cfg.Get().Storage.DeleteChecksAfterDays, mgoRepo, errs)
+				db.RemoveTransitionsOlderThan(cfg.Get().Storage.DeleteChecksAfterDays, mgoRepo, errs)
+				db.RemoveIncidentsOlderThan(cfg.Get().Storage.DeleteIncidentsAfterDays, mgoRepo, errs)
+			})
+
+			// Schedule downsampling of health checks into hourly and daily rollups, and deletion of older rollups. The
+			// first run is at startup, to catch up the periods missed while no replica was rolling up
+			rollup := func(t time.Time) {
+				log.Infof("rolling up healthchecks %v", t)
+				db.RollupCompletedPeriods(mgoRepo, errs, metrics, storageOpts)
+				db.RemoveRollupsOlderThan(cfg.Get().Storage.DeleteRollupsAfterDays, mgoRepo, errs)
+			}
+			jobs.Add(1)
+			go func() {
+				defer jobs.Done()
+				rollup(time.Now())
+				every(ctx, &jobs, func() time.Duration { return cfg.Get().Scheduling.RollupInterval }, rollup)
+			}()
+
+			// Merge the current statuses of federated health-aggregator instances every federation interval
+			federator := federation.NewFederator(cfg, mgoRepo, errs, metrics)
+			every(ctx, &jobs, func() time.Duration { return cfg.Get().Federation.Interval }, func(t time.Time) {
+				if len(cfg.Get().Federation.Sources) == 0 {
+					return
+				}
+				log.Infof("pulling statuses from federation sources %v", t)
+				federator.Pull(ctx)
+			})
+
+			// Publish the status page every status page interval
+			publisher := statuspage.NewPublisher(cfg, mgoRepo, errs)
+			every(ctx, &jobs, func() time.Duration { return cfg.Get().StatusPage.Interval }, func(t time.Time) {
+				publisher.Publish()
+			})
+
+			// Mark services whose checks have stopped as stale every scrape interval
+			every(ctx, &jobs, func() time.Duration { return cfg.Get().Scheduling.ScrapeInterval }, func(t time.Time) {
+				staleWatchdog.Watch()
+			})
+
+			jobs.Wait()
+			metrics.Gauges[constants.HealthAggregatorFederationSourceUp].Reset()
+			staleWatchdog.Stop()
+		}
 
-		// Log any errors that appear on the errs chan
-		go func() {
-			for e := range errs {
-				log.Errorf("%v", e)
+		// Without sharding a single replica checks every service, and housekeeps, while it leads. With sharding every
+		// replica checks its share of the services, and only the leader housekeeps. Replicas which do not discover
+		// services can not accept reloads
+		var work sync.WaitGroup
+		leading := func() bool { return true }
+		lead := func(ctx context.Context) {
+			var housekeeping sync.WaitGroup
+			housekeeping.Add(1)
+			go func() {
+				defer housekeeping.Done()
+				housekeep(ctx)
+			}()
+			check(ctx, nil, nil)
+			housekeeping.Wait()
+		}
+		// the Leases of leader election and sharding are held in their own cluster, whichever clusters are checked
+		var leaseClient kubernetes.Interface
+		if *leaderElect {
+			leaseClient, err = newLeaseClient(*leaderElectionKubeConfigPath)
+			if err != nil {
+				log.WithError(err).Fatal("failed to create kubernetes client for leader election")
 			}
-		}()
+		}
+		if *shardGroup != "" {
+			membership := shard.NewMembership(leaseClient, shard.Config{
+				Namespace: *leaderElectionNamespace,
+				Group:     *shardGroup,
+				Identity:  identity,
+			}, errs)
+			work.Add(2)
+			go func() {
+				defer work.Done()
+				membership.Run(ctx)
+			}()
+			go func() {
+				defer work.Done()
+				check(ctx, membership.Owns, membership.Changes())
+			}()
+			lead = housekeep
+		}
+		if *leaderElect {
+			elector := leader.NewElector(leaseClient, leader.Config{
+				Namespace: *leaderElectionNamespace,
+				Name:      *leaderElectionLease,
+				Identity:  identity,
+			})
+			if *shardGroup == "" {
+				leading = elector.IsLeader
+			}
+			work.Add(1)
+			go func() {
+				defer work.Done()
+				if err := elector.Run(ctx, lead); err != nil {
+					log.WithError(err).Fatal("failed to run leader election")
+				}
+			}()
+		} else {
+			work.Add(1)
+			go func() {
+				defer work.Done()
+				lead(ctx)
+			}()
+		}
 
 		// Set up routes and start API
-		router := handlers.NewRouter(reloadQueue)
-		allowedCORSMethods := h.AllowedMethods([]string{http.MethodPost, http.MethodOptions})
+		router := handlers.NewRouter(reloadQueue, mgoRepo, leading, cfg)
+		allowedCORSMethods := h.AllowedMethods([]string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions})
 		allowedCORSOrigins := h.AllowedOrigins([]string{"*"})
 		server := httpserver.New(*port, router, *writeTimeout, *readTimeout, allowedCORSMethods, allowedCORSOrigins)
 		go httpserver.Start(server)
 
 		// Start the Ops HTTP server
-		go initOpsHTTPServer(*opsPort, mgoSess, metrics)
+		go initOpsHTTPServer(*opsPort, mgoSess, metrics, staleWatchdog)
 
-		graceful(server, 10)
+		graceful(server, 10*time.Second)
+		cancel()
+		work.Wait()
+		jobs.Wait()
 	}
 	err := app.Run(os.Args)
 	if err != nil {
@@ -244,9 +673,86 @@ func createMongoRepoAndIndex(mgoSess *mgo.Session, dropDB bool, dbName string) *
 
 	createIndex(mgoRepo)
 
+	// the current status of each Service is read from the status collection, which responses stored before it existed
+	// are not in, so it is backfilled while empty
+	backfilled, err := db.BackfillCurrentStatuses(mgoRepo)
+	if err != nil {
+		log.WithError(err).Panic("failed to backfill current statuses")
+	}
+	log.Infof("backfilled the current status of %d services", backfilled)
+
 	return mgoRepo
 }
 
+// newKubeClient returns a client for a configured cluster, or for the cluster given by kubeConfigPath (or the cluster
+// health-aggregator runs in) if the cluster has no name
+func newKubeClient(cluster config.Cluster, kubeConfigPath string) (kubernetes.Interface, error) {
+	if cluster.Name == "" {
+		return discovery.NewKubeClient(kubeConfigPath), nil
+	}
+	return discovery.NewKubeClientForCluster(cluster, kubeConfigPath)
+}
+
+// loadServicesState loads the services state, retrying with backoff while mongo is unavailable. It returns false if
+// ctx is cancelled first
+func loadServicesState(ctx context.Context, mgoRepo *db.MongoRepository, errs chan error) (map[model.ServicesStateKey]model.Service, bool) {
+	backoff := time.Second
+	for {
+		state, err := db.GetServicesState(mgoRepo)
+		if err == nil {
+			return state, true
+		}
+		select {
+		case errs <- fmt.Errorf("Could not load services state, retrying in %v (%v)", backoff, err):
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// newLeaseClient returns a client for the cluster holding the leader election and shard Leases, given by kubeConfigPath or the
+// cluster health-aggregator runs in, independently of the clusters which are checked
+func newLeaseClient(kubeConfigPath string) (kubernetes.Interface, error) {
+	return discovery.NewKubeClientForCluster(config.Cluster{Name: "leases", InCluster: kubeConfigPath == "", KubeConfig: kubeConfigPath}, "")
+}
+
+// clusterServicesState returns the part of the services state discovered in the given cluster
+func clusterServicesState(state map[model.ServicesStateKey]model.Service, cluster string) map[model.ServicesStateKey]model.Service {
+	clusterState := make(map[model.ServicesStateKey]model.Service)
+	for key, svc := range state {
+		if key.Cluster == cluster {
+			clusterState[key] = svc
+		}
+	}
+	return clusterState
+}
+
+// fanOutReloads passes each reload request on to the reload queue of every cluster, until ctx is cancelled
+func fanOutReloads(ctx context.Context, reloadQueue chan uuid.UUID, clusterReloadQueues []chan uuid.UUID) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case reqID := <-reloadQueue:
+			for _, q := range clusterReloadQueues {
+				select {
+				case q <- reqID:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
+
 func graceful(hs *http.Server, timeout time.Duration) {
 	stop := make(chan os.Signal, 1)
 
@@ -266,6 +772,56 @@ func graceful(hs *http.Server, timeout time.Duration) {
 	}
 }
 
+// drain waits for scheduling, discovery and periodic jobs to stop once their context is cancelled, and for queued and
+// in-flight health checks to finish and their responses to be persisted. Health checks still running after the
+// timeout are aborted, after which pending writes are given the same timeout again to be flushed
+func drain(cancelChecks context.CancelFunc, jobs *sync.WaitGroup, persisted chan struct{}, timeout time.Duration) {
+	log.Info("stopping scheduling and discovery")
+
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		<-persisted
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("all health checks finished and persisted")
+		return
+	case <-time.After(timeout):
+		log.Warnf("health checks did not finish within %v, aborting them", timeout)
+		cancelChecks()
+	}
+
+	select {
+	case <-done:
+		log.Info("pending health check responses persisted")
+	case <-time.After(timeout):
+		log.Error("timed out waiting for pending health check responses to be persisted")
+	}
+}
+
+// every calls fn after each interval until ctx is cancelled. The interval is read again after every call so that
+// changes to the config are applied without a restart
+func every(ctx context.Context, wg *sync.WaitGroup, interval func() time.Duration, fn func(time.Time)) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			timer := time.NewTimer(interval())
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case t := <-timer.C:
+				fn(t)
+			}
+		}
+	}()
+}
+
 func setLogger(logLevel *string) {
 	log.SetFormatter(&log.JSONFormatter{})
 	lvl, err := log.ParseLevel(*logLevel)
@@ -276,21 +832,45 @@ func setLogger(logLevel *string) {
 }
 
 func createIndex(mgoRepo *db.MongoRepository) {
-	log.Debugf("creating mongodb index for collection %v", constants.HealthchecksCollection)
-	c := mgoRepo.Db().C(constants.HealthchecksCollection)
-
-	index := mgo.Index{
-		Key: []string{"-checkTime"},
+	indexes := map[string][]mgo.Index{
+		constants.HealthchecksCollection: {
+			{Key: []string{"-checkTime"}},
+			{Key: []string{"service.namespace", "service.name", "-checkTime"}},
+		},
+		constants.StatusCollection: {
+			{Key: []string{"service.namespace", "service.name", "service.cluster"}, Unique: true},
+		},
+		constants.TransitionsCollection: {
+			{Key: []string{"namespace", "service", "-time"}},
+			{Key: []string{"time"}},
+		},
+		constants.SilencesCollection: {
+			{Key: []string{"expiresAt"}},
+		},
+		constants.IncidentsCollection: {
+			{Key: []string{"namespace", "service", "state"}},
+			{Key: []string{"-openedAt"}},
+			{Key: []string{"closedAt"}},
+		},
+		constants.RollupsCollection: {
+			{Key: []string{"namespace", "service", "cluster", "period", "periodStart"}, Unique: true},
+		},
 	}
 
-	err := c.EnsureIndex(index)
-	if err != nil {
-		panic(err)
+	for collection, collectionIndexes := range indexes {
+		log.Debugf("creating mongodb indexes for collection %v", collection)
+		c := mgoRepo.Db().C(collection)
+		for _, index := range collectionIndexes {
+			err := c.EnsureIndex(index)
+			if err != nil {
+				panic(err)
+			}
+		}
 	}
 	log.Debug("index creation successful")
 }
 
-func initOpsHTTPServer(opsPort int, mgoSess healthcheck.MongoPingRefresh, metrics instrumentation.Metrics) {
+func initOpsHTTPServer(opsPort int, mgoSess healthcheck.MongoPingRefresh, metrics instrumentation.Metrics, staleWatchdog *watchdog.Watchdog) {
 	log.Info("starting ops server")
 
 	promMetrics := []prometheus.Collector{}
@@ -309,6 +889,7 @@ func initOpsHTTPServer(opsPort int, mgoSess healthcheck.MongoPingRefresh, metric
 		AddLink("vcs", fmt.Sprintf("github.com/utilitywarehouse/health-aggegrator")).
 		SetRevision(gitHash).
 		AddChecker("mongo", healthcheck.NewMongoHealthCheck(mgoSess, "Unable to access mongo db")).
+		AddChecker("stale services", staleWatchdog.Check).
 		AddMetrics(promMetrics...).
 		ReadyAlways().
 		WithInstrumentedChecks(),